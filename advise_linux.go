@@ -0,0 +1,13 @@
+package bitcesque
+
+import (
+	"syscall"
+)
+
+// Hints that the buffer will be read through once from start to end.
+func adviseSequential(buf []byte) error {
+	if buf == nil {
+		return nil
+	}
+	return syscall.Madvise(buf, syscall.MADV_SEQUENTIAL)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package bitcesque
+
+// Read-ahead hints are only given on Linux.
+func adviseSequential(buf []byte) error {
+	return nil
+}
@@ -0,0 +1,204 @@
+package bitcesque
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Returns the value associated with the given key, and whether it is present
+// and unexpired.  Assumes at least a read lock is held.
+func (d *DB) current(k []byte) ([]byte, bool, error) {
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return nil, false, nil
+	}
+	v, e := d.getVal(oal)
+	return v, e == nil, e
+}
+
+// Sets the given key to newVal only if its current value is expected, with a
+// nil expected matching only an absent key.  Returns whether the swap was
+// made, and any error writing it.
+func (d *DB) CompareAndSwap(k, expected, newVal []byte) (bool, error) {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return false, ErrDatabaseClosed
+	}
+	v, present, e := d.current(k)
+	if e != nil {
+		return false, e
+	}
+	if present != (expected != nil) || !bytes.Equal(v, expected) {
+		return false, nil
+	}
+	e = d.upsert(k, newVal, 0, 0)
+	return e == nil, e
+}
+
+// Sets the given key to the given value only if it is absent.  Returns
+// whether the value was set, and any error writing it.
+func (d *DB) SetNX(k, v []byte) (bool, error) {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return false, ErrDatabaseClosed
+	}
+	if _, present, e := d.current(k); present || e != nil {
+		return false, e
+	}
+	e := d.upsert(k, v, 0, 0)
+	return e == nil, e
+}
+
+// Returns a copy of the value associated with the given key if it is present,
+// otherwise sets it to v and returns that.  The boolean reports whether the
+// value was already present.
+func (d *DB) GetOrSet(k, v []byte) ([]byte, bool, error) {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return nil, false, ErrDatabaseClosed
+	}
+	old, present, e := d.current(k)
+	if e != nil {
+		return nil, false, e
+	}
+	if present {
+		return append([]byte{}, old...), true, nil
+	}
+	e = d.upsert(k, v, 0, 0)
+	if e != nil {
+		return nil, false, e
+	}
+	return v, false, nil
+}
+
+// Removes the given key, returning a copy of the value it held and whether it
+// was present.  Absent keys are left as they are.
+func (d *DB) GetAndDelete(k []byte) ([]byte, bool, error) {
+	defer d.endOp(OpWrite, d.startOp())
+	if len(k) > keyLenMask {
+		return nil, false, ErrKeyTooLarge
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return nil, false, ErrDatabaseClosed
+	}
+	old, present, e := d.current(k)
+	if !present || e != nil {
+		return nil, false, e
+	}
+	old = append([]byte{}, old...)
+	if e = d.remove(k); e != nil {
+		return nil, false, e
+	}
+	return old, true, nil
+}
+
+// Sets the given key to v, returning a copy of the value it held before and
+// whether it was present.
+func (d *DB) GetAndSet(k, v []byte) ([]byte, bool, error) {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return nil, false, ErrDatabaseClosed
+	}
+	old, present, e := d.current(k)
+	if e != nil {
+		return nil, false, e
+	}
+	if present {
+		old = append([]byte{}, old...)
+	}
+	if e = d.upsert(k, v, 0, 0); e != nil {
+		return nil, false, e
+	}
+	return old, present, nil
+}
+
+// Adds delta to the integer held by the given key, treating an absent key as
+// zero, and returns the result.  A value of exactly 8 bytes that isn't a
+// decimal number is taken as little-endian, and the result is written back in
+// the same encoding; otherwise values are decimal text.  Any expiry and user
+// flags are kept.
+// Returns ErrNotInteger if the value is neither, or ErrOverflow if the result
+// doesn't fit in an int64.
+func (d *DB) Increment(k []byte, delta int64) (int64, error) {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return 0, ErrDatabaseClosed
+	}
+	v, present, e := d.current(k)
+	if e != nil {
+		return 0, e
+	}
+	var n, expiry int64
+	var flags uint8
+	if present {
+		expiry = d.expiries[string(k)]
+		oal, _ := d.lookup(k)
+		flags = d.userFlags(oal)
+	}
+	binary := false
+	if len(v) > 0 {
+		n, e = strconv.ParseInt(string(v), 10, 64)
+		if e != nil && len(v) == 8 {
+			n, e, binary = int64(uint64FromBytes(v, 0)), nil, true
+		}
+		if e != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	sum := n + delta
+	if (delta > 0 && sum < n) || (delta < 0 && sum > n) {
+		return 0, ErrOverflow
+	}
+	if binary {
+		v = make([]byte, 8)
+		uint64ToBytes(v, 0, uint64(sum))
+	} else {
+		v = strconv.AppendInt(nil, sum, 10)
+	}
+	e = d.upsert(k, v, expiry, flags)
+	if e != nil {
+		return 0, e
+	}
+	return sum, nil
+}
+
+// Appends suffix to the value held by the given key, treating an absent key
+// as empty, so that a growing value such as a log needn't be read back by the
+// caller.  The whole value is rewritten, so appends cost the value's length
+// each, and compaction reclaims the earlier copies.  Any expiry and user
+// flags are kept.
+func (d *DB) Append(k, suffix []byte) error {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	v, present, e := d.current(k)
+	if e != nil {
+		return e
+	}
+	var expiry int64
+	var flags uint8
+	if present {
+		expiry = d.expiries[string(k)]
+		oal, _ := d.lookup(k)
+		flags = d.userFlags(oal)
+	}
+	if e = d.checkSizes(k, uint64(len(v))+uint64(len(suffix))); e != nil {
+		return e
+	}
+	return d.upsert(k, append(append(make([]byte, 0, len(v)+len(suffix)), v...), suffix...), expiry, flags)
+}
@@ -0,0 +1,63 @@
+package bitcesque
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// One line of the audit export.  Keys are given as for the JSON export.
+type auditRecord struct {
+	Offset  uint64  `json:"offset"`
+	Op      string  `json:"op"`
+	K       *string `json:"k,omitempty"`
+	K64     []byte  `json:"k64,omitempty"`
+	Time    string  `json:"time,omitempty"`
+	Size    int     `json:"size"`
+	Expires int64   `json:"expires,omitempty"` //Unix nanoseconds
+	Flags   uint8   `json:"flags,omitempty"`
+}
+
+// Writes a line to w for each record in the log from the given log offset
+// onwards, as ReadLog reads them, and returns the offset to carry on from.
+// Each line is a JSON object of the form
+//
+//	{"offset":...,"op":"put","k":...,"time":"2006-01-02T15:04:05.999999999Z","size":...}
+//
+// giving the record's log offset, whether it put or deleted the key, the key
+// as in ExportJSON, when it was written, in UTC, and the length of the value.
+// Records that expire carry "expires" in Unix nanoseconds, and those with
+// user flags "flags".  Values themselves are left out.  Records predating
+// timestamps have no "time", and compaction drops the records it rewrites
+// over, so the trail only goes back to the last Merge or Consolidate, and for
+// keys compacted since, shows their latest write only.
+func (d *DB) ExportAudit(w io.Writer, fromOffset uint64) (uint64, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	next, e := d.ReadLog(fromOffset, func(rec Record) error {
+		out := auditRecord{Offset: rec.Offset, Op: "put", Size: len(rec.Value), Flags: rec.Flags}
+		if rec.Removed {
+			out.Op = "delete"
+		}
+		if utf8.Valid(rec.Key) {
+			s := string(rec.Key)
+			out.K = &s
+		} else {
+			out.K64 = rec.Key
+		}
+		if !rec.Timestamp.IsZero() {
+			out.Time = rec.Timestamp.UTC().Format(time.RFC3339Nano)
+		}
+		if !rec.Expiry.IsZero() {
+			out.Expires = rec.Expiry.UnixNano()
+		}
+		return enc.Encode(&out)
+	})
+	if e != nil {
+		bw.Flush()
+		return next, e
+	}
+	return next, bw.Flush()
+}
@@ -0,0 +1,134 @@
+package bitcesque
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+)
+
+// Writes a point-in-time copy of the DB's live records to w.  The copy is
+// read from a snapshot, so writers aren't held up meanwhile.  It takes the
+// form of a data file holding one document per key, exactly as stored, so
+// encrypted records remain encrypted.  Use RestoreFrom to turn it back into a
+// DB.
+func (d *DB) Backup(w io.Writer) error {
+	if d.snapshot {
+		return d.backup(w)
+	}
+	s, e := d.Snapshot()
+	if e != nil {
+		return e
+	}
+	e = s.backup(w)
+	closeErr := s.Close()
+	if e == nil {
+		e = closeErr
+	}
+	return e
+}
+
+// Writes the copy described by Backup, holding a read lock throughout.
+func (d *DB) backup(w io.Writer) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	bw := bufio.NewWriter(w)
+	bw.Write(dataHeader(d.sum))
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if d.expired(k, t) {
+			continue
+		}
+		start := oal.offset - uint64(oal.prefix)
+		_, e := bw.Write(d.readSegment(oal.segment, start, oal.docSize()))
+		if e != nil {
+			return e
+		}
+	}
+	return bw.Flush()
+}
+
+// Creates a DB at location from a backup written by Backup, *deleting* the
+// data there.  Every record is verified as it is copied.  The restored DB has
+// no keyfile, so it should be opened with OpenAndVerifyDB, which indexes it,
+// and no metadata, so it is given a new identity then.
+func RestoreFrom(r io.Reader, location string) error {
+	lockfile, e := lockDB(location)
+	if e != nil {
+		return e
+	}
+	defer unlockDB(location, lockfile)
+	br := bufio.NewReader(r)
+	header := make([]byte, headerSize)
+	_, e = io.ReadFull(br, header)
+	if e != nil {
+		return errors.New("Not a bitcesque backup")
+	}
+	start, e := checkHeader(header, headerSize, dataMagic)
+	if e != nil {
+		return e
+	}
+	if start == 0 {
+		return errors.New("Not a bitcesque backup")
+	}
+	e = clearDB(location)
+	if e == nil {
+		e = os.Remove(metaPath(location))
+	}
+	if e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	f, e := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if e != nil {
+		return e
+	}
+	e = copyDocuments(f, br, header)
+	if e == nil {
+		e = f.Sync()
+	}
+	if e != nil {
+		f.Close()
+		os.Remove(location)
+		return e
+	}
+	return f.Close()
+}
+
+// Writes the header to f followed by the documents read from r, verifying
+// each, until r is exhausted.
+func copyDocuments(f *os.File, r io.Reader, header []byte) error {
+	w := bufio.NewWriter(f)
+	w.Write(header)
+	c := fileChecksum(header, uint64(len(header)))
+	pos := uint64(len(header))
+	head := make([]byte, 12)
+	for {
+		_, e := io.ReadFull(r, head)
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return corruptionAt(pos)
+		}
+		kField := uint32FromBytes(head, 4)
+		if kField&batchFlag != 0 {
+			return corruptionAt(pos)
+		}
+		prefix := uint64(docPrefix(kField&^keyLenMask, int(kField&keyLenMask)))
+		doc := make([]byte, prefix+uint64(uint32FromBytes(head, 8)))
+		copy(doc, head)
+		_, e = io.ReadFull(r, doc[12:])
+		if e != nil || !checkDocument(doc, c) {
+			return corruptionAt(pos)
+		}
+		_, e = w.Write(doc)
+		if e != nil {
+			return e
+		}
+		pos += uint64(len(doc))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,157 @@
+package bitcesque
+
+import (
+	"math"
+)
+
+// Accumulates upserts and removals to be applied to a DB all at once.  The
+// staged documents are written as a single checksummed frame, so after a
+// crash either every mutation in the batch is recovered or none are.
+type Batch struct {
+	db   *DB
+	buf  []byte    //Staged documents, preceded by room for the frame header
+	ops  []batchOp //Index updates to apply on commit, in order
+	err  error     //The first error staging a mutation, returned by Commit
+	size uint64    //Key and value bytes staged
+}
+
+type batchOp struct {
+	k      string
+	oal    offsetAndLength //Offset relative to the start of the frame
+	remove bool
+}
+
+// Returns an empty batch of mutations against the given DB.
+func (d *DB) NewBatch() *Batch {
+	return &Batch{d, make([]byte, docPrefix(batchFlag|d.sum.flags(), 0)), nil, nil, 0}
+}
+
+// Stages an insert or update of the given key with the given value.  If
+// either is too large to store, the batch will fail to commit.
+func (b *Batch) Upsert(k, v []byte) {
+	if e := b.db.checkSizes(k, uint64(len(v))); e != nil {
+		if b.err == nil {
+			b.err = e
+		}
+		return
+	}
+	r := newRecord(k, v, 0)
+	e := b.db.compressRecord(&r)
+	if e == nil {
+		e = b.db.sealRecord(&r)
+	}
+	if e != nil {
+		if b.err == nil {
+			b.err = e
+		}
+		return
+	}
+	r.pos = uint64(len(b.buf))
+	b.buf = append(b.buf, r.encode(b.db.sum)...)
+	b.ops = append(b.ops, batchOp{string(k), r.oal(0), false})
+	b.size += uint64(len(k) + len(v))
+}
+
+// Stages a removal of the given key.
+func (b *Batch) Remove(k []byte) {
+	if len(k) > keyLenMask {
+		if b.err == nil {
+			b.err = ErrKeyTooLarge
+		}
+		return
+	}
+	r := newRecord(k, []byte{}, 0)
+	if e := b.db.sealRecord(&r); e != nil {
+		if b.err == nil {
+			b.err = e
+		}
+		return
+	}
+	r.pos = uint64(len(b.buf))
+	b.buf = append(b.buf, r.encode(b.db.sum)...)
+	b.ops = append(b.ops, batchOp{string(k), r.oal(0), true})
+	b.size += uint64(len(k))
+}
+
+// Returns the number of mutations staged in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Discards all staged mutations, so the batch may be reused.
+func (b *Batch) Reset() {
+	b.buf = b.buf[:b.frameHeader()]
+	b.ops = b.ops[:0]
+	b.err = nil
+	b.size = 0
+}
+
+// Writes all staged mutations to the DB as one contiguous frame and applies
+// them to the index under a single lock acquisition.  The batch is reset
+// afterwards.  Committing an empty batch is a no-op.  If any mutation failed
+// to stage, nothing is written and the batch is reset.
+func (b *Batch) Commit() error {
+	if b.err != nil {
+		e := b.err
+		b.Reset()
+		return e
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	if uint64(len(b.buf)-b.frameHeader()) > math.MaxUint32 {
+		b.Reset()
+		return ErrValueTooLarge
+	}
+	d := b.db
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	return b.commit()
+}
+
+// Returns the size of the frame header, which depends on the checksum.
+func (b *Batch) frameHeader() int {
+	return int(docPrefix(batchFlag|b.db.sum.flags(), 0))
+}
+
+// Fills in the frame header and returns the whole frame.
+func (b *Batch) frame() []byte {
+	c := b.db.sum
+	uint32ToBytes(b.buf, 4, batchFlag|c.flags())
+	uint32ToBytes(b.buf, 8, uint32(len(b.buf)-b.frameHeader()))
+	c.store(b.buf, c.document(b.buf, nil))
+	return b.buf
+}
+
+// Writes the staged mutations and applies them, as Commit.  Assumes the
+// write lock is held.
+func (b *Batch) commit() error {
+	d := b.db
+	pos, e := d.appendBytes(b.frame())
+	if e != nil {
+		return e
+	}
+	for _, op := range b.ops {
+		if !op.remove {
+			oal := op.oal
+			oal.segment = d.activeID
+			oal.offset += pos
+			d.point(op.k, oal)
+			delete(d.expiries, op.k)
+		} else {
+			d.drop(op.k)
+			d.tombstones[d.activeID]++
+		}
+	}
+	d.io.logical.Add(b.size)
+	b.Reset()
+	d.evict()
+	return nil
+}
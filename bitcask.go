@@ -0,0 +1,410 @@
+package bitcesque
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The on-disk format of Riak's Erlang Bitcask.  A directory holds numbered
+// data files, each a sequence of entries with a big-endian header of the
+// CRC-32 of the rest of the entry, a timestamp in seconds, and the key and
+// value lengths, then the key and value.  Removals are entries whose value is
+// a tombstone.  Alongside each data file may be a hint file, listing each
+// entry's timestamp, key length, total size and offset, with the top bit of
+// the offset set for tombstones, then its key, and finishing with an entry
+// with no key whose size field holds the CRC-32 of the hint file before it.
+const (
+	bitcaskHeaderSize     = 14
+	bitcaskHintHeaderSize = 18
+	bitcaskMaxKey         = 1<<16 - 1
+	bitcaskTombstoneBit   = 1 << 63
+	bitcaskHintEnd        = 1<<63 - 1
+	bitcaskDataSuffix     = ".bitcask.data"
+	bitcaskHintSuffix     = ".bitcask.hint"
+	//Written by Bitcask 1.x; 2.x appends the 4 byte id of the file it's in
+	bitcaskTombstone  = "bitcask_tombstone"
+	bitcaskTombstone2 = "bitcask_tombstone2"
+)
+
+// Returns whether v is one of Bitcask's tombstone values.
+func bitcaskIsTombstone(v []byte) bool {
+	return string(v) == bitcaskTombstone ||
+		(len(v) == len(bitcaskTombstone2)+4 && string(v[:len(bitcaskTombstone2)]) == bitcaskTombstone2)
+}
+
+// Writes the DB's live pairs into dir, which is created if need be, as a
+// Bitcask data file and its hint file, for an Erlang Bitcask to open.  The
+// pairs are read from a snapshot, so writers aren't held up meanwhile.  Each
+// entry keeps its record's timestamp, or takes the current time for records
+// written before timestamps were recorded.  Bitcask has no per-key expiry, so
+// keys with a TTL are written without one.  Fails with ErrKeyTooLarge for keys
+// over 64kb - 1 bytes, which Bitcask can't hold, and refuses to write into a
+// directory already holding Bitcask data files.
+func (d *DB) ExportBitcask(dir string) error {
+	if d.snapshot {
+		return d.exportBitcask(dir)
+	}
+	s, e := d.Snapshot()
+	if e != nil {
+		return e
+	}
+	e = s.exportBitcask(dir)
+	closeErr := s.Close()
+	if e == nil {
+		e = closeErr
+	}
+	return e
+}
+
+// Writes the files described by ExportBitcask, holding a read lock throughout.
+func (d *DB) exportBitcask(dir string) error {
+	e := os.MkdirAll(dir, 0755)
+	if e != nil {
+		return e
+	}
+	existing, e := bitcaskFiles(dir)
+	if e != nil {
+		return e
+	}
+	if len(existing) > 0 {
+		return errors.New("Directory " + dir + " already holds Bitcask data files")
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	w, e := newBitcaskWriter(dir, 1)
+	if e != nil {
+		return e
+	}
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if d.expired(k, t) {
+			continue
+		}
+		if len(k) > bitcaskMaxKey {
+			w.abort()
+			return ErrKeyTooLarge
+		}
+		v, e := d.getVal(oal)
+		if e != nil {
+			w.abort()
+			return e
+		}
+		start := oal.offset - uint64(oal.prefix)
+		ts := decodeRecord(d.readSegment(oal.segment, start, uint64(oal.prefix)), start).timestamp
+		if ts == 0 {
+			ts = t
+		}
+		e = w.write([]byte(k), v, uint32(ts/int64(time.Second)))
+		if e != nil {
+			w.abort()
+			return e
+		}
+	}
+	return w.close()
+}
+
+// Writes a Bitcask data file and its hint file.
+type bitcaskWriter struct {
+	data, hint   *os.File
+	dataW, hintW *bufio.Writer
+	offset       uint64
+	hintCRC      uint32
+}
+
+// Creates the data and hint files with the given id in dir.
+func newBitcaskWriter(dir string, id int) (*bitcaskWriter, error) {
+	base := filepath.Join(dir, strconv.Itoa(id))
+	data, e := os.OpenFile(base+bitcaskDataSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if e != nil {
+		return nil, e
+	}
+	hint, e := os.OpenFile(base+bitcaskHintSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if e != nil {
+		data.Close()
+		os.Remove(data.Name())
+		return nil, e
+	}
+	return &bitcaskWriter{data, hint, bufio.NewWriter(data), bufio.NewWriter(hint), 0, 0}, nil
+}
+
+// Appends an entry for the given pair, and its hint.
+func (w *bitcaskWriter) write(k, v []byte, tstamp uint32) error {
+	var header [bitcaskHeaderSize]byte
+	binary.BigEndian.PutUint32(header[4:], tstamp)
+	binary.BigEndian.PutUint16(header[8:], uint16(len(k)))
+	binary.BigEndian.PutUint32(header[10:], uint32(len(v)))
+	crc := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, k)
+	binary.BigEndian.PutUint32(header[:], crc32.Update(crc, crc32.IEEETable, v))
+	w.dataW.Write(header[:])
+	w.dataW.Write(k)
+	_, e := w.dataW.Write(v)
+	if e != nil {
+		return e
+	}
+	total := uint32(bitcaskHeaderSize + len(k) + len(v))
+	e = w.writeHint(tstamp, k, total, w.offset)
+	w.offset += uint64(total)
+	return e
+}
+
+// Appends a hint entry, folding it into the hint file's CRC.
+func (w *bitcaskWriter) writeHint(tstamp uint32, k []byte, total uint32, offset uint64) error {
+	var header [bitcaskHintHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], tstamp)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(k)))
+	binary.BigEndian.PutUint32(header[6:], total)
+	binary.BigEndian.PutUint64(header[10:], offset)
+	w.hintCRC = crc32.Update(crc32.Update(w.hintCRC, crc32.IEEETable, header[:]), crc32.IEEETable, k)
+	w.hintW.Write(header[:])
+	_, e := w.hintW.Write(k)
+	return e
+}
+
+// Finishes the hint file with its CRC, then flushes, syncs and closes both
+// files.
+func (w *bitcaskWriter) close() error {
+	var trailer [bitcaskHintHeaderSize]byte
+	binary.BigEndian.PutUint32(trailer[6:], w.hintCRC)
+	binary.BigEndian.PutUint64(trailer[10:], bitcaskHintEnd)
+	w.hintW.Write(trailer[:])
+	e := w.dataW.Flush()
+	if e == nil {
+		e = w.hintW.Flush()
+	}
+	if e == nil {
+		e = w.data.Sync()
+	}
+	if e == nil {
+		e = w.hint.Sync()
+	}
+	dataErr, hintErr := w.data.Close(), w.hint.Close()
+	if e == nil {
+		e = dataErr
+	}
+	if e == nil {
+		e = hintErr
+	}
+	return e
+}
+
+// Closes and removes both files.
+func (w *bitcaskWriter) abort() {
+	w.data.Close()
+	w.hint.Close()
+	os.Remove(w.data.Name())
+	os.Remove(w.hint.Name())
+}
+
+// Returns the ids of the Bitcask data files in dir, in ascending order.
+func bitcaskFiles(dir string) ([]int, error) {
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		return nil, e
+	}
+	var out []int
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), bitcaskDataSuffix)
+		if !ok {
+			continue
+		}
+		id, e := strconv.Atoi(name)
+		if e == nil && id >= 0 {
+			out = append(out, id)
+		}
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+// Upserts every live pair of the Erlang Bitcask in dir, which should not be
+// open for writing elsewhere.  Data files are read oldest first, so later
+// entries and tombstones override earlier ones as in Bitcask itself.  Each
+// file is indexed from its hint file where that is intact, and otherwise
+// read through, stopping at a partial entry at the end as left by a crash.
+// Every entry read is checked against its CRC, and one that doesn't match
+// fails the import with an error wrapping ErrCorrupt.  Timestamps are not
+// kept.  Pairs are committed in batches as they are read, so on error those
+// already committed remain imported.
+func (d *DB) ImportBitcask(dir string) error {
+	ids, e := bitcaskFiles(dir)
+	if e != nil {
+		return e
+	}
+	b := d.NewBatch()
+	for _, id := range ids {
+		base := filepath.Join(dir, strconv.Itoa(id))
+		e = readBitcask(base, func(k, v []byte, tombstone bool) error {
+			if tombstone {
+				b.Remove(k)
+			} else {
+				b.Upsert(k, v)
+			}
+			if b.Len() >= importBatchSize {
+				return b.Commit()
+			}
+			return nil
+		})
+		if e != nil {
+			b.Reset()
+			return e
+		}
+	}
+	return b.Commit()
+}
+
+// Creates a DB at location holding the live pairs of the Erlang Bitcask in
+// dir, as ImportBitcask reads them.  The DB is closed once written.
+func ConvertBitcask(dir, location string) error {
+	d, e := NewDB(location)
+	if e != nil {
+		return e
+	}
+	e = d.ImportBitcask(dir)
+	closeErr := d.Close()
+	if e == nil {
+		e = closeErr
+	}
+	return e
+}
+
+// Calls fn with each entry of the Bitcask data file at base plus its suffix,
+// in order, using the hint file if it's intact.  k and v are only valid
+// during the call.
+func readBitcask(base string, fn func(k, v []byte, tombstone bool) error) error {
+	data, e := os.Open(base + bitcaskDataSuffix)
+	if e != nil {
+		return e
+	}
+	defer data.Close()
+	hints, e := readBitcaskHints(base + bitcaskHintSuffix)
+	if e != nil {
+		return scanBitcask(data, fn)
+	}
+	var buf []byte
+	for _, h := range hints {
+		if h.tombstone {
+			e = fn(h.key, nil, true)
+		} else {
+			buf = resize(buf, int(h.total))
+			_, e = data.ReadAt(buf, int64(h.offset))
+			if e != nil {
+				return e
+			}
+			var k, v []byte
+			k, v, e = checkBitcaskEntry(buf, h.offset)
+			if e == nil {
+				e = fn(k, v, bitcaskIsTombstone(v))
+			}
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Calls fn with each entry read straight through the data file in f.
+func scanBitcask(f *os.File, fn func(k, v []byte, tombstone bool) error) error {
+	r := bufio.NewReader(f)
+	var header [bitcaskHeaderSize]byte
+	var buf []byte
+	offset := uint64(0)
+	for {
+		_, e := io.ReadFull(r, header[:])
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		n := bitcaskHeaderSize + int(binary.BigEndian.Uint16(header[8:])) + int(binary.BigEndian.Uint32(header[10:]))
+		buf = resize(buf, n)
+		copy(buf, header[:])
+		_, e = io.ReadFull(r, buf[bitcaskHeaderSize:])
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		k, v, e := checkBitcaskEntry(buf, offset)
+		if e == nil {
+			e = fn(k, v, bitcaskIsTombstone(v))
+		}
+		if e != nil {
+			return e
+		}
+		offset += uint64(n)
+	}
+}
+
+// Returns the key and value of the Bitcask entry filling buf, read from the
+// given offset, or an error wrapping ErrCorrupt if it doesn't match its CRC.
+func checkBitcaskEntry(buf []byte, offset uint64) ([]byte, []byte, error) {
+	if len(buf) < bitcaskHeaderSize {
+		return nil, nil, corruptionAt(offset)
+	}
+	kLen := int(binary.BigEndian.Uint16(buf[8:]))
+	vLen := int(binary.BigEndian.Uint32(buf[10:]))
+	if len(buf) != bitcaskHeaderSize+kLen+vLen || crc32.ChecksumIEEE(buf[4:]) != binary.BigEndian.Uint32(buf) {
+		return nil, nil, corruptionAt(offset)
+	}
+	return buf[bitcaskHeaderSize : bitcaskHeaderSize+kLen], buf[bitcaskHeaderSize+kLen:], nil
+}
+
+// Returns buf with length n, reallocated only if it's too short.
+func resize(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
+
+// An entry in a Bitcask hint file.
+type bitcaskHint struct {
+	key       []byte
+	total     uint32
+	offset    uint64
+	tombstone bool
+}
+
+// Returns the entries of the hint file at path, or an error if it is missing,
+// truncated or doesn't match its CRC.
+func readBitcaskHints(path string) ([]bitcaskHint, error) {
+	buf, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	var out []bitcaskHint
+	pos := 0
+	for pos+bitcaskHintHeaderSize <= len(buf) {
+		kLen := int(binary.BigEndian.Uint16(buf[pos+4:]))
+		total := binary.BigEndian.Uint32(buf[pos+6:])
+		offset := binary.BigEndian.Uint64(buf[pos+10:])
+		if kLen == 0 && offset == bitcaskHintEnd {
+			if pos+bitcaskHintHeaderSize != len(buf) || crc32.ChecksumIEEE(buf[:pos]) != total {
+				break
+			}
+			return out, nil
+		}
+		end := pos + bitcaskHintHeaderSize + kLen
+		if end > len(buf) {
+			break
+		}
+		out = append(out, bitcaskHint{buf[pos+bitcaskHintHeaderSize : end], total, offset &^ bitcaskTombstoneBit, offset&bitcaskTombstoneBit != 0})
+		pos = end
+	}
+	return nil, errors.New("Damaged Bitcask hint file " + path)
+}
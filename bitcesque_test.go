@@ -1,9 +1,28 @@
 package bitcesque
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestBitcesque(t *testing.T) {
@@ -33,6 +52,13 @@ func TestBitcesque(t *testing.T) {
 	r2, _ := d.Get(k2)
 	r3, _ := d.Get(k3)
 
+	b1, _ := d.GetBytes(k1)
+	b2, _ := d.GetInto(k2, make([]byte, 0, 16))
+	b3, _ := d.GetZeroCopy(k3)
+	if string(b1) != string(v1) || string(b2) != string(v2) || string(b3) != string(v3) {
+		t.Error("Byte retrieval error")
+	}
+
 	e = d.Sync()
 	if e != nil {
 		t.Error("Sync error")
@@ -105,9 +131,4139 @@ func TestBitcesque(t *testing.T) {
 	d.Close()
 
 	d, e = OpenAndVerifyDB(loc)
-	if e == nil {
+	if !errors.Is(e, ErrCorrupt) {
 		t.Error("Error verifying integrity")
 	}
+	if e = d.Upsert(make([]byte, keyLenMask+1), v1); e != ErrKeyTooLarge {
+		t.Error("Oversized key accepted")
+	}
 	d.Close()
+	if _, e = d.Lookup(k1); e != ErrDatabaseClosed {
+		t.Error("Lookup on closed DB")
+	}
 	os.Remove(loc)
 }
+
+func TestBatch(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer os.Remove(loc)
+	defer os.Remove(loc + ".keys")
+
+	d, e := NewDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+
+	b := d.NewBatch()
+	b.Upsert([]byte("Dick"), []byte("Oregon"))
+	b.Upsert([]byte("Harry"), []byte("Wisconsin"))
+	b.Remove([]byte("Tom"))
+	if _, present := d.Get([]byte("Dick")); present {
+		t.Error("Batch applied before commit")
+	}
+	if e = b.Commit(); e != nil {
+		t.Error(e)
+	}
+	if b.Len() != 0 {
+		t.Error("Batch not reset after commit")
+	}
+	batchEnd := d.filledSize
+	d.Upsert([]byte("Tom"), []byte("New York"))
+
+	r1, _ := d.Get([]byte("Dick"))
+	r2, _ := d.Get([]byte("Harry"))
+	r3, _ := d.Get([]byte("Tom"))
+	if r1 != "Oregon" || r2 != "Wisconsin" || r3 != "New York" {
+		t.Error("Batch commit error")
+	}
+	d.Close()
+
+	d, e = OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Error(e)
+	}
+	r1, _ = d.Get([]byte("Dick"))
+	r3, _ = d.Get([]byte("Tom"))
+	if r1 != "Oregon" || r3 != "New York" {
+		t.Error("Error verifying batch")
+	}
+	//Chop the trailing upsert and the end of the batch frame
+	e = d.filehandle.Truncate(int64(batchEnd) - 1)
+	if e != nil {
+		t.Error(e)
+	}
+	d.Close()
+
+	d, e = OpenAndVerifyDB(loc)
+	if e == nil {
+		t.Error("Torn batch not detected")
+	}
+	r3, _ = d.Get([]byte("Tom"))
+	if _, present := d.Get([]byte("Dick")); present || r3 != "Washington" {
+		t.Error("Torn batch partially applied")
+	}
+	d.Close()
+}
+
+func TestTxn(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Upsert([]byte("Dick"), []byte("Oregon"))
+
+	txn := d.Begin()
+	txn.Upsert([]byte("Harry"), []byte("Wisconsin"))
+	txn.Remove([]byte("Tom"))
+	if v, e := txn.Get([]byte("Harry")); string(v) != "Wisconsin" || e != nil {
+		t.Error("Transaction can't read its own write")
+	}
+	if _, e := txn.Get([]byte("Tom")); e != ErrKeyNotFound {
+		t.Error("Transaction can't read its own removal")
+	}
+	if v, _ := txn.Get([]byte("Dick")); string(v) != "Oregon" {
+		t.Error("Transaction can't read the DB")
+	}
+	if _, present := d.Get([]byte("Harry")); present {
+		t.Error("Transaction applied before commit")
+	}
+	if e := txn.Commit(); e != nil {
+		t.Error(e)
+	}
+	if e := txn.Commit(); e != ErrTxnDone {
+		t.Error("Transaction committed twice")
+	}
+	r2, _ := d.Get([]byte("Harry"))
+	if _, present := d.Get([]byte("Tom")); present || r2 != "Wisconsin" {
+		t.Error("Transaction not applied")
+	}
+
+	//A key read, absent or not, changing under the transaction fails it
+	for _, k := range []string{"Dick", "Sally"} {
+		txn = d.Begin()
+		txn.Get([]byte(k))
+		txn.Upsert([]byte("Harry"), []byte("Ohio"))
+		d.Upsert([]byte(k), []byte("Maine"))
+		if v, _ := txn.Get([]byte(k)); string(v) == "Maine" {
+			t.Error("Transaction read not repeatable")
+		}
+		if e := txn.Commit(); e != ErrConflict {
+			t.Error("Conflict not detected for " + k)
+		}
+	}
+	//Writes to keys not read don't conflict, nor does compaction
+	txn = d.Begin()
+	txn.Get([]byte("Dick"))
+	txn.Upsert([]byte("Harry"), []byte("Ohio"))
+	d.Upsert([]byte("Tom"), []byte("Texas"))
+	d.Consolidate()
+	if e := txn.Commit(); e != nil {
+		t.Error(e)
+	}
+	txn = d.Begin()
+	txn.Upsert([]byte("Harry"), []byte("Utah"))
+	txn.Rollback()
+	d.Close()
+
+	d, e := OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	r1, _ := d.Get([]byte("Dick"))
+	r2, _ = d.Get([]byte("Harry"))
+	if r1 != "Maine" || r2 != "Ohio" {
+		t.Error("Wrong values after reopening: " + r1 + " " + r2)
+	}
+	d.Close()
+}
+
+func TestAutoCompact(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer os.Remove(loc)
+	defer os.Remove(loc + ".keys")
+
+	d, e := NewDBWithOptions(loc, &Options{
+		AutoCompactDeadRatio: 0.5,
+		AutoCompactInterval:  time.Millisecond,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	k := []byte("Tom")
+	for i := 0; i < 100; i++ {
+		d.Upsert(k, []byte("Washington"))
+	}
+	d.Remove([]byte("Nobody"))
+	for i := 0; i < 1000 && d.DeadRatio() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if d.DeadRatio() != 0 {
+		t.Error("Auto-compaction did not run")
+	}
+	r, _ := d.Get(k)
+	if r != "Washington" {
+		t.Error("Retrieval error after auto-compaction")
+	}
+	e = d.Close()
+	if e != nil {
+		t.Error(e)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, e := NewDBWithOptions(loc, &Options{MaxSegmentSize: 256})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 100; i++ {
+		d.Upsert([]byte(strconv.Itoa(i%40)), []byte(strconv.Itoa(i)))
+	}
+	d.Remove([]byte("0"))
+	if d.Segments() < 2 {
+		t.Error("Segments not rotated")
+	}
+	check := func(stage string) {
+		if _, present := d.Get([]byte("0")); present {
+			t.Error("Removal lost at " + stage)
+		}
+		for i := 61; i < 100; i++ {
+			if i%40 == 0 {
+				continue
+			}
+			r, _ := d.Get([]byte(strconv.Itoa(i % 40)))
+			if r != strconv.Itoa(i) {
+				t.Error("Retrieval error at " + stage)
+				return
+			}
+		}
+	}
+	check("write")
+	d.Close()
+
+	d, e = OpenDBWithOptions(loc, &Options{MaxSegmentSize: 256})
+	if e != nil {
+		t.Fatal(e)
+	}
+	check("reopen")
+	segs := d.Segments()
+	if e = d.Merge(); e != nil {
+		t.Error(e)
+	}
+	if d.Segments() != 2 || segs <= 2 {
+		t.Error("Merge error")
+	}
+	check("merge")
+	d.Upsert([]byte("1"), []byte("101"))
+	d.Upsert([]byte("1"), []byte("81"))
+	d.Close()
+
+	d, e = OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	check("verify")
+	if e = d.Consolidate(); e != nil {
+		t.Error(e)
+	}
+	if d.Segments() != 1 {
+		t.Error("Consolidate left extra segments")
+	}
+	check("consolidate")
+	d.Close()
+	ids, _ := listSegments(loc)
+	if len(ids) != 1 || ids[0] != 0 {
+		t.Error("Stale segment files left behind")
+	}
+}
+
+// Removes the DB at loc along with any segment and key files.
+func removeAll(loc string) {
+	matches, _ := filepath.Glob(loc + "*")
+	for _, m := range matches {
+		os.Remove(m)
+	}
+}
+
+func TestInterruptedMerge(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, e := NewDBWithOptions(loc, &Options{MaxSegmentSize: 64})
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Upsert([]byte("Dick"), []byte("Oregon"))
+	d.Upsert([]byte("Tom"), []byte("New York"))
+	d.Remove([]byte("Dick"))
+	d.Upsert([]byte("Harry"), []byte("Wisconsin"))
+	ids := d.segmentIDs()
+	d.Close()
+	if len(ids) < 3 {
+		t.Fatal("Expected several segments")
+	}
+	check := func(stage string) {
+		r1, _ := d.Get([]byte("Tom"))
+		r3, _ := d.Get([]byte("Harry"))
+		_, present := d.Get([]byte("Dick"))
+		if r1 != "New York" || r3 != "Wisconsin" || present {
+			t.Error("Retrieval error after " + stage)
+		}
+	}
+
+	//Crash while the merged file was being written
+	ioutil.WriteFile(mergePath(loc), []byte("partial"), 0666)
+	(&manifest{segments: ids, merging: ids[:2]}).write(loc)
+	d, e = OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	check("discarded merge")
+	d.Close()
+	if _, e = os.Stat(mergePath(loc)); !os.IsNotExist(e) {
+		t.Error("Partial merge output not discarded")
+	}
+
+	//Crash after the merged file was complete.  Concatenating the inputs is a
+	//valid, if unreduced, merge.
+	s0, _ := ioutil.ReadFile(segmentPath(loc, ids[0]))
+	s1, _ := ioutil.ReadFile(segmentPath(loc, ids[1]))
+	ioutil.WriteFile(mergePath(loc), append(s0, s1[headerSize:]...), 0666)
+	(&manifest{segments: ids, merging: ids[:2], merged: true}).write(loc)
+	d, e = OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	check("rolled forward merge")
+	if d.Segments() != len(ids)-1 {
+		t.Error("Merge not rolled forward")
+	}
+	d.Close()
+	if _, e = os.Stat(segmentPath(loc, ids[1])); !os.IsNotExist(e) {
+		t.Error("Merged input not removed")
+	}
+}
+
+func TestConsolidateOnline(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, e := NewDBWithOptions(loc, &Options{MaxSegmentSize: 4096, KeepVersions: 1})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 2000; i++ {
+		d.Upsert([]byte(strconv.Itoa(i%500)), []byte(strconv.Itoa(i)))
+	}
+	d.Remove([]byte("0"))
+
+	//Writes carry on during the merge, and must all survive it
+	done := make(chan struct{})
+	written := make(chan int)
+	go func() {
+		i := 0
+		for {
+			select {
+			case <-done:
+				written <- i
+				return
+			default:
+			}
+			k := []byte(strconv.Itoa(i % 700))
+			if i%7 == 0 {
+				d.Remove(k)
+			} else {
+				d.Upsert(k, []byte("w"+strconv.Itoa(i)))
+			}
+			i++
+		}
+	}()
+	for n := 0; n < 3; n++ {
+		if e = d.Consolidate(); e != nil {
+			t.Fatal(e)
+		}
+	}
+	close(done)
+	n := <-written
+	want := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		want[strconv.Itoa(i%500)] = strconv.Itoa(i)
+	}
+	delete(want, "0")
+	for i := 0; i < n; i++ {
+		if k := strconv.Itoa(i % 700); i%7 == 0 {
+			delete(want, k)
+		} else {
+			want[k] = "w" + strconv.Itoa(i)
+		}
+	}
+	check := func(stage string) {
+		got := d.Dump()
+		if len(got) != len(want) {
+			t.Error("Size mismatch after " + stage)
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Error("Value mismatch after " + stage + " for " + k)
+				return
+			}
+		}
+	}
+	check("consolidation")
+	if e = d.Consolidate(); e != nil {
+		t.Fatal(e)
+	}
+	if d.Segments() != 1 {
+		t.Error("Consolidation left several segments")
+	}
+	d.Close()
+	d, e = OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer d.Close()
+	check("reopen")
+}
+
+func TestTTL(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, e := NewDBWithOptions(loc, &Options{ExpirySweepInterval: -1})
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.UpsertWithTTL([]byte("Tom"), []byte("Washington"), 50*time.Millisecond)
+	d.UpsertWithTTL([]byte("Dick"), []byte("Oregon"), time.Hour)
+	d.Upsert([]byte("Harry"), []byte("Wisconsin"))
+	if r, _ := d.Get([]byte("Tom")); r != "Washington" {
+		t.Error("Retrieval error before expiry")
+	}
+	if _, present := d.ExpiresAt([]byte("Harry")); present {
+		t.Error("Expiry reported for key without TTL")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, present := d.Get([]byte("Tom")); present || d.Contains([]byte("Tom")) {
+		t.Error("Expired key still visible")
+	}
+	if d.Size() != 2 || len(d.Keys()) != 2 {
+		t.Error("Expired key still counted")
+	}
+	d.Close()
+
+	d, e = OpenDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, present := d.ExpiresAt([]byte("Dick")); !present {
+		t.Error("Expiry lost through keyfile")
+	}
+	if d.Contains([]byte("Tom")) {
+		t.Error("Expired key visible after reopen")
+	}
+	e = d.Consolidate()
+	if e != nil {
+		t.Error(e)
+	}
+	if d.kToPos.len() != 2 {
+		t.Error("Consolidate kept expired key")
+	}
+	d.Close()
+
+	d, e = OpenAndVerifyDBWithOptions(loc, &Options{ExpirySweepInterval: time.Millisecond})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, present := d.ExpiresAt([]byte("Dick")); !present {
+		t.Error("Expiry lost through verification")
+	}
+	d.UpsertWithTTL([]byte("Tom"), []byte("Washington"), time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	d.mutex.RLock()
+	_, indexed := d.kToPos.get("Tom")
+	d.mutex.RUnlock()
+	if indexed {
+		t.Error("Sweeper did not drop expired key")
+	}
+	d.Close()
+}
+
+func TestScan(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	opts := &Options{OrderedIndex: true}
+	d, e := NewDBWithOptions(loc, opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 300; i++ {
+		d.Upsert([]byte("user/"+strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+		d.Upsert([]byte("group/"+strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 300; i += 2 {
+		d.Remove([]byte("user/" + strconv.Itoa(i)))
+	}
+	d.Close()
+	d, e = OpenDBWithOptions(loc, opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer d.Close()
+
+	var got []string
+	it := d.Scan([]byte("user/1"))
+	for it.Next() {
+		if string(it.Value()) != string(it.Key()[5:]) {
+			t.Error("Scan value mismatch for " + string(it.Key()))
+		}
+		got = append(got, string(it.Key()))
+	}
+	var want []string
+	for _, k := range d.Keys() {
+		if strings.HasPrefix(k, "user/1") {
+			want = append(want, k)
+		}
+	}
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Error("Scan returned wrong keys")
+	}
+	if it.Next() {
+		t.Error("Exhausted iterator advanced")
+	}
+
+	it = d.Scan(nil)
+	n := 0
+	for it.Next() {
+		if n == 10 {
+			d.Remove([]byte("user/99"))
+			d.Upsert([]byte("zebra"), []byte("x"))
+		}
+		n++
+	}
+	if n != 450 {
+		t.Error("Full scan saw " + strconv.Itoa(n) + " keys")
+	}
+}
+
+func TestIteratorErr(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	opts := &Options{VerifyOnRead: true}
+	d, _ := NewDBWithOptions(loc, opts)
+	d.Upsert([]byte("a"), []byte("Washington"))
+	d.Upsert([]byte("b"), []byte("Oregon"))
+	d.Upsert([]byte("c"), []byte("Wisconsin"))
+	d.Close()
+	b, _ := ioutil.ReadFile(loc)
+	ioutil.WriteFile(loc, bytes.Replace(b, []byte("Oregon"), []byte("Oregan"), 1), 0666)
+
+	d, _ = OpenDBWithOptions(loc, opts)
+	defer d.Close()
+	it := d.Scan(nil)
+	if !it.Next() || string(it.Value()) != "Washington" || it.Err() != nil {
+		t.Error("Scan error before damage")
+	}
+	if it.Next() || !errors.Is(it.Err(), ErrCorrupt) || it.Next() {
+		t.Error("Damaged value not reported by iterator", it.Err())
+	}
+}
+
+func TestRangeScan(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	for _, opts := range []*Options{{OrderedIndex: true}, nil} {
+		d, e := NewDBWithOptions(loc, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		for i := 100; i < 200; i++ {
+			d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+		}
+		collect := func(it *Iterator) string {
+			var got []string
+			for it.Next() {
+				got = append(got, string(it.Key()))
+			}
+			return strings.Join(got, ",")
+		}
+		if r := collect(d.RangeScan([]byte("150"), []byte("155"))); r != "150,151,152,153,154" {
+			t.Error("Range scan returned " + r)
+		}
+		if r := collect(d.RangeScan([]byte("195"), nil)); r != "195,196,197,198,199" {
+			t.Error("Unbounded range scan returned " + r)
+		}
+		it := d.RangeScan([]byte("110"), []byte("130"))
+		it.Next()
+		it.Seek([]byte("125"))
+		if r := collect(it); r != "125,126,127,128,129" {
+			t.Error("Seek returned " + r)
+		}
+		it.Seek([]byte("1"))
+		if r := collect(it); !strings.HasPrefix(r, "110,111") {
+			t.Error("Backward seek returned " + r)
+		}
+		if r := collect(d.RangeScan([]byte("3"), nil)); r != "" {
+			t.Error("Empty range scan returned " + r)
+		}
+		d.Close()
+	}
+}
+
+func TestCompactIndex(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	for _, opts := range []*Options{{CompactIndex: true}, {DiskIndex: true}} {
+		//Enough removals to repack the arenas held in memory
+		x := newIndex(opts, loc, 0)
+		for i := 0; i < 200000; i++ {
+			x.set("key"+strconv.Itoa(i), offsetAndLength{uint64(i), 1, 5, docPrefix(0, len("key"+strconv.Itoa(i))), 0})
+		}
+		c := x.clone()
+		for i := 0; i < 200000; i += 2 {
+			x.remove("key" + strconv.Itoa(i))
+		}
+		x.set("key1", offsetAndLength{7, 2, 9, docPrefix(expiryFlag, 4), expiryFlag >> 24})
+		if x.len() != 100000 || c.len() != 200000 {
+			t.Error("Wrong sizes " + strconv.Itoa(x.len()) + ", " + strconv.Itoa(c.len()))
+		}
+		for i := 0; i < 200000; i++ {
+			k := "key" + strconv.Itoa(i)
+			oal, present := x.lookup([]byte(k))
+			if present != (i%2 == 1) || (present && i != 1 && oal.offset != uint64(i)) {
+				t.Fatal("Wrong entry for " + k)
+			}
+			if oal, _ = c.get(k); oal.offset != uint64(i) || oal.prefix != docPrefix(0, len(k)) {
+				t.Fatal("Clone changed for " + k)
+			}
+		}
+		if oal, _ := x.get("key1"); oal != (offsetAndLength{7, 2, 9, docPrefix(expiryFlag, 4), expiryFlag >> 24}) {
+			t.Error("Overwrite not kept")
+		}
+		n := 0
+		for k, oal := range x.all() {
+			if want, _ := x.get(k); want != oal {
+				t.Fatal("Iteration disagrees for " + k)
+			}
+			n++
+		}
+		if n != 100000 {
+			t.Error("Iterated " + strconv.Itoa(n) + " keys")
+		}
+
+		d, _ := NewDBWithOptions(loc, opts)
+		d.Upsert([]byte("Tom"), []byte("Washington"))
+		d.Upsert([]byte("Dick"), []byte("Oregon"))
+		d.Upsert([]byte("Tom"), []byte("Wisconsin"))
+		d.Remove([]byte("Dick"))
+		d.Close()
+		d, e := OpenDBWithOptions(loc, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v, _ := d.Get([]byte("Tom")); v != "Wisconsin" || d.Contains([]byte("Dick")) || d.Size() != 1 {
+			t.Error("Index not reloaded")
+		}
+		d.Close()
+		if scratch, _ := filepath.Glob(loc + ".index*"); len(scratch) != 0 {
+			t.Error("Scratch files left behind")
+		}
+	}
+}
+
+func TestLocking(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, e := NewDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = OpenDB(loc); e != ErrDatabaseLocked {
+		t.Error("Second open not refused")
+	}
+	if _, e = NewDB(loc); e != ErrDatabaseLocked {
+		t.Error("Second create not refused")
+	}
+	d.Close()
+	d, e = OpenDB(loc)
+	if e != nil {
+		t.Error("Lock not released on close")
+	}
+	d.Close()
+
+	//The lock file used without flock, left behind by a crash
+	os.Remove(loc + ".lock")
+	lock, e := lockByFile(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = lockByFile(loc); e != ErrDatabaseLocked {
+		t.Error("Second file lock not refused")
+	}
+	lock.Close()
+	if pid, _ := ioutil.ReadFile(loc + ".lock"); string(pid) != strconv.Itoa(os.Getpid()) {
+		t.Error("Process id not recorded in lock file: " + string(pid))
+	}
+	if _, e = lockByFile(loc); e != ErrDatabaseLocked {
+		t.Error("Stale file lock released by itself")
+	}
+	os.Remove(loc + ".lock")
+	if lock, e = lockByFile(loc); e != nil {
+		t.Error("File lock not taken after removing stale file")
+	} else if unlockByFile(loc, lock) != nil {
+		t.Error("File lock not released")
+	}
+}
+
+func TestStat(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	//A document as written before timestamps existed
+	old := []byte{0, 0, 0, 0, 3, 0, 0, 0, 6, 0, 0, 0}
+	old = append(old, "TomOregon"...)
+	uint32ToBytes(old, 0, crc32.Checksum(old[4:], crcTable))
+	ioutil.WriteFile(loc, old, 0666)
+
+	d, e := OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	st, present := d.Stat([]byte("Tom"))
+	if !present || st.Size != 6 || !st.Timestamp.IsZero() {
+		t.Error("Stat error for old-format record")
+	}
+	before := time.Now()
+	d.Upsert([]byte("Dick"), []byte("Washington"))
+	d.UpsertWithTTL([]byte("Harry"), []byte("Wisconsin"), time.Hour)
+	st, _ = d.Stat([]byte("Dick"))
+	if st.Size != 10 || st.Timestamp.Before(before) || !st.Expiry.IsZero() {
+		t.Error("Stat error")
+	}
+	st, _ = d.Stat([]byte("Harry"))
+	if st.Expiry.Before(before.Add(time.Hour)) || st.Timestamp.Before(before) {
+		t.Error("Stat error with expiry")
+	}
+	if _, present = d.Stat([]byte("Nobody")); present {
+		t.Error("Stat of missing key")
+	}
+	d.Consolidate()
+	st2, _ := d.Stat([]byte("Harry"))
+	if st2.Size != st.Size || st2.Timestamp != st.Timestamp || st2.Expiry != st.Expiry {
+		t.Error("Consolidate changed record metadata")
+	}
+	if st2.Offset == st.Offset {
+		t.Error("Stat offset not updated by Consolidate")
+	}
+	d.Close()
+
+	d, e = OpenDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	r1, _ := d.Get([]byte("Tom"))
+	r2, _ := d.Get([]byte("Dick"))
+	st, _ = d.Stat([]byte("Harry"))
+	if r1 != "Oregon" || r2 != "Washington" || st2 != st {
+		t.Error("Error reopening mixed-format DB")
+	}
+	d.Close()
+}
+
+func TestUserFlags(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	aead, _ := NewAESGCM(make([]byte, 16))
+	for _, opts := range []*Options{nil, {Encryption: aead, EncryptKeys: true, Checksum: XXHash64}} {
+		d, _ := NewDBWithOptions(loc, opts)
+		d.UpsertWithFlags([]byte("Tom"), []byte("Washington"), 0x81)
+		d.UpsertWithFlags([]byte("Count"), []byte("1"), 7)
+		d.UpsertWithFlags([]byte("Dick"), []byte("Oregon"), 3)
+		d.Upsert([]byte("Dick"), []byte("Idaho"))
+		d.Increment([]byte("Count"), 1)
+		d.Consolidate()
+		d.Close()
+		d, e := OpenAndVerifyDBWithOptions(loc, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		for k, want := range map[string]uint8{"Tom": 0x81, "Count": 7, "Dick": 0} {
+			if st, _ := d.Stat([]byte(k)); st.Flags != want {
+				t.Errorf("Expected flags %d for %s, got %d", want, k, st.Flags)
+			}
+		}
+		if v, _ := d.Get([]byte("Tom")); v != "Washington" {
+			t.Error("Wrong value read with flags")
+		}
+		if v, _ := d.Get([]byte("Count")); v != "2" {
+			t.Error("Wrong value incremented with flags")
+		}
+		d.Close()
+		d, _ = OpenDBWithOptions(loc, opts)
+		if st, _ := d.Stat([]byte("Tom")); st.Flags != 0x81 {
+			t.Error("Flags lost from keyfile")
+		}
+		d.Close()
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	m := d.Metadata()
+	if len(m.ID) != 36 || m.ID[14] != '4' || time.Since(m.Created) > time.Minute || m.FormatVersion != formatVersion {
+		t.Error("Wrong metadata for new DB: " + m.ID)
+	}
+	d.SetProperty("owner", "team a")
+	d.SetProperty("odd \"name\"", "line\nbreak")
+	d.SetProperty("gone", "soon")
+	d.SetProperty("gone", "")
+	s, _ := d.Snapshot()
+	if e := s.SetProperty("owner", "team b"); e != ErrReadOnly {
+		t.Error("Property set on snapshot")
+	}
+	s.Close()
+	d.Clear()
+	d.Close()
+
+	d, e := OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	got := d.Metadata()
+	if got.ID != m.ID || !got.Created.Equal(m.Created) || len(got.Properties) != 2 {
+		t.Error("Metadata not kept")
+	}
+	if v, _ := d.GetProperty("odd \"name\""); v != "line\nbreak" {
+		t.Error("Wrong property read back: " + v)
+	}
+	if _, present := d.GetProperty("gone"); present {
+		t.Error("Removed property read back")
+	}
+	n, e := d.CompactTo(loc + ".moved")
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.Close()
+	if v, _ := n.GetProperty("owner"); n.Metadata().ID != m.ID || v != "team a" {
+		t.Error("Metadata not kept by CompactTo")
+	}
+	n.Close()
+
+	//DBs predating metadata are given some on opening
+	os.Remove(metaPath(loc))
+	d, _ = OpenDB(loc)
+	if d.Metadata().ID == m.ID || len(d.Metadata().Properties) != 0 {
+		t.Error("Metadata not made afresh")
+	}
+	id := d.Metadata().ID
+	d.Close()
+	d, _ = OpenDB(loc)
+	if d.Metadata().ID != id {
+		t.Error("Fresh metadata not kept")
+	}
+	d.Close()
+	d, _ = NewDB(loc)
+	if d.Metadata().ID == id {
+		t.Error("New DB kept old identity")
+	}
+	d.Close()
+}
+
+func TestFormatVersion(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	d.Close()
+	for _, path := range []string{loc, loc + ".keys"} {
+		b, _ := ioutil.ReadFile(path)
+		if len(b) < headerSize || b[4] != formatVersion {
+			t.Fatal("Missing header in " + path)
+		}
+	}
+	d, e := OpenDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	r, _ := d.Get([]byte("Tom"))
+	if r != "Oregon" {
+		t.Error("Error reading versioned DB")
+	}
+	d.Close()
+
+	for _, path := range []string{loc + ".keys", loc} {
+		b, _ := ioutil.ReadFile(path)
+		b[4] = formatVersion + 1
+		ioutil.WriteFile(path, b, 0666)
+		d, e = OpenDB(loc)
+		if e != ErrUnsupportedVersion {
+			t.Error("Opened a file of unknown version: " + path)
+			d.Close()
+		}
+	}
+	_, e = OpenAndVerifyDB(loc)
+	if e != ErrUnsupportedVersion {
+		t.Error("Verified a file of unknown version")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	long := []byte(strings.Repeat(`{"name": "Tom", "state": "Oregon"}`, 100))
+	d, _ := NewDBWithOptions(loc, &Options{Compression: Flate})
+	d.Upsert([]byte("Tom"), long)
+	d.Upsert([]byte("Dick"), []byte("Washington"))
+	if d.filledSize > uint64(len(long)/2) {
+		t.Error("Value not compressed")
+	}
+	r, _ := d.GetBytes([]byte("Tom"))
+	st, _ := d.Stat([]byte("Tom"))
+	if string(r) != string(long) || st.Size != len(long) || !st.Compressed || st.StoredSize >= len(long) {
+		t.Error("Error reading compressed value")
+	}
+	//Recorded lengths are checked before anything is allocated for them
+	rec := newRecord([]byte("Tom"), long, 0)
+	d.compressRecord(&rec)
+	_, n := binary.Uvarint(rec.value[1:])
+	huge := append(binary.AppendUvarint([]byte{Flate.ID()}, 1<<40), rec.value[1+n:]...)
+	if _, e := d.decompress(huge); e != ErrCorrupt {
+		t.Error("Implausible length not taken as corruption", e)
+	}
+	short := append(binary.AppendUvarint([]byte{Flate.ID()}, 10), rec.value[1+n:]...)
+	if _, e := d.decompress(short); e != ErrCorrupt {
+		t.Error("Wrong length not taken as corruption", e)
+	}
+	d.opts.MaxValueSize = len(long) - 1
+	if _, e := d.decompress(rec.value); e != ErrCorrupt {
+		t.Error("Length over MaxValueSize not taken as corruption", e)
+	}
+	d.opts.MaxValueSize = 0
+	d.Close()
+
+	//Reading needs no configuration, and compaction undoes compression
+	d, e := OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.Consolidate()
+	r, _ = d.GetBytes([]byte("Tom"))
+	r2, _ := d.Get([]byte("Dick"))
+	if string(r) != string(long) || r2 != "Washington" {
+		t.Error("Error reading after recompression")
+	}
+	if d.filledSize < uint64(len(long)) {
+		t.Error("Value not decompressed by compaction")
+	}
+	d.Close()
+}
+
+func TestEncryption(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	aead, _ := NewAESGCM([]byte("0123456789abcdef"))
+	opts := &Options{Encryption: aead, EncryptKeys: true, Compression: Flate}
+	long := strings.Repeat("Oregon", 100)
+	d, _ := NewDBWithOptions(loc, opts)
+	d.Upsert([]byte("Tom"), []byte(long))
+	d.Upsert([]byte("Dick"), []byte("Washington"))
+	d.Upsert([]byte("Harry"), []byte("Wisconsin"))
+	b := d.NewBatch()
+	b.Remove([]byte("Harry"))
+	b.Commit()
+	r, _ := d.Get([]byte("Tom"))
+	st, _ := d.Stat([]byte("Tom"))
+	if r != long || st.Size != len(long) || d.Contains([]byte("Harry")) {
+		t.Error("Error reading encrypted value")
+	}
+	d.Close()
+	for _, path := range []string{loc, loc + ".keys"} {
+		b, _ := ioutil.ReadFile(path)
+		if strings.Contains(string(b), "Dick") || strings.Contains(string(b), "Washington") {
+			t.Error("Plaintext found in " + path)
+		}
+	}
+
+	if _, e := OpenDB(loc); e != ErrDecryption {
+		t.Error("Opened sealed keyfile without key")
+	}
+	if _, e := OpenAndVerifyDB(loc); e != ErrDecryption {
+		t.Error("Verified encrypted DB without key")
+	}
+	other, _ := NewAESGCM([]byte("fedcba9876543210"))
+	if _, e := OpenAndVerifyDBWithOptions(loc, &Options{Encryption: other}); e != ErrDecryption {
+		t.Error("Verified encrypted DB with the wrong key")
+	}
+
+	d, e := OpenAndVerifyDBWithOptions(loc, opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.Consolidate()
+	r, _ = d.Get([]byte("Dick"))
+	if r != "Washington" || d.Size() != 2 {
+		t.Error("Error reading encrypted DB after compaction")
+	}
+	d.Close()
+	d, e = OpenDBWithOptions(loc, opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	r, _ = d.Get([]byte("Tom"))
+	if r != long {
+		t.Error("Error reading encrypted DB from keyfile")
+	}
+	d.Close()
+
+	//Tampering with the timestamp, an authenticated header field, is detected
+	raw, _ := ioutil.ReadFile(loc)
+	raw[headerSize+12] ^= 1
+	uint32ToBytes(raw, headerSize, crc32.Checksum(raw[headerSize+4:headerSize+20+int(uint32FromBytes(raw, headerSize+8))], crcTable))
+	ioutil.WriteFile(loc, raw, 0666)
+	if _, e = OpenAndVerifyDBWithOptions(loc, opts); e != ErrDecryption {
+		t.Error("Tampered record accepted")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	d.Upsert([]byte{0xff, 0}, []byte{0xfe, 1})
+	d.UpsertWithTTL([]byte("Dick"), []byte("Washington"), time.Hour)
+	var buf strings.Builder
+	e := d.ExportJSON(&buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || lines[1] != `{"k":"Tom","v":"Oregon"}` || lines[2] != `{"k64":"/wA=","v64":"/gE="}` {
+		t.Error("Export error:", lines)
+	}
+	d.Close()
+
+	d, _ = NewDB(loc)
+	e = d.ImportJSON(strings.NewReader(buf.String() + `{"k":"Harry","v":"Wisconsin","expires":1}` + "\n"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	r, _ := d.Get([]byte{0xff, 0})
+	if r != "\xfe\x01" || d.Size() != 3 {
+		t.Error("Import error")
+	}
+	if _, present := d.ExpiresAt([]byte("Dick")); !present {
+		t.Error("Expiry not imported")
+	}
+	e = d.ImportJSON(strings.NewReader(`{"k":"Harry","v":"Wisconsin"}` + "\n" + `{"v":"Nowhere"}`))
+	if e == nil || !d.Contains([]byte("Harry")) {
+		t.Error("Malformed import error")
+	}
+	d.Close()
+}
+
+func TestBackup(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 100})
+	for i := 0; i < 50; i++ {
+		d.Upsert([]byte(strconv.Itoa(i%20)), []byte(strconv.Itoa(i)))
+	}
+	d.Remove([]byte("3"))
+	var buf strings.Builder
+	e := d.Backup(&buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+	want := d.Dump()
+	d.Close()
+
+	e = RestoreFrom(strings.NewReader(buf.String()), loc+".restored")
+	defer removeAll(loc + ".restored")
+	if e != nil {
+		t.Fatal(e)
+	}
+	d, e = OpenAndVerifyDB(loc + ".restored")
+	if e != nil {
+		t.Fatal(e)
+	}
+	got := d.Dump()
+	if len(got) != len(want) || len(got) != 19 {
+		t.Error("Restored DB size mismatch")
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Error("Restored DB mismatch for " + k)
+		}
+	}
+	d.Close()
+
+	e = RestoreFrom(strings.NewReader(buf.String()[:buf.Len()-1]), loc+".restored")
+	if !errors.Is(e, ErrCorrupt) {
+		t.Error("Truncated backup restored")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	defer removeAll(loc + ".replica")
+
+	primary, _ := NewDB(loc)
+	primary.Upsert([]byte("Tom"), []byte("Oregon"))
+	primary.Upsert([]byte("Dick"), []byte("Washington"))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go primary.ServeReplication(l)
+
+	replica, _ := NewDB(loc + ".replica")
+	replica.Upsert([]byte("Harry"), []byte("Wisconsin"))
+	follower, e := replica.Follow(l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	b := primary.NewBatch()
+	b.Upsert([]byte("Sally"), []byte("Ohio"))
+	b.Remove([]byte("Tom"))
+	b.Commit()
+	primary.UpsertWithTTL([]byte("Jane"), []byte("Maine"), time.Hour)
+	//Depending on when the follower connects, it sees these in a snapshot
+	//or as appends
+	for i := 0; i < 500 && !replica.Contains([]byte("Jane")); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !replica.Contains([]byte("Jane")) {
+		t.Fatal("Replica did not catch up: ", follower.Err())
+	}
+	primary.Upsert([]byte("Jane"), []byte("Vermont"))
+	for i := 0; i < 500 && replica.Dump()["Jane"] != "Vermont"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if follower.Applied() == 0 {
+		t.Error("Append not streamed")
+	}
+	got, want := replica.Dump(), primary.Dump()
+	if len(got) != 3 || len(got) != len(want) || got["Sally"] != "Ohio" || got["Jane"] != "Vermont" {
+		t.Error("Replica mismatch", got)
+	}
+	if e = replica.Upsert([]byte("Harry"), []byte("Wisconsin")); e != ErrReadOnly {
+		t.Error("Replica accepted a write")
+	}
+
+	primary.Close()
+	follower.Promote()
+	if e = replica.Upsert([]byte("Harry"), []byte("Wisconsin")); e != nil {
+		t.Error("Promoted replica rejected a write")
+	}
+	replica.Close()
+	replica, _ = OpenDB(loc + ".replica")
+	if replica.Size() != 4 {
+		t.Error("Replica not durable")
+	}
+	replica.Close()
+}
+
+func TestReplicationInterrupted(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	defer removeAll(loc + ".replica")
+
+	primary, _ := NewDB(loc)
+	defer primary.Close()
+	for i := 0; i < 40; i++ {
+		primary.Upsert([]byte(strconv.Itoa(i)), bytes.Repeat([]byte{'x'}, 100000))
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go primary.ServeReplication(l)
+
+	//Passes connections through to the primary, cutting the first off partway
+	//through the snapshot
+	proxy, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer proxy.Close()
+	go func() {
+		for first := true; ; first = false {
+			conn, e := proxy.Accept()
+			if e != nil {
+				return
+			}
+			upstream, e := net.Dial("tcp", l.Addr().String())
+			if e != nil {
+				conn.Close()
+				return
+			}
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			go func(cut bool) {
+				if cut {
+					io.CopyN(conn, upstream, 2*replSnapshotChunk)
+				} else {
+					io.Copy(conn, upstream)
+				}
+				conn.Close()
+				upstream.Close()
+			}(first)
+		}
+	}()
+
+	replica, _ := NewDB(loc + ".replica")
+	defer replica.Close()
+	follower, e := replica.Follow(proxy.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 500 && replica.Size() != primary.Size(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if replica.Size() != primary.Size() {
+		t.Fatal("Replica did not resync after an interrupted snapshot: ", replica.Size(), follower.Err())
+	}
+	primary.Upsert([]byte("Tom"), []byte("Oregon"))
+	for i := 0; i < 500 && !replica.Contains([]byte("Tom")); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !replica.Contains([]byte("Tom")) || follower.Applied() == 0 {
+		t.Error("Append not streamed after resync")
+	}
+	follower.Promote()
+}
+
+func TestServeUnix(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxKeySize: 16, MaxSocketMessage: 1024})
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	served := make(chan error, 1)
+	go func() { served <- d.ServeUnix(loc + ".sock") }()
+	var c *UnixClient
+	var e error
+	for i := 0; i < 500; i++ {
+		if c, e = DialUnix(loc + ".sock"); e == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	if v, e := c.Get([]byte("Tom")); e != nil || string(v) != "Oregon" {
+		t.Error("Wrong value over socket", e)
+	}
+	if _, e := c.Get([]byte("Dick")); e != ErrKeyNotFound {
+		t.Error("Absent key found over socket", e)
+	}
+	c.Upsert([]byte("Dick"), []byte("Maine"))
+	c.UpsertWithTTL([]byte("Harry"), []byte("Texas"), time.Hour)
+	c.Remove([]byte("Tom"))
+	if present, _ := c.Contains([]byte("Tom")); present || d.Contains([]byte("Tom")) {
+		t.Error("Key not removed over socket")
+	}
+	if v, _ := d.Get([]byte("Dick")); v != "Maine" {
+		t.Error("Upsert over socket not applied")
+	}
+	if expiry, present := d.ExpiresAt([]byte("Harry")); !present || expiry.IsZero() {
+		t.Error("TTL over socket not applied")
+	}
+	if e := c.Upsert(bytes.Repeat([]byte("k"), 17), []byte("x")); e != ErrKeyTooLarge {
+		t.Error("Wrong error over socket", e)
+	}
+	if e := c.Upsert([]byte("big"), make([]byte, 2048)); e != ErrValueTooLarge {
+		t.Error("Oversized request not refused", e)
+	}
+	if small, e := DialUnixWithOptions(loc+".sock", &Options{MaxSocketMessage: 4}); e != nil {
+		t.Error(e)
+	} else {
+		if _, e := small.Get([]byte("Dick")); e != ErrValueTooLarge {
+			t.Error("Oversized answer not refused", e)
+		}
+		small.Close()
+	}
+
+	//Frames as documented, written without the client
+	raw, e := net.Dial("unix", loc+".sock")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer raw.Close()
+	exchange := func(op byte, k, v []byte) (byte, string) {
+		frame := []byte{op}
+		frame = binary.LittleEndian.AppendUint32(frame, uint32(len(k)))
+		frame = binary.LittleEndian.AppendUint32(frame, uint32(len(v)))
+		raw.Write(append(append(frame, k...), v...))
+		reply := make([]byte, 5)
+		if _, e := io.ReadFull(raw, reply); e != nil {
+			t.Fatal(e)
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(reply[1:]))
+		if _, e := io.ReadFull(raw, payload); e != nil {
+			t.Fatal(e)
+		}
+		return reply[0], string(payload)
+	}
+	if status, v := exchange('G', []byte("Dick"), nil); status != 'V' || v != "Maine" {
+		t.Error("Wrong raw answer", status, v)
+	}
+	if status, _ := exchange('T', []byte("Sally"), []byte("short")); status != 'E' {
+		t.Error("Short TTL not answered with an error", status)
+	}
+	if status, _ := exchange('P', nil, make([]byte, 2048)); status != 'E' {
+		t.Error("Oversized raw request not answered with an error", status)
+	}
+	if status, _ := exchange('C', []byte("Dick"), nil); status != 'K' {
+		t.Error("Connection unusable after malformed requests", status)
+	}
+
+	//Concurrent clients share the one writer
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, e := DialUnix(loc + ".sock")
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer c.Close()
+			for j := 0; j < 50; j++ {
+				c.Upsert([]byte(strconv.Itoa(i*50+j)), []byte("x"))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if d.Size() != 202 {
+		t.Error("Lost concurrent writes over socket", d.Size())
+	}
+
+	d.Close()
+	if e := <-served; e != ErrDatabaseClosed {
+		t.Error("Serving didn't stop on close", e)
+	}
+	if _, e := c.Get([]byte("Dick")); e == nil {
+		t.Error("Connection outlived the DB")
+	}
+	if _, e := os.Stat(loc + ".sock"); !os.IsNotExist(e) {
+		t.Error("Socket left behind")
+	}
+}
+
+func TestServeDebug(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	d.Upsert([]byte("user:Tom"), []byte("Oregon"))
+	d.UpsertWithTTL([]byte("user:Dick"), []byte("Maine"), time.Hour)
+	d.Upsert([]byte("user:\xff"), []byte("Texas"))
+	d.Upsert([]byte("Harry"), []byte("Ohio"))
+	d.Upsert([]byte("Harry"), []byte("Iowa"))
+	srv := httptest.NewServer(d.debugHandler())
+	defer srv.Close()
+	get := func(method, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, e := http.DefaultClient.Do(req)
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	var stats DBStats
+	_, body := get("GET", "/stats")
+	if e := json.Unmarshal([]byte(body), &stats); e != nil || stats.Keys != 4 || stats.DeadBytes == 0 {
+		t.Error("Wrong stats: " + body)
+	}
+	expiry, _ := d.ExpiresAt([]byte("user:Dick"))
+	want := fmt.Sprintf("{\"k\":\"user:Dick\",\"expires\":%d}\n{\"k\":\"user:Tom\"}\n", expiry.UnixNano())
+	if _, body = get("GET", "/keys?prefix=user:&limit=2"); body != want {
+		t.Error("Wrong keys: " + body)
+	}
+	if _, body = get("GET", "/keys?prefix=user:"); strings.Count(body, "\n") != 3 || !strings.Contains(body, `"k64":"dXNlcjr/"`) {
+		t.Error("Wrong keys: " + body)
+	}
+	if _, body = get("GET", "/keys?prefix=Harry"); body != "{\"k\":\"Harry\"}\n" {
+		t.Error("Key equal to prefix not listed: " + body)
+	}
+	if _, body = get("GET", "/keys?limit=0"); body != "" {
+		t.Error("Keys listed past limit: " + body)
+	}
+	if code, _ := get("GET", "/compact"); code != http.StatusMethodNotAllowed {
+		t.Error("Compacted on GET")
+	}
+	if _, body = get("POST", "/compact?full=1"); json.Unmarshal([]byte(body), &stats) != nil || stats.DeadBytes != 0 {
+		t.Error("Wrong stats after compacting: " + body)
+	}
+	var verified struct {
+		Records int
+		Offset  uint64
+		Error   string
+	}
+	if _, body = get("POST", "/verify"); json.Unmarshal([]byte(body), &verified) != nil || verified.Records != 4 || verified.Error != "" || verified.Offset != d.CommittedOffset() {
+		t.Error("Wrong verification: " + body)
+	}
+	if code, _ := get("GET", "/debug/pprof/heap"); code != http.StatusOK {
+		t.Error("No heap profile")
+	}
+
+	//Serving stops when the DB is closed
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	served := make(chan error, 1)
+	go func() { served <- d.ServeDebug(addr) }()
+	for i := 0; i < 500; i++ {
+		if resp, e := http.Get("http://" + addr + "/stats"); e == nil {
+			resp.Body.Close()
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.Close()
+	if e := <-served; e != ErrDatabaseClosed {
+		t.Error("Serving didn't stop on close", e)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 200})
+	for i := 0; i < 100; i++ {
+		d.Upsert([]byte(strconv.Itoa(i%10)), []byte(strconv.Itoa(i)))
+	}
+	s, e := d.Snapshot()
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.Upsert([]byte("0"), []byte("Changed"))
+	d.Remove([]byte("1"))
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	d.Consolidate()
+
+	want := map[string]string{}
+	for i := 90; i < 100; i++ {
+		want[strconv.Itoa(i%10)] = strconv.Itoa(i)
+	}
+	got := s.Dump()
+	if len(got) != len(want) {
+		t.Error("Snapshot sees later writes")
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Error("Snapshot mismatch for " + k)
+		}
+	}
+	it, n := s.Scan(nil), 0
+	for it.Next() {
+		n++
+	}
+	if n != 10 {
+		t.Error("Snapshot scan error")
+	}
+	if e = s.Upsert([]byte("Tom"), []byte("Oregon")); e != ErrReadOnly {
+		t.Error("Snapshot accepted a write")
+	}
+	r, _ := d.Get([]byte("0"))
+	if r != "Changed" || d.Contains([]byte("1")) {
+		t.Error("Snapshot affected the DB")
+	}
+	if e = s.Close(); e != nil {
+		t.Error(e)
+	}
+	d.Close()
+}
+
+func TestAll(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	for i := 0; i < 10; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*i)))
+	}
+	n := 0
+	for k, v := range d.All() {
+		i, _ := strconv.Atoi(string(k))
+		if i != n || string(v) != strconv.Itoa(i*i) {
+			t.Error("All out of order")
+		}
+		n++
+	}
+	if n != 10 {
+		t.Error("All missed pairs")
+	}
+	for range d.All() {
+		break
+	}
+	//Breaking out early must not leave the DB locked
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+
+	it := d.Scan([]byte("T"))
+	it.Close()
+	if it.Next() {
+		t.Error("Closed iterator advanced")
+	}
+	it = d.Scan(nil)
+	it.Seek([]byte("8"))
+	n = 0
+	for range it.All() {
+		n++
+	}
+	if n != 3 {
+		t.Error("Iterator All after Seek error")
+	}
+	d.Close()
+}
+
+func TestChanCtx(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	for i := 0; i < 10; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*i)))
+	}
+	c := make(chan string)
+	d.ValChanCtx(context.Background(), c)
+	n := 0
+	for v := range c {
+		if v != strconv.Itoa(n*n) {
+			t.Error("ValChanCtx error")
+		}
+		n++
+	}
+	if n != 10 {
+		t.Error("ValChanCtx missed values")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c = make(chan string)
+	d.KeyChanCtx(ctx, c)
+	<-c
+	cancel()
+	for range c {
+	}
+	//The abandoned consumer must not leave the DB locked
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	d.Close()
+}
+
+func TestGetMany(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Upsert([]byte("Dick"), []byte("Oregon"))
+	d.UpsertWithTTL([]byte("Harry"), []byte("Wisconsin"), -time.Second)
+	m := d.GetMany([][]byte{[]byte("Tom"), []byte("Dick"), []byte("Harry"), []byte("Sally")})
+	if len(m) != 2 || string(m["Tom"]) != "Washington" || string(m["Dick"]) != "Oregon" {
+		t.Error("GetMany error")
+	}
+	d.Close()
+}
+
+func TestAtomic(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	k := []byte("Tom")
+	ok, e := d.CompareAndSwap(k, []byte("Washington"), []byte("Oregon"))
+	if ok || e != nil {
+		t.Error("CompareAndSwap on absent key error")
+	}
+	ok, _ = d.CompareAndSwap(k, nil, []byte("Washington"))
+	if !ok {
+		t.Error("CompareAndSwap insert error")
+	}
+	ok, _ = d.CompareAndSwap(k, []byte("Oregon"), []byte("Wisconsin"))
+	if ok {
+		t.Error("CompareAndSwap mismatch error")
+	}
+	ok, _ = d.CompareAndSwap(k, []byte("Washington"), []byte("Oregon"))
+	if v, _ := d.Get(k); !ok || v != "Oregon" {
+		t.Error("CompareAndSwap error")
+	}
+
+	k = []byte("Dick")
+	ok, _ = d.SetNX(k, []byte("Oregon"))
+	ok2, _ := d.SetNX(k, []byte("Florida"))
+	if v, _ := d.Get(k); !ok || ok2 || v != "Oregon" {
+		t.Error("SetNX error")
+	}
+	v, loaded, _ := d.GetOrSet(k, []byte("Florida"))
+	if !loaded || string(v) != "Oregon" {
+		t.Error("GetOrSet existing error")
+	}
+	v, loaded, _ = d.GetOrSet([]byte("Harry"), []byte("Florida"))
+	if loaded || string(v) != "Florida" || !d.Contains([]byte("Harry")) {
+		t.Error("GetOrSet absent error")
+	}
+
+	v, loaded, _ = d.GetAndSet([]byte("Harry"), []byte("Ohio"))
+	if !loaded || string(v) != "Florida" {
+		t.Error("GetAndSet existing error")
+	}
+	v, loaded, _ = d.GetAndSet([]byte("Sally"), []byte("Maine"))
+	if r, _ := d.Get([]byte("Sally")); loaded || v != nil || r != "Maine" {
+		t.Error("GetAndSet absent error")
+	}
+	v, loaded, _ = d.GetAndDelete([]byte("Harry"))
+	if !loaded || string(v) != "Ohio" || d.Contains([]byte("Harry")) {
+		t.Error("GetAndDelete existing error")
+	}
+	if _, loaded, _ = d.GetAndDelete([]byte("Harry")); loaded {
+		t.Error("GetAndDelete absent error")
+	}
+
+	k = []byte("log")
+	d.Append(k, []byte("one "))
+	if v, _ := d.Get(k); v != "one " {
+		t.Error("Append to absent key error: " + v)
+	}
+	d.UpsertWithFlags(k, []byte("one "), 7)
+	d.Append(k, []byte("two"))
+	stat, _ := d.Stat(k)
+	if v, _ := d.Get(k); v != "one two" || stat.Flags != 7 {
+		t.Error("Append error: " + v)
+	}
+
+	k = []byte("counter")
+	n, _ := d.Increment(k, 5)
+	n, _ = d.Increment(k, -2)
+	if v, _ := d.Get(k); n != 3 || v != "3" {
+		t.Error("Decimal Increment error")
+	}
+	d.Upsert(k, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	n, _ = d.Increment(k, 2)
+	if v, _ := d.GetBytes(k); n != 1 || string(v) != "\x01\x00\x00\x00\x00\x00\x00\x00" {
+		t.Error("Binary Increment error")
+	}
+	if _, e = d.Increment([]byte("Tom"), 1); e != ErrNotInteger {
+		t.Error("Increment of non-integer not reported")
+	}
+	d.Upsert(k, []byte(strconv.FormatInt(1<<63-1, 10)))
+	if _, e = d.Increment(k, 1); e != ErrOverflow {
+		t.Error("Increment overflow not reported")
+	}
+	d.Close()
+	if _, e = d.CompareAndSwap(k, nil, []byte("Florida")); e != ErrDatabaseClosed {
+		t.Error("CompareAndSwap on closed DB error")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	k := []byte("Tom")
+	if _, e := d.UpsertIfVersion(k, []byte("Washington"), 1); e != ErrVersionMismatch {
+		t.Error("Absent key matched a version")
+	}
+	if _, e := d.UpsertIfVersion(k, []byte("Washington"), 0); e != ErrVersionMismatch {
+		t.Error("Absent key matched version 0")
+	}
+	v1, e := d.InsertWithVersion(k, []byte("Washington"))
+	if e != nil || v1 == 0 {
+		t.Error("Insert failed")
+	}
+	if _, e = d.InsertWithVersion(k, []byte("Texas")); e != ErrVersionMismatch {
+		t.Error("Insert over a present key")
+	}
+	if got, present := d.Version(k); got != v1 || !present {
+		t.Error("Wrong version returned")
+	}
+	d.Upsert(k, []byte("Oregon"))
+	v2, _ := d.Version(k)
+	if v2 <= v1 {
+		t.Error("Version not increased by write")
+	}
+	if _, e = d.UpsertIfVersion(k, []byte("Ohio"), v1); e != ErrVersionMismatch {
+		t.Error("Stale version matched")
+	}
+	d.Upsert([]byte("Dick"), []byte("Maine"))
+	d.Consolidate()
+	val, v3, present := d.GetWithVersion(k)
+	if string(val) != "Oregon" || v3 != v2 || !present {
+		t.Error("Version not kept by compaction")
+	}
+	if _, e = d.UpsertIfVersion(k, []byte("Ohio"), v2); e != nil {
+		t.Error(e)
+	}
+	d.Remove(k)
+	if _, present = d.Version(k); present {
+		t.Error("Removed key has a version")
+	}
+
+	//Versions written ahead of the clock, as by a process whose clock has
+	//since gone back, are still exceeded after reopening
+	lastStamp.Store(now() + int64(time.Hour))
+	d.Upsert(k, []byte("Maine"))
+	ahead, _ := d.Version(k)
+	d.Close()
+	lastStamp.Store(0)
+	d, _ = OpenDB(loc)
+	if v, e := d.UpsertIfVersion(k, []byte("Vermont"), ahead); e != nil || v <= ahead {
+		t.Error("Version went back after reopening", e)
+	}
+	d.Close()
+	lastStamp.Store(0)
+}
+
+func TestStreaming(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	big := []byte(strings.Repeat("0123456789", 20000))
+	e := d.UpsertReader([]byte("Tom"), uint32(len(big)), bytes.NewReader(big))
+	if e != nil {
+		t.Error(e)
+	}
+	if v, _ := d.GetBytes([]byte("Tom")); !bytes.Equal(v, big) {
+		t.Error("UpsertReader error")
+	}
+	e = d.UpsertReader([]byte("Tom"), uint32(len(big)+1), bytes.NewReader(big))
+	if e != io.ErrUnexpectedEOF {
+		t.Error("Short reader not reported")
+	}
+	d.Upsert([]byte("Dick"), []byte("Oregon"))
+	d.Close()
+
+	d, e = OpenAndVerifyDB(loc)
+	if e != nil {
+		t.Error(e)
+	}
+	if v, _ := d.GetBytes([]byte("Tom")); !bytes.Equal(v, big) {
+		t.Error("Streamed value not durable")
+	}
+	if v, _ := d.Get([]byte("Dick")); v != "Oregon" {
+		t.Error("Write after failed stream lost")
+	}
+	rc, n, present := d.GetReader([]byte("Tom"))
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Consolidate()
+	if v, _ := ioutil.ReadAll(rc); !present || n != int64(len(big)) || !bytes.Equal(v, big) {
+		t.Error("GetReader error")
+	}
+	rc.Close()
+	if _, _, present = d.GetReader([]byte("Harry")); present {
+		t.Error("GetReader of absent key error")
+	}
+	d.Close()
+}
+
+func TestLargeValues(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	big := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, opts := range []*Options{nil, {SyncWrites: true}, {NoMmap: true}, {WriteBuffer: 1 << 20}} {
+		d, e := NewDBWithOptions(loc, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		d.Upsert([]byte("small"), []byte("value"))
+		d.Upsert([]byte("big"), big)
+		d.UpsertWithTTL([]byte("ttl"), big[:vectoredWriteSize], time.Hour)
+		if v, _ := d.Lookup([]byte("big")); !bytes.Equal(v, big) {
+			t.Error("Large value read back wrong")
+		}
+		d.Close()
+		d, e = OpenAndVerifyDBWithOptions(loc, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v, _ := d.Lookup([]byte("big")); !bytes.Equal(v, big) {
+			t.Error("Large value read back wrong after reopening")
+		}
+		if v, _ := d.Lookup([]byte("ttl")); !bytes.Equal(v, big[:vectoredWriteSize]) {
+			t.Error("Value with TTL read back wrong after reopening")
+		}
+		d.Clear()
+		d.Close()
+	}
+}
+
+func TestRemoveRange(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	for _, opts := range []*Options{{OrderedIndex: true}, {}} {
+		d, _ := NewDBWithOptions(loc, opts)
+		for _, k := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+			d.Upsert([]byte(k), []byte(k))
+		}
+		n, e := d.RemovePrefix([]byte("ab"))
+		if n != 2 || e != nil || d.Contains([]byte("ab")) || d.Contains([]byte("abc")) || !d.Contains([]byte("a")) {
+			t.Error("RemovePrefix error")
+		}
+		n, _ = d.RemoveRange([]byte("b"), []byte("c"))
+		if n != 2 || d.Size() != 2 {
+			t.Error("RemoveRange error")
+		}
+		d.Close()
+		d, _ = OpenAndVerifyDB(loc)
+		if keys := d.Keys(); len(keys) != 2 {
+			t.Error("Range removal not durable")
+		}
+		d.Close()
+	}
+}
+
+func TestClear(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 256})
+	for i := 0; i < 50; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte("Washington"))
+	}
+	s, _ := d.Snapshot()
+	e := d.Clear()
+	if e != nil {
+		t.Error(e)
+	}
+	if d.Size() != 0 || d.Segments() != 1 || d.Contains([]byte("1")) {
+		t.Error("Clear error")
+	}
+	if v, _ := s.Get([]byte("1")); v != "Washington" {
+		t.Error("Snapshot disturbed by Clear")
+	}
+	s.Close()
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	d.Close()
+
+	d, _ = OpenAndVerifyDB(loc)
+	if v, _ := d.Get([]byte("Tom")); d.Size() != 1 || v != "Oregon" {
+		t.Error("Write after Clear lost")
+	}
+	d.Close()
+}
+
+func TestCountPrefix(t *testing.T) {
+	for _, opts := range []*Options{{OrderedIndex: true}, {}} {
+		f, _ := ioutil.TempFile("", "bitcesque")
+		f.Close()
+		loc := f.Name()
+		defer removeAll(loc)
+
+		d, _ := NewDBWithOptions(loc, opts)
+		for _, k := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+			d.Upsert([]byte(k), []byte(k))
+		}
+		d.Remove([]byte("abc"))
+		if d.CountPrefix([]byte("a")) != 2 || d.CountPrefix([]byte("b")) != 2 || d.CountPrefix(nil) != 5 || d.CountPrefix([]byte("d")) != 0 {
+			t.Error("CountPrefix error")
+		}
+		b := d.NewBatch()
+		for i := 0; i < 4*countPrefixSample; i++ {
+			b.Upsert([]byte("tenant"+strconv.Itoa(i%4)+"/"+strconv.Itoa(i)), []byte("x"))
+		}
+		b.Commit()
+		n := d.CountPrefix([]byte("tenant1/"))
+		if !opts.OrderedIndex && (n < countPrefixSample*3/4 || n > countPrefixSample*5/4) || opts.OrderedIndex && n != countPrefixSample {
+			t.Error("CountPrefix estimate error", n)
+		}
+		d.Close()
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	for _, policy := range []EvictionPolicy{EvictFIFO, EvictLRU} {
+		opts := &Options{CacheMaxBytes: 4096, CacheEviction: policy}
+		d, _ := NewDBWithOptions(loc, opts)
+		v := bytes.Repeat([]byte("x"), 100)
+		for i := 0; i < 100; i++ {
+			d.Upsert([]byte(strconv.Itoa(i)), v)
+			//Keeps the first key recently used
+			d.Contains([]byte("0"))
+		}
+		if st := d.Stats(); st.LiveBytes > opts.CacheMaxBytes || st.Keys < 20 {
+			t.Error("Cache not kept to size", st.LiveBytes, st.Keys)
+		}
+		if !d.Contains([]byte("99")) || d.Contains([]byte("50")) {
+			t.Error("Wrong keys evicted")
+		}
+		if d.Contains([]byte("0")) != (policy == EvictLRU) {
+			t.Error("Reads not heeded by eviction policy", policy)
+		}
+		//Found without reading, which would count as use
+		oldest := 100
+		for _, k := range d.Keys() {
+			if n, _ := strconv.Atoi(k); n > 0 && n < oldest {
+				oldest = n
+			}
+		}
+		d.Consolidate()
+		size := d.Stats().FileSize
+		d.Close()
+
+		d, _ = OpenDBWithOptions(loc, opts)
+		keys := d.Size()
+		d.Upsert([]byte("100"), v)
+		if d.Size() != keys || d.Contains([]byte(strconv.Itoa(oldest))) || !d.Contains([]byte(strconv.Itoa(oldest+1))) || d.Contains([]byte("0")) != (policy == EvictLRU) {
+			t.Error("Eviction order not kept on reopening", policy)
+		}
+		if size > 2*opts.CacheMaxBytes {
+			t.Error("Compaction didn't reclaim evicted records", size)
+		}
+		d.Close()
+	}
+}
+
+func TestStats(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	d.Upsert([]byte("Dick"), []byte("Wisconsin"))
+	d.Remove([]byte("Dick"))
+	st := d.Stats()
+	if st.Keys != 1 || st.Segments != 1 || st.Tombstones != 1 || st.UnsavedWrites != 4 || !st.LastCompaction.IsZero() {
+		t.Error("Stats error")
+	}
+	if st.FileSize != d.totalSize() || st.LiveBytes+st.DeadBytes != st.FileSize || st.DeadBytes == 0 {
+		t.Error("Stats size error")
+	}
+	d.Consolidate()
+	st = d.Stats()
+	if st.Tombstones != 0 || st.DeadBytes != 0 || st.LastCompaction.IsZero() {
+		t.Error("Stats error after compaction")
+	}
+	d.Remove([]byte("Tom"))
+	d.Close()
+
+	d, _ = OpenAndVerifyDB(loc)
+	if st = d.Stats(); st.Keys != 0 || st.Tombstones != 1 || st.UnsavedWrites != 2 {
+		t.Error("Stats error after verifying")
+	}
+	d.Close()
+	d, _ = OpenDB(loc)
+	if st = d.Stats(); st.UnsavedWrites != 0 {
+		t.Error("Stats error after reopening")
+	}
+	d.Close()
+}
+
+func TestIOStats(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	defer d.Close()
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Remove([]byte("Tom"))
+	b := d.NewBatch()
+	b.Upsert([]byte("Dick"), []byte("Wisconsin"))
+	b.Upsert([]byte("Harry"), []byte("Ohio"))
+	b.Commit()
+	st := d.Stats()
+	if st.LogicalBytes != 13+3+13+9 || st.AppendedBytes < st.LogicalBytes || st.CompactedBytes != 0 || st.IndexBytes != 0 {
+		t.Error("IO stats error", st.LogicalBytes, st.AppendedBytes)
+	}
+	syncs := st.Syncs
+	d.Sync()
+	if st = d.Stats(); st.Syncs != syncs+1 {
+		t.Error("Sync not counted")
+	}
+	d.Consolidate()
+	d.Checkpoint()
+	st = d.Stats()
+	if st.CompactedBytes == 0 || st.IndexBytes == 0 || st.LogicalBytes != 38 {
+		t.Error("Compaction and index writes not counted")
+	}
+	if st.WriteAmplification() <= 1 {
+		t.Error("Write amplification error", st.WriteAmplification())
+	}
+	if (DBStats{}).WriteAmplification() != 0 {
+		t.Error("Write amplification of nothing written")
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	defer d.Close()
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Upsert([]byte("Dick"), []byte("Wisconsin"))
+	d.Upsert([]byte("Harry"), bytes.Repeat([]byte("x"), 1000))
+	d.Upsert([]byte("Sally"), []byte("Ohio"))
+	d.Remove([]byte("Sally"))
+	h := d.SizeHistogram()
+	if h.Keys[2] != 1 || h.Keys[3] != 2 || h.Values[4] != 2 || h.Values[10] != 1 {
+		t.Error("Size histogram error", h.Keys, h.Values)
+	}
+	if min, max := SizeBucket(10); min != 512 || max != 1023 {
+		t.Error("Size bucket error", min, max)
+	}
+	if min, max := SizeBucket(0); min != 0 || max != 0 {
+		t.Error("Size bucket error for empty", min, max)
+	}
+}
+
+func TestCompactionEstimate(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	defer d.Close()
+	for i := 0; i < 100; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte("first"))
+	}
+	b := d.NewBatch()
+	for i := 0; i < 50; i++ {
+		b.Upsert([]byte(strconv.Itoa(i)), []byte("second"))
+	}
+	b.Commit()
+	for i := 90; i < 100; i++ {
+		d.Remove([]byte(strconv.Itoa(i)))
+	}
+	est, e := d.CompactionEstimate()
+	if e != nil {
+		t.Fatal(e)
+	}
+	//50 overwritten, 10 removed and their 10 tombstones
+	if est.DeadRecords != 70 {
+		t.Error("Wrong dead record count: " + strconv.Itoa(est.DeadRecords))
+	}
+	if est.Duration <= 0 {
+		t.Error("No duration estimated")
+	}
+	before := d.Stats().FileSize
+	if e = d.Consolidate(); e != nil {
+		t.Fatal(e)
+	}
+	if before-d.Stats().FileSize != est.ReclaimedBytes {
+		t.Error("Reclaimed bytes misestimated")
+	}
+	est, _ = d.CompactionEstimate()
+	if est.DeadRecords != 0 || est.ReclaimedBytes != 0 {
+		t.Error("Dead records estimated after compaction")
+	}
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{VerifyOnRead: true})
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Upsert([]byte("Dick"), []byte("Oregon"))
+	if v, e := d.Lookup([]byte("Tom")); e != nil || string(v) != "Washington" {
+		t.Error("VerifyOnRead error on intact record")
+	}
+	st, _ := d.Stat([]byte("Tom"))
+	fh, _ := os.OpenFile(loc, os.O_WRONLY, 0)
+	fh.WriteAt([]byte("w"), st.Offset)
+	fh.Close()
+	if _, e := d.Lookup([]byte("Tom")); !errors.Is(e, ErrCorrupt) {
+		t.Error("Corrupt record not reported")
+	}
+	if _, present := d.Get([]byte("Tom")); present {
+		t.Error("Corrupt record served")
+	}
+	if v, _ := d.Get([]byte("Dick")); v != "Oregon" {
+		t.Error("VerifyOnRead error on neighbouring record")
+	}
+	d.Close()
+}
+
+func TestChecksum(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	for in, want := range map[string]uint64{"": 0xef46db3751d8e999, "abc": 0x44bc2cf5ad770999} {
+		var x xxh64
+		x.reset()
+		x.write([]byte(in))
+		if x.sum() != want {
+			t.Errorf("Wrong xxHash of %q", in)
+		}
+	}
+
+	big := bytes.Repeat([]byte("Washington"), 1000)
+	for _, c := range []Checksum{CRC32C, XXHash64, CRC64} {
+		d, _ := NewDBWithOptions(loc, &Options{Checksum: c, MaxSegmentSize: 4096})
+		for i := 0; i < 100; i++ {
+			d.Upsert([]byte(strconv.Itoa(i)), []byte("Oregon"))
+		}
+		b := d.NewBatch()
+		b.Upsert([]byte("Dick"), []byte("Oregon"))
+		b.Remove([]byte("0"))
+		b.Commit()
+		d.Upsert([]byte("Harry"), big)
+		d.UpsertReader([]byte("Tom"), uint32(len(big)), bytes.NewReader(big))
+		if e := d.Consolidate(); e != nil {
+			t.Fatal(e)
+		}
+		d.Close()
+
+		//The DB keeps the checksum it was created with
+		d, e := OpenAndVerifyDBWithOptions(loc, &Options{Checksum: (c + 1) % 3, VerifyOnRead: true})
+		if e != nil {
+			t.Fatal(c, e)
+		}
+		if d.sum != c || fileChecksum(d.filebuffer, d.filledSize) != c {
+			t.Error("Checksum not kept for " + c.String())
+		}
+		if d.Size() != 102 || d.Contains([]byte("0")) {
+			t.Error("Wrong keys read with " + c.String())
+		}
+		for _, k := range []string{"Harry", "Tom"} {
+			if v, e := d.Lookup([]byte(k)); e != nil || !bytes.Equal(v, big) {
+				t.Error("Wrong value read with " + c.String())
+			}
+		}
+
+		//Copies take the checksum along
+		n, e := d.CompactTo(loc + ".compacted")
+		d.Close()
+		if e != nil {
+			t.Fatal(c, e)
+		}
+		if n.sum != c || n.Size() != 102 {
+			t.Error("Checksum not kept by CompactTo for " + c.String())
+		}
+		st, _ := n.Stat([]byte("5"))
+		fh, _ := os.OpenFile(segmentPath(n.location, st.Segment), os.O_WRONLY, 0)
+		fh.WriteAt([]byte("o"), st.Offset)
+		fh.Close()
+		if _, e := n.Lookup([]byte("5")); !errors.Is(e, ErrCorrupt) {
+			t.Error("Corrupt record not reported with " + c.String())
+		}
+		n.Close()
+	}
+}
+
+func TestScrub(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	found := make(chan uint64, 10)
+	d, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 256, OnCorruption: func(segment uint32, offset uint64) { found <- offset }})
+	for i := 0; i < 30; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte("Washington"))
+	}
+	st, _ := d.Stat([]byte("3"))
+	fh, _ := os.OpenFile(segmentPath(loc, st.Segment), os.O_WRONLY, 0)
+	fh.WriteAt([]byte("w"), st.Offset)
+	fh.Close()
+	d.StartScrub(time.Millisecond)
+	select {
+	case offset := <-found:
+		if offset != uint64(st.Offset)-21 {
+			t.Error("Scrubber reported wrong offset")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Scrubber missed corruption")
+	}
+	for d.Stats().LastScrub.IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+	if st := d.Stats(); st.CorruptRegions != 1 {
+		t.Error("Scrubber reported corruption more than once")
+	}
+	d.Close()
+}
+
+func TestRepair(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	for i := 0; i < 10; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte("Washington"))
+	}
+	st3, _ := d.Stat([]byte("3"))
+	st4, _ := d.Stat([]byte("4"))
+	d.Close()
+	fh, _ := os.OpenFile(loc, os.O_WRONLY, 0)
+	fh.WriteAt([]byte("w"), st3.Offset)
+	fh.Close()
+
+	report, e := RepairDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	start, end := uint64(st3.Offset)-21, uint64(st4.Offset)-21
+	if report.Segments != 1 || report.Records != 9 || len(report.Dropped) != 1 || report.Dropped[0] != (DroppedRegion{0, start, end - start}) || report.BytesDropped != end-start {
+		t.Error("Repair report error")
+	}
+	d, e = OpenDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if d.Size() != 9 || d.Contains([]byte("3")) || !d.Contains([]byte("9")) {
+		t.Error("Repaired DB error")
+	}
+	d.Close()
+	if report, _ = RepairDB(loc); len(report.Dropped) != 0 || report.Records != 9 {
+		t.Error("Repair of intact DB error")
+	}
+}
+
+func TestRecoveryPolicy(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	corrupt := func() {
+		removeAll(loc)
+		d, _ := NewDB(loc)
+		d.Upsert([]byte("Tom"), []byte("Washington"))
+		d.Upsert([]byte("Dick"), []byte("Oregon"))
+		d.Upsert([]byte("Harry"), []byte("Wisconsin"))
+		st, _ := d.Stat([]byte("Dick"))
+		d.Close()
+		fh, _ := os.OpenFile(loc, os.O_WRONLY, 0)
+		fh.WriteAt([]byte("o"), st.Offset)
+		fh.Close()
+	}
+
+	corrupt()
+	d, e := OpenAndVerifyDB(loc)
+	if !errors.Is(e, ErrCorrupt) || d.Size() != 1 {
+		t.Error("StopAtCorruption error")
+	}
+	d.Upsert([]byte("Sally"), []byte("Florida"))
+	if v, _ := d.Get([]byte("Sally")); v != "Florida" {
+		t.Error("Write after stopping at corruption misplaced")
+	}
+	d.Close()
+
+	corrupt()
+	d, e = OpenAndVerifyDBWithOptions(loc, &Options{Recovery: FailOnCorruption})
+	if !errors.Is(e, ErrCorrupt) || d != nil {
+		t.Error("FailOnCorruption error")
+	}
+
+	corrupt()
+	d, e = OpenAndVerifyDBWithOptions(loc, &Options{Recovery: SkipCorruptRecords})
+	if e != nil || d.Size() != 2 || !d.Contains([]byte("Harry")) {
+		t.Error("SkipCorruptRecords error")
+	}
+	d.Close()
+
+	corrupt()
+	d, e = OpenAndVerifyDBWithOptions(loc, &Options{Recovery: TruncateAtCorruption})
+	if e != nil || d.Size() != 1 {
+		t.Error("TruncateAtCorruption error")
+	}
+	d.Upsert([]byte("Sally"), []byte("Florida"))
+	d.Close()
+	d, e = OpenAndVerifyDB(loc)
+	if v, _ := d.Get([]byte("Sally")); e != nil || d.Size() != 2 || v != "Florida" {
+		t.Error("Truncated DB error")
+	}
+	d.Close()
+}
+
+func TestVerifyProgress(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	v := []byte(strings.Repeat("x", 1<<20))
+	for i := 0; i < 40; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), v)
+	}
+	d.Close()
+
+	var calls [][2]uint64
+	d, e := OpenAndVerifyDBWithOptions(loc, &Options{OnVerifyProgress: func(scanned, total uint64) {
+		calls = append(calls, [2]uint64{scanned, total})
+	}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.Close()
+	last := calls[len(calls)-1]
+	if len(calls) < 3 || last[0] != last[1] || calls[0][0] >= last[0] {
+		t.Error("Progress not reported")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if d, e = OpenAndVerifyDBContext(ctx, loc, nil); e != context.Canceled || d != nil {
+		t.Error("Cancellation not reported")
+	}
+	if d, e = OpenDB(loc); e != nil || d.Size() != 40 {
+		t.Error("Cancelled verification left DB locked or damaged")
+	}
+	d.Close()
+}
+
+func TestKeyfileTrailer(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Upsert([]byte("Dick"), []byte("Oregon"))
+	d.Close()
+	if _, e := os.Stat(loc + ".keys.tmp"); !os.IsNotExist(e) {
+		t.Error("Temporary keyfile left behind")
+	}
+	d, e := OpenDB(loc)
+	if e != nil || d.Size() != 2 {
+		t.Error("Keyfile with trailer not read")
+	}
+	d.Close()
+
+	keys, _ := ioutil.ReadFile(loc + ".keys")
+	ioutil.WriteFile(loc+".keys", keys[:len(keys)-5], 0666)
+	if _, e = OpenDB(loc); !errors.Is(e, ErrCorrupt) {
+		t.Error("Torn keyfile not detected")
+	}
+	keys[headerSize+2] ^= 1
+	ioutil.WriteFile(loc+".keys", keys, 0666)
+	if _, e = OpenDB(loc); !errors.Is(e, ErrCorrupt) {
+		t.Error("Damaged keyfile not detected")
+	}
+}
+
+func TestKeyfileStaleness(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	d.Upsert([]byte("Dick"), []byte("Oregon"))
+	d.Close()
+	stale, _ := ioutil.ReadFile(loc + ".keys")
+
+	d, _ = OpenDB(loc)
+	d.Upsert([]byte("Tom"), []byte("Wisconsin"))
+	d.Remove([]byte("Dick"))
+	d.Upsert([]byte("Harry"), []byte("Florida"))
+	d.Close()
+	check := func(when string) {
+		d, e := OpenDB(loc)
+		if e != nil {
+			t.Fatal(e)
+		}
+		v1, _ := d.Get([]byte("Tom"))
+		v3, _ := d.Get([]byte("Harry"))
+		if v1 != "Wisconsin" || v3 != "Florida" || d.Contains([]byte("Dick")) || d.Size() != 2 {
+			t.Error("Stale keyfile served " + when)
+		}
+		d.Close()
+	}
+	//Appended to since the keyfile was written
+	ioutil.WriteFile(loc+".keys", stale, 0666)
+	check("after appends")
+	//Rewritten since
+	d, _ = OpenDB(loc)
+	d.Consolidate()
+	d.Close()
+	ioutil.WriteFile(loc+".keys", stale, 0666)
+	check("after compaction")
+	//Missing altogether
+	os.Remove(loc + ".keys")
+	check("without keyfile")
+}
+
+func TestCheckpoint(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	crashed := loc + "-crashed"
+	defer removeAll(crashed)
+
+	d, _ := NewDBWithOptions(loc, &Options{CheckpointWrites: 3})
+	for i := 0; i < 3; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte("Washington"))
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for d.Stats().UnsavedWrites != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, e := os.Stat(loc + ".keys"); e != nil {
+		t.Fatal("Keyfile not checkpointed")
+	}
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	//Copying the files of an open DB stands in for a crash
+	for _, suffix := range []string{"", ".keys", ".manifest"} {
+		b, _ := ioutil.ReadFile(loc + suffix)
+		ioutil.WriteFile(crashed+suffix, b, 0666)
+	}
+	d.Close()
+
+	d, e := OpenDB(crashed)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v, _ := d.Get([]byte("Tom")); d.Size() != 4 || v != "Oregon" {
+		t.Error("Checkpointed DB error")
+	}
+	if e = d.Checkpoint(); e != nil {
+		t.Error(e)
+	}
+	d.Close()
+	if e = d.Checkpoint(); e != ErrDatabaseClosed {
+		t.Error("Checkpoint of closed DB not reported")
+	}
+}
+
+func TestIndexLog(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	crashed := loc + "-crashed"
+	defer removeAll(crashed)
+
+	opts := &Options{IndexLog: true}
+	d, e := NewDBWithOptions(loc, opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 3; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte("Washington"))
+	}
+	d.Remove([]byte("1"))
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	for _, suffix := range []string{"", ".keys", ".manifest", ".ilog"} {
+		b, _ := ioutil.ReadFile(loc + suffix)
+		ioutil.WriteFile(crashed+suffix, b, 0666)
+	}
+	//Damage to a record the log covers goes unnoticed, as it isn't rescanned
+	b, _ := ioutil.ReadFile(crashed)
+	b[headerSize+21] ^= 0xff
+	ioutil.WriteFile(crashed, b, 0666)
+	if e = d.Consolidate(); e != nil {
+		t.Fatal(e)
+	}
+	if stats, _ := os.Stat(loc + ".ilog"); stats == nil || stats.Size() != 0 {
+		t.Error("Index log not emptied by compaction")
+	}
+	d.Close()
+
+	d, e = OpenDBWithOptions(crashed, opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v, _ := d.Get([]byte("Tom")); d.Size() != 3 || v != "Oregon" || d.Contains([]byte("1")) {
+		t.Error("Index log not replayed")
+	}
+	d.Close()
+	if stats, _ := os.Stat(crashed + ".ilog"); stats == nil || stats.Size() != 0 {
+		t.Error("Index log not emptied on close")
+	}
+}
+
+func TestParallelVerify(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 256})
+	for i := 0; i < 200; i++ {
+		k := []byte(strconv.Itoa(i % 50))
+		switch i % 7 {
+		case 3:
+			d.Remove(k)
+		case 5:
+			d.UpsertWithTTL(k, []byte("Paris"), -time.Second)
+		default:
+			d.Upsert(k, []byte(strconv.Itoa(i)))
+		}
+	}
+	want := d.Dump()
+	d.Close()
+
+	for _, workers := range []int{1, 8} {
+		d, e := OpenAndVerifyDBWithOptions(loc, &Options{VerifyWorkers: workers})
+		if e != nil {
+			t.Fatal(e)
+		}
+		got := d.Dump()
+		if len(got) != len(want) {
+			t.Error("Parallel verification error with", workers, "workers")
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Error("Parallel verification error with", workers, "workers")
+			}
+		}
+		d.Close()
+	}
+}
+
+func TestHintFiles(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	opts := &Options{MaxSegmentSize: 256, HintFiles: true}
+	d, _ := NewDBWithOptions(loc, opts)
+	for i := 0; i < 200; i++ {
+		k := []byte(strconv.Itoa(i % 50))
+		switch i % 7 {
+		case 3:
+			d.Remove(k)
+		case 5:
+			d.UpsertWithTTL(k, []byte("Paris"), -time.Second)
+		default:
+			d.Upsert(k, []byte(strconv.Itoa(i)))
+		}
+	}
+	want := d.Dump()
+	d.Close()
+	if _, e := os.Stat(hintPath(loc, 0)); e != nil {
+		t.Fatal("Hint file not written")
+	}
+	//Damage to a superseded record goes unnoticed when the hints are used
+	b, _ := ioutil.ReadFile(loc)
+	b[headerSize+21] ^= 0xff
+	ioutil.WriteFile(loc, b, 0666)
+
+	d, e := OpenAndVerifyDBWithOptions(loc, opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	got := d.Dump()
+	if len(got) != len(want) {
+		t.Error("DB not indexed from hint files")
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Error("DB not indexed from hint files")
+		}
+	}
+	d.Close()
+
+	b, _ = ioutil.ReadFile(hintPath(loc, 1))
+	ioutil.WriteFile(hintPath(loc, 0), b, 0666)
+	if d, e = OpenAndVerifyDBWithOptions(loc, opts); !errors.Is(e, ErrCorrupt) {
+		t.Error("Stale hint file used")
+	}
+	d.Close()
+}
+
+func TestFilters(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	opts := &Options{MaxSegmentSize: 4096, HintFiles: true, DiskIndex: true}
+	d, _ := NewDBWithOptions(loc, opts)
+	for i := 0; i < 2000; i++ {
+		d.Upsert([]byte("key"+strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 2000; i += 2 {
+		d.Remove([]byte("key" + strconv.Itoa(i)))
+	}
+	d.Close()
+	if _, e := os.Stat(filterPath(loc, 0)); e != nil {
+		t.Fatal("Filter file not written")
+	}
+	if _, e := readFilter(loc, &segment{1, nil, nil, 0, false}); e == nil {
+		t.Error("Stale filter file read")
+	}
+
+	check := func(when string) {
+		passed := 0
+		for i := 0; i < 2000; i++ {
+			k := []byte("key" + strconv.Itoa(i))
+			if d.Contains(k) != (i%2 == 1) {
+				t.Fatal("Wrong answer for " + string(k) + " " + when)
+			}
+			if d.mayContain([]byte("missing" + strconv.Itoa(i))) {
+				passed++
+			}
+		}
+		//Each segment's filter lets about 1% through
+		if passed > 2000*len(d.filters)/50 {
+			t.Error(strconv.Itoa(passed) + " missing keys passed the filters " + when)
+		}
+	}
+	d, e := OpenDBWithOptions(loc, opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer d.Close()
+	check("on reopening")
+	if e = d.Consolidate(); e != nil {
+		t.Fatal(e)
+	}
+	check("after compaction")
+}
+
+func TestValueCache(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{NoMmap: true, ValueCacheSize: 4096})
+	defer d.Close()
+	d.Upsert([]byte("a"), []byte("first"))
+	for i := 0; i < 3; i++ {
+		if v, _ := d.Get([]byte("a")); string(v) != "first" {
+			t.Fatal("Wrong value read through the cache")
+		}
+	}
+	if s := d.Stats(); s.CacheHits != 2 || s.CacheMisses != 1 {
+		t.Errorf("Expected 2 hits and 1 miss, got %d and %d", s.CacheHits, s.CacheMisses)
+	}
+	v, _ := d.Lookup([]byte("a"))
+	v[0] = 'F'
+	if v, _ := d.Get([]byte("a")); string(v) != "first" {
+		t.Fatal("Cached value modified through Lookup")
+	}
+	d.Upsert([]byte("a"), []byte("second"))
+	if v, _ := d.Get([]byte("a")); string(v) != "second" {
+		t.Fatal("Stale value read after overwrite")
+	}
+
+	for i := 0; i < 200; i++ {
+		d.Upsert([]byte("key"+strconv.Itoa(i)), []byte(strings.Repeat("v", i)))
+	}
+	for i := 0; i < 200; i++ {
+		d.Get([]byte("key" + strconv.Itoa(i)))
+	}
+	if s := d.Stats(); s.CacheBytes > 4096 || s.CacheBytes == 0 {
+		t.Error("Cache holds " + strconv.Itoa(s.CacheBytes) + " bytes")
+	}
+
+	//Compaction moves live values to where removed ones, still cached, were
+	f, _ = ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc2 := f.Name()
+	defer removeAll(loc2)
+	d2, _ := NewDBWithOptions(loc2, &Options{NoMmap: true, ValueCacheSize: 4096})
+	defer d2.Close()
+	for i := 0; i < 10; i++ {
+		d2.Upsert([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i)))
+		d2.Get([]byte("key" + strconv.Itoa(i)))
+	}
+	for i := 0; i < 5; i++ {
+		d2.Remove([]byte("key" + strconv.Itoa(i)))
+	}
+	if e := d2.Consolidate(); e != nil {
+		t.Fatal(e)
+	}
+	for i := 5; i < 10; i++ {
+		if v, _ := d2.Get([]byte("key" + strconv.Itoa(i))); string(v) != "value"+strconv.Itoa(i) {
+			t.Fatal("Wrong value read after compaction for key" + strconv.Itoa(i))
+		}
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 4096})
+	defer d.Close()
+	for i := 0; i < 100; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+	}
+	done := make(chan bool)
+	for g := 0; g < 16; g++ {
+		go func(g int) {
+			ok := true
+			for i := 0; i < 2000; i++ {
+				k := strconv.Itoa((g + i) % 100)
+				if v, present := d.Get([]byte(k)); !present || v != k {
+					ok = false
+				}
+			}
+			done <- ok
+		}(g)
+	}
+	for i := 0; i < 2000; i++ {
+		k := []byte(strconv.Itoa(i % 100))
+		d.Upsert(k, k)
+		if i%500 == 0 {
+			d.Merge()
+		}
+	}
+	for g := 0; g < 16; g++ {
+		if !<-done {
+			t.Error("Concurrent read error")
+		}
+	}
+}
+
+func TestLockFreeReads(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 4096, LockFreeReads: true})
+	for i := 0; i < 100; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+	}
+	d.UpsertWithTTL([]byte("Tom"), []byte("Oregon"), -time.Second)
+	deadline := time.Now().Add(10 * time.Second)
+	for d.view.Load() == nil && time.Now().Before(deadline) {
+		d.Get([]byte("1"))
+		time.Sleep(time.Millisecond)
+	}
+	if d.view.Load() == nil {
+		t.Fatal("Index not published")
+	}
+	if v, _ := d.Lookup([]byte("7")); string(v) != "7" || !d.Contains([]byte("8")) || d.Contains([]byte("Tom")) {
+		t.Error("Lock-free read error")
+	}
+	if _, e := d.Lookup([]byte("Tom")); e != ErrKeyNotFound {
+		t.Error("Expired key read lock-free")
+	}
+
+	done := make(chan bool)
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			ok := true
+			var buf []byte
+			for i := 0; i < 2000; i++ {
+				k := strconv.Itoa((g + i) % 100)
+				buf, _ = d.GetInto([]byte(k), buf[:0])
+				if v, present := d.Get([]byte(k)); !present || v != k || string(buf) != k {
+					ok = false
+				}
+			}
+			done <- ok
+		}(g)
+	}
+	for i := 0; i < 500; i++ {
+		k := []byte(strconv.Itoa(i % 100))
+		d.Upsert(k, k)
+		if i%100 == 0 {
+			d.Merge()
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+	for g := 0; g < 8; g++ {
+		if !<-done {
+			t.Error("Concurrent lock-free read error")
+		}
+	}
+	d.Close()
+	if _, present := d.Get([]byte("1")); present {
+		t.Error("Closed DB read lock-free")
+	}
+}
+
+func TestWriteQueue(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{WriteQueue: 64, SyncWrites: true})
+	done := make(chan error)
+	for g := 0; g < 16; g++ {
+		go func(g int) {
+			var e error
+			for i := 0; i < 50 && e == nil; i++ {
+				k := []byte(strconv.Itoa(g*100 + i))
+				e = d.Upsert(k, k)
+				if e == nil && i%10 == 0 {
+					e = d.Remove(k)
+				}
+			}
+			done <- e
+		}(g)
+	}
+	for g := 0; g < 16; g++ {
+		if e := <-done; e != nil {
+			t.Error(e)
+		}
+	}
+	if v, _ := d.Get([]byte("1512")); d.Size() != 16*45 || v != "1512" || d.Contains([]byte("1510")) {
+		t.Error("Queued write error")
+	}
+	results := []<-chan error{d.UpsertAsync([]byte("Tom"), []byte("Oregon")), d.UpsertAsync([]byte("Tom"), []byte("Paris")), d.RemoveAsync([]byte("1512"))}
+	for _, result := range results {
+		if e := <-result; e != nil {
+			t.Error(e)
+		}
+	}
+	if v, _ := d.Get([]byte("Tom")); v != "Paris" || d.Contains([]byte("1512")) {
+		t.Error("Async write error")
+	}
+	if e := d.Upsert(make([]byte, keyLenMask+1), nil); e != ErrKeyTooLarge {
+		t.Error("Oversized key queued")
+	}
+	d.Close()
+	if e := <-d.UpsertAsync([]byte("Tom"), []byte("Oregon")); e != ErrDatabaseClosed {
+		t.Error("Write queued to closed DB")
+	}
+
+	d, _ = OpenDB(loc)
+	if v, _ := d.Get([]byte("Tom")); v != "Paris" || d.Size() != 16*45 {
+		t.Error("Queued writes not persisted")
+	}
+	d.Close()
+}
+
+func TestWriteBuffer(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	for _, opts := range []*Options{
+		{WriteBuffer: 1 << 20, FlushInterval: time.Hour},
+		{WriteBuffer: 1 << 20, FlushInterval: time.Hour, LockFreeReads: true, NoMmap: true},
+		{WriteBuffer: 256, FlushInterval: time.Millisecond, MaxSegmentSize: 1024},
+	} {
+		d, e := NewDBWithOptions(loc, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		fileSize := func() int64 {
+			stats, _ := os.Stat(loc)
+			return stats.Size()
+		}
+		empty := fileSize()
+		for i := 0; i < 100; i++ {
+			d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*2)))
+		}
+		d.Remove([]byte("7"))
+		check := func(stage string) {
+			for i := 0; i < 100; i++ {
+				v, present := d.Get([]byte(strconv.Itoa(i)))
+				if i == 7 && present || i != 7 && v != strconv.Itoa(i*2) {
+					t.Error("Retrieval error " + stage)
+					return
+				}
+			}
+		}
+		check("while buffered")
+		if opts.FlushInterval == time.Hour && fileSize() != empty {
+			t.Error("Appends not buffered")
+		}
+		rc, n, present := d.GetReader([]byte("42"))
+		if !present || n != 2 {
+			t.Error("GetReader error while buffered")
+		} else if v, _ := io.ReadAll(rc); string(v) != "84" {
+			t.Error("GetReader of buffered value error", string(v))
+		}
+		if rc != nil {
+			rc.Close()
+		}
+		if opts.FlushInterval == time.Hour && fileSize() == empty {
+			t.Error("Buffered value not written out for GetReader")
+		}
+		s, e := d.Snapshot()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v, _ := s.Get([]byte("3")); v != "6" {
+			t.Error("Snapshot missed buffered append")
+		}
+		s.Close()
+		if e = d.Sync(); e != nil {
+			t.Fatal(e)
+		}
+		if opts.MaxSegmentSize == 0 && fileSize() == empty {
+			t.Error("Sync didn't write out buffered appends")
+		}
+		d.Upsert([]byte("late"), []byte("x"))
+		if e = d.Consolidate(); e != nil {
+			t.Fatal(e)
+		}
+		check("after consolidation")
+		d.Upsert([]byte("later"), []byte("y"))
+		d.Close()
+
+		d, e = OpenAndVerifyDBWithOptions(loc, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		check("after reopening")
+		if !d.Contains([]byte("late")) || !d.Contains([]byte("later")) {
+			t.Error("Buffered appends lost on close")
+		}
+		d.Clear()
+		d.Close()
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	crashed := loc + "-crashed"
+	defer removeAll(crashed)
+
+	opts := &Options{Preallocate: 1 << 16, MaxSegmentSize: 1 << 15}
+	d, _ := NewDBWithOptions(loc, opts)
+	for i := 0; i < 1000; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte("Washington"))
+	}
+	d.Checkpoint()
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	stats, _ := os.Stat(segmentPath(loc, d.activeID))
+	if stats.Size() != 1<<16 {
+		t.Error("Active file not preallocated")
+	}
+	files := make(map[string][]byte)
+	for _, suffix := range []string{"", ".1", ".keys", ".manifest"} {
+		files[suffix], _ = ioutil.ReadFile(loc + suffix)
+	}
+	d.Close()
+	stats, _ = os.Stat(loc + ".1")
+	if stats.Size() == 1<<16 {
+		t.Error("Preallocated space not trimmed on close")
+	}
+
+	for _, open := range []func(string, *Options) (*DB, error){OpenDBWithOptions, OpenAndVerifyDBWithOptions} {
+		for suffix, b := range files {
+			ioutil.WriteFile(crashed+suffix, b, 0666)
+		}
+		d, e := open(crashed, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v, _ := d.Get([]byte("Tom")); d.Size() != 1001 || v != "Oregon" {
+			t.Error("Preallocated DB not recovered")
+		}
+		d.Upsert([]byte("Tom"), []byte("Paris"))
+		d.Close()
+		d, _ = OpenDB(crashed)
+		if v, _ := d.Get([]byte("Tom")); v != "Paris" {
+			t.Error("Write after recovery lost")
+		}
+		d.Close()
+	}
+}
+
+func TestNoMmap(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	opts := &Options{NoMmap: true, MaxSegmentSize: 1 << 14, HintFiles: true}
+	d, _ := NewDBWithOptions(loc, opts)
+	for i := 0; i < 2000; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*i)))
+	}
+	big := bytes.Repeat([]byte("Oregon"), scanWindow/3)
+	d.Upsert([]byte("Tom"), big)
+	if len(d.sealed) == 0 || len(d.filebuffer) > headerSize {
+		t.Fatal("Unexpected mapping")
+	}
+	if v, _ := d.Get([]byte("1999")); v != strconv.Itoa(1999*1999) {
+		t.Error("Get without mapping failed")
+	}
+	if v, _ := d.GetBytes([]byte("Tom")); !bytes.Equal(v, big) {
+		t.Error("Large value without mapping failed")
+	}
+	d.Remove([]byte("0"))
+	d.Merge()
+	d.Close()
+
+	for _, open := range []func(string, *Options) (*DB, error){OpenDBWithOptions, OpenAndVerifyDBWithOptions} {
+		d, e := open(loc, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v, _ := d.GetBytes([]byte("Tom")); !bytes.Equal(v, big) {
+			t.Error("DB not indexed without mapping")
+		}
+		if v, _ := d.GetZeroCopy([]byte("7")); string(v) != "49" {
+			t.Error("GetZeroCopy without mapping failed")
+		}
+		d.Upsert([]byte("Ann"), []byte("Paris"))
+		d.Close()
+	}
+	d, _ = OpenAndVerifyDB(loc)
+	if v, _ := d.Get([]byte("Ann")); d.Size() != 2001 || v != "Paris" {
+		t.Error("Files written without mapping unreadable with it")
+	}
+	d.Close()
+}
+
+func TestSizeLimits(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxKeySize: 8, MaxValueSize: 16})
+	if e := d.Upsert([]byte("Tom"), []byte("Oregon")); e != nil {
+		t.Error(e)
+	}
+	if e := d.Upsert([]byte("Washington"), []byte("Oregon")); e != ErrKeyTooLarge {
+		t.Error("Key over limit accepted")
+	}
+	if e := d.Upsert([]byte("Tom"), []byte("Washington, Oregon")); e != ErrValueTooLarge {
+		t.Error("Value over limit accepted")
+	}
+	if e := d.UpsertReader([]byte("Tom"), 17, bytes.NewReader(make([]byte, 17))); e != ErrValueTooLarge {
+		t.Error("Streamed value over limit accepted")
+	}
+	b := d.NewBatch()
+	b.Upsert([]byte("Jim"), []byte("Idaho"))
+	b.Upsert([]byte("Jim"), make([]byte, 17))
+	if e := b.Commit(); e != ErrValueTooLarge || d.Contains([]byte("Jim")) {
+		t.Error("Batched value over limit accepted")
+	}
+	if v, _ := d.Get([]byte("Tom")); v != "Oregon" || d.Size() != 1 {
+		t.Error("Rejected write applied")
+	}
+	d.Close()
+
+	//Compression or encryption can grow a record past what fits
+	if checkRecord(&record{key: make([]byte, keyLenMask+1)}) != ErrKeyTooLarge {
+		t.Error("Grown record accepted")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	hooked := make(chan error, 1)
+	opts := &Options{MaxFileSize: 1 << 12, MaxSegmentSize: 1 << 10, ReadOnlyWhenFull: true, OnQuotaExceeded: func(e error) { hooked <- e }}
+	d, _ := NewDBWithOptions(loc, opts)
+	var e error
+	for i := 0; e == nil; i++ {
+		e = d.Upsert([]byte("Tom"), []byte(strconv.Itoa(i)))
+	}
+	if e != ErrQuotaExceeded || !errors.Is(<-hooked, ErrQuotaExceeded) {
+		t.Fatal("Quota not enforced")
+	}
+	if size := d.Stats().FileSize; size > 1<<12 {
+		t.Error("Quota exceeded", size)
+	}
+	if s := d.Stats(); s.QuotaFailures != 1 || !s.Full {
+		t.Error("Quota failure not counted")
+	}
+	if e := d.Upsert([]byte("Jim"), []byte("Idaho")); e != ErrReadOnly {
+		t.Error("Full DB not read-only")
+	}
+	d.Consolidate()
+	if e := d.Upsert([]byte("Jim"), []byte("Idaho")); e != nil || d.Stats().Full {
+		t.Error("Compaction didn't make room", e)
+	}
+	d.Close()
+}
+
+func TestFold(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	for i := 0; i < 100; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*i)))
+	}
+	d.Remove([]byte("0"))
+	seen := 0
+	e := d.Fold(func(k, v []byte) error {
+		i, _ := strconv.Atoi(string(k))
+		if string(v) != strconv.Itoa(i*i) {
+			t.Error("Fold value mismatch")
+		}
+		//Writes made during the fold aren't seen by it
+		d.Upsert([]byte("new"+string(k)), v)
+		seen++
+		return nil
+	})
+	if e != nil || seen != 99 {
+		t.Error("Fold error", e, seen)
+	}
+	seen = 0
+	e = d.Fold(func(k, v []byte) error {
+		seen++
+		if seen == 10 {
+			return ErrStop
+		}
+		return nil
+	})
+	if e != nil || seen != 10 {
+		t.Error("Fold not stopped", e, seen)
+	}
+	if e = d.Fold(func(k, v []byte) error { return ErrCorrupt }); e != ErrCorrupt {
+		t.Error("Fold error not returned")
+	}
+	d.Close()
+}
+
+func TestBulkBytes(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{Compression: Flate, CompressionThreshold: 64})
+	long := strings.Repeat("Oregon", 100)
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	d.Upsert([]byte("Jim"), []byte(long))
+	d.UpsertWithTTL([]byte("Ann"), []byte("Idaho"), -time.Second)
+	if kvs := d.KeysAndVals(); len(kvs) != 2 || kvs[0][0] == "" || kvs[1][0] == "" {
+		t.Error("KeysAndVals has empty entries", len(kvs))
+	}
+	keys := d.KeysBytes()
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	if len(keys) != 2 || string(keys[0]) != "Jim" || string(keys[1]) != "Tom" {
+		t.Error("KeysBytes mismatch")
+	}
+	vals := d.ValsBytes()
+	sort.Slice(vals, func(i, j int) bool { return len(vals[i]) < len(vals[j]) })
+	if len(vals) != 2 || string(vals[0]) != "Oregon" || string(vals[1]) != long {
+		t.Error("ValsBytes mismatch")
+	}
+	pairs := d.Pairs()
+	if len(pairs) != 2 {
+		t.Fatal("Pairs mismatch")
+	}
+	for _, kv := range pairs {
+		if v, _ := d.Get(kv.Key); v != string(kv.Value) {
+			t.Error("Pairs mismatch")
+		}
+	}
+	//Returned values are copies, unaffected by later writes
+	d.Upsert([]byte("Tom"), []byte("Paris!"))
+	d.Consolidate()
+	if string(vals[0]) != "Oregon" {
+		t.Error("ValsBytes not copied")
+	}
+	d.Close()
+}
+
+func TestKeysPage(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	for _, opts := range []*Options{{OrderedIndex: true}, nil} {
+		d, _ := NewDBWithOptions(loc, opts)
+		for i := 0; i < 1000; i++ {
+			d.Upsert([]byte(strconv.Itoa(10000 + i)[1:]), []byte("Oregon"))
+		}
+		d.UpsertWithTTL([]byte("0500"), []byte("Idaho"), -time.Second)
+		var all []string
+		var after []byte
+		for {
+			page := d.KeysPage(after, 64)
+			if len(page) == 0 {
+				break
+			}
+			if len(page) > 64 {
+				t.Fatal("Page over limit")
+			}
+			all = append(all, page...)
+			after = []byte(page[len(page)-1])
+		}
+		if len(all) != 999 || !sort.StringsAreSorted(all) || all[0] != "0000" || all[500] != "0501" {
+			t.Error("Paging mismatch", len(all))
+		}
+		d.Close()
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	users, admins, tricky := d.Bucket("users"), d.Bucket("users\x00"), d.Bucket("")
+	users.Upsert([]byte("Tom"), []byte("Oregon"))
+	users.Upsert([]byte("Jim"), []byte("Idaho"))
+	admins.Upsert([]byte("Tom"), []byte("Paris"))
+	tricky.Upsert([]byte("users"), []byte("Boston"))
+	d.Upsert([]byte("Tom"), []byte("Washington"))
+	if v, _ := users.Get([]byte("Tom")); v != "Oregon" {
+		t.Error("Bucket get mismatch")
+	}
+	if v, _ := admins.Get([]byte("Tom")); v != "Paris" || admins.Contains([]byte("Jim")) {
+		t.Error("Buckets not separate")
+	}
+	var keys []string
+	for k, v := range users.All() {
+		keys = append(keys, string(k)+"="+string(v))
+	}
+	if strings.Join(keys, ",") != "Jim=Idaho,Tom=Oregon" {
+		t.Error("Bucket iteration mismatch", keys)
+	}
+	if s := users.Stats(); s.Keys != 2 || s.LiveBytes == 0 {
+		t.Error("Bucket stats mismatch", s)
+	}
+	if n, e := users.Clear(); n != 2 || e != nil || users.Contains([]byte("Jim")) {
+		t.Error("Bucket not cleared", n, e)
+	}
+	if !admins.Contains([]byte("Tom")) || !tricky.Contains([]byte("users")) || !d.Contains([]byte("Tom")) {
+		t.Error("Clearing a bucket touched others")
+	}
+	d.Close()
+}
+
+func TestAsFS(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	files := map[string]string{
+		"index.html":       "<h1>Hello</h1>",
+		"css/site.css":     "body {}",
+		"img/a/logo.png":   "PNG",
+		"img/a.txt":        "A",
+		"img/b":            "B",
+		"img/b/nested.txt": "nested",
+	}
+	for k, v := range files {
+		d.Upsert([]byte(k), []byte(v))
+	}
+	d.Upsert([]byte("/absolute"), []byte("hidden"))
+	fsys := d.AsFS()
+	e := fstest.TestFS(fsys, "index.html", "css/site.css", "img/a/logo.png", "img/a.txt", "img/b")
+	if e != nil {
+		t.Error(e)
+	}
+	if b, e := fs.ReadFile(fsys, "css/site.css"); e != nil || string(b) != "body {}" {
+		t.Error("ReadFile mismatch", e)
+	}
+	entries, _ := fs.ReadDir(fsys, "img")
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name()+strconv.FormatBool(entry.IsDir()))
+	}
+	//A key that is also a directory shows as the file
+	if strings.Join(names, ",") != "atrue,a.txtfalse,bfalse" {
+		t.Error("ReadDir mismatch", names)
+	}
+	if _, e := fs.Stat(fsys, "missing"); !errors.Is(e, fs.ErrNotExist) {
+		t.Error("Missing file found")
+	}
+	d.Close()
+}
+
+func TestBitcask(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	defer removeAll(loc + ".bitcask")
+	defer removeAll(loc + ".converted")
+
+	d, _ := NewDB(loc)
+	for i := 0; i < 20; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte("v"+strconv.Itoa(i)))
+	}
+	e := d.ExportBitcask(loc + ".bitcask")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if d.ExportBitcask(loc+".bitcask") == nil {
+		t.Error("Exported over existing Bitcask files")
+	}
+	d.Close()
+
+	//A later file removes one key and overwrites another, and a third without
+	//a hint file ends in a partial entry
+	w, _ := newBitcaskWriter(loc+".bitcask", 2)
+	w.write([]byte("3"), []byte(bitcaskTombstone2+"\x00\x00\x00\x02"), 1)
+	w.write([]byte("4"), []byte("new"), 1)
+	w.close()
+	w, _ = newBitcaskWriter(loc+".bitcask", 3)
+	w.write([]byte("5"), []byte("newer"), 1)
+	w.close()
+	os.Remove(filepath.Join(loc+".bitcask", "3"+bitcaskHintSuffix))
+	df, _ := os.OpenFile(filepath.Join(loc+".bitcask", "3"+bitcaskDataSuffix), os.O_WRONLY|os.O_APPEND, 0)
+	df.Write([]byte{1, 2, 3, 4, 5})
+	df.Close()
+
+	e = ConvertBitcask(loc+".bitcask", loc+".converted")
+	if e != nil {
+		t.Fatal(e)
+	}
+	d, _ = OpenDB(loc + ".converted")
+	if d.Size() != 19 || d.Contains([]byte("3")) {
+		t.Error("Tombstone not applied")
+	}
+	v4, _ := d.Get([]byte("4"))
+	v5, _ := d.Get([]byte("5"))
+	v7, _ := d.Get([]byte("7"))
+	if v4 != "new" || v5 != "newer" || v7 != "v7" {
+		t.Error("Converted values mismatch")
+	}
+
+	//Damage an entry in the file without hints
+	path := filepath.Join(loc+".bitcask", "3"+bitcaskDataSuffix)
+	buf, _ := os.ReadFile(path)
+	buf[bitcaskHeaderSize] ^= 0xff
+	os.WriteFile(path, buf, 0644)
+	if e := d.ImportBitcask(loc + ".bitcask"); !errors.Is(e, ErrCorrupt) {
+		t.Error("Damaged entry imported")
+	}
+	d.Close()
+}
+
+func TestViewAt(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 200})
+	d.Upsert([]byte("a"), []byte("1"))
+	d.Upsert([]byte("b"), []byte("1"))
+	first := d.CommittedOffset()
+	for i := 0; i < 20; i++ {
+		d.Upsert([]byte("a"), []byte(strconv.Itoa(i+2)))
+	}
+	d.Remove([]byte("b"))
+	second := d.CommittedOffset()
+	d.Upsert([]byte("c"), []byte("1"))
+	if d.Segments() < 2 {
+		t.Fatal("Expected several segments")
+	}
+
+	v, e := d.ViewAt(first)
+	if e != nil {
+		t.Fatal(e)
+	}
+	a, _ := v.Get([]byte("a"))
+	if a != "1" || !v.Contains([]byte("b")) || v.Size() != 2 {
+		t.Error("View at first offset mismatch")
+	}
+	v.Close()
+	v, _ = d.ViewAt(second)
+	a, _ = v.Get([]byte("a"))
+	if a != "21" || v.Contains([]byte("b")) || v.Contains([]byte("c")) {
+		t.Error("View at second offset mismatch")
+	}
+	v.Close()
+	if _, e = d.ViewAt(first - 1); e != ErrBadOffset {
+		t.Error("Viewed within a document")
+	}
+	if _, e = d.ViewAt(d.CommittedOffset() + 1); e != ErrBadOffset {
+		t.Error("Viewed past the end of the log")
+	}
+
+	e = d.Merge()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = d.ViewAt(first); e != ErrBadOffset {
+		t.Error("Viewed rewritten log")
+	}
+	third := d.CommittedOffset()
+	d.Upsert([]byte("c"), []byte("2"))
+	d.Close()
+	d, _ = OpenDB(loc)
+	defer d.Close()
+	if _, e = d.ViewAt(first); e != ErrBadOffset {
+		t.Error("Compaction forgotten on reopening")
+	}
+	v, e = d.ViewAt(third)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c, _ := v.Get([]byte("c"))
+	if c != "1" || v.Size() != 2 {
+		t.Error("View after merge mismatch")
+	}
+	v.Close()
+}
+
+func TestReadLog(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 200, Compression: Flate, CompressionThreshold: 1})
+	defer d.Close()
+	d.UpsertWithFlags([]byte("a"), []byte("1"), 3)
+	b := d.NewBatch()
+	b.Upsert([]byte("b"), bytes.Repeat([]byte("x"), 100))
+	b.Remove([]byte("a"))
+	b.Commit()
+	for i := 0; i < 10; i++ {
+		d.Upsert([]byte("c"), []byte(strconv.Itoa(i)))
+	}
+	var recs []Record
+	next, e := d.ReadLog(0, func(rec Record) error {
+		rec.Key, rec.Value = append([]byte{}, rec.Key...), append([]byte{}, rec.Value...)
+		recs = append(recs, rec)
+		return nil
+	})
+	if e != nil || next != d.CommittedOffset() || len(recs) != 13 {
+		t.Fatal("Wrong records read", e, len(recs))
+	}
+	if string(recs[0].Key) != "a" || recs[0].Flags != 3 || recs[0].Timestamp.IsZero() || recs[0].Removed {
+		t.Error("Wrong first record")
+	}
+	if !bytes.Equal(recs[1].Value, bytes.Repeat([]byte("x"), 100)) || !recs[2].Removed {
+		t.Error("Wrong batch records")
+	}
+
+	//Resume part way through, stopping early
+	var keys []string
+	next, e = d.ReadLog(recs[3].Offset, func(rec Record) error {
+		keys = append(keys, string(rec.Value))
+		if len(keys) == 2 {
+			return ErrStop
+		}
+		return nil
+	})
+	if e != nil || strings.Join(keys, ",") != "0,1" {
+		t.Error("Wrong records from resuming", e, keys)
+	}
+	d.ReadLog(next, func(rec Record) error {
+		keys = append(keys, string(rec.Value))
+		return ErrStop
+	})
+	if keys[2] != "2" {
+		t.Error("Wrong record after stopping: " + keys[2])
+	}
+	d.Upsert([]byte("d"), []byte("1"))
+	n := 0
+	next, e = d.ReadLog(d.CommittedOffset()-1, func(rec Record) error { n++; return nil })
+	if e != ErrBadOffset {
+		t.Error("Read from within a document")
+	}
+	end := d.CommittedOffset()
+	if next, e = d.ReadLog(end, func(rec Record) error { n++; return nil }); e != nil || next != end || n != 0 {
+		t.Error("Read past the end of the log")
+	}
+}
+
+func TestExportAudit(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDB(loc)
+	defer d.Close()
+	d.UpsertWithTTL([]byte("Tom"), []byte("Washington"), time.Hour)
+	d.Upsert([]byte("\xff"), []byte("Oregon"))
+	d.Remove([]byte("Tom"))
+	var buf bytes.Buffer
+	next, e := d.ExportAudit(&buf, 0)
+	if e != nil || next != d.CommittedOffset() {
+		t.Fatal(e)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var recs []map[string]any
+	for _, line := range lines {
+		var rec map[string]any
+		if e := json.Unmarshal([]byte(line), &rec); e != nil {
+			t.Fatal(e)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 3 || recs[0]["op"] != "put" || recs[0]["k"] != "Tom" || recs[0]["size"] != 10.0 || recs[0]["expires"] == nil {
+		t.Error("Wrong audit of first write: " + lines[0])
+	}
+	if _, e := time.Parse(time.RFC3339Nano, recs[0]["time"].(string)); e != nil {
+		t.Error(e)
+	}
+	if recs[1]["k64"] != "/w==" || recs[2]["op"] != "delete" || recs[2]["size"] != 0.0 {
+		t.Error("Wrong audit: " + buf.String())
+	}
+	buf.Reset()
+	d.Upsert([]byte("Dick"), []byte("Maine"))
+	d.ExportAudit(&buf, next)
+	if !strings.Contains(buf.String(), `"k":"Dick"`) || strings.Count(buf.String(), "\n") != 1 {
+		t.Error("Wrong audit from offset: " + buf.String())
+	}
+}
+
+func TestReadOnlyDB(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	w, _ := NewDBWithOptions(loc, &Options{MaxSegmentSize: 200})
+	defer w.Close()
+	w.Upsert([]byte("Tom"), []byte("Washington"))
+	w.Upsert([]byte("Dick"), []byte("Maine"))
+	w.Remove([]byte("Dick"))
+	r, e := OpenReadOnlyDB(loc, &Options{RefreshInterval: -1})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer r.Close()
+	if v, _ := r.Get([]byte("Tom")); v != "Washington" || r.Contains([]byte("Dick")) {
+		t.Error("Reader opened with wrong contents")
+	}
+	if r.Upsert([]byte("Harry"), []byte("Oregon")) != ErrReadOnly || r.Merge() != ErrReadOnly {
+		t.Error("Wrote to a reader")
+	}
+
+	//Appends, including to segments started since, show up on refresh
+	for i := 0; i < 20; i++ {
+		w.Upsert([]byte(strconv.Itoa(i)), bytes.Repeat([]byte("x"), i+1))
+	}
+	w.Upsert([]byte("Tom"), []byte("Oregon"))
+	if r.Contains([]byte("19")) {
+		t.Error("Reader saw appends before refreshing")
+	}
+	if e := r.Refresh(); e != nil {
+		t.Fatal(e)
+	}
+	check := func() {
+		t.Helper()
+		if r.Size() != w.Size() || r.Segments() != w.Segments() {
+			t.Fatal("Reader out of step", r.Size(), w.Size(), r.Segments(), w.Segments())
+		}
+		for _, k := range w.Keys() {
+			v, _ := w.Get([]byte(k))
+			if got, _ := r.Get([]byte(k)); got != v {
+				t.Error("Wrong value for " + k + ": " + got)
+			}
+		}
+	}
+	check()
+	if w.Segments() < 3 {
+		t.Error("Writer didn't rotate")
+	}
+
+	//Compaction replaces the files, and the reader starts afresh
+	for i := 0; i < 10; i++ {
+		w.Remove([]byte(strconv.Itoa(i)))
+	}
+	w.Merge()
+	r.Refresh()
+	check()
+	w.Upsert([]byte("Harry"), []byte("Texas"))
+	w.Consolidate()
+	r.Refresh()
+	check()
+	n := 0
+	if e := r.Fold(func(k, v []byte) error { n++; return nil }); e != nil || n != w.Size() {
+		t.Error("Wrong fold of reader", e, n)
+	}
+	w.Clear()
+	w.Upsert([]byte("Dick"), []byte("Vermont"))
+	r.Refresh()
+	check()
+
+	//Readers refresh themselves in the background
+	bg, _ := OpenReadOnlyDB(loc, &Options{RefreshInterval: time.Millisecond})
+	defer bg.Close()
+	w.Upsert([]byte("Harry"), []byte("Ohio"))
+	for i := 0; i < 1000 && !bg.Contains([]byte("Harry")); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if v, _ := bg.Get([]byte("Harry")); v != "Ohio" {
+		t.Error("Reader didn't refresh in the background")
+	}
+
+	//Closing a reader leaves the writer's files alone
+	r.Close()
+	w.Upsert([]byte("Tom"), []byte("Maine"))
+	w.Close()
+	d, e := OpenDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer d.Close()
+	if v, _ := d.Get([]byte("Tom")); v != "Maine" {
+		t.Error("Lost writes after closing a reader")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	d, _ := NewDBWithOptions(loc, &Options{KeepVersions: 2, MaxSegmentSize: 100})
+	defer d.Close()
+	for i := 0; i < 5; i++ {
+		d.Upsert([]byte("a"), []byte(strconv.Itoa(i)))
+		d.Upsert([]byte("b"), []byte(strconv.Itoa(i)))
+	}
+	check := func() {
+		t.Helper()
+		h := d.History([]byte("a"))
+		if len(h) != 3 || string(h[0]) != "4" || string(h[1]) != "3" || string(h[2]) != "2" {
+			t.Error("History mismatch")
+		}
+		if v, ok := d.GetVersion([]byte("a"), 1); !ok || string(v) != "3" {
+			t.Error("GetVersion mismatch")
+		}
+		if _, ok := d.GetVersion([]byte("a"), 3); ok {
+			t.Error("Version beyond kept depth returned")
+		}
+	}
+	check()
+	e := d.Consolidate()
+	if e != nil {
+		t.Fatal(e)
+	}
+	check()
+	if d.DeadRatio() != 0 {
+		t.Error("Kept versions counted as dead")
+	}
+	d.Remove([]byte("b"))
+	if d.History([]byte("b")) != nil {
+		t.Error("History kept for removed key")
+	}
+	d.Close()
+
+	//Indexing afresh leaves the current values in place
+	d, _ = OpenAndVerifyDB(loc)
+	if v, _ := d.Get([]byte("a")); v != "4" {
+		t.Error("Current value lost after compaction")
+	}
+}
+
+func TestTombstoneRetention(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	for _, retention := range []time.Duration{0, time.Hour} {
+		d, _ := NewDBWithOptions(loc, &Options{TombstoneRetention: retention})
+		d.Upsert([]byte("a"), []byte("1"))
+		d.Upsert([]byte("b"), []byte("1"))
+		d.Upsert([]byte("c"), []byte("1"))
+		d.Remove([]byte("a"))
+		d.Remove([]byte("b"))
+		d.Upsert([]byte("b"), []byte("2"))
+		e := d.Consolidate()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if d.DeadRatio() != 0 {
+			t.Error("Kept tombstones counted as dead")
+		}
+		d.Close()
+		d, _ = OpenAndVerifyDB(loc)
+		want := 0
+		if retention > 0 {
+			want = 1
+		}
+		if got := d.Stats().Tombstones; got != want {
+			t.Error("Expected", want, "tombstones after compaction, got", got)
+		}
+		if d.Contains([]byte("a")) || d.Size() != 2 {
+			t.Error("Kept tombstone mismatch")
+		}
+		d.Close()
+	}
+}
+
+func TestDiff(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	defer removeAll(loc + ".b")
+
+	a, _ := NewDB(loc)
+	defer a.Close()
+	b, _ := NewDBWithOptions(loc+".b", &Options{Compression: Flate, CompressionThreshold: 1})
+	defer b.Close()
+	for i := 0; i < 100; i++ {
+		v := []byte(strings.Repeat(strconv.Itoa(i), 50))
+		a.Upsert([]byte(strconv.Itoa(i)), v)
+		b.Upsert([]byte(strconv.Itoa(i)), v)
+	}
+	a.Remove([]byte("1"))
+	b.Remove([]byte("2"))
+	b.Upsert([]byte("3"), []byte("x"))
+	added, removed, changed, e := Diff(a, b)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(added) != 1 || added[0] != "1" || len(removed) != 1 || removed[0] != "2" || len(changed) != 1 || changed[0] != "3" {
+		t.Error("Diff mismatch:", added, removed, changed)
+	}
+	added, removed, changed, _ = Diff(a, a)
+	if len(added)+len(removed)+len(changed) != 0 {
+		t.Error("DB differs from itself")
+	}
+	n := 0
+	DiffFunc(a, b, func(k []byte, kind DiffKind) error {
+		n++
+		return ErrStop
+	})
+	if n != 1 {
+		t.Error("DiffFunc didn't stop")
+	}
+}
+
+func TestMergeInto(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	defer removeAll(loc + ".src")
+
+	dst, _ := NewDB(loc)
+	defer dst.Close()
+	src, _ := NewDB(loc + ".src")
+	defer src.Close()
+	dst.Upsert([]byte("a"), []byte("dst"))
+	src.Upsert([]byte("a"), []byte("src"))
+	src.Upsert([]byte("b"), []byte("src"))
+	dst.Upsert([]byte("c"), []byte("dst"))
+	src.Upsert([]byte("c"), []byte("src"))
+	src.UpsertWithTTL([]byte("d"), []byte("src"), time.Hour)
+
+	//Last writer wins: a was written first to dst, c last
+	e := MergeInto(dst, src, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	want := map[string]string{"a": "src", "b": "src", "c": "src", "d": "src"}
+	got := dst.Dump()
+	if len(got) != len(want) {
+		t.Error("Merged size mismatch")
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Error("Merged value mismatch for " + k)
+		}
+	}
+	if s, _ := dst.Stat([]byte("d")); s.Expiry.IsZero() {
+		t.Error("TTL not kept")
+	}
+
+	dst.Upsert([]byte("a"), []byte("newer"))
+	dst.Upsert([]byte("b"), []byte("newer"))
+	e = MergeInto(dst, src, func(k, dstV, srcV []byte) []byte {
+		if string(k) == "b" {
+			return nil
+		}
+		return append(append([]byte{}, dstV...), srcV...)
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v, _ := dst.Get([]byte("a")); v != "newersrc" || dst.Contains([]byte("b")) {
+		t.Error("Resolver not applied")
+	}
+}
+
+func TestSplitTo(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	parts := []string{loc + ".0", loc + ".1", loc + ".2"}
+	for _, p := range parts {
+		defer removeAll(p)
+	}
+
+	d, _ := NewDB(loc)
+	defer d.Close()
+	for i := 0; i < 300; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*2)))
+	}
+	d.Remove([]byte("7"))
+	d.UpsertWithTTL([]byte("ttl"), []byte("x"), time.Hour)
+	e := d.SplitTo(parts, HashPartition(len(parts)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	want := d.Dump()
+	got := make(map[string]string)
+	for i, p := range parts {
+		part, e := OpenDB(p)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if part.Size() == 0 {
+			t.Error("Empty part")
+		}
+		for k, v := range part.Dump() {
+			if HashPartition(len(parts))([]byte(k)) != i {
+				t.Error("Key in wrong part: " + k)
+			}
+			got[k] = v
+		}
+		if s, ok := part.Stat([]byte("ttl")); ok && s.Expiry.IsZero() {
+			t.Error("TTL not kept")
+		}
+		part.Close()
+	}
+	if len(got) != len(want) {
+		t.Error("Split size mismatch")
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Error("Split value mismatch for " + k)
+		}
+	}
+	if d.SplitTo(parts, func(k []byte) int { return 3 }) == nil {
+		t.Error("Out of range partition accepted")
+	}
+}
+
+func TestCompactTo(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+	defer removeAll(loc + ".moved")
+
+	d, _ := NewDB(loc)
+	for i := 0; i < 300; i++ {
+		d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*2)))
+		d.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+	}
+	d.Remove([]byte("7"))
+	d.UpsertWithTTL([]byte("ttl"), []byte("x"), time.Hour)
+	if _, e := d.CompactTo(loc); e == nil {
+		t.Error("Compacted onto own location")
+	}
+
+	//Writes made during the copy must carry over
+	written := make(chan int)
+	go func() {
+		i := 0
+		for d.Upsert([]byte("w"+strconv.Itoa(i)), []byte("v")) == nil {
+			i++
+		}
+		written <- i
+	}()
+	n, e := d.CompactTo(loc + ".moved")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	count := <-written
+	for i := 0; i < count; i++ {
+		if _, ok := n.Get([]byte("w" + strconv.Itoa(i))); !ok {
+			t.Fatal("Lost write made during CompactTo")
+		}
+	}
+	if _, e := d.Lookup([]byte("1")); e != ErrDatabaseClosed {
+		t.Error("Old DB still open")
+	}
+	if v, _ := n.Get([]byte("1")); v != "1" {
+		t.Error("Wrong value after CompactTo")
+	}
+	if n.Contains([]byte("7")) {
+		t.Error("Removed key revived")
+	}
+	if s, ok := n.Stat([]byte("ttl")); !ok || s.Expiry.IsZero() {
+		t.Error("TTL not kept")
+	}
+	if n.Size() != 300+count {
+		t.Error("Wrong size after CompactTo")
+	}
+	if e := n.Upsert([]byte("new"), []byte("y")); e != nil {
+		t.Error(e)
+	}
+}
+
+func TestShardedDB(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bitcesque")
+	defer os.RemoveAll(dir)
+
+	s, e := NewShardedDB(dir, 4, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 200; i++ {
+		s.Upsert([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+	}
+	s.Remove([]byte("5"))
+	for _, d := range s.Shards() {
+		if d.Size() == 0 {
+			t.Error("Empty shard")
+		}
+	}
+	if e = s.Consolidate(); e != nil {
+		t.Fatal(e)
+	}
+	s.Close()
+
+	s, e = OpenShardedDB(dir, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if len(s.Shards()) != 4 || s.Size() != 199 || s.Contains([]byte("5")) {
+		t.Error("Reopened sharded DB mismatch")
+	}
+	if v, _ := s.Get([]byte("17")); v != "17" {
+		t.Error("Get mismatch")
+	}
+	n := 0
+	for range s.All() {
+		n++
+	}
+	if n != 199 {
+		t.Error("All mismatch")
+	}
+
+	//A split lands keys in the shards a ShardedDB routes them to
+	d, _ := NewDB(filepath.Join(dir, "single"))
+	defer d.Close()
+	d.Upsert([]byte("k"), []byte("v"))
+	split := filepath.Join(dir, "split")
+	os.Mkdir(split, 0777)
+	d.SplitTo([]string{ShardLocation(split, 0), ShardLocation(split, 1)}, HashPartition(2))
+	s2, e := OpenShardedDB(split, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s2.Close()
+	if v, _ := s2.Get([]byte("k")); v != "v" {
+		t.Error("Split not routed as sharded")
+	}
+}
+
+func TestOpenDir(t *testing.T) {
+	parent, _ := ioutil.TempDir("", "bitcesque")
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "db")
+
+	d, e := NewDir(dir, &Options{MaxSegmentSize: 100, HintFiles: true})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 50; i++ {
+		d.Upsert([]byte(strconv.Itoa(i%10)), []byte(strconv.Itoa(i)))
+	}
+	if e = d.Merge(); e != nil {
+		t.Fatal(e)
+	}
+	d.Close()
+	if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+		t.Error("DB files outside its directory")
+	}
+
+	d, e = OpenDir(dir, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer d.Close()
+	if v, _ := d.Get([]byte("3")); v != "43" || d.Size() != 10 {
+		t.Error("Reopened directory DB mismatch")
+	}
+	if _, e = OpenDir(dir, nil); e != ErrDatabaseLocked {
+		t.Error("Directory DB not locked")
+	}
+}
+
+// Opens a DB at a fresh location holding n keys, for benchmarks, returning
+// it along with its keys.
+func benchDB(b *testing.B, n int, opts *Options) (*DB, [][]byte) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	b.Cleanup(func() { removeAll(loc) })
+	d, e := NewDBWithOptions(loc, opts)
+	if e != nil {
+		b.Fatal(e)
+	}
+	b.Cleanup(func() { d.Close() })
+	keys := make([][]byte, n)
+	v := bytes.Repeat([]byte("v"), 100)
+	for i := range keys {
+		keys[i] = []byte("key" + strconv.Itoa(i))
+		d.Upsert(keys[i], v)
+	}
+	return d, keys
+}
+
+func BenchmarkGet(b *testing.B) {
+	d, keys := benchDB(b, 1000, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Get(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkGetInto(b *testing.B) {
+	d, keys := benchDB(b, 1000, nil)
+	buf := make([]byte, 0, 256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, _ = d.GetInto(keys[i%len(keys)], buf[:0])
+	}
+}
+
+func BenchmarkGetZeroCopy(b *testing.B) {
+	d, keys := benchDB(b, 1000, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.GetZeroCopy(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkContains(b *testing.B) {
+	d, keys := benchDB(b, 1000, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Contains(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkUpsert(b *testing.B) {
+	d, keys := benchDB(b, 1000, nil)
+	v := bytes.Repeat([]byte("w"), 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Upsert(keys[i%len(keys)], v)
+	}
+}
+
+func BenchmarkGetIntoCompactIndex(b *testing.B) {
+	d, keys := benchDB(b, 1000, &Options{CompactIndex: true})
+	buf := make([]byte, 0, 256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, _ = d.GetInto(keys[i%len(keys)], buf[:0])
+	}
+}
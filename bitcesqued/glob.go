@@ -0,0 +1,98 @@
+package bitcesqued
+
+// Returns whether s matches the Redis-style glob pattern: * matches any run
+// of bytes, ? any single byte, [...] any byte in the set (with ^ negating it
+// and a-z giving ranges), and \ escapes the next byte.
+func globMatch(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			rest, ok := matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			pattern, s = rest, s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// Matches c against the character class starting after a '[', returning the
+// pattern following the class and whether c is in it.
+func matchClass(pattern []byte, c byte) ([]byte, bool) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+		hi := lo
+		if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+			hi = pattern[2]
+			pattern = pattern[2:]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		pattern = pattern[1:]
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return pattern, matched != negate
+}
+
+// Returns the literal prefix of the pattern, before any wildcard, so that
+// matching can be limited to keys starting with it.
+func globPrefix(pattern []byte) []byte {
+	var out []byte
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[':
+			return out
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+		}
+		out = append(out, pattern[i])
+	}
+	return out
+}
@@ -0,0 +1,127 @@
+package bitcesqued
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Requests are limited in size so a misbehaving client can't make the server
+// allocate without bound.
+const (
+	maxArgs    = 1 << 20
+	maxBulkLen = 512 << 20
+)
+
+var (
+	errProtocol = errors.New("Protocol error")
+	errTooLarge = errors.New("Request too large")
+)
+
+// Reads one command from r, either as a RESP array of bulk strings or as an
+// inline command separated by spaces.  Returns a nil command for blank lines
+// and empty or null arrays, errProtocol for other negative counts, and
+// errTooLarge if limit is positive and the arguments total more bytes.
+func readCommand(r *bufio.Reader, limit int) ([][]byte, error) {
+	line, e := readLine(r)
+	if e != nil {
+		return nil, e
+	}
+	if len(line) == 0 || line[0] != '*' {
+		if limit > 0 && len(line) > limit {
+			return nil, errTooLarge
+		}
+		var out [][]byte
+		for _, field := range strings.Fields(string(line)) {
+			out = append(out, []byte(field))
+		}
+		return out, nil
+	}
+	n, e := strconv.Atoi(string(line[1:]))
+	if e != nil || n < -1 || n > maxArgs {
+		return nil, errProtocol
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	out := make([][]byte, 0, n)
+	total := 0
+	for i := 0; i < n; i++ {
+		line, e = readLine(r)
+		if e != nil {
+			return nil, e
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, e := strconv.Atoi(string(line[1:]))
+		if e != nil || size < 0 || size > maxBulkLen {
+			return nil, errProtocol
+		}
+		total += size
+		if limit > 0 && total > limit {
+			return nil, errTooLarge
+		}
+		arg := make([]byte, size+2)
+		_, e = io.ReadFull(r, arg)
+		if e != nil {
+			return nil, e
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		out = append(out, arg[:size])
+	}
+	return out, nil
+}
+
+// Reads a line terminated by CRLF, or a bare LF, returning it without the
+// terminator.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, e := r.ReadSlice('\n')
+	if e == bufio.ErrBufferFull {
+		return nil, errProtocol
+	}
+	if e != nil {
+		return nil, e
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// Writes replies in RESP.  Errors are left to the underlying writer to
+// report on flush.
+type replyWriter struct {
+	*bufio.Writer
+}
+
+func (w replyWriter) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w replyWriter) err(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w replyWriter) integer(n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w replyWriter) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w replyWriter) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w replyWriter) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,503 @@
+// Package bitcesqued serves a bitcesque DB over the Redis protocol (RESP), so
+// that existing Redis clients in any language can talk to it.  The supported
+// commands are GET, SET (with EX or PX), DEL, EXISTS, KEYS, SCAN and DBSIZE,
+// along with PING, ECHO, SELECT 0, COMMAND and QUIT for the benefit of
+// clients that issue them on connecting.  Given a password, the server
+// requires clients to AUTH first, and it can serve over TLS.
+package bitcesqued
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bnyeggen/bitcesque"
+	"github.com/bnyeggen/bitcesque/internal/limit"
+)
+
+// Returned by Serve and ListenAndServe once Shutdown has been called.
+var ErrServerClosed = errors.New("Server closed")
+
+// SCAN cursors are remembered server-side, up to this many at once.
+const maxCursors = 4096
+
+// The least and greatest number of arguments each command takes, -1 meaning
+// no limit.
+var arities = map[string][2]int{
+	"PING": {0, 1}, "ECHO": {1, 1}, "QUIT": {0, 0}, "COMMAND": {0, -1},
+	"SELECT": {1, 1}, "DBSIZE": {0, 0}, "GET": {1, 1}, "SET": {2, 6},
+	"DEL": {1, -1}, "EXISTS": {1, -1}, "KEYS": {1, 1}, "SCAN": {1, 5},
+}
+
+// Configures a Server.
+type ServerOptions struct {
+	// If set, clients must give this password with AUTH, either alone or
+	// after the username "default", before any other command but QUIT.
+	Password string
+	// If set, connections accepted by Serve and ListenAndServe are served
+	// over TLS with this configuration.  Set ClientAuth and ClientCAs to
+	// require client certificates.
+	TLSConfig *tls.Config
+	// If positive, each connection runs at most this many commands a second
+	// on average, in bursts of up to RateBurst, holding later commands back
+	// until their turn.
+	RateLimit float64
+	RateBurst int
+	// If positive, at most this many commands run at once across all
+	// connections, the rest waiting their turn, so that no number of clients
+	// can starve the DB's writers of its lock.
+	MaxInflight int
+	// If positive, a command whose arguments total more than this many bytes
+	// is refused and its connection closed.  Arguments can never be longer
+	// than 512mb each.
+	MaxRequestSize int
+}
+
+// Serves a DB to Redis clients.
+type Server struct {
+	db         *bitcesque.DB
+	opts       ServerOptions
+	inflight   chan struct{} //Holds a token per running command, if limited
+	mutex      sync.Mutex
+	listeners  map[net.Listener]bool
+	conns      map[net.Conn]bool
+	closing    bool
+	conndone   sync.WaitGroup    //Tracks connection goroutines
+	cursors    map[uint64][]byte //SCAN resume points, by cursor
+	nextCursor uint64
+}
+
+// Returns a server for the given DB, which it takes ownership of: Shutdown
+// closes it.
+func NewServer(db *bitcesque.DB) *Server {
+	return NewServerWithOptions(db, nil)
+}
+
+// As NewServer, configured by the given options.  A nil opts gives the
+// defaults, which neither authenticate clients nor use TLS.
+func NewServerWithOptions(db *bitcesque.DB, opts *ServerOptions) *Server {
+	s := &Server{
+		db:        db,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+		cursors:   make(map[uint64][]byte),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.MaxInflight > 0 {
+		s.inflight = make(chan struct{}, s.opts.MaxInflight)
+	}
+	return s
+}
+
+// Listens on the given TCP address and serves connections until Shutdown.
+func (s *Server) ListenAndServe(addr string) error {
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
+	return s.Serve(l)
+}
+
+// Listens on the given TCP address and serves connections over TLS until
+// Shutdown, with the certificate and key in the given PEM files added to any
+// ServerOptions.TLSConfig.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	cert, e := tls.LoadX509KeyPair(certFile, keyFile)
+	if e != nil {
+		return e
+	}
+	config := &tls.Config{}
+	if s.opts.TLSConfig != nil {
+		config = s.opts.TLSConfig.Clone()
+	}
+	config.Certificates = append(config.Certificates, cert)
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
+	return s.serve(tls.NewListener(l, config))
+}
+
+// Serves connections accepted from l until Shutdown, always returning a
+// non-nil error.  l is closed on return.
+func (s *Server) Serve(l net.Listener) error {
+	if s.opts.TLSConfig != nil {
+		l = tls.NewListener(l, s.opts.TLSConfig)
+	}
+	return s.serve(l)
+}
+
+// As Serve, with l already wrapped in TLS if need be.
+func (s *Server) serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closing {
+		s.mutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, l)
+		s.mutex.Unlock()
+		l.Close()
+	}()
+	for {
+		conn, e := l.Accept()
+		if e != nil {
+			s.mutex.Lock()
+			closing := s.closing
+			s.mutex.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+			return e
+		}
+		s.mutex.Lock()
+		if s.closing {
+			s.mutex.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.conndone.Add(1)
+		s.mutex.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Stops accepting connections, lets each open one finish the command it is
+// running, and then closes the DB.  If ctx ends first, remaining connections
+// are closed outright, and ctx's error returned once the DB is closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		//Wakes connections blocked waiting for their next command
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.conndone.Wait()
+		close(done)
+	}()
+	var e error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		e = ctx.Err()
+		s.mutex.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mutex.Unlock()
+		<-done
+	}
+	closeErr := s.db.Close()
+	if e == nil {
+		e = closeErr
+	}
+	return e
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.conndone.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	w := replyWriter{bufio.NewWriter(conn)}
+	authed := s.opts.Password == ""
+	var limiter *limit.Limiter
+	if s.opts.RateLimit > 0 {
+		limiter = limit.New(s.opts.RateLimit, s.opts.RateBurst)
+	}
+	for {
+		cmd, e := readCommand(r, s.opts.MaxRequestSize)
+		if e != nil {
+			if e == errProtocol {
+				w.err("ERR Protocol error")
+				w.Flush()
+			} else if e == errTooLarge {
+				w.err("ERR request too large")
+				w.Flush()
+			}
+			return
+		}
+		if len(cmd) == 0 {
+			continue
+		}
+		if limiter != nil {
+			if wait := limiter.Reserve(); wait > 0 {
+				//Replies already due shouldn't wait on the limit
+				w.Flush()
+				time.Sleep(wait)
+			}
+		}
+		var quit bool
+		switch name := strings.ToUpper(string(cmd[0])); {
+		case name == "AUTH":
+			authed = s.auth(w, cmd[1:]) || authed
+		case !authed && name != "QUIT":
+			w.err("NOAUTH Authentication required.")
+		default:
+			if s.inflight != nil {
+				s.inflight <- struct{}{}
+			}
+			quit = s.dispatch(w, cmd)
+			if s.inflight != nil {
+				<-s.inflight
+			}
+		}
+		s.mutex.Lock()
+		closing := s.closing
+		s.mutex.Unlock()
+		//Replies are flushed once no more pipelined commands are waiting
+		if r.Buffered() == 0 || quit || closing {
+			if w.Flush() != nil || quit || closing {
+				return
+			}
+		}
+	}
+}
+
+// Runs one command, writing its reply.  Returns whether the connection should
+// then be closed.
+func (s *Server) dispatch(w replyWriter, cmd [][]byte) bool {
+	name, args := strings.ToUpper(string(cmd[0])), cmd[1:]
+	arity, known := arities[name]
+	if !known {
+		w.err("ERR unknown command '" + string(cmd[0]) + "'")
+		return false
+	}
+	if len(args) < arity[0] || (arity[1] >= 0 && len(args) > arity[1]) {
+		w.err("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return false
+	}
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "ECHO":
+		w.bulk(args[0])
+	case "QUIT":
+		w.simple("OK")
+		return true
+	case "COMMAND":
+		w.array(0)
+	case "SELECT":
+		if string(args[0]) != "0" {
+			w.err("ERR DB index is out of range")
+		} else {
+			w.simple("OK")
+		}
+	case "DBSIZE":
+		w.integer(s.db.Size())
+	case "GET":
+		v, e := s.db.Lookup(args[0])
+		if e == bitcesque.ErrKeyNotFound {
+			w.null()
+		} else if e != nil {
+			w.err("ERR " + e.Error())
+		} else {
+			w.bulk(v)
+		}
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		count := 0
+		for _, k := range args {
+			if !s.db.Contains(k) {
+				continue
+			}
+			if e := s.db.Remove(k); e != nil {
+				w.err("ERR " + e.Error())
+				return false
+			}
+			count++
+		}
+		w.integer(count)
+	case "EXISTS":
+		count := 0
+		for _, k := range args {
+			if s.db.Contains(k) {
+				count++
+			}
+		}
+		w.integer(count)
+	case "KEYS":
+		var keys [][]byte
+		it := s.db.Scan(globPrefix(args[0]))
+		for it.Next() {
+			if globMatch(args[0], it.Key()) {
+				keys = append(keys, it.Key())
+			}
+		}
+		if e := it.Err(); e != nil {
+			w.err("ERR " + e.Error())
+			break
+		}
+		w.array(len(keys))
+		for _, k := range keys {
+			w.bulk(k)
+		}
+	case "SCAN":
+		s.scan(w, args)
+	}
+	return false
+}
+
+// AUTH [username] password.  Returns whether the password was right.
+func (s *Server) auth(w replyWriter, args [][]byte) bool {
+	if len(args) < 1 || len(args) > 2 {
+		w.err("ERR wrong number of arguments for 'auth' command")
+		return false
+	}
+	if s.opts.Password == "" {
+		w.err("ERR AUTH called without any password configured")
+		return false
+	}
+	password := args[len(args)-1]
+	right := subtle.ConstantTimeCompare(password, []byte(s.opts.Password)) == 1
+	if !right || (len(args) == 2 && string(args[0]) != "default") {
+		w.err("WRONGPASS invalid username-password pair")
+		return false
+	}
+	w.simple("OK")
+	return true
+}
+
+// SET key value [EX seconds | PX milliseconds]
+func (s *Server) set(w replyWriter, args [][]byte) {
+	var ttl time.Duration
+	for i := 2; i < len(args); i += 2 {
+		opt := strings.ToUpper(string(args[i]))
+		if (opt != "EX" && opt != "PX") || i+1 >= len(args) || ttl != 0 {
+			w.err("ERR syntax error")
+			return
+		}
+		n, e := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if e != nil || n <= 0 {
+			w.err("ERR invalid expire time in 'set' command")
+			return
+		}
+		if opt == "EX" {
+			ttl = time.Duration(n) * time.Second
+		} else {
+			ttl = time.Duration(n) * time.Millisecond
+		}
+	}
+	if len(args[1]) == 0 {
+		//Empty values are tombstones on disk, so can't be stored
+		w.err("ERR empty values are not supported")
+		return
+	}
+	var e error
+	if ttl != 0 {
+		e = s.db.UpsertWithTTL(args[0], args[1], ttl)
+	} else {
+		e = s.db.Upsert(args[0], args[1])
+	}
+	if e != nil {
+		w.err("ERR " + e.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+func (s *Server) scan(w replyWriter, args [][]byte) {
+	cursor, e := strconv.ParseUint(string(args[0]), 10, 64)
+	if e != nil {
+		w.err("ERR invalid cursor")
+		return
+	}
+	var pattern []byte
+	count := 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.err("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, e = strconv.Atoi(string(args[i+1]))
+			if e != nil || count < 1 {
+				w.err("ERR syntax error")
+				return
+			}
+		default:
+			w.err("ERR syntax error")
+			return
+		}
+	}
+	it := s.db.Scan(globPrefix(pattern))
+	if cursor != 0 {
+		s.mutex.Lock()
+		resume, present := s.cursors[cursor]
+		delete(s.cursors, cursor)
+		s.mutex.Unlock()
+		if !present {
+			w.err("ERR invalid cursor")
+			return
+		}
+		it.Seek(resume)
+	}
+	var keys [][]byte
+	examined := 0
+	next := uint64(0)
+	for it.Next() {
+		if examined == count {
+			next = s.saveCursor(it.Key())
+			break
+		}
+		examined++
+		if pattern == nil || globMatch(pattern, it.Key()) {
+			keys = append(keys, it.Key())
+		}
+	}
+	if e := it.Err(); e != nil {
+		w.err("ERR " + e.Error())
+		return
+	}
+	w.array(2)
+	w.bulk([]byte(strconv.FormatUint(next, 10)))
+	w.array(len(keys))
+	for _, k := range keys {
+		w.bulk(k)
+	}
+}
+
+// Remembers where a SCAN should resume from, returning the cursor for it.
+// The oldest cursors are forgotten once there are too many.
+func (s *Server) saveCursor(resume []byte) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextCursor++
+	s.cursors[s.nextCursor] = resume
+	delete(s.cursors, s.nextCursor-maxCursors)
+	return s.nextCursor
+}
@@ -0,0 +1,278 @@
+package bitcesqued
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+func TestServer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bitcesqued")
+	defer os.RemoveAll(dir)
+	loc := filepath.Join(dir, "db")
+	db, e := bitcesque.NewDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	srv := NewServer(db)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	served := make(chan error)
+	go func() { served <- srv.Serve(l) }()
+
+	conn, e := net.Dial("tcp", l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	expect := func(cmd, reply string) {
+		conn.Write([]byte(cmd))
+		buf := make([]byte, len(reply))
+		_, e := io.ReadFull(r, buf)
+		if e != nil || string(buf) != reply {
+			t.Errorf("%q: got %q, want %q", cmd, buf, reply)
+		}
+	}
+	expect("PING\r\n", "+PONG\r\n")
+	expect("*3\r\n$3\r\nSET\r\n$3\r\nTom\r\n$6\r\nOregon\r\n", "+OK\r\n")
+	expect("SET Dick Washington EX 100\r\n", "+OK\r\n")
+	expect("SET Harry Wisconsin\r\nGET Tom\r\n", "+OK\r\n$6\r\nOregon\r\n")
+	expect("*2\r\n$3\r\nGET\r\n$6\r\nNobody\r\n", "$-1\r\n")
+	expect("EXISTS Tom Nobody Dick\r\n", ":2\r\n")
+	expect("KEYS *r*\r\n", "*1\r\n$5\r\nHarry\r\n")
+	expect("SCAN 0 COUNT 2\r\n", "*2\r\n$1\r\n1\r\n*2\r\n$4\r\nDick\r\n$5\r\nHarry\r\n")
+	expect("SCAN 1 COUNT 2\r\n", "*2\r\n$1\r\n0\r\n*1\r\n$3\r\nTom\r\n")
+	expect("DEL Tom Nobody\r\n", ":1\r\n")
+	expect("DBSIZE\r\n", ":2\r\n")
+	expect("FLUSHALL\r\n", "-ERR unknown command 'FLUSHALL'\r\n")
+	expect("GET\r\n", "-ERR wrong number of arguments for 'get' command\r\n")
+
+	//Shutdown waits for the idle connection, then closes the DB
+	e = srv.Shutdown(context.Background())
+	if e != nil {
+		t.Error(e)
+	}
+	if e = <-served; e != ErrServerClosed {
+		t.Error("Serve returned", e)
+	}
+	if _, e = r.ReadByte(); e == nil {
+		t.Error("Connection left open")
+	}
+	db, e = bitcesque.OpenDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	v, _ := db.Get([]byte("Harry"))
+	if v != "Wisconsin" || db.Contains([]byte("Tom")) {
+		t.Error("Writes not persisted")
+	}
+	db.Close()
+}
+
+func TestMalformedArrays(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bitcesqued")
+	defer os.RemoveAll(dir)
+	db, e := bitcesque.NewDB(filepath.Join(dir, "db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	srv := NewServer(db)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	for _, c := range []struct{ cmd, reply string }{
+		{"*-1\r\n*0\r\nPING\r\n", "+PONG\r\n"},
+		{"*-5\r\n", "-ERR Protocol error\r\n"},
+	} {
+		conn, e := net.Dial("tcp", l.Addr().String())
+		if e != nil {
+			t.Fatal(e)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte(c.cmd))
+		buf := make([]byte, len(c.reply))
+		if _, e = io.ReadFull(conn, buf); e != nil || string(buf) != c.reply {
+			t.Errorf("%q: got %q, want %q", c.cmd, buf, c.reply)
+		}
+		conn.Close()
+	}
+	//The server survived to answer
+	conn, e := net.Dial("tcp", l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("PING\r\n"))
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "+PONG\r\n" {
+		t.Error("Server not answering after malformed arrays", line)
+	}
+}
+
+// Returns a self-signed certificate for 127.0.0.1, and a pool trusting it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, e := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestAuthAndTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bitcesqued")
+	defer os.RemoveAll(dir)
+	db, e := bitcesque.NewDB(filepath.Join(dir, "db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	cert, pool := testCert(t)
+	srv := NewServerWithOptions(db, &ServerOptions{
+		Password:  "hunter2",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	//Plaintext clients fail the handshake
+	plain, _ := net.Dial("tcp", l.Addr().String())
+	plain.SetDeadline(time.Now().Add(10 * time.Second))
+	plain.Write([]byte("PING\r\n"))
+	if b, _ := bufio.NewReader(plain).ReadString('\n'); b == "+PONG\r\n" {
+		t.Error("Served without TLS")
+	}
+	plain.Close()
+
+	conn, e := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	expect := func(cmd, reply string) {
+		conn.Write([]byte(cmd))
+		buf := make([]byte, len(reply))
+		_, e := io.ReadFull(r, buf)
+		if e != nil || string(buf) != reply {
+			t.Errorf("%q: got %q, want %q", cmd, buf, reply)
+		}
+	}
+	expect("SET Tom Oregon\r\n", "-NOAUTH Authentication required.\r\n")
+	expect("AUTH hunter3\r\n", "-WRONGPASS invalid username-password pair\r\n")
+	expect("AUTH admin hunter2\r\n", "-WRONGPASS invalid username-password pair\r\n")
+	expect("GET Tom\r\n", "-NOAUTH Authentication required.\r\n")
+	expect("AUTH default hunter2\r\n", "+OK\r\n")
+	expect("SET Tom Oregon\r\nGET Tom\r\n", "+OK\r\n$6\r\nOregon\r\n")
+	expect("AUTH hunter3\r\nGET Tom\r\n", "-WRONGPASS invalid username-password pair\r\n$6\r\nOregon\r\n")
+}
+
+func TestLimits(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bitcesqued")
+	defer os.RemoveAll(dir)
+	db, e := bitcesque.NewDB(filepath.Join(dir, "db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	srv := NewServerWithOptions(db, &ServerOptions{RateLimit: 20, RateBurst: 2, MaxInflight: 1, MaxRequestSize: 16})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	//Commands past the burst are held back to the rate
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	start := time.Now()
+	conn.Write([]byte("PING\r\nPING\r\nPING\r\nPING\r\nPING\r\nPING\r\n"))
+	buf := make([]byte, 6*len("+PONG\r\n"))
+	if _, e := io.ReadFull(conn, buf); e != nil {
+		t.Fatal(e)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Error("Commands not rate limited", elapsed)
+	}
+
+	//Connections share the inflight limit without starving
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			c, _ := net.Dial("tcp", l.Addr().String())
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			c.Write([]byte("SET Tom Oregon\r\n"))
+			b := make([]byte, 5)
+			_, e := io.ReadFull(c, b)
+			done <- e == nil && string(b) == "+OK\r\n"
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if !<-done {
+			t.Error("Command failed under the inflight limit")
+		}
+	}
+
+	big, _ := net.Dial("tcp", l.Addr().String())
+	defer big.Close()
+	big.SetDeadline(time.Now().Add(10 * time.Second))
+	big.Write([]byte("*3\r\n$3\r\nSET\r\n$3\r\nTom\r\n$14\r\nWashington, DC\r\n"))
+	r := bufio.NewReader(big)
+	if line, _ := r.ReadString('\n'); line != "-ERR request too large\r\n" {
+		t.Error("Wrong reply to an oversized command: " + line)
+	}
+	if _, e := r.ReadByte(); e == nil {
+		t.Error("Connection left open after an oversized command")
+	}
+}
+
+func TestGlob(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"user:*:name", "user:12:name", true},
+		{"user:*:name", "user:12:age", false},
+	}
+	for _, c := range cases {
+		if globMatch([]byte(c.pattern), []byte(c.s)) != c.match {
+			t.Errorf("globMatch(%q, %q) != %v", c.pattern, c.s, c.match)
+		}
+	}
+	if string(globPrefix([]byte(`user\*:*`))) != "user*:" {
+		t.Error("globPrefix error")
+	}
+}
@@ -0,0 +1,78 @@
+//go:build grpc
+
+package bitcesquerpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Returns options for grpc.NewServer that reject, with Unauthenticated, any
+// call not carrying the given token as "authorization: Bearer <token>"
+// metadata, as clients dialing with WithToken do.  Serve over TLS too, or the
+// token crosses the network in the clear.
+func TokenAuth(token string) []grpc.ServerOption {
+	check := func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, given := range md.Get("authorization") {
+			if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) == 1 {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "Missing or wrong token")
+	}
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if e := check(ctx); e != nil {
+			return nil, e
+		}
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if e := check(ss.Context()); e != nil {
+			return e
+		}
+		return handler(srv, ss)
+	}
+	return []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary), grpc.ChainStreamInterceptor(stream)}
+}
+
+// Returns an option for grpc.NewServer to serve over TLS with the given
+// configuration.  Set ClientAuth and ClientCAs to require client
+// certificates.
+func TLS(config *tls.Config) grpc.ServerOption {
+	return grpc.Creds(credentials.NewTLS(config))
+}
+
+// Returns an option for grpc.NewServer to serve over TLS with the
+// certificate and key in the given PEM files.
+func TLSFromFiles(certFile, keyFile string) (grpc.ServerOption, error) {
+	creds, e := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if e != nil {
+		return nil, e
+	}
+	return grpc.Creds(creds), nil
+}
+
+// Sends a token with each call, as TokenAuth expects.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// Returns an option for grpc.NewClient that authenticates each call with the
+// given token, as TokenAuth expects.  The connection must use TLS.
+func WithToken(token string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(tokenCredentials(token))
+}
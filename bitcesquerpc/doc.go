@@ -0,0 +1,26 @@
+// Package bitcesquerpc serves a bitcesque DB over gRPC, for running it as a
+// small sidecar store.  The service is defined in bitcesque.proto.
+//
+// The protobuf and gRPC stubs are generated rather than checked in, and the
+// server depends on them and on google.golang.org/grpc, so it is only built
+// with the grpc build tag:
+//
+//	go generate github.com/bnyeggen/bitcesque/bitcesquerpc
+//	go build -tags grpc ./...
+//
+// The grpc workflow under .github does the same on each push, and runs the
+// package's tests against the generated stubs.
+//
+// Clients use the generated NewBitcesqueClient.  To require a token of
+// clients, and serve over TLS, pass TokenAuth and TLS or TLSFromFiles to
+// grpc.NewServer, and have clients dial with WithToken:
+//
+//	tlsOpt, e := bitcesquerpc.TLSFromFiles("server.pem", "server.key")
+//	srv := grpc.NewServer(append(bitcesquerpc.TokenAuth(token), tlsOpt)...)
+//	bitcesquerpc.RegisterBitcesqueServer(srv, bitcesquerpc.NewServer(db))
+//
+// Limits likewise gives options that cap each client's call rate, the calls
+// running at once and the size of requests.
+package bitcesquerpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative bitcesque.proto
@@ -0,0 +1,98 @@
+//go:build grpc
+
+package bitcesquerpc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bnyeggen/bitcesque/internal/limit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Limiters are forgotten once full, when there are more than this many.
+const maxIdleLimiters = 1024
+
+// Configures Limits.
+type LimitOptions struct {
+	// If positive, each client connection makes at most this many calls a
+	// second on average, in bursts of up to RateBurst.  Calls beyond that
+	// fail with ResourceExhausted.
+	RateLimit float64
+	RateBurst int
+	// If positive, at most this many calls run at once across all clients,
+	// so that no number of them can starve the DB's writers of its lock.
+	// Further calls wait their turn, failing if their context ends first.
+	MaxInflight int
+	// If positive, requests of more than this many bytes fail with
+	// ResourceExhausted, in place of gRPC's default of 4mb.
+	MaxRequestSize int
+}
+
+// Returns options for grpc.NewServer that impose the given limits.
+func Limits(opts LimitOptions) []grpc.ServerOption {
+	var mutex sync.Mutex
+	limiters := make(map[string]*limit.Limiter)
+	var inflight chan struct{}
+	if opts.MaxInflight > 0 {
+		inflight = make(chan struct{}, opts.MaxInflight)
+	}
+	admit := func(ctx context.Context) (func(), error) {
+		if opts.RateLimit > 0 {
+			var addr string
+			if p, present := peer.FromContext(ctx); present {
+				addr = p.Addr.String()
+			}
+			mutex.Lock()
+			l := limiters[addr]
+			if l == nil {
+				if len(limiters) >= maxIdleLimiters {
+					for a, other := range limiters {
+						if other.Full() {
+							delete(limiters, a)
+						}
+					}
+				}
+				l = limit.New(opts.RateLimit, opts.RateBurst)
+				limiters[addr] = l
+			}
+			mutex.Unlock()
+			if !l.Allow() {
+				return nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+			}
+		}
+		if inflight == nil {
+			return func() {}, nil
+		}
+		select {
+		case inflight <- struct{}{}:
+			return func() { <-inflight }, nil
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		done, e := admit(ctx)
+		if e != nil {
+			return nil, e
+		}
+		defer done()
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		done, e := admit(ss.Context())
+		if e != nil {
+			return e
+		}
+		defer done()
+		return handler(srv, ss)
+	}
+	out := []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary), grpc.ChainStreamInterceptor(stream)}
+	if opts.MaxRequestSize > 0 {
+		out = append(out, grpc.MaxRecvMsgSize(opts.MaxRequestSize))
+	}
+	return out
+}
@@ -0,0 +1,116 @@
+//go:build grpc
+
+package bitcesquerpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bnyeggen/bitcesque"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Implements the Bitcesque service over a DB.
+type Server struct {
+	UnimplementedBitcesqueServer
+	db *bitcesque.DB
+}
+
+// Returns a server for the given DB.  Closing the DB remains the caller's
+// responsibility, after the gRPC server has stopped.
+func NewServer(db *bitcesque.DB) *Server {
+	return &Server{db: db}
+}
+
+// Translates a DB error to a gRPC status.
+func toStatus(e error) error {
+	switch {
+	case e == nil:
+		return nil
+	case errors.Is(e, bitcesque.ErrKeyNotFound):
+		return status.Error(codes.NotFound, e.Error())
+	case errors.Is(e, bitcesque.ErrDatabaseClosed):
+		return status.Error(codes.Unavailable, e.Error())
+	case errors.Is(e, bitcesque.ErrKeyTooLarge), errors.Is(e, bitcesque.ErrValueTooLarge):
+		return status.Error(codes.InvalidArgument, e.Error())
+	case errors.Is(e, bitcesque.ErrCorrupt), errors.Is(e, bitcesque.ErrDecryption):
+		return status.Error(codes.DataLoss, e.Error())
+	}
+	return status.Error(codes.Internal, e.Error())
+}
+
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	v, e := s.db.Lookup(req.Key)
+	if e != nil {
+		return nil, toStatus(e)
+	}
+	return &GetResponse{Value: v}, nil
+}
+
+func (s *Server) Put(ctx context.Context, req *PutRequest) (*PutResponse, error) {
+	if len(req.Value) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Empty values are not supported")
+	}
+	var e error
+	if req.TtlMillis > 0 {
+		e = s.db.UpsertWithTTL(req.Key, req.Value, time.Duration(req.TtlMillis)*time.Millisecond)
+	} else {
+		e = s.db.Upsert(req.Key, req.Value)
+	}
+	if e != nil {
+		return nil, toStatus(e)
+	}
+	return &PutResponse{}, nil
+}
+
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if e := s.db.Remove(req.Key); e != nil {
+		return nil, toStatus(e)
+	}
+	return &DeleteResponse{}, nil
+}
+
+func (s *Server) BatchWrite(ctx context.Context, req *BatchWriteRequest) (*BatchWriteResponse, error) {
+	b := s.db.NewBatch()
+	for _, m := range req.Mutations {
+		if len(m.Value) == 0 {
+			b.Remove(m.Key)
+		} else {
+			b.Upsert(m.Key, m.Value)
+		}
+	}
+	if e := b.Commit(); e != nil {
+		return nil, toStatus(e)
+	}
+	return &BatchWriteResponse{}, nil
+}
+
+func (s *Server) Scan(req *ScanRequest, stream Bitcesque_ScanServer) error {
+	var it *bitcesque.Iterator
+	if len(req.Start) > 0 || len(req.End) > 0 {
+		var end []byte
+		if len(req.End) > 0 {
+			end = req.End
+		}
+		it = s.db.RangeScan(req.Start, end)
+	} else {
+		it = s.db.Scan(req.Prefix)
+	}
+	defer it.Close()
+	sent := uint32(0)
+	for it.Next() {
+		if req.Limit > 0 && sent == req.Limit {
+			break
+		}
+		if e := stream.Context().Err(); e != nil {
+			return status.FromContextError(e).Err()
+		}
+		if e := stream.Send(&KeyValue{Key: it.Key(), Value: it.Value()}); e != nil {
+			return e
+		}
+		sent++
+	}
+	return toStatus(it.Err())
+}
@@ -0,0 +1,100 @@
+//go:build grpc
+
+package bitcesquerpc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bnyeggen/bitcesque"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestServer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bitcesquerpc")
+	defer os.RemoveAll(dir)
+	db, e := bitcesque.NewDBWithOptions(filepath.Join(dir, "db"), &bitcesque.Options{OrderedIndex: true})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	RegisterBitcesqueServer(srv, NewServer(db))
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn, e := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	c := NewBitcesqueClient(conn)
+	ctx := context.Background()
+
+	if _, e = c.Put(ctx, &PutRequest{Key: []byte("user:Tom"), Value: []byte("Oregon")}); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = c.Put(ctx, &PutRequest{Key: []byte("Empty")}); status.Code(e) != codes.InvalidArgument {
+		t.Error("Empty value accepted", e)
+	}
+	if resp, e := c.Get(ctx, &GetRequest{Key: []byte("user:Tom")}); e != nil || string(resp.Value) != "Oregon" {
+		t.Error("Get error", resp, e)
+	}
+	if _, e = c.Get(ctx, &GetRequest{Key: []byte("Nobody")}); status.Code(e) != codes.NotFound {
+		t.Error("Absent key found", e)
+	}
+	_, e = c.BatchWrite(ctx, &BatchWriteRequest{Mutations: []*Mutation{
+		{Key: []byte("user:Dick"), Value: []byte("Maine")},
+		{Key: []byte("user:Harry"), Value: []byte("Ohio")},
+		{Key: []byte("user:Tom")},
+	}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = c.Delete(ctx, &DeleteRequest{Key: []byte("user:Harry")}); e != nil {
+		t.Error(e)
+	}
+	if db.Contains([]byte("user:Tom")) || db.Contains([]byte("user:Harry")) {
+		t.Error("Keys not removed")
+	}
+
+	db.Upsert([]byte("user:Sally"), []byte("Texas"))
+	scan := func(req *ScanRequest) []string {
+		stream, e := c.Scan(ctx, req)
+		if e != nil {
+			t.Fatal(e)
+		}
+		var out []string
+		for {
+			kv, e := stream.Recv()
+			if e == io.EOF {
+				return out
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+			out = append(out, string(kv.Key)+"="+string(kv.Value))
+		}
+	}
+	if got := scan(&ScanRequest{Prefix: []byte("user:")}); len(got) != 2 || got[0] != "user:Dick=Maine" || got[1] != "user:Sally=Texas" {
+		t.Error("Scan error", got)
+	}
+	if got := scan(&ScanRequest{Prefix: []byte("user:"), Limit: 1}); len(got) != 1 || got[0] != "user:Dick=Maine" {
+		t.Error("Scan with limit error", got)
+	}
+	if got := scan(&ScanRequest{Start: []byte("user:E")}); len(got) != 1 || got[0] != "user:Sally=Texas" {
+		t.Error("Range scan error", got)
+	}
+}
@@ -0,0 +1,264 @@
+package bitcesque
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// A filter file holds the Bloom filter of a sealed segment, written
+// alongside its hint file.  After the header come the id, tag and size of the
+// segment, 16 bytes as for keyfile marks, then a count of the filter's
+// parts, each given as its number of 64 bit words, capacity and keys added,
+// 4 bytes apiece, followed by the words, and a trailer as for keyfiles.
+const filterMagic = "BCSF"
+
+const (
+	// Bits set per key, giving about a 1% false positive rate at bloomBits
+	// bits per key.
+	bloomHashes = 7
+	bloomBits   = 10
+	// Keys the first part of a growing filter holds.
+	minBloomKeys = 1024
+)
+
+// Returns where the filter file for the given segment is kept.
+func filterPath(location string, id uint32) string {
+	return segmentPath(location, id) + ".filter"
+}
+
+// A Bloom filter sized for a fixed number of keys.
+type bloom struct {
+	words    []uint64
+	capacity uint32
+	n        uint32 //Keys added
+}
+
+func newBloom(capacity int) *bloom {
+	capacity = max(capacity, 1)
+	return &bloom{make([]uint64, (capacity*bloomBits+63)/64), uint32(capacity), 0}
+}
+
+// Returns the 64 bit FNV-1a hash of the given key, which the filters split
+// into two for double hashing.  Filters are kept on disk, so the hash must
+// not vary between processes.
+func bloomHash[K string | []byte](k K) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(k); i++ {
+		h ^= uint64(k[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (b *bloom) add(h uint64) {
+	m := uint32(len(b.words) * 64)
+	for i, h1, h2 := uint32(0), uint32(h), uint32(h>>32)|1; i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		b.words[bit/64] |= 1 << (bit % 64)
+	}
+	b.n++
+}
+
+// Returns false if the key with the given hash was never added.
+func (b *bloom) mayContain(h uint64) bool {
+	m := uint32(len(b.words) * 64)
+	for i, h1, h2 := uint32(0), uint32(h), uint32(h>>32)|1; i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		if b.words[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The keys written to a segment, as a Bloom filter that grows by adding
+// parts, each twice the size of the last, as earlier ones fill up.
+type keyFilter struct {
+	parts []*bloom
+}
+
+func (f *keyFilter) add(h uint64) {
+	last := len(f.parts) - 1
+	if last < 0 || f.parts[last].n >= f.parts[last].capacity {
+		capacity := minBloomKeys
+		if last >= 0 {
+			capacity = 2 * int(f.parts[last].capacity)
+		}
+		f.parts = append(f.parts, newBloom(capacity))
+		last++
+	}
+	f.parts[last].add(h)
+}
+
+func (f *keyFilter) mayContain(h uint64) bool {
+	for _, b := range f.parts {
+		if b.mayContain(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the given key may be in the index, by the filters of the
+// segments it could point into.
+func (d *DB) mayContain(k []byte) bool {
+	h := bloomHash(k)
+	for _, f := range d.filters {
+		if f.mayContain(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the index entry for the given key, and whether it has one.  Where
+// filters are kept, keys they rule out aren't looked for in the index, sparing
+// a disk index the reads.  Counts as a use of the key for EvictLRU.
+func (d *DB) lookup(k []byte) (offsetAndLength, bool) {
+	if d.filters != nil && !d.mayContain(k) {
+		return offsetAndLength{}, false
+	}
+	oal, present := d.kToPos.lookup(k)
+	if present && d.evictions != nil {
+		d.evictions.read(k)
+	}
+	return oal, present
+}
+
+// Adds the given key to the filter of the given segment, if filters are kept.
+// Assumes the write lock is held.
+func (d *DB) filterKey(k string, id uint32) {
+	if d.filters == nil {
+		return
+	}
+	f := d.filters[id]
+	if f == nil {
+		f = &keyFilter{}
+		d.filters[id] = f
+	}
+	f.add(bloomHash(k))
+}
+
+// Replaces the filters of the given segments with ones sized to hold the keys
+// the index points into them.  Assumes the write lock is held.
+func (d *DB) rebuildFilters(ids []uint32) {
+	if d.filters == nil {
+		return
+	}
+	counts := make(map[uint32]int, len(ids))
+	for _, id := range ids {
+		counts[id] = 0
+	}
+	for _, oal := range d.kToPos.all() {
+		if n, present := counts[oal.segment]; present {
+			counts[oal.segment] = n + 1
+		}
+	}
+	for id, n := range counts {
+		d.filters[id] = &keyFilter{[]*bloom{newBloom(max(n, minBloomKeys))}}
+	}
+	for k, oal := range d.kToPos.all() {
+		if _, present := counts[oal.segment]; present {
+			d.filters[oal.segment].add(bloomHash(k))
+		}
+	}
+}
+
+// Starts keeping filters, if the options call for them, loading those of
+// sealed segments from their files where fresh and building the rest.
+// Assumes the write lock is held, or that the DB isn't yet shared.
+func (d *DB) loadFilters() {
+	if !d.opts.DiskIndex || d.snapshot {
+		return
+	}
+	d.filters = make(map[uint32]*keyFilter)
+	ids := []uint32{d.activeID}
+	for id, seg := range d.sealed {
+		if f, e := readFilter(d.location, seg); e == nil {
+			d.filters[id] = f
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	d.rebuildFilters(ids)
+}
+
+// Returns the contents of a filter file for the given sealed segment.
+// Assumes at least a read lock is held.
+func (d *DB) encodeFilter(seg *segment) []byte {
+	f := d.filters[seg.id]
+	buf := fileHeader(filterMagic)
+	mark := make([]byte, markSize+4)
+	uint32ToBytes(mark, 0, seg.id)
+	tag := fileTag(seg.filebuffer, seg.size)
+	mark[4], mark[5] = byte(tag), byte(tag>>8)
+	uint64ToBytes(mark, 8, seg.size)
+	uint32ToBytes(mark, markSize, uint32(len(f.parts)))
+	buf = append(buf, mark...)
+	for _, b := range f.parts {
+		part := make([]byte, 12+8*len(b.words))
+		uint32ToBytes(part, 0, uint32(len(b.words)))
+		uint32ToBytes(part, 4, b.capacity)
+		uint32ToBytes(part, 8, b.n)
+		for i, w := range b.words {
+			uint64ToBytes(part, uint64(12+8*i), w)
+		}
+		buf = append(buf, part...)
+	}
+	trailer := make([]byte, trailerSize)
+	uint32ToBytes(trailer, 0, uint32(len(buf)-headerSize))
+	buf = append(buf, trailer[:4]...)
+	uint32ToBytes(trailer, 4, crc32.Checksum(buf, crcTable))
+	return append(buf, trailer[4:]...)
+}
+
+// Returns the filter recorded by the filter file for the given segment, or
+// an error if there is none or it is stale or damaged.
+func readFilter(location string, seg *segment) (*keyFilter, error) {
+	buf, e := os.ReadFile(filterPath(location, seg.id))
+	if e != nil {
+		return nil, e
+	}
+	pos, e := checkHeader(buf, uint64(len(buf)), filterMagic)
+	if e == nil && pos != headerSize {
+		e = fmt.Errorf("%w in filter file: no header", ErrCorrupt)
+	}
+	var body []byte
+	if e == nil {
+		body, e = checkTrailer(buf)
+	}
+	if e == nil && len(body) < markSize+4 {
+		e = fmt.Errorf("%w in filter file: truncated", ErrCorrupt)
+	}
+	if e != nil {
+		return nil, e
+	}
+	tag := uint16(body[4]) | uint16(body[5])<<8
+	if dataStart(seg.filebuffer, seg.size) != headerSize || uint32FromBytes(body, 0) != seg.id || tag != fileTag(seg.filebuffer, seg.size) || uint64FromBytes(body, 8) != seg.size {
+		return nil, fmt.Errorf("%w in filter file: stale", ErrCorrupt)
+	}
+	parts := uint64(uint32FromBytes(body, markSize))
+	if parts > uint64(len(body))/12 {
+		return nil, fmt.Errorf("%w in filter file: truncated", ErrCorrupt)
+	}
+	f := &keyFilter{make([]*bloom, parts)}
+	pos = markSize + 4
+	for i := range f.parts {
+		if uint64(len(body)) < pos+12 {
+			return nil, fmt.Errorf("%w in filter file: truncated", ErrCorrupt)
+		}
+		words := uint64(uint32FromBytes(body, pos))
+		if words == 0 || uint64(len(body))-pos-12 < 8*words {
+			return nil, fmt.Errorf("%w in filter file: truncated", ErrCorrupt)
+		}
+		b := &bloom{make([]uint64, words), uint32FromBytes(body, pos+4), uint32FromBytes(body, pos+8)}
+		pos += 12
+		for j := range b.words {
+			b.words[j] = uint64FromBytes(body, pos)
+			pos += 8
+		}
+		f.parts[i] = b
+	}
+	return f, nil
+}
@@ -0,0 +1,115 @@
+package bitcesque
+
+import (
+	"iter"
+	"strings"
+	"time"
+)
+
+// A namespace within a DB, whose keys are stored with a prefix derived from
+// its name.  The prefix escapes any zero bytes in the name and ends in a zero
+// byte followed by a one, so no bucket's keys can collide with another's, and
+// buckets sort by name.  Keys written to the DB directly share the keyspace,
+// so should not start with a zero byte if buckets are in use.
+type Bucket struct {
+	db     *DB
+	name   string
+	prefix []byte
+}
+
+// Returns a handle on the bucket with the given name.  Buckets need no
+// creating; one exists as long as it holds keys.
+func (d *DB) Bucket(name string) *Bucket {
+	escaped := strings.ReplaceAll(name, "\x00", "\x00\xff")
+	return &Bucket{d, name, []byte("\x00" + escaped + "\x00\x01")}
+}
+
+// Returns the name the bucket was opened with.
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// Returns the key as stored in the DB.
+func (b *Bucket) key(k []byte) []byte {
+	return append(append(make([]byte, 0, len(b.prefix)+len(k)), b.prefix...), k...)
+}
+
+// As DB.Get, within the bucket.
+func (b *Bucket) Get(k []byte) (string, bool) {
+	return b.db.Get(b.key(k))
+}
+
+// As DB.Lookup, within the bucket.
+func (b *Bucket) Lookup(k []byte) ([]byte, error) {
+	return b.db.Lookup(b.key(k))
+}
+
+// As DB.Contains, within the bucket.
+func (b *Bucket) Contains(k []byte) bool {
+	return b.db.Contains(b.key(k))
+}
+
+// As DB.Upsert, within the bucket.
+func (b *Bucket) Upsert(k, v []byte) error {
+	return b.db.Upsert(b.key(k), v)
+}
+
+// As DB.UpsertWithTTL, within the bucket.
+func (b *Bucket) UpsertWithTTL(k, v []byte, ttl time.Duration) error {
+	return b.db.UpsertWithTTL(b.key(k), v, ttl)
+}
+
+// As DB.UpsertWithFlags, within the bucket.
+func (b *Bucket) UpsertWithFlags(k, v []byte, flags uint8) error {
+	return b.db.UpsertWithFlags(b.key(k), v, flags)
+}
+
+// As DB.Remove, within the bucket.
+func (b *Bucket) Remove(k []byte) error {
+	return b.db.Remove(b.key(k))
+}
+
+// Returns an iterator over the bucket's keys starting with the given prefix,
+// in ascending order.  Keys are returned without the bucket's prefix.
+func (b *Bucket) Scan(prefix []byte) *Iterator {
+	it := b.db.Scan(b.key(prefix))
+	it.trim = len(b.prefix)
+	return it
+}
+
+// Returns every live pair in the bucket in ascending key order, as DB.All.
+func (b *Bucket) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		b.Scan(nil).All()(yield)
+	}
+}
+
+// Removes every key in the bucket, returning how many there were.
+func (b *Bucket) Clear() (int, error) {
+	return b.db.RemovePrefix(b.prefix)
+}
+
+// Statistics about a bucket.
+type BucketStats struct {
+	// Number of live keys.
+	Keys int
+	// Bytes taken up by their current records.
+	LiveBytes uint64
+}
+
+// Returns statistics about the bucket.
+func (b *Bucket) Stats() BucketStats {
+	d := b.db
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	var out BucketStats
+	t := now()
+	for _, k := range d.keysInRange(string(b.prefix), prefixEnd(b.prefix)) {
+		if !d.expired(k, t) {
+			out.Keys++
+			oal, _ := d.kToPos.get(k)
+			out.LiveBytes += oal.docSize()
+		}
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package bitcesque
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Bytes each cached value is charged on top of its length, for its entry.
+const cacheEntryOverhead = 64
+
+// Where a cached value is stored.
+type cacheKey struct {
+	segment uint32
+	offset  uint64
+}
+
+type cacheEntry struct {
+	key cacheKey
+	v   []byte
+}
+
+// A cache of values read, keyed by where they are stored, that forgets the
+// least recently used once over its size in bytes.  Safe for concurrent use,
+// so that readers holding only a read lock can share it.
+type valueCache struct {
+	mutex   sync.Mutex
+	limit   int
+	size    int
+	entries map[cacheKey]*list.Element
+	order   *list.List //Most recently used first
+	hits    uint64
+	misses  uint64
+}
+
+func newValueCache(limit int) *valueCache {
+	return &valueCache{limit: limit, entries: make(map[cacheKey]*list.Element), order: list.New()}
+}
+
+// Returns the cached value at the given position, and whether there is one.
+// The value must not be modified.
+func (c *valueCache) get(segment uint32, offset uint64) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el, present := c.entries[cacheKey{segment, offset}]
+	if !present {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).v, true
+}
+
+// Caches the value at the given position, which the cache then owns, evicting
+// others as need be.  Values too large to fit aren't cached.
+func (c *valueCache) put(segment uint32, offset uint64, v []byte) {
+	cost := len(v) + cacheEntryOverhead
+	if cost > c.limit {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	k := cacheKey{segment, offset}
+	if el, present := c.entries[k]; present {
+		c.remove(el)
+	}
+	c.entries[k] = c.order.PushFront(&cacheEntry{k, v})
+	c.size += cost
+	for c.size > c.limit {
+		c.remove(c.order.Back())
+	}
+}
+
+// Forgets the given entry.  Assumes the cache's mutex is held.
+func (c *valueCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.v) + cacheEntryOverhead
+}
+
+// Forgets the values cached from the given segments, as they have been
+// rewritten.
+func (c *valueCache) purge(ids []uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	purged := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		purged[id] = true
+	}
+	for k, el := range c.entries {
+		if purged[k.segment] {
+			c.remove(el)
+		}
+	}
+}
+
+// Forgets every cached value.
+func (c *valueCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.order.Init()
+	c.size = 0
+}
+
+// Returns how many lookups found a value, how many didn't, and the bytes
+// cached.
+func (c *valueCache) stats() (hits, misses uint64, size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.misses, c.size
+}
+
+// Returns whether the value oal points to goes through the cache, rather than
+// being read straight from a mapping each time.
+func (d *DB) cacheable(oal offsetAndLength) bool {
+	return d.cache != nil && (d.opts.NoMmap || oal.compressed() || oal.format&(encryptedFlag>>24) != 0)
+}
@@ -0,0 +1,216 @@
+package bitcesque
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hash/crc64"
+	"math/bits"
+)
+
+// The algorithm each document and batch frame is checked with, chosen when a
+// DB is created and recorded in the header of each of its data files.  A 64
+// bit checksum doesn't fit the 4 byte field leading each document, so its
+// upper half follows the value length, marked by wideChecksumFlag.
+type Checksum uint8
+
+const (
+	// CRC-32 with the Castagnoli polynomial, computed in hardware on most
+	// CPUs.  The default, and the only choice for files written before there
+	// was one.
+	CRC32C Checksum = iota
+	// The 64 bit xxHash, faster than CRC32C where that isn't computed in
+	// hardware, and far less likely to miss damage to large values.
+	XXHash64
+	// CRC-64 with the ECMA polynomial, slower than either, but detecting
+	// every burst of errors up to 64 bits long.
+	CRC64
+)
+
+// Marks a document, or batch frame, whose checksum has a second 4 byte field
+// after the value length.
+const wideChecksumFlag = 1 << 25
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+func (c Checksum) String() string {
+	switch c {
+	case CRC32C:
+		return "CRC32C"
+	case XXHash64:
+		return "XXHash64"
+	case CRC64:
+		return "CRC64"
+	}
+	return "unknown checksum"
+}
+
+// Returns the DB's options, but with the checksum its data files record, for
+// creating DBs its documents are to be copied into as they are stored.
+func (d *DB) copyOptions() *Options {
+	opts := d.opts
+	opts.Checksum = d.sum
+	return &opts
+}
+
+// Returns the flags documents checked with the algorithm carry.
+func (c Checksum) flags() uint32 {
+	if c == CRC32C {
+		return 0
+	}
+	return wideChecksumFlag
+}
+
+// Returns a digest fed the header of a document or batch frame, that is all
+// that precedes its value, ready for the value.  The checksum's own fields
+// are left out.
+func (c Checksum) begin(head []byte) digest {
+	g := digest{c: c}
+	if c == XXHash64 {
+		g.xx.reset()
+	}
+	g.write(head[4:12])
+	g.write(head[docPrefix(c.flags(), 0):])
+	return g
+}
+
+// Returns the checksum of the document or batch frame with the given header
+// and value.
+func (c Checksum) document(head, value []byte) uint64 {
+	g := c.begin(head)
+	g.write(value)
+	return g.sum()
+}
+
+// Fills in the checksum fields of the given header.
+func (c Checksum) store(head []byte, sum uint64) {
+	uint32ToBytes(head, 0, uint32(sum))
+	if c != CRC32C {
+		uint32ToBytes(head, 12, uint32(sum>>32))
+	}
+}
+
+// Returns the checksum recorded in the fields of the given header.
+func (c Checksum) stored(head []byte) uint64 {
+	sum := uint64(uint32FromBytes(head, 0))
+	if c != CRC32C {
+		sum |= uint64(uint32FromBytes(head, 12)) << 32
+	}
+	return sum
+}
+
+// Accumulates a checksum over bytes passed a piece at a time.
+type digest struct {
+	c   Checksum
+	crc uint64 //Running CRC, of either width
+	xx  xxh64
+}
+
+func (g *digest) write(p []byte) {
+	switch g.c {
+	case XXHash64:
+		g.xx.write(p)
+	case CRC64:
+		g.crc = crc64.Update(g.crc, crc64Table, p)
+	default:
+		g.crc = uint64(crc32.Update(uint32(g.crc), crcTable, p))
+	}
+}
+
+func (g *digest) sum() uint64 {
+	if g.c == XXHash64 {
+		return g.xx.sum()
+	}
+	return g.crc
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// The state of a 64 bit xxHash with a seed of zero, over bytes passed a piece
+// at a time.
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	mem   [32]byte //Bytes left over from the last whole stripe
+	n     int
+}
+
+func (x *xxh64) reset() {
+	x.v = [4]uint64{xxPrime1, xxPrime2, 0, 0}
+	x.v[0] += xxPrime2
+	x.v[3] -= xxPrime1
+	x.total, x.n = 0, 0
+}
+
+func xxRound(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*xxPrime2, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	return (acc^xxRound(0, v))*xxPrime1 + xxPrime4
+}
+
+// Consumes 32 byte stripes of p.
+func (x *xxh64) stripes(p []byte) {
+	for ; len(p) >= 32; p = p[32:] {
+		for i := range x.v {
+			x.v[i] = xxRound(x.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+		}
+	}
+}
+
+func (x *xxh64) write(p []byte) {
+	x.total += uint64(len(p))
+	if x.n > 0 {
+		c := copy(x.mem[x.n:], p)
+		x.n += c
+		p = p[c:]
+		if x.n < 32 {
+			return
+		}
+		x.stripes(x.mem[:])
+		x.n = 0
+	}
+	whole := len(p) &^ 31
+	x.stripes(p[:whole])
+	x.n = copy(x.mem[:], p[whole:])
+}
+
+func (x *xxh64) sum() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v[0], 1) + bits.RotateLeft64(x.v[1], 7) + bits.RotateLeft64(x.v[2], 12) + bits.RotateLeft64(x.v[3], 18)
+		for _, v := range x.v {
+			h = xxMerge(h, v)
+		}
+	} else {
+		h = x.v[2] + xxPrime5
+	}
+	h += x.total
+	p := x.mem[:x.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,270 @@
+// Command bitcesque inspects and edits a bitcesque DB from the shell.
+//
+//	bitcesque get <db> <key>
+//	bitcesque put [-ttl duration] <db> <key> <value | ->
+//	bitcesque del <db> <key>...
+//	bitcesque keys <db> [prefix]
+//	bitcesque dump <db> [prefix]
+//	bitcesque verify <db>
+//	bitcesque repair <db>
+//	bitcesque compact <db>
+//	bitcesque stats <db>
+//
+// put reads the value from standard input if it is given as -, and creates
+// the DB if there is none.  dump prints tab-separated pairs, quoting keys and
+// values that aren't printable.  The DB must not be open elsewhere.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+type command struct {
+	args string //Usage of the positional arguments
+	run  func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]command{
+	"get":     {"<db> <key>", get},
+	"put":     {"[-ttl duration] <db> <key> <value | ->", put},
+	"del":     {"<db> <key>...", del},
+	"keys":    {"<db> [prefix]", keys},
+	"dump":    {"<db> [prefix]", dump},
+	"verify":  {"<db>", verify},
+	"repair":  {"<db>", repair},
+	"compact": {"<db>", compact},
+	"stats":   {"<db>", stats},
+}
+
+var errUsage = errors.New("usage")
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, known := commands[os.Args[1]]
+	if !known {
+		usage()
+	}
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: bitcesque %s %s\n", os.Args[1], cmd.args)
+		fs.PrintDefaults()
+	}
+	e := cmd.run(fs, os.Args[2:])
+	if e == errUsage {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "bitcesque:", e)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: bitcesque <command> [arguments]\n\ncommands:")
+	for _, name := range []string{"get", "put", "del", "keys", "dump", "verify", "repair", "compact", "stats"} {
+		fmt.Fprintf(os.Stderr, "\t%s %s\n", name, commands[name].args)
+	}
+	os.Exit(2)
+}
+
+// Opens the existing DB at location, verifying it if it wasn't closed
+// cleanly, or creates one there if create is set.
+func open(location string, create bool) (*bitcesque.DB, error) {
+	if _, e := os.Stat(location); os.IsNotExist(e) {
+		if create {
+			return bitcesque.NewDB(location)
+		}
+		return nil, errors.New("no DB at " + location)
+	}
+	if _, e := os.Stat(location + ".keys"); e == nil {
+		return bitcesque.OpenDB(location)
+	}
+	return bitcesque.OpenAndVerifyDB(location)
+}
+
+// Parses flags, checks the positional argument count is within the given
+// bounds (max < 0 for none), and opens the DB named by the first.
+func setup(fs *flag.FlagSet, args []string, min, max int, create bool) (*bitcesque.DB, []string, error) {
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return nil, nil, errUsage
+	}
+	db, e := open(args[0], create)
+	return db, args[1:], e
+}
+
+// Closes the DB, returning the first of e and any error closing it.
+func finish(db *bitcesque.DB, e error) error {
+	closeErr := db.Close()
+	if e == nil {
+		e = closeErr
+	}
+	return e
+}
+
+func get(fs *flag.FlagSet, args []string) error {
+	db, args, e := setup(fs, args, 2, 2, false)
+	if e != nil {
+		return e
+	}
+	v, e := db.Lookup([]byte(args[0]))
+	if e == nil {
+		os.Stdout.Write(v)
+		fmt.Println()
+	}
+	return finish(db, e)
+}
+
+func put(fs *flag.FlagSet, args []string) error {
+	ttl := fs.Duration("ttl", 0, "Expire the key after this long")
+	db, args, e := setup(fs, args, 3, 3, true)
+	if e != nil {
+		return e
+	}
+	v := []byte(args[1])
+	if args[1] == "-" {
+		v, e = ioutil.ReadAll(os.Stdin)
+		if e != nil {
+			return finish(db, e)
+		}
+	}
+	if len(v) == 0 {
+		return finish(db, errors.New("empty values are not supported"))
+	}
+	if *ttl > 0 {
+		e = db.UpsertWithTTL([]byte(args[0]), v, *ttl)
+	} else {
+		e = db.Upsert([]byte(args[0]), v)
+	}
+	return finish(db, e)
+}
+
+func del(fs *flag.FlagSet, args []string) error {
+	db, args, e := setup(fs, args, 2, -1, false)
+	if e != nil {
+		return e
+	}
+	for _, k := range args {
+		if e = db.Remove([]byte(k)); e != nil {
+			break
+		}
+	}
+	return finish(db, e)
+}
+
+func keys(fs *flag.FlagSet, args []string) error {
+	db, args, e := setup(fs, args, 1, 2, false)
+	if e != nil {
+		return e
+	}
+	var prefix []byte
+	if len(args) > 0 {
+		prefix = []byte(args[0])
+	}
+	it := db.Scan(prefix)
+	for it.Next() {
+		fmt.Println(quote(it.Key()))
+	}
+	return finish(db, it.Err())
+}
+
+func dump(fs *flag.FlagSet, args []string) error {
+	db, args, e := setup(fs, args, 1, 2, false)
+	if e != nil {
+		return e
+	}
+	var prefix []byte
+	if len(args) > 0 {
+		prefix = []byte(args[0])
+	}
+	it := db.Scan(prefix)
+	for it.Next() {
+		fmt.Printf("%s\t%s\n", quote(it.Key()), quote(it.Value()))
+	}
+	return finish(db, it.Err())
+}
+
+func verify(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	db, e := bitcesque.OpenAndVerifyDB(fs.Arg(0))
+	if db == nil {
+		return e
+	}
+	if e == nil {
+		fmt.Printf("OK: %d keys\n", db.Size())
+	}
+	return finish(db, e)
+}
+
+func repair(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	report, e := bitcesque.RepairDB(fs.Arg(0))
+	for _, r := range report.Dropped {
+		fmt.Printf("dropped\t%d bytes at %d of segment %d\n", r.Length, r.Offset, r.Segment)
+	}
+	if e == nil {
+		fmt.Printf("OK: kept %d records, dropped %d bytes\n", report.Records, report.BytesDropped)
+	}
+	return e
+}
+
+func compact(fs *flag.FlagSet, args []string) error {
+	db, _, e := setup(fs, args, 1, 1, false)
+	if e != nil {
+		return e
+	}
+	before := db.DeadRatio()
+	e = db.Consolidate()
+	if e == nil {
+		fmt.Printf("Reclaimed %.1f%% of the DB\n", before*100)
+	}
+	return finish(db, e)
+}
+
+func stats(fs *flag.FlagSet, args []string) error {
+	db, _, e := setup(fs, args, 1, 1, false)
+	if e != nil {
+		return e
+	}
+	st := db.Stats()
+	fmt.Printf("keys\t%d\n", st.Keys)
+	fmt.Printf("segments\t%d\n", st.Segments)
+	fmt.Printf("bytes\t%d\n", st.FileSize)
+	fmt.Printf("live\t%d\n", st.LiveBytes)
+	fmt.Printf("dead\t%d (%.1f%%)\n", st.DeadBytes, db.DeadRatio()*100)
+	fmt.Printf("tombstones\t%d\n", st.Tombstones)
+	return finish(db, nil)
+}
+
+// Returns b as is if it is printable text without tabs, or else quoted Go
+// style.
+func quote(b []byte) string {
+	if !utf8.Valid(b) {
+		return strconv.Quote(string(b))
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) || r == '"' {
+			return strconv.Quote(string(b))
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Set in the environment of the test binary when it is run as the command.
+const asCommand = "BITCESQUE_TEST_AS_COMMAND"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(asCommand) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Runs the command with the given arguments and standard input, returning
+// its standard output and error and its exit code.
+func run(t *testing.T, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), asCommand+"=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	e := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(e, &exit) {
+		return stdout.String(), stderr.String(), exit.ExitCode()
+	}
+	if e != nil {
+		t.Fatal(e)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+func TestCommands(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bitcesque")
+	defer os.RemoveAll(dir)
+	db := filepath.Join(dir, "db")
+
+	if _, stderr, code := run(t, "", "get", db, "Tom"); code != 1 || !strings.Contains(stderr, "no DB at") {
+		t.Error("Get from missing DB error", code, stderr)
+	}
+	for _, kv := range [][]string{{"user:Tom", "Oregon"}, {"user:Dick", "Maine"}, {"Harry", "Ohio"}} {
+		if _, stderr, code := run(t, "", "put", db, kv[0], kv[1]); code != 0 {
+			t.Fatal("Put error", code, stderr)
+		}
+	}
+	if _, _, code := run(t, "Texas", "put", db, "Sally", "-"); code != 0 {
+		t.Error("Put from standard input error", code)
+	}
+	if _, stderr, code := run(t, "", "put", db, "Empty", "-"); code != 1 || !strings.Contains(stderr, "empty values") {
+		t.Error("Empty value accepted", code, stderr)
+	}
+	if stdout, _, code := run(t, "", "get", db, "user:Tom"); code != 0 || stdout != "Oregon\n" {
+		t.Error("Get error", code, stdout)
+	}
+	if stdout, _, code := run(t, "", "get", db, "Sally"); code != 0 || stdout != "Texas\n" {
+		t.Error("Get of value from standard input error", code, stdout)
+	}
+	if _, stderr, code := run(t, "", "get", db, "Nobody"); code != 1 || !strings.Contains(stderr, "Key not found") {
+		t.Error("Get of absent key error", code, stderr)
+	}
+	if stdout, _, code := run(t, "", "keys", db); code != 0 || stdout != "Harry\nSally\nuser:Dick\nuser:Tom\n" {
+		t.Error("Keys error", code, stdout)
+	}
+	if stdout, _, code := run(t, "", "keys", db, "user:"); code != 0 || stdout != "user:Dick\nuser:Tom\n" {
+		t.Error("Keys with prefix error", code, stdout)
+	}
+	if _, _, code := run(t, "", "del", db, "user:Tom", "Sally"); code != 0 {
+		t.Error("Del error", code)
+	}
+	if _, _, code := run(t, "", "get", db, "user:Tom"); code != 1 {
+		t.Error("Deleted key still present", code)
+	}
+	if stdout, _, code := run(t, "", "keys", db); code != 0 || stdout != "Harry\nuser:Dick\n" {
+		t.Error("Keys after del error", code, stdout)
+	}
+	if stdout, _, code := run(t, "", "dump", db, "user:"); code != 0 || stdout != "user:Dick\tMaine\n" {
+		t.Error("Dump error", code, stdout)
+	}
+
+	if _, stderr, code := run(t, "", "get", db); code != 2 || !strings.Contains(stderr, "usage: bitcesque get") {
+		t.Error("Missing argument not reported", code, stderr)
+	}
+	if _, stderr, code := run(t, "", "frobnicate"); code != 2 || !strings.Contains(stderr, "commands:") {
+		t.Error("Unknown command not reported", code, stderr)
+	}
+}
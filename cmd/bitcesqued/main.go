@@ -0,0 +1,75 @@
+// Command bitcesqued serves a bitcesque DB over the Redis protocol.
+//
+//	bitcesqued -db /path/to/data [-addr :6379] [-tls-cert cert.pem -tls-key key.pem]
+//
+// If BITCESQUED_PASSWORD is set in the environment, clients must AUTH with
+// it, and with -tls-cert and -tls-key, connections are served over TLS.  The
+// DB is created if absent.  On SIGINT or SIGTERM the server stops
+// accepting connections, finishes in-flight commands and closes the DB, so
+// the keyfile is written and the next start is fast.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bnyeggen/bitcesque"
+	"github.com/bnyeggen/bitcesque/bitcesqued"
+)
+
+func main() {
+	addr := flag.String("addr", ":6379", "TCP address to listen on")
+	location := flag.String("db", "", "Path of the DB to serve")
+	certFile := flag.String("tls-cert", "", "PEM certificate to serve TLS with")
+	keyFile := flag.String("tls-key", "", "PEM key for -tls-cert")
+	flag.Parse()
+	if *location == "" || (*certFile == "") != (*keyFile == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	db, e := open(*location)
+	if e != nil {
+		log.Fatal(e)
+	}
+	srv := bitcesqued.NewServerWithOptions(db, &bitcesqued.ServerOptions{Password: os.Getenv("BITCESQUED_PASSWORD")})
+
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if e := srv.Shutdown(ctx); e != nil {
+			log.Print(e)
+		}
+		close(done)
+	}()
+	if *certFile != "" {
+		e = srv.ListenAndServeTLS(*addr, *certFile, *keyFile)
+	} else {
+		e = srv.ListenAndServe(*addr)
+	}
+	if e != bitcesqued.ErrServerClosed {
+		db.Close()
+		log.Fatal(e)
+	}
+	<-done
+}
+
+// Opens the DB at location, creating it if there is nothing there, and
+// verifying it if it wasn't closed cleanly.
+func open(location string) (*bitcesque.DB, error) {
+	if _, e := os.Stat(location); os.IsNotExist(e) {
+		return bitcesque.NewDB(location)
+	}
+	if _, e := os.Stat(location + ".keys"); e == nil {
+		return bitcesque.OpenDB(location)
+	}
+	return bitcesque.OpenAndVerifyDB(location)
+}
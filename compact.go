@@ -0,0 +1,213 @@
+package bitcesque
+
+import (
+	"time"
+)
+
+// Removes the given key's current record, if any, from the live byte count.
+// Assumes the write lock is held.
+func (d *DB) forget(k string) {
+	if oal, present := d.kToPos.get(k); present {
+		d.liveBytes[oal.segment] -= oal.docSize()
+	}
+}
+
+// Recomputes the live byte counts from the index.  File headers count as
+// live, since compaction can't reclaim them, as do tombstones it kept.  Assumes the write lock is held,
+// or that the DB is not yet shared.
+func (d *DB) recountLiveBytes() {
+	d.liveBytes = make(map[uint32]uint64, len(d.sealed)+1)
+	d.liveBytes[d.activeID] = dataStart(d.filebuffer, d.filledSize)
+	for id, s := range d.sealed {
+		d.liveBytes[id] = dataStart(s.filebuffer, s.size)
+	}
+	for _, oal := range d.kToPos.all() {
+		d.liveBytes[oal.segment] += oal.docSize()
+	}
+	for id, n := range d.keptTombstones {
+		d.liveBytes[id] += n
+	}
+	for _, h := range d.history {
+		for _, oal := range h {
+			d.liveBytes[oal.segment] += oal.docSize()
+		}
+	}
+}
+
+// Returns the fraction of the backing files taken up by records that have
+// since been overwritten or removed, and so would be reclaimed by
+// Consolidate.
+func (d *DB) DeadRatio() float64 {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	total, live := d.totalSize(), uint64(0)
+	for _, n := range d.liveBytes {
+		live += n
+	}
+	return deadRatio(total, live)
+}
+
+func deadRatio(total, live uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(total-live) / float64(total)
+}
+
+// Returns whether the DB is more fragmented than the options allow, and if
+// so whether merging the sealed segments would suffice to fix that.  Assumes
+// at least a read lock is held.
+func (d *DB) compactionDue() (due, mergeOnly bool) {
+	if len(d.sealed) > 0 {
+		total, live := uint64(0), uint64(0)
+		for id, s := range d.sealed {
+			total += s.size
+			live += d.liveBytes[id]
+		}
+		if total >= d.opts.AutoCompactMinSize && deadRatio(total, live) > d.opts.AutoCompactDeadRatio {
+			return true, true
+		}
+		return false, false
+	}
+	return d.logEnd() >= d.opts.AutoCompactMinSize &&
+		deadRatio(d.logEnd(), d.liveBytes[d.activeID]) > d.opts.AutoCompactDeadRatio, false
+}
+
+// Periodically compacts the DB when it is more fragmented than the options
+// allow, until the DB is closed.  Segmented DBs only have their sealed
+// segments merged.
+func (d *DB) autoCompact() {
+	defer d.background.Done()
+	interval := d.opts.AutoCompactInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		d.mutex.RLock()
+		due, mergeOnly := d.compactionDue()
+		d.mutex.RUnlock()
+		if !due {
+			continue
+		}
+		var e error
+		if mergeOnly {
+			e = d.Merge()
+		} else {
+			e = d.Consolidate()
+		}
+		if e != nil && e != ErrDatabaseClosed && d.opts.OnAutoCompactError != nil {
+			d.opts.OnAutoCompactError(e)
+		}
+	}
+}
+
+// Records that a compaction begun at start has finished, having written n
+// bytes.  Assumes the write lock is held.
+func (d *DB) finishCompaction(start time.Time, n uint64) {
+	d.compacted = time.Now()
+	if elapsed := d.compacted.Sub(start); elapsed > 0 {
+		d.compactRate = float64(n) / elapsed.Seconds()
+	}
+}
+
+// What compacting the DB would achieve, as projected by CompactionEstimate.
+type CompactionEstimate struct {
+	// Bytes Consolidate would free, and the records it would drop:
+	// overwritten, removed and expired ones, and tombstones beyond
+	// Options.TombstoneRetention.
+	ReclaimedBytes uint64
+	DeadRecords    int
+	// How long Consolidate would take, going by the rate the last compaction
+	// since opening wrote at, or failing that the rate the files were read at
+	// for the estimate.
+	Duration time.Duration
+}
+
+// Returns what Consolidate would reclaim if run now, and how long it would
+// take, without writing anything.  Every segment is scanned to count records,
+// which takes time in proportion to the files' size, but from a snapshot, so
+// writers aren't held up meanwhile.
+func (d *DB) CompactionEstimate() (CompactionEstimate, error) {
+	//Records are counted from the files
+	if e := d.flush(); e != nil {
+		return CompactionEstimate{}, e
+	}
+	d.mutex.RLock()
+	rate := d.compactRate
+	d.mutex.RUnlock()
+	var out CompactionEstimate
+	e := d.viewing(func(s *DB) error {
+		var e error
+		out, e = s.estimateCompaction(rate)
+		return e
+	})
+	return out, e
+}
+
+// Runs the scan described by CompactionEstimate, projecting its duration
+// from the given rate in bytes per second, if known.  Holds the read lock
+// throughout.
+func (d *DB) estimateCompaction(rate float64) (CompactionEstimate, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	var out CompactionEstimate
+	if d.closed {
+		return out, ErrDatabaseClosed
+	}
+	start := time.Now()
+	records, total := 0, uint64(0)
+	active := &segment{d.activeID, d.filehandle, d.filebuffer, d.filledSize, false}
+	for _, seg := range append(sortedSegments(d.sealed), active) {
+		total += seg.size
+		s := newScanner(seg.filebuffer, seg.filehandle)
+		_, e := s.scan(dataStart(seg.filebuffer, seg.size), seg.size, func(r *record) error {
+			records++
+			return nil
+		})
+		s.release()
+		if e != nil {
+			return out, e
+		}
+	}
+	scanned := time.Since(start)
+	graves, e := d.retainedTombstones(d.segmentIDs())
+	if e != nil {
+		return out, e
+	}
+	//What the merged file would hold
+	kept, live := len(graves), uint64(headerSize)
+	for _, oal := range graves {
+		live += oal.docSize()
+	}
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if d.expired(k, t) {
+			continue
+		}
+		kept += 1 + len(d.history[k])
+		live += oal.docSize()
+		for _, h := range d.history[k] {
+			live += h.docSize()
+		}
+	}
+	if total > live {
+		out.ReclaimedBytes = total - live
+	}
+	if records > kept {
+		out.DeadRecords = records - kept
+	}
+	if rate <= 0 && scanned > 0 {
+		rate = float64(total) / scanned.Seconds()
+	}
+	if rate > 0 {
+		out.Duration = time.Duration(float64(live) / rate * float64(time.Second))
+	}
+	return out, nil
+}
@@ -0,0 +1,110 @@
+package bitcesque
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+// Returns a new DB at the given location, *deleting* the data there, holding
+// only the DB's live records, and closes the DB in its favour.  Unlike
+// Consolidate, the location may be on other storage, so this serves to move a
+// DB between volumes.
+//
+// The live set is copied from a snapshot while the DB goes on serving reads
+// and writes.  Only then are writers held up, while what was appended
+// meanwhile is copied across, after which writes to the DB fail with
+// ErrReadOnly until it is closed.  Compaction and checkpoints of the DB wait
+// for the copy to finish.  The new DB is created with the DB's options,
+// checksum and metadata, identity included, and records are copied as
+// stored, keeping their timestamps and expiries but not earlier versions.  On
+// error the DB is left open and untouched.
+func (d *DB) CompactTo(newLocation string) (*DB, error) {
+	defer d.endOp(OpCompact, d.startOp())
+	from, e := filepath.Abs(d.location)
+	if e == nil {
+		var to string
+		to, e = filepath.Abs(newLocation)
+		if e == nil && from == to {
+			e = errors.New("Cannot compact a DB onto its own location")
+		}
+	}
+	if e != nil {
+		return nil, e
+	}
+	n, e := d.compactTo(newLocation)
+	if e != nil {
+		return nil, e
+	}
+	if e = d.Close(); e != nil {
+		n.Close()
+		return nil, e
+	}
+	return n, nil
+}
+
+// Writes the live set to a new DB at the given location and hands writes
+// over to it, as CompactTo describes, short of closing the DB.
+func (d *DB) compactTo(newLocation string) (*DB, error) {
+	//Log rewrites all hold this, so positions in the snapshot stay valid
+	d.checkpointing.Lock()
+	defer d.checkpointing.Unlock()
+	s, e := d.Snapshot()
+	if e != nil {
+		return nil, e
+	}
+	id, pos := s.activeID, s.logEnd()
+	n, e := NewDBWithOptions(newLocation, d.copyOptions())
+	if e == nil {
+		n.meta = s.meta
+		e = n.meta.write(newLocation)
+	}
+	if e == nil {
+		e = s.copyLive([]*DB{n}, nil)
+	}
+	s.Close()
+	if e == nil {
+		e = d.handOver(n, id, pos)
+	}
+	if e != nil {
+		if n != nil {
+			n.Close()
+		}
+		return nil, e
+	}
+	return n, nil
+}
+
+// Appends to n everything written to the DB since the given position in the
+// given segment, and makes the DB refuse further writes.  Assumes
+// checkpointing is held, so the log hasn't been rewritten since.
+func (d *DB) handOver(n *DB, id uint32, pos uint64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	if e := d.flushWrites(); e != nil {
+		return e
+	}
+	active := &segment{d.activeID, d.filehandle, d.filebuffer, d.filledSize, false}
+	for _, seg := range append(sortedSegments(d.sealed), active) {
+		if seg.id < id {
+			continue
+		}
+		start := dataStart(seg.filebuffer, seg.size)
+		if seg.id == id {
+			start = pos
+		}
+		if seg.size <= start {
+			continue
+		}
+		if e := n.applyFrames(d.readSegment(seg.id, start, seg.size-start)); e != nil {
+			return e
+		}
+	}
+	d.moved = true
+	return nil
+}
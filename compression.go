@@ -0,0 +1,168 @@
+package bitcesque
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Compresses values on disk.  A compressed value is stored as the codec's id,
+// the uncompressed length as a uvarint, and then the compressed bytes, with
+// compressedFlag set in the document's format byte.  Since the id is recorded
+// with every value, a DB can hold values written with several codecs, and
+// any registered codec can read them back whatever the DB is configured to
+// write with.
+type Codec interface {
+	// A nonzero id, unique among registered codecs and never reused.
+	ID() byte
+	// Returns src compressed.
+	Compress(src []byte) ([]byte, error)
+	// Appends the decompression of src to dst, returning the extended slice.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// Values shorter than this are stored raw unless Options says otherwise.
+const defaultCompressionThreshold = 64
+
+// DEFLATE compression from the standard library, always registered.
+var Flate Codec = flateCodec{}
+
+var codecs = map[byte]Codec{Flate.ID(): Flate}
+
+// Makes the given codec available for reading values.  Codecs other than
+// Flate, e.g. wrappers around snappy or zstd, must be registered before
+// opening any DB containing values they wrote, typically from an init
+// function; registration is not safe to do concurrently with DB use.
+func RegisterCodec(c Codec) {
+	if c.ID() == 0 {
+		panic("bitcesque: codec id 0 is reserved")
+	}
+	if existing, present := codecs[c.ID()]; present && existing != c {
+		panic(fmt.Sprintf("bitcesque: codec id %d registered twice", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte {
+	return 1
+}
+
+func (flateCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, e := flate.NewWriter(&buf, flate.DefaultCompression)
+	if e != nil {
+		return nil, e
+	}
+	w.Write(src)
+	e = w.Close()
+	return buf.Bytes(), e
+}
+
+func (flateCodec) Decompress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	r := flate.NewReader(bytes.NewReader(src))
+	_, e := io.Copy(buf, r)
+	r.Close()
+	return buf.Bytes(), e
+}
+
+// Sets the record to store its value compressed with the configured codec,
+// if there is one, the value is long enough, and compressing it saves space.
+// The record's value must not already be compressed.
+func (d *DB) compressRecord(r *record) error {
+	c := d.opts.Compression
+	threshold := d.opts.CompressionThreshold
+	if threshold == 0 {
+		threshold = defaultCompressionThreshold
+	}
+	if c == nil || len(r.value) < threshold {
+		return nil
+	}
+	compressed, e := c.Compress(r.value)
+	if e != nil {
+		return e
+	}
+	out := make([]byte, 1, 1+binary.MaxVarintLen64+len(compressed))
+	out[0] = c.ID()
+	out = binary.AppendUvarint(out, uint64(len(r.value)))
+	out = append(out, compressed...)
+	if len(out) < len(r.value) {
+		r.flags |= compressedFlag
+		r.value = out
+	}
+	return nil
+}
+
+// Returns the stored value v, of a document with compressedFlag set,
+// decompressed.  The recorded length is checked against the largest value
+// the DB could have written before anything is allocated for it.
+func (d *DB) decompress(v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return nil, ErrCorrupt
+	}
+	c, present := codecs[v[0]]
+	if !present {
+		return nil, ErrUnknownCodec
+	}
+	size, n := binary.Uvarint(v[1:])
+	if n <= 0 || size > math.MaxUint32 || d.opts.MaxValueSize > 0 && size > uint64(d.opts.MaxValueSize) {
+		return nil, ErrCorrupt
+	}
+	out, e := c.Decompress(make([]byte, 0, size), v[1+n:])
+	if e != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, e)
+	}
+	if uint64(len(out)) != size {
+		return nil, ErrCorrupt
+	}
+	return out, nil
+}
+
+// Returns the uncompressed length recorded at the start of a compressed
+// value, or -1 if it can't be read.
+func decompressedSize(v []byte) int {
+	if len(v) == 0 {
+		return -1
+	}
+	size, n := binary.Uvarint(v[1:])
+	if n <= 0 {
+		return -1
+	}
+	return int(size)
+}
+
+// Returns the given record with its value decompressed, if it was stored
+// compressed.
+func (d *DB) decompressRecord(r record) (record, error) {
+	if r.flags&compressedFlag == 0 {
+		return r, nil
+	}
+	v, e := d.decompress(r.value)
+	if e != nil {
+		return r, e
+	}
+	r.flags &^= compressedFlag
+	r.value = v
+	return r, nil
+}
+
+// Returns the given decrypted record with its value compressed as the DB is
+// currently configured to.  Values already compressed with the configured
+// codec are left as they are.
+func (d *DB) recompressRecord(r record) (record, error) {
+	c := d.opts.Compression
+	if r.flags&compressedFlag != 0 && c != nil && len(r.value) > 0 && r.value[0] == c.ID() {
+		return r, nil
+	}
+	r, e := d.decompressRecord(r)
+	if e != nil {
+		return r, e
+	}
+	e = d.compressRecord(&r)
+	return r, e
+}
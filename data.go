@@ -3,21 +3,140 @@
 package bitcesque
 
 import (
+	"context"
 	"errors"
 	"os"
-	"strconv"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"time"
 )
 
+// How many bytes of a segment OpenAndVerifyDBContext verifies between
+// checking its context and reporting progress.
+const verifyProgressStep = 16 << 20
+
 // Represents a collection of key / value pairs of arbitrary bytes.
 type DB struct {
-	kToPos     map[string]offsetAndLength
-	location   string   //Location of underlying file
-	filledSize uint64   //Writes happen at this position
-	filehandle *os.File //Open file
-	filebuffer []byte   //Mmap'd buffer over file, used only for reads
-	mutex      sync.RWMutex
+	kToPos         index
+	expiries       map[string]int64    //Expiry times of keys that have them
+	ordered        *skipList           //The keys of kToPos in order, if enabled
+	location       string              //Location of underlying file
+	lockfile       *os.File            //Holds the process-level lock while open
+	activeID       uint32              //Segment id of the file being written
+	filledSize     uint64              //Writes happen at this position
+	filehandle     *os.File            //Open file
+	filebuffer     []byte              //Mmap'd buffer over file, used only for reads
+	sealed         map[uint32]*segment //Older, read-only segments by id
+	liveBytes      map[uint32]uint64   //Bytes of each segment taken up by current records
+	tombstones     map[uint32]int      //Tombstones known to be in each segment
+	keptTombstones map[uint32]uint64   //Bytes of each segment taken up by tombstones compaction kept
+	compacted      time.Time           //When the DB was last compacted, if since opening
+	compactRate    float64             //Bytes per second the last compaction wrote
+	unsaved        uint64              //Appends made since the keyfile was written
+	allocated      uint64              //Size of the active file, which may run past filledSize
+	wbuf           []byte              //Appends not yet written to the active file, which follow filledSize
+	scrubbing      bool                //Whether the scrubber has been started
+	scrubbed       time.Time           //When the scrubber last finished a pass
+	corrupt        int                 //Damaged regions found by the scrubber
+	quotaFailures  int                 //Writes refused with ErrQuotaExceeded
+	io             ioCounters          //Bytes written and syncs, for Stats
+	full           bool                //Set when a write ran out of space, if that makes the DB read-only
+	horizon        uint64              //Log offset before which compaction has rewritten the log
+	moved          bool                //Set once CompactTo has handed writes over to a new DB
+	opts           Options
+	mutex          shardedRWMutex           //Key reads lock one shard, writes all of them
+	checkpointing  sync.Mutex               //Serializes writing the keyfile
+	checkpointDue  chan struct{}            //Signalled when enough writes call for a checkpoint
+	ilog           *os.File                 //Index log being appended to, if any
+	ilogKeys       map[string]struct{}      //Keys changed since the last index log group
+	view           atomic.Pointer[readView] //Published for lock-free reads, if enabled
+	epochs         epochs                   //Readers of published views
+	viewMisses     atomic.Uint64            //Reads that found no view since one was last published
+	viewSize       atomic.Uint64            //Keys in the view last published
+	rebuildingView atomic.Bool
+	history        map[string][]offsetAndLength //Earlier records of keys, newest first, if keeping versions
+	filters        map[uint32]*keyFilter        //Bloom filters of the keys written to each segment, if kept
+	cache          *valueCache                  //Recently read values, if caching
+	evictions      *evictList                   //Live keys in eviction order, if a cache
+	sum            Checksum                     //What documents are checked with, as the data files record
+	meta           *Metadata                    //Replaced rather than modified
+	writes         chan *writeRequest           //Mutations for the writer goroutine, if queueing
+	queueing       sync.RWMutex                 //Held to enqueue, or exclusively to shut the queue
+	queueClosed    bool
+	closed         bool           //Set once Close has begun
+	replLog        *replLog       //Recent appends, if serving replication
+	follower       *Follower      //Set while following a primary
+	snapshot       bool           //Whether this is a read-only view from Snapshot
+	reader         bool           //Whether this follows another process's writes, from OpenReadOnlyDB
+	stop           chan struct{}  //Closed to halt background goroutines
+	background     sync.WaitGroup //Tracks background goroutines
+}
+
+// Wraps freshly opened file state in a DB, starting any background work the
+// options call for.
+func newDB(location string, lockfile *os.File, sealed map[uint32]*segment, active *segment, m index, expiries map[string]int64, opts *Options) *DB {
+	d := &DB{
+		kToPos:        m,
+		expiries:      expiries,
+		location:      location,
+		lockfile:      lockfile,
+		activeID:      active.id,
+		filledSize:    active.size,
+		filehandle:    active.filehandle,
+		filebuffer:    active.filebuffer,
+		sealed:        sealed,
+		allocated:     active.size,
+		tombstones:    make(map[uint32]int),
+		stop:          make(chan struct{}),
+		checkpointDue: make(chan struct{}, 1),
+		sum:           fileChecksum(active.filebuffer, active.size),
+	}
+	if opts != nil {
+		d.opts = *opts
+	}
+	if m, e := readManifest(location); e == nil && m != nil {
+		d.horizon = m.compacted
+	}
+	if stats, e := active.filehandle.Stat(); e == nil && uint64(stats.Size()) > d.allocated {
+		d.allocated = uint64(stats.Size())
+	}
+	d.recountLiveBytes()
+	d.loadFilters()
+	d.seedStamp()
+	if d.opts.ValueCacheSize > 0 {
+		d.cache = newValueCache(d.opts.ValueCacheSize)
+	}
+	if d.opts.OrderedIndex {
+		d.ordered = newSkipList()
+		for k := range m.all() {
+			d.ordered.insert(k)
+		}
+	}
+	if d.opts.CacheMaxBytes > 0 {
+		d.evictions = newEvictList(m, d.opts.CacheEviction)
+	}
+	if d.opts.AutoCompactDeadRatio > 0 {
+		d.background.Add(1)
+		go d.autoCompact()
+	}
+	if d.opts.ExpirySweepInterval >= 0 {
+		d.background.Add(1)
+		go d.sweepExpired()
+	}
+	if d.opts.CheckpointInterval > 0 || d.opts.CheckpointWrites > 0 {
+		d.background.Add(1)
+		go d.checkpointer()
+	}
+	if d.opts.WriteQueue > 0 {
+		d.writes = make(chan *writeRequest, d.opts.WriteQueue)
+		d.background.Add(1)
+		go d.writer()
+	}
+	if d.buffering() {
+		d.background.Add(1)
+		go d.flusher()
+	}
+	return d
 }
 
 // Returns the location of the file backing the given DB.
@@ -25,138 +144,435 @@ func (d *DB) GetLocation() string {
 	return d.location
 }
 
-func makeFilebuf(f *os.File) ([]byte, error) {
-	stats, e := f.Stat()
+// Creates a new DB at the given location, *deleting* the data there.
+func NewDB(location string) (*DB, error) {
+	return NewDBWithOptions(location, nil)
+}
+
+// As NewDB, but with the given options.  A nil opts gives the defaults.
+func NewDBWithOptions(location string, opts *Options) (*DB, error) {
+	lockfile, e := lockDB(location)
 	if e != nil {
 		return nil, e
 	}
-	fLen := stats.Size()
-	mmapLen := int(fLen)
-	//Map at least 4gb to avoid constantly remapping, but never read invalid part
-	//since it will have no pointers in
-	if mmapLen < 4000000000 {
-		mmapLen = 4000000000
-	} else {
-		mmapLen *= 2
+	e = clearDB(location)
+	if e != nil {
+		unlockDB(location, lockfile)
+		return nil, e
 	}
-	return syscall.Mmap(int(f.Fd()), 0, mmapLen, syscall.PROT_READ, syscall.MAP_SHARED)
-}
-
-// Creates a new DB at the given location, *deleting* the data there.
-func NewDB(location string) (*DB, error) {
-	filehandle, e := os.OpenFile(location, os.O_TRUNC|os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	var c Checksum
+	if opts != nil {
+		c = opts.Checksum
+	}
+	active, e := openActiveSegment(location, 0, opts != nil && opts.NoMmap, c)
 	if e != nil {
+		unlockDB(location, lockfile)
 		return nil, e
 	}
-	mmap, e := makeFilebuf(filehandle)
+	d := newDB(location, lockfile, make(map[uint32]*segment), active, newIndex(opts, location, 0), make(map[string]int64), opts)
+	d.meta = newMetadata()
+	e = d.meta.write(location)
+	if e == nil {
+		e = d.startIndexLog(false)
+	}
 	if e != nil {
+		d.Close()
 		return nil, e
 	}
-	return &DB{
-		make(map[string]offsetAndLength),
-		location,
-		0,
-		filehandle,
-		mmap,
-		sync.RWMutex{},
-	}, nil
+	return d, nil
+}
+
+// Deletes the files of any DB at location, leaving a manifest for an empty
+// one.  Assumes the DB's lock is held.
+func clearDB(location string) error {
+	ids, e := listSegments(location)
+	if e != nil {
+		return e
+	}
+	for _, id := range ids {
+		os.Remove(segmentPath(location, id))
+		os.Remove(hintPath(location, id))
+		os.Remove(filterPath(location, id))
+	}
+	os.Remove(mergePath(location))
+	os.Remove(location + ".keys")
+	os.Remove(location + ".keys.tmp")
+	os.Remove(indexLogPath(location))
+	return (&manifest{segments: []uint32{0}}).write(location)
+}
+
+// Removes every key, deleting the DB's files and starting afresh in place
+// with the handle still open.  Snapshots and readers from GetReader keep
+// seeing the old contents.  Followers are sent a removal of every key.
+func (d *DB) Clear() error {
+	d.checkpointing.Lock()
+	defer d.checkpointing.Unlock()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	var frame []byte
+	if d.replLog != nil {
+		b := d.NewBatch()
+		for k := range d.kToPos.all() {
+			b.Remove([]byte(k))
+		}
+		if b.err != nil {
+			return b.err
+		}
+		if b.Len() > 0 {
+			frame = b.frame()
+		}
+	}
+	d.quiesce()
+	//Files must be closed before they can be removed on some platforms
+	for _, s := range d.sealed {
+		e := s.close()
+		if e != nil {
+			return e
+		}
+	}
+	d.sealed = make(map[uint32]*segment)
+	e := d.closeIndexLog()
+	if e == nil {
+		e = d.unmapActive()
+	}
+	if e == nil {
+		e = d.filehandle.Close()
+	}
+	if e == nil {
+		e = clearDB(d.location)
+	}
+	if e != nil {
+		return e
+	}
+	active, e := openActiveSegment(d.location, 0, d.opts.NoMmap, d.sum)
+	if e != nil {
+		return e
+	}
+	d.activeID = active.id
+	d.filehandle = active.filehandle
+	d.filebuffer = active.filebuffer
+	d.filledSize = active.size
+	d.allocated = active.size
+	d.wbuf = nil
+	d.kToPos = newIndex(&d.opts, d.location, 0)
+	d.expiries = make(map[string]int64)
+	d.history = nil
+	if d.ordered != nil {
+		d.ordered = newSkipList()
+	}
+	d.recountLiveBytes()
+	d.loadFilters()
+	if d.cache != nil {
+		d.cache.clear()
+	}
+	d.tombstones = make(map[uint32]int)
+	d.keptTombstones = nil
+	d.horizon = 0
+	if frame != nil {
+		d.replLog.append(frame)
+	}
+	return d.startIndexLog(false)
 }
 
 // Opens a pre-existing database, loading its keystore.  Assumes validity.
+// Records appended since the keyfile was written, e.g. before a crash, are
+// indexed from the data files; if the keyfile is missing or otherwise no
+// longer describes them, the whole DB is verified as by OpenAndVerifyDB.
 func OpenDB(location string) (*DB, error) {
-	filehandle, e := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	return OpenDBWithOptions(location, nil)
+}
+
+// As OpenDB, but with the given options.  A nil opts gives the defaults.
+func OpenDBWithOptions(location string, opts *Options) (*DB, error) {
+	lockfile, e := lockDB(location)
 	if e != nil {
 		return nil, e
 	}
-	stat, e := filehandle.Stat()
+	sealed, active, e := openSegments(location, opts)
 	if e != nil {
+		unlockDB(location, lockfile)
 		return nil, e
 	}
-	pos := uint64(stat.Size())
-	mmap, e := makeFilebuf(filehandle)
+	out := &DB{location: location}
+	if opts != nil {
+		out.opts = *opts
+	}
+	marks, e := out.populateKeys()
+	stale := false
+	if e == nil && marks != nil {
+		if len(marks) > 0 {
+			out.replayIndexLog(marks)
+		}
+		stale = out.catchUp(marks, append(sortedSegments(sealed), active))
+	}
+	if e != nil || stale {
+		for _, seg := range sealed {
+			seg.close()
+		}
+		active.close()
+		unlockDB(location, lockfile)
+	}
 	if e != nil {
 		return nil, e
 	}
-	out := &DB{
-		make(map[string]offsetAndLength),
-		location,
-		pos,
-		filehandle,
-		mmap,
-		sync.RWMutex{},
+	if stale {
+		return OpenAndVerifyDBWithOptions(location, opts)
+	}
+	d := newDB(location, lockfile, sealed, active, out.kToPos, out.expiries, opts)
+	d.unsaved = out.unsaved
+	d.meta, e = loadMetadata(location)
+	if e == nil {
+		e = d.startIndexLog(marks != nil && d.unsaved == 0)
 	}
-	e = out.populateKeys()
 	if e != nil {
+		d.Close()
 		return nil, e
 	}
-	return out, nil
+	return d, nil
+}
+
+// Brings an index loaded from a keyfile up to date with the given segments,
+// indexing anything appended to them since the keyfile was written, and
+// counting what was as unsaved.  Returns true if that can't be done, because
+// segments have been replaced, removed or truncated, or their tails don't
+// verify, in which case the whole DB must be verified instead.
+func (d *DB) catchUp(marks map[uint32]fileMark, segs []*segment) bool {
+	current := 0
+	t := now()
+	for _, seg := range segs {
+		mark, present := marks[seg.id]
+		if !present {
+			if seg.size == dataStart(seg.filebuffer, seg.size) {
+				continue
+			}
+			return true
+		}
+		current++
+		if mark.tag != fileTag(seg.filebuffer, seg.size) || mark.size > seg.size {
+			return true
+		}
+		id := seg.id
+		s := newScanner(seg.filebuffer, seg.filehandle)
+		end, e := s.scan(mark.size, seg.size, func(r *record) error {
+			oal := r.oal(id)
+			e := openRecord(d.opts.Encryption, r)
+			if e == nil {
+				indexRecord(d.kToPos, d.expiries, r, oal, t)
+				d.unsaved++
+			}
+			return e
+		})
+		if errors.Is(e, ErrCorrupt) && s.zeroFrom(end, seg.size) {
+			seg.size, e = end, nil
+			seg.filebuffer = truncateFilebuf(seg.filebuffer, end)
+		}
+		s.release()
+		if e != nil {
+			return true
+		}
+	}
+	return current != len(marks)
+}
+
+// Points an index being built from the data files at a verified and
+// decrypted record, or drops its key if it is a tombstone or expired as of t.
+func indexRecord(m index, expiries map[string]int64, r *record, oal offsetAndLength, t int64) {
+	k := string(r.key)
+	if len(r.value) == 0 || (r.expiry != 0 && r.expiry <= t) {
+		m.remove(k)
+		delete(expiries, k)
+		return
+	}
+	m.set(k, oal)
+	if r.expiry != 0 {
+		expiries[k] = r.expiry
+	} else {
+		delete(expiries, k)
+	}
 }
 
 // Loads the pre-existing db at the given location, verifying its records
 // and re-deriving the keyfile.  Intended to be called after an unclean
 // shutdown.  If invalid records are encountered, loading is stopped and the
-// db is returned with records up to that point, along with an error.
+// db is returned with records up to that point, along with an error; other
+// behaviour can be chosen with Options.Recovery.
 func OpenAndVerifyDB(location string) (*DB, error) {
-	filehandle, e := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	return OpenAndVerifyDBWithOptions(location, nil)
+}
+
+// As OpenAndVerifyDB, but with the given options.  A nil opts gives the
+// defaults.
+func OpenAndVerifyDBWithOptions(location string, opts *Options) (*DB, error) {
+	return OpenAndVerifyDBContext(context.Background(), location, opts)
+}
+
+// As OpenAndVerifyDBWithOptions, but giving up with the context's error if it
+// is done before verification finishes.  Progress is reported to
+// Options.OnVerifyProgress.  Segments are verified concurrently, by as many
+// goroutines as Options.VerifyWorkers allows.
+func OpenAndVerifyDBContext(ctx context.Context, location string, opts *Options) (*DB, error) {
+	lockfile, e := lockDB(location)
 	if e != nil {
 		return nil, e
 	}
-	fi, _ := filehandle.Stat()
-	fLen := uint64(fi.Size())
-	mmap, e := makeFilebuf(filehandle)
+	sealed, active, e := openSegments(location, opts)
 	if e != nil {
+		unlockDB(location, lockfile)
 		return nil, e
 	}
-	m := make(map[string]offsetAndLength)
-	pos := uint64(0)
-	for pos < uint64(fLen) {
-		kLen := uint32FromBytes(mmap, pos+4)
-		vLen := uint32FromBytes(mmap, pos+8)
-		k := mmap[pos+12 : pos+12+uint64(kLen)]
-		if checkDocument(mmap[pos : pos+12+uint64(kLen)+uint64(vLen)]) {
-			if vLen > 0 {
-				m[string(k)] = offsetAndLength{pos + 12 + uint64(kLen), vLen}
-			} else {
-				delete(m, string(k))
+	v := &verifier{ctx: ctx, location: location, policy: StopAtCorruption, t: now(), total: active.size}
+	workers := 0
+	if opts != nil {
+		v.aead, v.policy, v.progress, workers = opts.Encryption, opts.Recovery, opts.OnVerifyProgress, opts.VerifyWorkers
+		v.hints = opts.HintFiles
+	}
+	for _, seg := range sealed {
+		v.total += seg.size
+	}
+	segs := append(sortedSegments(sealed), active)
+	frags := v.verifyAll(segs, workers)
+	m := newIndex(opts, location, 0)
+	expiries := make(map[string]int64)
+	tombstones := make(map[uint32]int)
+	records := uint64(0)
+	for i, f := range frags {
+		f.mergeInto(m, expiries)
+		tombstones[segs[i].id] = f.tombstones
+		records += f.records
+		if f.err == nil {
+			continue
+		}
+		if !errors.Is(f.err, ErrCorrupt) || v.policy != StopAtCorruption {
+			for _, seg := range sealed {
+				seg.close()
 			}
-		} else {
-			return &DB{
-				m,
-				location,
-				pos,
-				filehandle,
-				mmap,
-				sync.RWMutex{},
-			}, errors.New("Corruption detected starting at position " + strconv.FormatUint(pos, 10))
-		}
-		pos += 12 + uint64(kLen) + uint64(vLen)
-	}
-	return &DB{
-		m,
-		location,
-		pos,
-		filehandle,
-		mmap,
-		sync.RWMutex{},
-	}, nil
-}
-
-// Close the DB after flushing to disk.
+			active.close()
+			unlockDB(location, lockfile)
+			return nil, f.err
+		}
+		//Appends go to the end of the file regardless, so the active
+		//segment keeps its full size for them to be indexed correctly
+		d := newDB(location, lockfile, sealed, active, m, expiries, opts)
+		d.tombstones, d.unsaved = tombstones, records
+		d.meta, e = loadMetadata(location)
+		if e == nil {
+			e = d.startIndexLog(false)
+		}
+		if e != nil {
+			d.Close()
+			return nil, e
+		}
+		return d, f.err
+	}
+	if v.progress != nil {
+		v.progress(v.total, v.total)
+	}
+	//The keyfile is not trusted, so none of the records count as saved
+	d := newDB(location, lockfile, sealed, active, m, expiries, opts)
+	d.tombstones, d.unsaved = tombstones, records
+	d.meta, e = loadMetadata(location)
+	if e == nil {
+		e = d.startIndexLog(false)
+	}
+	if e != nil {
+		d.Close()
+		return nil, e
+	}
+	return d, nil
+}
+
+// Close the DB after flushing to disk.  Afterwards the DB appears empty, and
+// writes fail with ErrDatabaseClosed, as does closing it again.
 func (d *DB) Close() error {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return ErrDatabaseClosed
+	}
+	d.closed = true
+	f := d.follower
+	d.mutex.Unlock()
+	if f != nil {
+		f.halt()
+	}
+	close(d.stop)
+	d.closeQueue()
+	d.background.Wait()
+	d.checkpointing.Lock()
+	defer d.checkpointing.Unlock()
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	e := d.dumpKeys()
-	e = syscall.Munmap(d.filebuffer)
+	if d.replLog != nil {
+		d.replLog.close()
+	}
+	var dumpErr error
+	if !d.snapshot && !d.reader {
+		//Should buffered appends fail to be written, the keyfile's marks
+		//run past the end of the file, so it won't be trusted
+		dumpErr = d.flushWrites()
+		if e := d.dumpKeys(); dumpErr == nil {
+			dumpErr = e
+		}
+		if dumpErr == nil {
+			dumpErr = d.resetIndexLog()
+		}
+	}
+	if e := d.closeIndexLog(); e != nil && dumpErr == nil {
+		dumpErr = e
+	}
+	//Emptying the index keeps readers away from the unmapped files
+	defer func() {
+		d.kToPos = newIndex(&d.opts, d.location, 0)
+		d.expiries = make(map[string]int64)
+		d.history = nil
+		if d.ordered != nil {
+			d.ordered = newSkipList()
+		}
+	}()
+	d.quiesce()
+	if !d.snapshot && !d.reader {
+		if e := d.trimAllocation(); e != nil && dumpErr == nil {
+			dumpErr = e
+		}
+	}
+	for _, seg := range d.sealed {
+		e := seg.close()
+		if e != nil {
+			return e
+		}
+	}
+	e := d.unmapActive()
 	if e != nil {
 		return e
 	}
-	return d.filehandle.Close()
+	e = d.filehandle.Close()
+	if e != nil || d.snapshot || d.reader {
+		return e
+	}
+	e = unlockDB(d.location, d.lockfile)
+	if e != nil {
+		return e
+	}
+	return dumpErr
 }
 
 // Flushes all DB writes to disk.
 func (d *DB) Sync() error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if e := d.flushWrites(); e != nil {
+		return e
+	}
+	d.io.syncs.Add(1)
 	return d.filehandle.Sync()
 }
 
@@ -164,16 +580,25 @@ func (d *DB) Sync() error {
 func (d *DB) Size() int {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
-	return len(d.kToPos)
+	n, t := d.kToPos.len(), now()
+	for _, expiry := range d.expiries {
+		if expiry <= t {
+			n--
+		}
+	}
+	return n
 }
 
 // Returns a slice containing all current keys.
 func (d *DB) Keys() []string {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
-	out := make([]string, 0, len(d.kToPos))
-	for k, _ := range d.kToPos {
-		out = append(out, k)
+	out := make([]string, 0, d.kToPos.len())
+	t := now()
+	for k, _ := range d.kToPos.all() {
+		if !d.expired(k, t) {
+			out = append(out, k)
+		}
 	}
 	return out
 }
@@ -182,9 +607,12 @@ func (d *DB) Keys() []string {
 func (d *DB) Vals() []string {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
-	out := make([]string, 0, len(d.kToPos))
-	for _, oal := range d.kToPos {
-		out = append(out, string(d.getValAtOAL(oal)))
+	out := make([]string, 0, d.kToPos.len())
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if !d.expired(k, t) {
+			out = append(out, string(d.getValAtOAL(oal)))
+		}
 	}
 	return out
 }
@@ -193,9 +621,12 @@ func (d *DB) Vals() []string {
 func (d *DB) Dump() map[string]string {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
-	out := make(map[string]string, len(d.kToPos))
-	for k, oal := range d.kToPos {
-		out[k] = string(d.getValAtOAL(oal))
+	out := make(map[string]string, d.kToPos.len())
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if !d.expired(k, t) {
+			out[k] = string(d.getValAtOAL(oal))
+		}
 	}
 	return out
 }
@@ -204,21 +635,103 @@ func (d *DB) Dump() map[string]string {
 func (d *DB) KeysAndVals() [][2]string {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
-	out := make([][2]string, len(d.kToPos))
-	for k, oal := range d.kToPos {
-		kv := [2]string{k, string(d.getValAtOAL(oal))}
-		out = append(out, kv)
+	out := make([][2]string, 0, d.kToPos.len())
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if !d.expired(k, t) {
+			kv := [2]string{k, string(d.getValAtOAL(oal))}
+			out = append(out, kv)
+		}
 	}
 	return out
 }
 
+// A key and its value.
+type KV struct {
+	Key, Value []byte
+}
+
+// As Keys, but returning each key as a byte slice.
+func (d *DB) KeysBytes() [][]byte {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	out := make([][]byte, 0, d.kToPos.len())
+	t := now()
+	for k := range d.kToPos.all() {
+		if !d.expired(k, t) {
+			out = append(out, []byte(k))
+		}
+	}
+	return out
+}
+
+// As Vals, but returning each value as a byte slice.  Values that can't be
+// read are left out.
+func (d *DB) ValsBytes() [][]byte {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	out := make([][]byte, 0, d.kToPos.len())
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if d.expired(k, t) {
+			continue
+		}
+		v, e := d.ownedVal(oal)
+		if e == nil {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Returns all current key / value pairs, in no particular order.  Pairs whose
+// values can't be read are left out.
+func (d *DB) Pairs() []KV {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	out := make([]KV, 0, d.kToPos.len())
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if d.expired(k, t) {
+			continue
+		}
+		v, e := d.ownedVal(oal)
+		if e == nil {
+			out = append(out, KV{[]byte(k), v})
+		}
+	}
+	return out
+}
+
+// Returns the value oal points to in a slice the caller may keep, copying it
+// only if it points into a data file or the cache.  Assumes at least a read
+// lock is held.
+func (d *DB) ownedVal(oal offsetAndLength) ([]byte, error) {
+	if d.cacheable(oal) {
+		var v []byte
+		e := d.withVal(oal, func(cached []byte) { v = append([]byte{}, cached...) })
+		return v, e
+	}
+	v, e := d.getVal(oal)
+	if e != nil || oal.compressed() || oal.format&(encryptedFlag>>24) != 0 {
+		return v, e
+	}
+	return append([]byte{}, v...), nil
+}
+
 // Asynchronously returns all presently valid keys through the given channel.
 // Retains a read lock until all keys have been written, then closes the channel.
+//
+// Deprecated: a consumer that stops reading leaves the read lock held, and
+// writers blocked, forever.  Use KeyChanCtx, Scan or All instead.
 func (d *DB) KeyChan(c chan string) {
 	go func() {
 		d.mutex.RLock()
-		for k, _ := range d.kToPos {
-			c <- k
+		t := now()
+		for k, _ := range d.kToPos.all() {
+			if !d.expired(k, t) {
+				c <- k
+			}
 		}
 		close(c)
 		d.mutex.RUnlock()
@@ -227,25 +740,68 @@ func (d *DB) KeyChan(c chan string) {
 
 // Asynchronously returns all presently valid vals through the given channel.
 // Retains a read lock all values have been written, then closes the channel.
+//
+// Deprecated: as KeyChan.  Use ValChanCtx, Scan or All instead.
 func (d *DB) ValChan(c chan string) {
 	go func() {
 		d.mutex.RLock()
-		for _, oal := range d.kToPos {
-			c <- string(d.getValAtOAL(oal))
+		t := now()
+		for k, oal := range d.kToPos.all() {
+			if !d.expired(k, t) {
+				c <- string(d.getValAtOAL(oal))
+			}
 		}
 		close(c)
 		d.mutex.RUnlock()
 	}()
 }
 
+// Asynchronously returns all valid keys through the given channel, in
+// ascending order, then closes it.  No lock is held while waiting on the
+// consumer, so writes made meanwhile may or may not be seen.  If ctx is done
+// first, sending stops and the channel is closed early.
+func (d *DB) KeyChanCtx(ctx context.Context, c chan<- string) {
+	go func() {
+		defer close(c)
+		it := d.Scan(nil)
+		defer it.Close()
+		for it.Next() {
+			select {
+			case c <- string(it.Key()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// As KeyChanCtx, but sends the values of the keys, in key order.
+func (d *DB) ValChanCtx(ctx context.Context, c chan<- string) {
+	go func() {
+		defer close(c)
+		it := d.Scan(nil)
+		defer it.Close()
+		for it.Next() {
+			select {
+			case c <- string(it.Value()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
 // Asynchronously returns all presently valid key/val pairs through the given
 // channel.  Retains a read lock until all pairs have been written, then closes
 // the channel.
 func (d *DB) keyAndValChan(c chan [2]string) {
 	go func() {
 		d.mutex.RLock()
-		for k, oal := range d.kToPos {
-			c <- [2]string{k, string(d.getValAtOAL(oal))}
+		t := now()
+		for k, oal := range d.kToPos.all() {
+			if !d.expired(k, t) {
+				c <- [2]string{k, string(d.getValAtOAL(oal))}
+			}
 		}
 		close(c)
 		d.mutex.RUnlock()
@@ -0,0 +1,167 @@
+package bitcesque
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Keys listed by /keys when no limit is given.
+const defaultDebugKeys = 100
+
+// Serves an HTTP endpoint at the given TCP address for inspecting the DB
+// while it runs, until the DB is closed.  It offers:
+//
+//	GET  /stats                  Stats, as JSON
+//	GET  /keys?prefix=&limit=    keys with the prefix, 100 unless limit is
+//	                             given, as newline-delimited JSON in the form
+//	                             ExportJSON writes, without values
+//	POST /compact[?full=1]       Merge, or with full, Consolidate, then Stats
+//	POST /verify                 reads every record in the log, checking it
+//	                             against its checksum, and reports how many
+//	                             it read and the first error
+//	     /debug/pprof/           the profiles of net/http/pprof
+//
+// Nothing is authenticated, so the address should only be reachable by
+// operators, e.g. on localhost.
+func (d *DB) ServeDebug(addr string) error {
+	d.mutex.RLock()
+	closed := d.closed
+	d.mutex.RUnlock()
+	if closed {
+		return ErrDatabaseClosed
+	}
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
+	srv := &http.Server{Handler: d.debugHandler()}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-d.stop:
+		case <-done:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if srv.Shutdown(ctx) != nil {
+			srv.Close()
+		}
+	}()
+	e = srv.Serve(l)
+	select {
+	case <-d.stop:
+		return ErrDatabaseClosed
+	default:
+		return e
+	}
+}
+
+// Returns the handler ServeDebug serves.
+func (d *DB) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, d.Stats())
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultDebugKeys
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, e := strconv.Atoi(s)
+			if e != nil || n < 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, k := range d.keysWithPrefix([]byte(r.URL.Query().Get("prefix")), limit) {
+			var rec jsonRecord
+			if utf8.ValidString(k) {
+				rec.K = &k
+			} else {
+				rec.K64 = []byte(k)
+			}
+			if t, present := d.ExpiresAt([]byte(k)); present {
+				rec.Expires = t.UnixNano()
+			}
+			if enc.Encode(&rec) != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/compact", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		var e error
+		if r.URL.Query().Get("full") != "" {
+			e = d.Consolidate()
+		} else {
+			e = d.Merge()
+		}
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeDebugJSON(w, d.Stats())
+	})
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		var out struct {
+			Records int    `json:"records"`
+			Offset  uint64 `json:"offset"` //Where reading stopped
+			Error   string `json:"error,omitempty"`
+		}
+		var e error
+		out.Offset, e = d.ReadLog(0, func(rec Record) error {
+			out.Records++
+			return r.Context().Err()
+		})
+		if e != nil {
+			out.Error = e.Error()
+		}
+		writeDebugJSON(w, out)
+	})
+	return mux
+}
+
+// Writes v to w as indented JSON.
+func writeDebugJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// Returns up to limit live keys starting with prefix, in ascending order.
+// Those after the prefix itself follow it directly in KeysPage's order.
+func (d *DB) keysWithPrefix(prefix []byte, limit int) []string {
+	var out []string
+	if limit > 0 && d.Contains(prefix) {
+		out = append(out, string(prefix))
+	}
+	for _, k := range d.KeysPage(append([]byte{}, prefix...), limit-len(out)) {
+		if !strings.HasPrefix(k, string(prefix)) {
+			break
+		}
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,136 @@
+package bitcesque
+
+import (
+	"bytes"
+)
+
+// How a key differs between two DBs.
+type DiffKind int
+
+const (
+	// The key is only in the second DB.
+	DiffAdded DiffKind = iota
+	// The key is only in the first DB.
+	DiffRemoved
+	// The key is in both, with different values.
+	DiffChanged
+)
+
+// Returns the keys only in b, only in a, and in both with different values.
+// Each DB is read from a snapshot, so writers aren't held up meanwhile, and
+// values are compared without copying them where they are stored plainly.
+// Use DiffFunc to avoid collecting the keys of large differences.
+func Diff(a, b *DB) (added, removed, changed []string, e error) {
+	e = DiffFunc(a, b, func(k []byte, kind DiffKind) error {
+		switch kind {
+		case DiffAdded:
+			added = append(added, string(k))
+		case DiffRemoved:
+			removed = append(removed, string(k))
+		default:
+			changed = append(changed, string(k))
+		}
+		return nil
+	})
+	return added, removed, changed, e
+}
+
+// Calls fn with each key that differs between a and b, in no particular
+// order, and how it differs, stopping at the first error fn returns.
+// Returning ErrStop ends the comparison early, and DiffFunc then returns nil.
+// k is only valid during the call.
+func DiffFunc(a, b *DB, fn func(k []byte, kind DiffKind) error) error {
+	e := a.viewing(func(a *DB) error {
+		return b.viewing(func(b *DB) error {
+			return diff(a, b, fn)
+		})
+	})
+	if e == ErrStop {
+		return nil
+	}
+	return e
+}
+
+// Calls fn with a snapshot of the DB, or the DB itself if it already is one,
+// closing the snapshot afterwards.
+func (d *DB) viewing(fn func(s *DB) error) error {
+	if d.snapshot {
+		return fn(d)
+	}
+	s, e := d.Snapshot()
+	if e != nil {
+		return e
+	}
+	e = fn(s)
+	closeErr := s.Close()
+	if e == nil {
+		e = closeErr
+	}
+	return e
+}
+
+// Runs the comparison described by DiffFunc, holding read locks on both DBs
+// throughout.
+func diff(a, b *DB, fn func(k []byte, kind DiffKind) error) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a != b {
+		b.mutex.RLock()
+		defer b.mutex.RUnlock()
+	}
+	if a.closed || b.closed {
+		return ErrDatabaseClosed
+	}
+	t := now()
+	for k, aOAL := range a.kToPos.all() {
+		if a.expired(k, t) {
+			continue
+		}
+		bOAL, present := b.kToPos.get(k)
+		if !present || b.expired(k, t) {
+			if e := fn([]byte(k), DiffRemoved); e != nil {
+				return e
+			}
+			continue
+		}
+		same, e := sameValue(a, aOAL, b, bOAL)
+		if e == nil && !same {
+			e = fn([]byte(k), DiffChanged)
+		}
+		if e != nil {
+			return e
+		}
+	}
+	for k := range b.kToPos.all() {
+		if b.expired(k, t) {
+			continue
+		}
+		if _, present := a.kToPos.get(k); present && !a.expired(k, t) {
+			continue
+		}
+		if e := fn([]byte(k), DiffAdded); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Returns whether the values aOAL and bOAL point to in a and b are equal,
+// reading them only if their stored lengths don't already settle it.
+func sameValue(a *DB, aOAL offsetAndLength, b *DB, bOAL offsetAndLength) (bool, error) {
+	plain := func(oal offsetAndLength) bool {
+		return !oal.compressed() && oal.format&(encryptedFlag>>24) == 0
+	}
+	if plain(aOAL) && plain(bOAL) && aOAL.length != bOAL.length {
+		return false, nil
+	}
+	aV, e := a.getVal(aOAL)
+	if e != nil {
+		return false, e
+	}
+	bV, e := b.getVal(bOAL)
+	if e != nil {
+		return false, e
+	}
+	return bytes.Equal(aV, bV), nil
+}
@@ -0,0 +1,35 @@
+package bitcesque
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Returns the location of the DB kept in dir by NewDir and OpenDir, for use
+// with the functions that take a location, such as OpenAndVerifyDB,
+// RestoreFrom and RepairDB.  Every file of the DB, from its segments,
+// keyfile and manifest to its lock and the temporary files of compaction,
+// lives alongside it in dir, so renames never cross filesystems.
+func DirLocation(dir string) string {
+	return filepath.Join(dir, "db")
+}
+
+// Creates a new DB in dir, creating dir if need be and *deleting* any DB
+// already there.  A nil opts gives the defaults.
+func NewDir(dir string, opts *Options) (*DB, error) {
+	e := os.MkdirAll(dir, 0777)
+	if e != nil {
+		return nil, e
+	}
+	return NewDBWithOptions(DirLocation(dir), opts)
+}
+
+// Opens the DB in dir as OpenDBWithOptions does, creating dir and an empty
+// DB in it if need be.
+func OpenDir(dir string, opts *Options) (*DB, error) {
+	e := os.MkdirAll(dir, 0777)
+	if e != nil {
+		return nil, e
+	}
+	return OpenDBWithOptions(DirLocation(dir), opts)
+}
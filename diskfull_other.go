@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package bitcesque
+
+// Disk full errors aren't recognized here, so fail writes as they are.
+func diskFull(e error) bool {
+	return false
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package bitcesque
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Returns whether a write failed for lack of disk space.
+func diskFull(e error) bool {
+	return errors.Is(e, syscall.ENOSPC)
+}
@@ -0,0 +1,17 @@
+package bitcesque
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ERROR_HANDLE_DISK_FULL and ERROR_DISK_FULL.
+const (
+	errHandleDiskFull syscall.Errno = 39
+	errDiskFull       syscall.Errno = 112
+)
+
+// Returns whether a write failed for lack of disk space.
+func diskFull(e error) bool {
+	return errors.Is(e, errDiskFull) || errors.Is(e, errHandleDiskFull)
+}
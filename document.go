@@ -1,145 +1,782 @@
 package bitcesque
 
 import (
-	"hash/crc32"
-	"io/ioutil"
-	"os"
-	"syscall"
+	"fmt"
+	"sync"
+	"time"
 )
 
-var crcTable = crc32.MakeTable(crc32.Castagnoli)
+// Each document is laid out as
+//
+//	checksum (4) | format byte, key length (1 + 3) | value length (4) |
+//	[checksum, upper half (4)] | [expiry (8)] | [timestamp (8)] |
+//	[user flags (1)] | key | value
+//
+// The bits of the format byte say which optional fields are present, so that
+// documents written before a field existed still read correctly.  The high
+// bit marks a batch frame, whose "value" is a run of ordinary documents that
+// must be applied all together or not at all.  The next marks an expiry time,
+// and the next a write timestamp, both in Unix nanoseconds.  The next marks a
+// value stored compressed, as described by Codec, and the next two an
+// encrypted value and an encrypted key, as described in encryption.go.  The
+// next marks a 64 bit checksum, as described in checksum.go, and the last a
+// byte of flags for the application's own use, set by UpsertWithFlags.
+const (
+	batchFlag      = 1 << 31
+	expiryFlag     = 1 << 30
+	timestampFlag  = 1 << 29
+	compressedFlag = 1 << 28
+	encryptedFlag  = 1 << 27
+	sealedKeyFlag  = 1 << 26
+	userFlagsFlag  = 1 << 24
+	keyLenMask     = 1<<24 - 1
+)
 
 // This points into the document, directly at the value field
 type offsetAndLength struct {
-	offset uint64
-	length uint32
-}
-
-// Generates the byte representation of the document, including the header.
-// Empty v interpreted as tombstone.
-func newDocument(k, v []byte) []byte {
-	outsize := len(k) + len(v) + 12
-	out := make([]byte, 12, outsize)
-	uint32ToBytes(out, 4, uint32(len(k)))
-	uint32ToBytes(out, 8, uint32(len(v)))
-	out = append(out, k...)
-	out = append(out, v...)
-	hash := crc32.Checksum(out[4:], crcTable)
-	uint32ToBytes(out, 0, hash)
+	offset  uint64
+	segment uint32
+	length  uint32
+	prefix  uint32 //Bytes of the document preceding the value
+	format  uint8  //The document's format byte
+}
+
+// A document as decoded from a data file.
+type record struct {
+	pos       uint64 //Position of the document within its segment
+	flags     uint32
+	expiry    int64 //Unix nanoseconds, or 0 if the document never expires
+	timestamp int64 //Unix nanoseconds, or 0 if the document predates them
+	userFlags uint8
+	key       []byte
+	value     []byte
+}
+
+// Returns a record for a fresh write of the given key and value, stamped with
+// the current time.  Empty v interpreted as tombstone.  A nonzero expiry is
+// the time in Unix nanoseconds after which the record should be disregarded.
+func newRecord(k, v []byte, expiry int64) record {
+	r := record{flags: timestampFlag, timestamp: stamp(), key: k, value: v}
+	if expiry != 0 {
+		r.flags |= expiryFlag
+		r.expiry = expiry
+	}
+	return r
+}
+
+// Returns the number of bytes preceding the value in a document with the
+// given flags and key length.  Encrypted keys take up no room there.
+func docPrefix(flags uint32, kLen int) uint32 {
+	if flags&sealedKeyFlag != 0 {
+		kLen = 0
+	}
+	prefix := uint32(12 + kLen)
+	if flags&wideChecksumFlag != 0 {
+		prefix += 4
+	}
+	if flags&expiryFlag != 0 {
+		prefix += 8
+	}
+	if flags&timestampFlag != 0 {
+		prefix += 8
+	}
+	if flags&userFlagsFlag != 0 {
+		prefix++
+	}
+	return prefix
+}
+
+// Generates the byte representation of the record, including the header,
+// checked with the given algorithm.
+func (r *record) encode(c Checksum) []byte {
+	out := make([]byte, 0, int(docPrefix(r.flags|c.flags(), len(r.key)))+len(r.value))
+	return r.encodeTo(out, true, c)
+}
+
+// Appends the byte representation of the record to out, leaving off the
+// value unless withValue is set, though the checksum covers it regardless.
+// The record's flags are updated to say which checksum it carries.
+func (r *record) encodeTo(out []byte, withValue bool, c Checksum) []byte {
+	r.flags = r.flags&^wideChecksumFlag | c.flags()
+	start := uint64(len(out))
+	out = append(out, make([]byte, docPrefix(c.flags(), 0))...)
+	uint32ToBytes(out, start+4, r.flags|uint32(len(r.key)))
+	uint32ToBytes(out, start+8, uint32(len(r.value)))
+	if r.flags&expiryFlag != 0 {
+		out = append(out, make([]byte, 8)...)
+		uint64ToBytes(out, uint64(len(out)-8), uint64(r.expiry))
+	}
+	if r.flags&timestampFlag != 0 {
+		out = append(out, make([]byte, 8)...)
+		uint64ToBytes(out, uint64(len(out)-8), uint64(r.timestamp))
+	}
+	if r.flags&userFlagsFlag != 0 {
+		out = append(out, r.userFlags)
+	}
+	out = append(out, r.key...)
+	sum := c.document(out[start:], r.value)
+	if withValue {
+		out = append(out, r.value...)
+	}
+	c.store(out[start:], sum)
 	return out
 }
 
-// Return the appropriate value offset-and-length for the document, were it
-// inserted at the given position.
-func getOAL(pos uint64, k, v []byte) offsetAndLength {
-	return offsetAndLength{pos + 12 + uint64(len(k)), uint32(len(v))}
+// Decodes the already verified document b, found at the given position.
+func decodeRecord(b []byte, pos uint64) record {
+	kField := uint32FromBytes(b, 4)
+	r := record{pos: pos, flags: kField &^ keyLenMask}
+	i := uint64(12)
+	if r.flags&wideChecksumFlag != 0 {
+		i += 4
+	}
+	if r.flags&expiryFlag != 0 {
+		r.expiry = int64(uint64FromBytes(b, i))
+		i += 8
+	}
+	if r.flags&timestampFlag != 0 {
+		r.timestamp = int64(uint64FromBytes(b, i))
+		i += 8
+	}
+	if r.flags&userFlagsFlag != 0 {
+		r.userFlags = b[i]
+		i++
+	}
+	kLen := uint64(kField & keyLenMask)
+	r.key = b[i : i+kLen]
+	r.value = b[i+kLen:]
+	return r
+}
+
+// Returns the offset-and-length of the record's value, were it in the given
+// segment.
+func (r *record) oal(segment uint32) offsetAndLength {
+	prefix := docPrefix(r.flags, len(r.key))
+	return offsetAndLength{r.pos + uint64(prefix), segment, uint32(len(r.value)), prefix, uint8(r.flags >> 24)}
 }
 
-// Returns the value in the DB at the given offset and length.
+// Returns the size of the document the given offset-and-length points into.
+func (oal offsetAndLength) docSize() uint64 {
+	return uint64(oal.prefix) + uint64(oal.length)
+}
+
+// Returns whether the value the given offset-and-length points at is stored
+// compressed.
+func (oal offsetAndLength) compressed() bool {
+	return oal.format&(compressedFlag>>24) != 0
+}
+
+// Returns the value in the DB at the given offset and length, or nil if it
+// can't be decompressed.
 func (d *DB) getValAtOAL(oal offsetAndLength) []byte {
-	return d.filebuffer[oal.offset : oal.offset+uint64(oal.length)]
+	v, _ := d.getVal(oal)
+	return v
+}
+
+// Returns the value in the DB at the given offset and length, decrypting and
+// decompressing it if need be, and first checking the whole document against
+// its checksum if the options ask.  Plain values point directly into the
+// data file.
+func (d *DB) getVal(oal offsetAndLength) ([]byte, error) {
+	return d.valFrom(d, oal)
+}
+
+// Reads segments, either those of the DB or those of a published view.
+type segmentReader interface {
+	readSegment(segment uint32, pos, length uint64) []byte
+}
+
+// As getVal, but reading from src.
+func (d *DB) valFrom(src segmentReader, oal offsetAndLength) ([]byte, error) {
+	var v []byte
+	encrypted := oal.format&(encryptedFlag>>24) != 0
+	if encrypted || d.opts.VerifyOnRead {
+		start := oal.offset - uint64(oal.prefix)
+		doc := src.readSegment(oal.segment, start, oal.docSize())
+		if d.opts.VerifyOnRead && (uint64(len(doc)) < oal.docSize() || !checkDocument(doc, d.sum)) {
+			return nil, corruptionAt(start)
+		}
+		v = doc[oal.prefix:]
+		if encrypted {
+			r := decodeRecord(doc, start)
+			e := openRecord(d.opts.Encryption, &r)
+			if e != nil {
+				return nil, e
+			}
+			v = r.value
+		}
+	} else {
+		v = src.readSegment(oal.segment, oal.offset, uint64(oal.length))
+	}
+	if !oal.compressed() {
+		return v, nil
+	}
+	return d.decompress(v)
+}
+
+// Returns the whole record the given offset-and-length points into.
+func (d *DB) getRecordAtOAL(oal offsetAndLength) record {
+	start := oal.offset - uint64(oal.prefix)
+	return decodeRecord(d.readSegment(oal.segment, start, oal.docSize()), start)
+}
+
+// Returns length bytes from pos onwards in the given segment.
+func (d *DB) readSegment(segment uint32, pos, length uint64) []byte {
+	if b, ok := d.buffered(segment, pos, length); ok {
+		return b
+	}
+	buf, f := d.filebuffer, d.filehandle
+	if segment != d.activeID {
+		s := d.sealed[segment]
+		buf, f = s.filebuffer, s.filehandle
+	}
+	end := pos + length
+	if end <= uint64(len(buf)) {
+		return buf[pos:end]
+	}
+	//The mapping could not be grown to cover this, so read it directly
+	out := make([]byte, length)
+	n, _ := f.ReadAt(out, int64(pos))
+	return out[:n]
 }
 
 // Takes a slice pointing at the entire document, including checksum, and
-// verifies the checksum matches the contents.
-func checkDocument(b []byte) bool {
-	checksum := uint32FromBytes(b, 0)
-	return checksum == crc32.Checksum(b[4:], crcTable)
+// verifies the checksum, by the given algorithm, matches the contents.
+func checkDocument(b []byte, c Checksum) bool {
+	if uint32FromBytes(b, 4)&wideChecksumFlag != c.flags() || len(b) < int(docPrefix(c.flags(), 0)) {
+		return false
+	}
+	g := c.begin(b)
+	return g.sum() == c.stored(b)
 }
 
-// Rewrites backing file to contain only valid entries.
-func (d *DB) Consolidate() error {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	tmp, e := ioutil.TempFile("", "")
+// Walks the documents in buf from start up to end, calling fn with each one
+// valid by the given checksum.  Batch frames are verified as a whole before
+// any of their contents are passed along.  Returns the position following the
+// last valid document, and an error if a corrupt or truncated document was
+// encountered before end, or fn returned one.
+func scanDocuments(buf []byte, start, end uint64, c Checksum, fn func(r *record) error) (uint64, error) {
+	pos := start
+	for pos < end {
+		if end-pos < 12 {
+			return pos, corruptionAt(pos)
+		}
+		kField := uint32FromBytes(buf, pos+4)
+		vLen := uint64(uint32FromBytes(buf, pos+8))
+		if kField&batchFlag != 0 {
+			prefix := uint64(docPrefix(kField&^keyLenMask, 0))
+			if end-pos < prefix || end-pos-prefix < vLen || !checkDocument(buf[pos:pos+prefix+vLen], c) {
+				return pos, corruptionAt(pos)
+			}
+			_, e := scanDocuments(buf, pos+prefix, pos+prefix+vLen, c, fn)
+			if e != nil {
+				return pos, e
+			}
+			pos += prefix + vLen
+			continue
+		}
+		prefix := uint64(docPrefix(kField&^keyLenMask, int(kField&keyLenMask)))
+		if end-pos < prefix || end-pos-prefix < vLen || !checkDocument(buf[pos:pos+prefix+vLen], c) {
+			return pos, corruptionAt(pos)
+		}
+		r := decodeRecord(buf[pos:pos+prefix+vLen], pos)
+		e := fn(&r)
+		if e != nil {
+			return pos, e
+		}
+		pos += prefix + vLen
+	}
+	return pos, nil
+}
+
+// Returns whether buf holds only zeros, as preallocated space left at the end
+// of a file by an unclean shutdown does.  No document is all zeros.
+func allZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns an error wrapping ErrCorrupt that gives where the corruption lies.
+func corruptionAt(pos uint64) error {
+	return fmt.Errorf("%w starting at position %d", ErrCorrupt, pos)
+}
+
+// Values at least this long are written straight from the caller's slice,
+// after their header, rather than copied in behind it first.
+const vectoredWriteSize = 4096
+
+// Buffers for assembling documents, or their headers, to be appended.
+var headBuffers = sync.Pool{New: func() any { b := make([]byte, 0, vectoredWriteSize); return &b }}
+
+// Appends the given bytes to the end of the active segment, first rotating to
+// a new segment if they would take it past the configured maximum size, and
+// remapping the read buffer if the file has outgrown it.  With a write
+// buffer, the bytes may only be buffered.  Returns the position the bytes
+// were written at, in what is then the active segment.  Assumes the write
+// lock is held.
+func (d *DB) appendBytes(b []byte) (uint64, error) {
+	return d.appendParts(b, nil)
+}
+
+// Appends the given record's document as appendBytes does.  Large values are
+// written straight from the record, following a header assembled in a pooled
+// buffer, rather than copied in after it.  Assumes the write lock is held.
+func (d *DB) appendRecord(r *record) (uint64, error) {
+	buf := headBuffers.Get().(*[]byte)
+	defer func() {
+		//Buffers grown for outsized keys are left for the collector
+		if cap(*buf) <= 2*vectoredWriteSize {
+			headBuffers.Put(buf)
+		}
+	}()
+	if len(r.value) < vectoredWriteSize {
+		*buf = r.encodeTo((*buf)[:0], true, d.sum)
+		return d.appendParts(*buf, nil)
+	}
+	*buf = r.encodeTo((*buf)[:0], false, d.sum)
+	return d.appendParts(*buf, r.value)
+}
+
+// Appends head followed by tail, in a single write where the platform allows,
+// as appendBytes does.  Assumes the write lock is held.
+func (d *DB) appendParts(head, tail []byte) (uint64, error) {
+	d.flushIndexLog()
+	size := len(head) + len(tail)
+	e := d.makeRoom(uint64(size))
 	if e != nil {
-		return e
+		return 0, d.writeFailed(e)
 	}
-	mNew := make(map[string]offsetAndLength)
-	pos := uint64(0)
-	for k, oal := range d.kToPos {
-		v := d.getValAtOAL(oal)
-		doc := newDocument([]byte(k), v)
-		newOAL := getOAL(pos, []byte(k), v)
-		mNew[string(k)] = newOAL
-		tmp.Write(doc)
-		pos += uint64(len(doc))
-	}
-	e = d.filehandle.Close()
+	if d.buffering() && size <= d.opts.WriteBuffer {
+		pos, e := d.bufferAppend(head, tail)
+		if e != nil {
+			return pos, d.writeFailed(e)
+		}
+		d.noteAppend()
+		if d.replLog != nil {
+			d.replLog.append(head, tail)
+		}
+		return pos, nil
+	}
+	e = d.flushWrites()
 	if e != nil {
-		return e
+		return 0, d.writeFailed(e)
 	}
-	e = syscall.Munmap(d.filebuffer)
+	pos := d.filledSize
+	e = d.reserve(uint64(size))
 	if e != nil {
-		return e
+		return pos, d.writeFailed(e)
+	}
+	n, e := writeParts(d.filehandle, head, tail, int64(pos))
+	d.filledSize += uint64(n)
+	d.io.appended.Add(uint64(n))
+	if e == nil && d.opts.SyncWrites {
+		d.io.syncs.Add(1)
+		e = d.filehandle.Sync()
 	}
-	e = tmp.Close()
 	if e != nil {
+		//A partial or unsynced document must not be found on reopening
+		d.truncateActive(pos)
+		return pos, d.writeFailed(e)
+	}
+	d.noteAppend()
+	if d.replLog != nil {
+		d.replLog.append(head, tail)
+	}
+	//If the mapping can't be grown, the old one stays valid, reads past its
+	//end fall back to ReadAt, and growth is retried on the next append
+	d.growActive(head)
+	d.growActive(tail)
+	return pos, nil
+}
+
+// Rotates to a new segment if appending n bytes would take the active one
+// past the configured maximum size, after checking the data files as a whole
+// have room for them.  Assumes the write lock is held.
+func (d *DB) makeRoom(n uint64) error {
+	if e := d.checkQuota(n); e != nil {
 		return e
 	}
-	//Move new file to old loc
-	e = os.Rename(tmp.Name(), d.location)
+	max := d.opts.MaxSegmentSize
+	start, end := dataStart(d.filebuffer, d.filledSize), d.logEnd()
+	if max > 0 && end > start && end+n > max {
+		return d.rotate()
+	}
+	return nil
+}
+
+// Rewrites backing file to contain only valid entries.  All segments are
+// merged into a single one, which becomes the active segment.
+//
+// Writers are only held up at the start, while the active segment is sealed,
+// and at the end, while what they appended meanwhile is copied onto the
+// merged file and it is swapped in; live records are copied in between with
+// reads and writes carrying on.  If no segment id is left to rotate to, the
+// whole merge holds up writers instead.
+func (d *DB) Consolidate() error {
+	defer d.endOp(OpCompact, d.startOp())
+	d.checkpointing.Lock()
+	defer d.checkpointing.Unlock()
+	start := time.Now()
+	view, e := d.freeze()
 	if e != nil {
 		return e
 	}
-	filehandle, e := os.OpenFile(d.location, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	var p *pendingMerge
+	if view != nil {
+		p, e = view.writeMerge(view.segmentIDs()[:len(view.sealed)])
+		if e != nil {
+			return e
+		}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		if p != nil {
+			p.discard()
+		}
+		return ErrDatabaseClosed
+	}
+	//What was appended meanwhile is copied from the file
+	if e = d.flushWrites(); e != nil {
+		if p != nil {
+			p.discard()
+		}
+		return e
+	}
+	if p == nil {
+		p, e = d.writeMerge(d.segmentIDs())
+		if e != nil {
+			return e
+		}
+	}
+	filehandle, pos, e := d.installMerge(p, true)
 	if e != nil {
+		d.abandonIndexLog()
 		return e
 	}
-	buf, e := makeFilebuf(filehandle)
+	buf, e := mapSegment(filehandle, pos, true, d.opts.NoMmap)
 	if e != nil {
 		return e
 	}
-	d.kToPos = mNew
+	d.activeID = p.ids[0]
 	d.filehandle = filehandle
 	d.filledSize = pos
+	d.allocated = pos
 	d.filebuffer = buf
-	return nil
+	d.recountLiveBytes()
+	d.finishCompaction(start, pos)
+	d.full = false
+	return d.compactIndexLog()
 }
 
-// Removes the given key from the DB, recording it as deleted.
-func (d *DB) Remove(k []byte) {
+// Seals the active segment and returns a view of the index over the sealed
+// segments, sharing their files rather than opening its own as Snapshot
+// does, for Consolidate to read without holding up writers.  Returns a nil
+// view if there is no segment id left to rotate to.  Assumes checkpointing is
+// held, so the sealed segments stay as they are until it is released.
+func (d *DB) freeze() (*DB, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	doc := newDocument(k, []byte{})
-	delete(d.kToPos, string(k))
-	d.filehandle.Write(doc)
+	if d.closed {
+		return nil, ErrDatabaseClosed
+	}
+	if d.snapshot || d.reader {
+		return nil, ErrReadOnly
+	}
+	if d.activeID == maxSegmentID {
+		return nil, nil
+	}
+	if e := d.rotate(); e != nil {
+		return nil, e
+	}
+	view := &DB{
+		kToPos:    d.kToPos.clone(),
+		expiries:  make(map[string]int64, len(d.expiries)),
+		location:  d.location,
+		activeID:  d.activeID,
+		sealed:    make(map[uint32]*segment, len(d.sealed)),
+		opts:      d.opts,
+		sum:       d.sum,
+		snapshot:  true,
+		evictions: d.evictions,
+	}
+	for k, expiry := range d.expiries {
+		view.expiries[k] = expiry
+	}
+	if d.history != nil {
+		view.history = make(map[string][]offsetAndLength, len(d.history))
+		for k, h := range d.history {
+			view.history[k] = append([]offsetAndLength{}, h...)
+		}
+	}
+	for id, seg := range d.sealed {
+		view.sealed[id] = seg
+	}
+	return view, nil
 }
 
-// Inserts or updates the given key with the given value.
-func (d *DB) Upsert(k, v []byte) {
+// Removes the given key from the DB, recording it as deleted.  Returns any
+// error writing the record, in which case the key is left in place.
+func (d *DB) Remove(k []byte) error {
+	defer d.endOp(OpWrite, d.startOp())
+	if len(k) > keyLenMask {
+		return ErrKeyTooLarge
+	}
+	if d.writes != nil {
+		return <-d.enqueue(&writeRequest{k, nil, true, make(chan error, 1)})
+	}
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	doc := newDocument(k, v)
-	d.kToPos[string(k)] = getOAL(d.filledSize, k, v)
-	d.filehandle.Write(doc)
-	d.filledSize += uint64(len(doc))
-	if d.filledSize > uint64(len(d.filebuffer)) {
-		newLen := len(d.filebuffer) * 2
-		syscall.Munmap(d.filebuffer)
-		mmap, _ := syscall.Mmap(int(d.filehandle.Fd()), 0, newLen, syscall.PROT_READ, syscall.MAP_SHARED)
-		d.filebuffer = mmap
+	return d.remove(k)
+}
+
+// Writes a tombstone for the given key and drops it from the index.  Assumes
+// the write lock is held.
+func (d *DB) remove(k []byte) error {
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	r := newRecord(k, []byte{}, 0)
+	e := d.sealRecord(&r)
+	if e != nil {
+		return e
+	}
+	_, e = d.appendRecord(&r)
+	if e != nil {
+		return e
+	}
+	d.io.logical.Add(uint64(len(k)))
+	d.drop(string(k))
+	d.tombstones[d.activeID]++
+	return nil
+}
+
+// Inserts or updates the given key with the given value.  Returns any error
+// writing the record, in which case the previous value is left in place.
+func (d *DB) Upsert(k, v []byte) error {
+	defer d.endOp(OpWrite, d.startOp())
+	if d.writes != nil {
+		if e := d.checkSizes(k, uint64(len(v))); e != nil {
+			return e
+		}
+		return <-d.enqueue(&writeRequest{k, v, false, make(chan error, 1)})
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.upsert(k, v, 0, 0)
+}
+
+// Writes the given key and value with the given expiry and user flags, and
+// points the index at them.  Assumes the write lock is held.
+func (d *DB) upsert(k, v []byte, expiry int64, flags uint8) error {
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	e := d.checkSizes(k, uint64(len(v)))
+	if e != nil {
+		return e
+	}
+	r := newRecord(k, v, expiry)
+	if flags != 0 {
+		r.flags |= userFlagsFlag
+		r.userFlags = flags
+	}
+	e = d.compressRecord(&r)
+	if e == nil {
+		e = d.sealRecord(&r)
+	}
+	if e != nil {
+		return e
 	}
+	pos, e := d.appendRecord(&r)
+	if e != nil {
+		return e
+	}
+	d.io.logical.Add(uint64(len(k) + len(v)))
+	r.pos = pos
+	d.point(string(k), r.oal(d.activeID))
+	if expiry != 0 {
+		d.expiries[string(k)] = expiry
+	} else {
+		delete(d.expiries, string(k))
+	}
+	d.evict()
+	return nil
+}
+
+// Points the index for the given key at a newly written document.  Assumes
+// the write lock is held.
+func (d *DB) point(k string, oal offsetAndLength) {
+	if old, present := d.kToPos.get(k); present {
+		d.forget(k)
+		d.retain(k, old)
+	} else if d.ordered != nil {
+		d.ordered.insert(k)
+	}
+	d.kToPos.set(k, oal)
+	d.filterKey(k, oal.segment)
+	d.liveBytes[oal.segment] += oal.docSize()
+	if d.evictions != nil {
+		d.evictions.written(k)
+	}
+	d.logIndex(k)
+	d.invalidateView()
+}
+
+// Removes the given key from the index.  Assumes the write lock is held.
+func (d *DB) drop(k string) {
+	if _, present := d.kToPos.get(k); !present {
+		return
+	}
+	d.forget(k)
+	d.forgetHistory(k)
+	d.kToPos.remove(k)
+	delete(d.expiries, k)
+	if d.evictions != nil {
+		d.evictions.remove(k)
+	}
+	if d.ordered != nil {
+		d.ordered.remove(k)
+	}
+	d.logIndex(k)
+	d.invalidateView()
 }
 
 // Returns the value associated with the given key, and whether it is present.
 func (d *DB) Get(k []byte) (string, bool) {
+	defer d.endOp(OpRead, d.startOp())
+	var val string
+	if present, ok := d.readView(k, func(v []byte) { val = string(v) }); ok {
+		return val, present
+	}
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return "", false
+	}
+	e := d.withVal(oal, func(v []byte) { val = string(v) })
+	return val, e == nil
+}
+
+// Returns a copy of the value associated with the given key.  Unlike Get,
+// this distinguishes why a value couldn't be returned: ErrKeyNotFound if the
+// key is absent or expired, or ErrDatabaseClosed if the DB has been closed.
+func (d *DB) Lookup(k []byte) ([]byte, error) {
+	defer d.endOp(OpRead, d.startOp())
+	var val []byte
+	if present, ok := d.readView(k, func(v []byte) { val = append([]byte{}, v...) }); ok {
+		if !present {
+			return nil, ErrKeyNotFound
+		}
+		return val, nil
+	}
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	if d.closed {
+		return nil, ErrDatabaseClosed
+	}
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return nil, ErrKeyNotFound
+	}
+	v, e := d.getVal(oal)
+	if e != nil || oal.compressed() {
+		return v, e
+	}
+	return append([]byte{}, v...), nil
+}
+
+// Returns copies of the values associated with the given keys, resolved under
+// a single read lock.  Keys that are absent or expired are left out.
+func (d *DB) GetMany(keys [][]byte) map[string][]byte {
+	defer d.endOp(OpRead, d.startOp())
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
-	oal, present := d.kToPos[string(k)]
-	if !present {
-		return "", false
+	out := make(map[string][]byte, len(keys))
+	t := now()
+	for _, k := range keys {
+		oal, present := d.lookup(k)
+		if !present || d.expired(string(k), t) {
+			continue
+		}
+		v, e := d.getVal(oal)
+		if e != nil {
+			continue
+		}
+		if !oal.compressed() {
+			v = append([]byte{}, v...)
+		}
+		out[string(k)] = v
+	}
+	return out
+}
+
+// Returns a copy of the value associated with the given key, and whether it
+// is present.
+func (d *DB) GetBytes(k []byte) ([]byte, bool) {
+	return d.GetInto(k, nil)
+}
+
+// Appends the value associated with the given key to buf, returning the
+// extended slice and whether the key is present.  Passing a reused buffer's
+// buf[:0] avoids allocating on every read.
+func (d *DB) GetInto(k, buf []byte) ([]byte, bool) {
+	defer d.endOp(OpRead, d.startOp())
+	if present, ok := d.readView(k, func(v []byte) { buf = append(buf, v...) }); ok {
+		return buf, present
+	}
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return buf, false
+	}
+	e := d.withVal(oal, func(v []byte) { buf = append(buf, v...) })
+	return buf, e == nil
+}
+
+// Returns the value associated with the given key without copying it, and
+// whether it is present.  The slice points directly into the mapped data
+// file, so it must not be modified (doing so faults), and must not be used
+// after any subsequent write to or compaction of the DB, either of which may
+// unmap the memory beneath it.  Intended only for short-lived reads, such as
+// decoding or hashing a value in place.  Values stored compressed are
+// necessarily returned as a fresh copy.
+func (d *DB) GetZeroCopy(k []byte) ([]byte, bool) {
+	defer d.endOp(OpRead, d.startOp())
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return nil, false
 	}
-	out := d.getValAtOAL(oal)
-	return string(out), true
+	v, e := d.getVal(oal)
+	if e != nil {
+		return nil, false
+	}
+	return v, true
 }
 
 // Returns whether the given key exists in the DB.  Does not need to hit disk
 // (unless you're under such memory pressure that you're swapping the keyfile
 // as well).
 func (d *DB) Contains(k []byte) bool {
-	d.mutex.RLock()
-	defer d.mutex.RUnlock()
-	_, present := d.kToPos[string(k)]
-	return present
+	if present, ok := d.readView(k, nil); ok {
+		return present
+	}
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	_, present := d.lookup(k)
+	return present && !d.expired(string(k), now())
 }
@@ -0,0 +1,149 @@
+package bitcesque
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// An encrypted document's value field holds a random nonce followed by the
+// sealed plaintext, with every other header field and the key authenticated
+// as additional data.  With sealedKeyFlag also set, the key is sealed along
+// with the value, as a uvarint length and the key preceding the value, and
+// the document's key field is left empty.  Tombstones are sealed too, so that
+// only the holder of the key can tell them apart from upserts.
+
+// Keyfile header flag marking the entries as sealed.
+const keyfileSealed = 1
+
+// Returns an AES-GCM cipher for use as Options.Encryption, given a 16, 24 or
+// 32 byte key.  Any other cipher.AEAD, such as ChaCha20-Poly1305, may be used
+// in its place.
+func NewAESGCM(key []byte) (cipher.AEAD, error) {
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the fields of the record's header other than the checksum and value
+// length, followed by its key field, as authenticated with an encrypted value.
+// The value length is covered implicitly by the ciphertext's, and the flag
+// saying how wide the checksum is left out, as that may change on encoding.
+func (r *record) aad() []byte {
+	flags := r.flags &^ wideChecksumFlag
+	out := make([]byte, 4, int(docPrefix(flags, len(r.key)))-8)
+	uint32ToBytes(out, 0, flags|uint32(len(r.key)))
+	if flags&expiryFlag != 0 {
+		out = out[:len(out)+8]
+		uint64ToBytes(out, uint64(len(out)-8), uint64(r.expiry))
+	}
+	if flags&timestampFlag != 0 {
+		out = out[:len(out)+8]
+		uint64ToBytes(out, uint64(len(out)-8), uint64(r.timestamp))
+	}
+	if flags&userFlagsFlag != 0 {
+		out = append(out, r.userFlags)
+	}
+	return append(out, r.key...)
+}
+
+// Encrypts the record's value, and its key too if sealKeys is set.
+func sealRecord(aead cipher.AEAD, r *record, sealKeys bool) error {
+	plain := r.value
+	r.flags |= encryptedFlag
+	if sealKeys {
+		r.flags |= sealedKeyFlag
+		plain = binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(r.key)+len(r.value)), uint64(len(r.key)))
+		plain = append(plain, r.key...)
+		plain = append(plain, r.value...)
+		r.key = nil
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	_, e := rand.Read(nonce)
+	if e != nil {
+		return e
+	}
+	r.value = aead.Seal(nonce, nonce, plain, r.aad())
+	return nil
+}
+
+// Decrypts the record in place, if it is encrypted, clearing the flags that
+// say so.
+func openRecord(aead cipher.AEAD, r *record) error {
+	if r.flags&encryptedFlag == 0 {
+		return nil
+	}
+	if aead == nil || len(r.value) < aead.NonceSize() {
+		return ErrDecryption
+	}
+	n := aead.NonceSize()
+	plain, e := aead.Open(nil, r.value[:n], r.value[n:], r.aad())
+	if e != nil {
+		return ErrDecryption
+	}
+	if r.flags&sealedKeyFlag != 0 {
+		kLen, i := binary.Uvarint(plain)
+		if i <= 0 || uint64(len(plain)-i) < kLen {
+			return ErrDecryption
+		}
+		r.key = plain[i : i+int(kLen)]
+		plain = plain[i+int(kLen):]
+	}
+	r.flags &^= encryptedFlag | sealedKeyFlag
+	r.value = plain
+	return nil
+}
+
+// Encrypts the record as the DB is configured to, if at all, failing if it
+// no longer fits in a document.
+func (d *DB) sealRecord(r *record) error {
+	if d.opts.Encryption != nil {
+		e := sealRecord(d.opts.Encryption, r, d.opts.EncryptKeys)
+		if e != nil {
+			return e
+		}
+	}
+	return checkRecord(r)
+}
+
+// Returns the given record decrypted, then compressed and encrypted as the
+// DB is currently configured to, for rewriting during compaction.
+func (d *DB) rewriteRecord(r record) (record, error) {
+	e := openRecord(d.opts.Encryption, &r)
+	if e != nil {
+		return r, e
+	}
+	r, e = d.recompressRecord(r)
+	if e != nil {
+		return r, e
+	}
+	e = d.sealRecord(&r)
+	return r, e
+}
+
+// Returns the given keyfile entries sealed with aead, authenticating the
+// keyfile header.
+func sealKeyfile(aead cipher.AEAD, header, entries []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(entries)+aead.Overhead())
+	_, e := rand.Read(nonce)
+	if e != nil {
+		return nil, e
+	}
+	return aead.Seal(nonce, nonce, entries, header), nil
+}
+
+// Returns the keyfile entries sealed by sealKeyfile.
+func openKeyfile(aead cipher.AEAD, header, sealed []byte) ([]byte, error) {
+	if aead == nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrDecryption
+	}
+	n := aead.NonceSize()
+	out, e := aead.Open(nil, sealed[:n], sealed[n:], header)
+	if e != nil {
+		return nil, ErrDecryption
+	}
+	return out, nil
+}
@@ -0,0 +1,71 @@
+package bitcesque
+
+import (
+	"errors"
+	"math"
+)
+
+// Errors returned by DB operations, to be compared against with errors.Is.
+var (
+	ErrKeyNotFound    = errors.New("Key not found")
+	ErrDatabaseClosed = errors.New("Database is closed")
+	ErrCorrupt        = errors.New("Corruption detected")
+	ErrKeyTooLarge    = errors.New("Key too large")
+	ErrValueTooLarge  = errors.New("Value too large")
+	ErrNotInteger     = errors.New("Value is not an integer")
+	ErrOverflow       = errors.New("Integer overflow")
+	ErrQuotaExceeded  = errors.New("Disk quota exceeded")
+	ErrStop           = errors.New("Iteration stopped")
+	ErrConflict       = errors.New("Transaction conflicts with a concurrent write")
+	ErrTxnDone        = errors.New("Transaction already committed or rolled back")
+	ErrReadOnly       = errors.New("Database is read-only")
+
+	// Returned when reading a value written with a codec that hasn't been
+	// registered.
+	ErrUnknownCodec = errors.New("Value compressed with unknown codec")
+
+	// Returned when an encrypted record or keyfile can't be read, because no
+	// cipher is configured, the wrong key is in use, or the data was tampered
+	// with.
+	ErrDecryption = errors.New("Record could not be decrypted")
+
+	// Returned when opening a file written in a format version this package
+	// does not understand, e.g. by a newer release.
+	ErrUnsupportedVersion = errors.New("Unsupported file format version")
+
+	// Returned when opening a DB that another handle, in this process or any
+	// other, already has open.
+	ErrDatabaseLocked = errors.New("Database is locked by another process")
+
+	// Returned by UpsertIfVersion and InsertWithVersion when the key no longer
+	// has the version, or presence, given.
+	ErrVersionMismatch = errors.New("Key has changed since the version given")
+
+	// Returned by ViewAt for an offset that isn't the end of a document in the
+	// log as it now stands.
+	ErrBadOffset = errors.New("Offset is not a record boundary in the retained log")
+)
+
+// Returns an error if the given key, or a value of the given length, is over
+// the limits set in the options or can't be represented in a document.
+func (d *DB) checkSizes(k []byte, vLen uint64) error {
+	if len(k) > keyLenMask || (d.opts.MaxKeySize > 0 && len(k) > d.opts.MaxKeySize) {
+		return ErrKeyTooLarge
+	}
+	if vLen > math.MaxUint32 || (d.opts.MaxValueSize > 0 && vLen > uint64(d.opts.MaxValueSize)) {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// Returns an error if the given record, as it will be written, can't be
+// represented in a document, since compression or encryption can grow it.
+func checkRecord(r *record) error {
+	if len(r.key) > keyLenMask {
+		return ErrKeyTooLarge
+	}
+	if uint64(len(r.value)) > math.MaxUint32 {
+		return ErrValueTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package bitcesque
+
+import (
+	"container/list"
+	"iter"
+	"sort"
+	"sync"
+)
+
+// Which records a DB with Options.CacheMaxBytes removes first.
+type EvictionPolicy int
+
+const (
+	// Removes the records written longest ago first.
+	EvictFIFO EvictionPolicy = iota
+	// Removes the records least recently written or read first.
+	EvictLRU
+)
+
+// The live keys of a DB in the order they are to be evicted.  Safe for
+// concurrent use, so that readers holding only a read lock can mark keys
+// used.
+type evictList struct {
+	mutex   sync.Mutex
+	lru     bool
+	entries map[string]*list.Element
+	order   *list.List //Next to be evicted first
+}
+
+// Returns a list of the keys in the given index, ordered by where their
+// records are stored, which for keys written since the last compaction is the
+// order they were written in.
+func newEvictList(m index, policy EvictionPolicy) *evictList {
+	type stored struct {
+		k   string
+		oal offsetAndLength
+	}
+	var keys []stored
+	for k, oal := range m.all() {
+		keys = append(keys, stored{k, oal})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i].oal, keys[j].oal
+		return a.segment < b.segment || a.segment == b.segment && a.offset < b.offset
+	})
+	l := &evictList{lru: policy == EvictLRU, entries: make(map[string]*list.Element, len(keys)), order: list.New()}
+	for _, s := range keys {
+		l.entries[s.k] = l.order.PushBack(s.k)
+	}
+	return l
+}
+
+// Moves the given key, written anew, to the back of the list.
+func (l *evictList) written(k string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if el, present := l.entries[k]; present {
+		l.order.MoveToBack(el)
+	} else {
+		l.entries[k] = l.order.PushBack(k)
+	}
+}
+
+// Moves the given key, just read, to the back of the list if the policy
+// cares about reads.
+func (l *evictList) read(k []byte) {
+	if !l.lru {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if el, present := l.entries[string(k)]; present {
+		l.order.MoveToBack(el)
+	}
+}
+
+// Takes the given key, removed, off the list.
+func (l *evictList) remove(k string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if el, present := l.entries[k]; present {
+		l.order.Remove(el)
+		delete(l.entries, k)
+	}
+}
+
+// Returns each key's place in the list.
+func (l *evictList) ranks() map[string]int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	out := make(map[string]int, len(l.entries))
+	i := 0
+	for el := l.order.Front(); el != nil; el = el.Next() {
+		out[el.Value.(string)] = i
+		i++
+	}
+	return out
+}
+
+// Returns the entries of the index in the order their keys are to be
+// evicted, if the DB is a cache, so that compaction writing them in that
+// order keeps it for reopening.  Keys not on the list come first.
+func (d *DB) inEvictionOrder() iter.Seq2[string, offsetAndLength] {
+	if d.evictions == nil {
+		return d.kToPos.all()
+	}
+	rank := d.evictions.ranks()
+	type ranked struct {
+		k    string
+		oal  offsetAndLength
+		rank int
+	}
+	entries := make([]ranked, 0, d.kToPos.len())
+	for k, oal := range d.kToPos.all() {
+		r, present := rank[k]
+		if !present {
+			r = -1
+		}
+		entries = append(entries, ranked{k, oal, r})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].rank < entries[j].rank })
+	return func(yield func(string, offsetAndLength) bool) {
+		for _, e := range entries {
+			if !yield(e.k, e.oal) {
+				return
+			}
+		}
+	}
+}
+
+// Removes keys, in the order Options.CacheEviction asks for, until the live
+// records take up no more than Options.CacheMaxBytes.  Eviction is best
+// effort: if the tombstones can't be written, the keys are left for the next
+// write to evict.  Assumes the write lock is held.
+func (d *DB) evict() {
+	if d.evictions == nil || d.readOnly() {
+		return
+	}
+	var live uint64
+	for _, n := range d.liveBytes {
+		live += n
+	}
+	if live <= d.opts.CacheMaxBytes {
+		return
+	}
+	b := d.NewBatch()
+	d.evictions.mutex.Lock()
+	for el := d.evictions.order.Front(); el != nil && live > d.opts.CacheMaxBytes; el = el.Next() {
+		k := el.Value.(string)
+		oal, _ := d.kToPos.get(k)
+		live -= min(live, oal.docSize())
+		b.Remove([]byte(k))
+	}
+	d.evictions.mutex.Unlock()
+	if b.err == nil && b.Len() > 0 {
+		b.commit()
+	}
+}
@@ -0,0 +1,24 @@
+package bitcesque
+
+// Inserts or updates the given key with the given value, recording alongside
+// it a byte of flags for the application's own use, e.g. to mark the value's
+// encoding, which Stat returns.  The flags are written into the record's
+// header, so cost a byte rather than a prefix on the value, and are kept by
+// compaction.  Later writes of the key replace them, with zero unless they
+// too give flags.
+func (d *DB) UpsertWithFlags(k, v []byte, flags uint8) error {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.upsert(k, v, 0, flags)
+}
+
+// Returns the user flags of the record oal points to.  Assumes at least a
+// read lock is held.
+func (d *DB) userFlags(oal offsetAndLength) uint8 {
+	if oal.format&(userFlagsFlag>>24) == 0 {
+		return 0
+	}
+	start := oal.offset - uint64(oal.prefix)
+	return decodeRecord(d.readSegment(oal.segment, start, uint64(oal.prefix)), start).userFlags
+}
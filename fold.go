@@ -0,0 +1,49 @@
+package bitcesque
+
+// Calls fn with every live pair, in no particular order, stopping at the
+// first error fn returns.  Returning ErrStop ends the fold early, and Fold
+// then returns nil; any other error is returned as is.  The pairs come from
+// a snapshot, so writers aren't held up meanwhile, and fn may itself write
+// to the DB without those writes being seen.  k and v are only valid during
+// the call.
+func (d *DB) Fold(fn func(k, v []byte) error) error {
+	if d.snapshot {
+		return d.fold(fn)
+	}
+	s, e := d.Snapshot()
+	if e != nil {
+		return e
+	}
+	e = s.fold(fn)
+	closeErr := s.Close()
+	if e == nil {
+		e = closeErr
+	}
+	return e
+}
+
+// Runs the fold described by Fold, holding a read lock throughout.
+func (d *DB) fold(fn func(k, v []byte) error) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if d.expired(k, t) {
+			continue
+		}
+		v, e := d.getVal(oal)
+		if e == nil {
+			e = fn([]byte(k), v)
+		}
+		if e == ErrStop {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
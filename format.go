@@ -0,0 +1,75 @@
+package bitcesque
+
+import "crypto/rand"
+
+// New data files and keyfiles begin with an 8 byte header: a 4 byte magic
+// number identifying the kind of file, a format version byte, a byte of flags
+// specific to the kind of file, and 2 bytes that data files fill at random,
+// so that a file can be told apart from a later one of the same name.  Files
+// from before the header existed are recognized by its absence and read as
+// version 0.  The flags byte of a data file gives the Checksum its documents
+// are checked with.
+const (
+	dataMagic     = "BCSQ"
+	keyfileMagic  = "BCSK"
+	formatVersion = 1
+	headerSize    = 8
+)
+
+// Returns the header to begin a new file of the kind identified by magic.
+func fileHeader(magic string) []byte {
+	out := make([]byte, headerSize)
+	copy(out, magic)
+	out[4] = formatVersion
+	if magic == dataMagic {
+		rand.Read(out[6:])
+	}
+	return out
+}
+
+// Returns the random tag from a data file's header, or 0 if it has none.
+func fileTag(buf []byte, size uint64) uint16 {
+	if dataStart(buf, size) != headerSize {
+		return 0
+	}
+	return uint16(buf[6]) | uint16(buf[7])<<8
+}
+
+// Returns how many header bytes precede the contents of a file of the kind
+// identified by magic, given a buffer holding its first size bytes: the
+// header's length, or 0 for files predating it.  Fails with
+// ErrUnsupportedVersion if the header names an unknown version.
+func checkHeader(buf []byte, size uint64, magic string) (uint64, error) {
+	if size < headerSize || string(buf[:4]) != magic {
+		return 0, nil
+	}
+	if buf[4] == 0 || buf[4] > formatVersion || magic == dataMagic && Checksum(buf[5]) > CRC64 {
+		return 0, ErrUnsupportedVersion
+	}
+	return headerSize, nil
+}
+
+// Returns the header to begin a new data file whose documents are checked
+// with the given algorithm.
+func dataHeader(c Checksum) []byte {
+	out := fileHeader(dataMagic)
+	out[5] = byte(c)
+	return out
+}
+
+// Returns the algorithm the documents of a data file are checked with, given
+// a buffer holding its first size bytes.
+func fileChecksum(buf []byte, size uint64) Checksum {
+	if dataStart(buf, size) != headerSize {
+		return CRC32C
+	}
+	return Checksum(buf[5])
+}
+
+// Returns how many header bytes precede the documents in a data file, given
+// a buffer holding its first size bytes.  The header has already been
+// checked on open.
+func dataStart(buf []byte, size uint64) uint64 {
+	start, _ := checkHeader(buf, size, dataMagic)
+	return start
+}
@@ -0,0 +1,211 @@
+package bitcesque
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A read-only view of a DB as a file system, from AsFS.
+type dbFS struct {
+	db *DB
+}
+
+// Returns a read-only file system whose files are the DB's keys, holding
+// their values, for use with anything that consumes an fs.FS.  Keys with /
+// separators appear within directories, which exist as long as a key lies
+// under them; keys that aren't valid fs paths, such as those starting or
+// ending with /, are not visible.  A key that is also a directory of other
+// keys opens as the file.  Each file is read whole on opening.
+func (d *DB) AsFS() fs.FS {
+	return dbFS{d}
+}
+
+func (f dbFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		v, e := f.db.Lookup([]byte(name))
+		if e == nil {
+			//Written since the lookup, the key's time may be a little late
+			stat, _ := f.db.Stat([]byte(name))
+			return &fsFile{bytes.NewReader(v), fsInfo{name, int64(len(v)), stat.Timestamp, false}}, nil
+		}
+		if e != ErrKeyNotFound {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: e}
+		}
+	}
+	entries := f.entries(name)
+	if entries == nil && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &fsDir{fsInfo{name, 0, time.Time{}, true}, entries}, nil
+}
+
+func (f dbFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+	v, e := f.db.Lookup([]byte(name))
+	if e == ErrKeyNotFound {
+		e = fs.ErrNotExist
+		if f.entries(name) != nil {
+			e = fs.ErrInvalid
+		}
+	}
+	if e != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: e}
+	}
+	return v, nil
+}
+
+func (f dbFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries := f.entries(name)
+	if entries == nil && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return entries, nil
+}
+
+func (f dbFS) Stat(name string) (fs.FileInfo, error) {
+	file, e := f.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+// Returns the entries of the given directory in name order, or nil if no key
+// lies under it.
+func (f dbFS) entries(dir string) []fs.DirEntry {
+	prefix := dir + "/"
+	if dir == "." {
+		prefix = ""
+	}
+	d := f.db
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	listed := make(map[string]int)
+	var out []fs.DirEntry
+	t := now()
+	for _, k := range d.keysInRange(prefix, prefixEnd([]byte(prefix))) {
+		if d.expired(k, t) || !fs.ValidPath(k) {
+			continue
+		}
+		name, _, isDir := strings.Cut(k[len(prefix):], "/")
+		info := fsInfo{name, 0, time.Time{}, isDir}
+		if !isDir {
+			oal, _ := d.kToPos.get(k)
+			stat, e := d.stat(oal)
+			if e != nil {
+				continue
+			}
+			info.size, info.modTime = int64(stat.Size), stat.Timestamp
+		}
+		i, seen := listed[name]
+		if seen {
+			//A key that is also a directory is listed once, as a file
+			if !isDir {
+				out[i] = fs.FileInfoToDirEntry(info)
+			}
+			continue
+		}
+		listed[name] = len(out)
+		out = append(out, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out
+}
+
+// Describes a key or directory.
+type fsInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i fsInfo) Name() string {
+	if i.name == "." {
+		return "."
+	}
+	return i.name[strings.LastIndexByte(i.name, '/')+1:]
+}
+
+func (i fsInfo) Size() int64 {
+	return i.size
+}
+
+func (i fsInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i fsInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i fsInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i fsInfo) Sys() any {
+	return nil
+}
+
+// An opened key, read from a copy of its value.
+type fsFile struct {
+	*bytes.Reader
+	info fsInfo
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *fsFile) Close() error {
+	return nil
+}
+
+// An opened directory.
+type fsDir struct {
+	info    fsInfo
+	entries []fs.DirEntry
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		out := d.entries
+		d.entries = nil
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	out := d.entries[:n]
+	d.entries = d.entries[n:]
+	return out, nil
+}
@@ -0,0 +1,144 @@
+package bitcesque
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// A hint file summarizes a sealed segment, so that OpenAndVerifyDB can index
+// it without reading its records.  After the header come the id, tag and
+// size of the segment, 16 bytes as for keyfile marks, then a keyfile-format
+// entry for each record in order, with tombstones given a zero length, and
+// a trailer as for keyfiles.  A hint whose mark doesn't match its segment is
+// stale and ignored.
+const hintMagic = "BCSH"
+
+// Returns where the hint file for the given segment is kept.
+func hintPath(location string, id uint32) string {
+	return segmentPath(location, id) + ".hint"
+}
+
+// Writes the hint file for the given sealed segment in the background, if
+// the options call for hint files, along with its filter file if filters are
+// kept.  Filters aren't written with encrypted keys, as they would reveal
+// which keys are present.  Assumes the write lock is held.
+func (d *DB) hintSegment(id uint32) {
+	if !d.opts.HintFiles {
+		return
+	}
+	d.background.Add(1)
+	go func() {
+		defer d.background.Done()
+		d.mutex.RLock()
+		seg := d.sealed[id]
+		//Close waits for this before unmapping the segment
+		if seg == nil || dataStart(seg.filebuffer, seg.size) != headerSize {
+			d.mutex.RUnlock()
+			return
+		}
+		buf, e := d.encodeHints(seg)
+		var filter []byte
+		if d.filters[id] != nil && !(d.opts.EncryptKeys && d.opts.Encryption != nil) {
+			filter = d.encodeFilter(seg)
+		}
+		d.mutex.RUnlock()
+		if e == nil {
+			e = writeFileAtomic(hintPath(d.location, id), buf)
+		}
+		if e != nil {
+			os.Remove(hintPath(d.location, id))
+		} else {
+			d.wroteFile(len(buf))
+		}
+		if filter == nil {
+			return
+		}
+		if writeFileAtomic(filterPath(d.location, id), filter) != nil {
+			os.Remove(filterPath(d.location, id))
+		} else {
+			d.wroteFile(len(filter))
+		}
+	}()
+}
+
+// Returns the contents of a hint file for the given segment.  Assumes at
+// least a read lock is held.
+func (d *DB) encodeHints(seg *segment) ([]byte, error) {
+	header := fileHeader(hintMagic)
+	mark := make([]byte, markSize)
+	uint32ToBytes(mark, 0, seg.id)
+	tag := fileTag(seg.filebuffer, seg.size)
+	mark[4], mark[5] = byte(tag), byte(tag>>8)
+	uint64ToBytes(mark, 8, seg.size)
+	var out []byte
+	s := newScanner(seg.filebuffer, seg.filehandle)
+	defer s.release()
+	_, e := s.scan(headerSize, seg.size, func(r *record) error {
+		oal := r.oal(seg.id)
+		e := openRecord(d.opts.Encryption, r)
+		if e != nil {
+			return e
+		}
+		if len(r.value) == 0 {
+			oal = offsetAndLength{}
+		}
+		out = appendEntry(out, string(r.key), oal, r.expiry)
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	if d.opts.EncryptKeys && d.opts.Encryption != nil {
+		header[5] |= keyfileSealed
+		out, e = sealKeyfile(d.opts.Encryption, header, out)
+		if e != nil {
+			return nil, e
+		}
+	}
+	buf := append(append(header, mark...), out...)
+	trailer := make([]byte, trailerSize)
+	uint32ToBytes(trailer, 0, uint32(len(mark)+len(out)))
+	buf = append(buf, trailer[:4]...)
+	uint32ToBytes(trailer, 4, crc32.Checksum(buf, crcTable))
+	return append(buf, trailer[4:]...), nil
+}
+
+// Returns the index fragment recorded by the hint file for the given
+// segment, or an error if there is none or it is stale or damaged.
+func (v *verifier) readHints(seg *segment) (*fragment, error) {
+	buf, e := os.ReadFile(hintPath(v.location, seg.id))
+	if e != nil {
+		return nil, e
+	}
+	pos, e := checkHeader(buf, uint64(len(buf)), hintMagic)
+	if e == nil && pos != headerSize {
+		e = fmt.Errorf("%w in hint file: no header", ErrCorrupt)
+	}
+	var entries []byte
+	if e == nil {
+		entries, e = checkTrailer(buf)
+	}
+	if e == nil && len(entries) < markSize {
+		e = fmt.Errorf("%w in hint file: truncated", ErrCorrupt)
+	}
+	if e != nil {
+		return nil, e
+	}
+	tag := uint16(entries[4]) | uint16(entries[5])<<8
+	if dataStart(seg.filebuffer, seg.size) != headerSize || uint32FromBytes(entries, 0) != seg.id || tag != fileTag(seg.filebuffer, seg.size) || uint64FromBytes(entries, 8) != seg.size {
+		return nil, fmt.Errorf("%w in hint file: stale", ErrCorrupt)
+	}
+	entries = entries[markSize:]
+	if buf[5]&keyfileSealed != 0 {
+		entries, e = openKeyfile(v.aead, buf[:headerSize], entries)
+		if e != nil {
+			return nil, e
+		}
+	}
+	f := newFragment()
+	eachEntry(entries, func(k string, oal offsetAndLength, expiry int64) {
+		f.index(k, oal, expiry, oal.length == 0, v.t)
+	})
+	return f, nil
+}
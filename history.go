@@ -0,0 +1,73 @@
+package bitcesque
+
+// Returns the value the given key held n writes ago, with 0 giving the
+// current value, and whether that version is still known.  Only as many
+// earlier versions as Options.KeepVersions asks for are kept.
+func (d *DB) GetVersion(k []byte, n int) ([]byte, bool) {
+	defer d.endOp(OpRead, d.startOp())
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	oal, present := d.lookup(k)
+	if !present || n < 0 || d.expired(string(k), now()) {
+		return nil, false
+	}
+	if n > 0 {
+		h := d.history[string(k)]
+		if n > len(h) {
+			return nil, false
+		}
+		oal = h[n-1]
+	}
+	v, e := d.ownedVal(oal)
+	return v, e == nil
+}
+
+// Returns the known versions of the given key's value, newest first, starting
+// with the current value, or nil if the key is absent.
+func (d *DB) History(k []byte) [][]byte {
+	defer d.endOp(OpRead, d.startOp())
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return nil
+	}
+	h := d.history[string(k)]
+	out := make([][]byte, 0, len(h)+1)
+	for _, version := range append([]offsetAndLength{oal}, h...) {
+		v, e := d.ownedVal(version)
+		if e != nil {
+			break
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// Keeps the given key's overwritten record as its latest earlier version, if
+// the options ask for versions, forgetting the oldest beyond their number.
+// Retained records count as live.  Assumes the write lock is held.
+func (d *DB) retain(k string, old offsetAndLength) {
+	n := d.opts.KeepVersions
+	if n <= 0 {
+		return
+	}
+	if d.history == nil {
+		d.history = make(map[string][]offsetAndLength)
+	}
+	h := append([]offsetAndLength{old}, d.history[k]...)
+	d.liveBytes[old.segment] += old.docSize()
+	for _, oal := range h[min(n, len(h)):] {
+		d.liveBytes[oal.segment] -= oal.docSize()
+	}
+	d.history[k] = h[:min(n, len(h))]
+}
+
+// Forgets the earlier versions of the given key.  Assumes the write lock is
+// held.
+func (d *DB) forgetHistory(k string) {
+	for _, oal := range d.history[k] {
+		d.liveBytes[oal.segment] -= oal.docSize()
+	}
+	delete(d.history, k)
+}
@@ -0,0 +1,62 @@
+//go:build badger
+
+package bitcesque
+
+import (
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Upserts every live pair of the Badger store in dir, which is opened
+// read-only, so may not be open elsewhere.  Pairs with a TTL keep it, and
+// those already expired are skipped.  Pairs are committed in batches as they
+// are read, so on error those already committed remain imported.  Depends on
+// github.com/dgraph-io/badger/v4, so only built with the badger build tag.
+func (d *DB) ImportBadger(dir string) error {
+	src, e := badger.Open(badger.DefaultOptions(dir).WithReadOnly(true).WithLogger(nil))
+	if e != nil {
+		return e
+	}
+	defer src.Close()
+	b := d.NewBatch()
+	e = src.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			v, e := item.ValueCopy(nil)
+			if e != nil {
+				return e
+			}
+			if expiry := item.ExpiresAt(); expiry != 0 {
+				ttl := time.Until(time.Unix(int64(expiry), 0))
+				if ttl <= 0 {
+					continue
+				}
+				//Batches don't carry expiries, so keep order by flushing first
+				e = b.Commit()
+				if e == nil {
+					e = d.UpsertWithTTL(item.KeyCopy(nil), v, ttl)
+				}
+			} else {
+				b.Upsert(item.Key(), v)
+				if b.Len() >= importBatchSize {
+					e = b.Commit()
+				}
+			}
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if e != nil {
+		b.Reset()
+		return e
+	}
+	return b.Commit()
+}
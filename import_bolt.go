@@ -0,0 +1,46 @@
+//go:build bolt
+
+package bitcesque
+
+import (
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Upserts every pair in the given top-level bucket of the BoltDB file at
+// path, which is opened read-only, so may not be open elsewhere for writing.
+// Nested buckets are skipped.  Pairs are committed in batches as they are
+// read, so on error those already committed remain imported.  Depends on
+// go.etcd.io/bbolt, so only built with the bolt build tag.
+func (d *DB) ImportBolt(path, bucket string) error {
+	src, e := bolt.Open(path, 0400, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if e != nil {
+		return e
+	}
+	defer src.Close()
+	b := d.NewBatch()
+	e = src.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return errors.New("No bucket " + bucket + " in " + path)
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			//Staging copies the pair, which is only valid during the transaction
+			b.Upsert(k, v)
+			if b.Len() >= importBatchSize {
+				return b.Commit()
+			}
+			return nil
+		})
+	})
+	if e != nil {
+		b.Reset()
+		return e
+	}
+	return b.Commit()
+}
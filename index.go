@@ -0,0 +1,381 @@
+package bitcesque
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/maphash"
+	"iter"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// Keys are packed into arenas of this many bytes, bar any longer ones,
+	// which get an arena to themselves.
+	arenaSize = 1 << 20
+	// As arenaSize, for indexes kept on disk, where fewer mappings are better.
+	diskArenaSize = 64 << 20
+	// Bits of a key's arena reference giving its offset within the arena.
+	arenaShift = 28
+)
+
+// The DB's index from keys to the documents holding their current values: a
+// map, or a compactIndex where Options.CompactIndex asks for one.  Like a map,
+// copies of it share the same entries.
+type index struct {
+	m       map[string]offsetAndLength
+	compact *compactIndex
+}
+
+// Returns an empty index of the kind the given options, which may be nil, ask
+// for, with room for about n keys.  An index kept on disk has its scratch
+// files beside the given location.
+func newIndex(opts *Options, location string, n int) index {
+	if opts == nil || !opts.CompactIndex && !opts.DiskIndex {
+		return index{make(map[string]offsetAndLength, n), nil}
+	}
+	c := &compactIndex{seed: maphash.MakeSeed()}
+	if opts.DiskIndex {
+		c.location = location
+	}
+	if n > 0 {
+		c.resize(n)
+	}
+	return index{nil, c}
+}
+
+// Returns the entry for the given key, and whether it has one.
+func (x index) lookup(k []byte) (offsetAndLength, bool) {
+	if x.compact != nil {
+		return x.compact.lookup(k)
+	}
+	oal, present := x.m[string(k)]
+	return oal, present
+}
+
+// As lookup, for a key held as a string.
+func (x index) get(k string) (offsetAndLength, bool) {
+	if x.compact != nil {
+		return x.compact.get(k)
+	}
+	oal, present := x.m[k]
+	return oal, present
+}
+
+// Points the given key at the given document.
+func (x index) set(k string, oal offsetAndLength) {
+	if x.compact != nil {
+		x.compact.set(k, oal)
+	} else {
+		x.m[k] = oal
+	}
+}
+
+// Removes the given key, if present.
+func (x index) remove(k string) {
+	if x.compact != nil {
+		x.compact.remove(k)
+	} else {
+		delete(x.m, k)
+	}
+}
+
+// Returns the number of keys in the index.
+func (x index) len() int {
+	if x.compact != nil {
+		return x.compact.n
+	}
+	return len(x.m)
+}
+
+// Returns the entries of the index, in no particular order.  Entries may be
+// overwritten while iterating, but, unlike with a map, none may be added or
+// removed.
+func (x index) all() iter.Seq2[string, offsetAndLength] {
+	if x.compact != nil {
+		return x.compact.all
+	}
+	return func(yield func(string, offsetAndLength) bool) {
+		for k, oal := range x.m {
+			if !yield(k, oal) {
+				return
+			}
+		}
+	}
+}
+
+// Returns a copy of the index that changes independently of it.
+func (x index) clone() index {
+	if x.compact != nil {
+		return index{nil, x.compact.clone()}
+	}
+	m := make(map[string]offsetAndLength, len(x.m))
+	for k, oal := range x.m {
+		m[k] = oal
+	}
+	return index{m, nil}
+}
+
+// An index kept in a few large allocations rather than one per key, for DBs
+// with too many keys for a map to hold economically.  Keys are packed into
+// arenas, each preceded by its length, and found through an open-addressed
+// table of slots, probed linearly from their hash.  Each key costs its
+// length plus 30 to 55 bytes, depending on how full the table is, against a
+// map's hundred or so, at some cost in speed.
+//
+// Given a location, the arenas and table are instead mapped from scratch
+// files there, leaving the OS to page them in and out.
+type compactIndex struct {
+	seed     maphash.Seed
+	slots    []slot
+	n        int //Occupied slots
+	arenas   [][]byte
+	dead     int        //Arena bytes taken up by removed keys, roughly
+	location string     //Where scratch files go, if the index is kept on disk
+	mapped   []*scratch //Mappings of the arenas, which clones share
+	table    *scratch   //Mapping of the slots, which are the index's own
+}
+
+// An entry of a compactIndex, holding an offsetAndLength with its prefix,
+// which the key's length implies, left out.
+type slot struct {
+	pos    uint64 //Segment and offset of the value, as keyfile entries pack them
+	length uint32
+	key    uint32 //Low bits of the key's arena reference
+	keyHi  uint16 //High bits of the key's arena reference, which is zero for an empty slot
+	format uint8
+}
+
+// Returns the offsetAndLength the given slot, with a key of the given length,
+// holds.
+func (s slot) oal(kLen int) offsetAndLength {
+	return offsetAndLength{s.pos & (1<<segmentShift - 1), uint32(s.pos >> segmentShift), s.length, docPrefix(uint32(s.format)<<24, kLen), s.format}
+}
+
+// Returns whether the slot holds an entry.
+func (s slot) used() bool {
+	return s.ref() != 0
+}
+
+// Returns the given offsetAndLength as a slot for the key with the given
+// arena reference.
+func newSlot(ref uint64, oal offsetAndLength) slot {
+	return slot{uint64(oal.segment)<<segmentShift | oal.offset, oal.length, uint32(ref), uint16(ref >> 32), oal.format}
+}
+
+// Returns the arena reference of the given slot's key.
+func (s slot) ref() uint64 {
+	return uint64(s.keyHi)<<32 | uint64(s.key)
+}
+
+// Returns the key with the given arena reference in the given arenas.  The
+// reference is one more than the arena number, shifted up arenaShift bits,
+// plus the key's offset within it.  Keys longer than an arena start their
+// own, so offsets fit.
+func arenaKey(arenas [][]byte, ref uint64) []byte {
+	a := arenas[ref>>arenaShift-1]
+	n, l := binary.Uvarint(a[ref&(1<<arenaShift-1):])
+	start := ref&(1<<arenaShift-1) + uint64(l)
+	return a[start : start+n]
+}
+
+func (c *compactIndex) key(ref uint64) []byte {
+	return arenaKey(c.arenas, ref)
+}
+
+// Returns a zeroed buffer of the given size, mapped if the index is on disk.
+func (c *compactIndex) alloc(size int) []byte {
+	if c.location == "" {
+		return make([]byte, size)
+	}
+	s := newScratch(c.location, size)
+	c.mapped = append(c.mapped, s)
+	return s.buf
+}
+
+// Copies the given key into an arena, returning its reference.
+func (c *compactIndex) store(k string) uint64 {
+	need := binary.MaxVarintLen32 + len(k)
+	last := len(c.arenas) - 1
+	if last < 0 || cap(c.arenas[last])-len(c.arenas[last]) < need {
+		c.arenas = append(c.arenas, c.alloc(max(c.arenaSize(), need))[:0])
+		last++
+	}
+	a := c.arenas[last]
+	ref := uint64(last+1)<<arenaShift | uint64(len(a))
+	c.arenas[last] = append(binary.AppendUvarint(a, uint64(len(k))), k...)
+	return ref
+}
+
+// Returns the index of the slot holding the key with the given hash that eq
+// accepts, and whether there is one; if not, the empty slot it would go in.
+func (c *compactIndex) probe(h uint64, eq func(k []byte) bool) (int, bool) {
+	if len(c.slots) == 0 {
+		return 0, false
+	}
+	mask := uint64(len(c.slots) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		s := c.slots[i]
+		if !s.used() {
+			return int(i), false
+		}
+		if eq(c.key(s.ref())) {
+			return int(i), true
+		}
+	}
+}
+
+func (c *compactIndex) lookup(k []byte) (offsetAndLength, bool) {
+	i, present := c.probe(maphash.Bytes(c.seed, k), func(b []byte) bool {
+		return bytes.Equal(b, k)
+	})
+	if !present {
+		return offsetAndLength{}, false
+	}
+	return c.slots[i].oal(len(k)), true
+}
+
+// Returns the slot index of the given key, and whether it is present.
+func (c *compactIndex) find(k string) (int, bool) {
+	return c.probe(maphash.String(c.seed, k), func(b []byte) bool {
+		return string(b) == k
+	})
+}
+
+func (c *compactIndex) get(k string) (offsetAndLength, bool) {
+	i, present := c.find(k)
+	if !present {
+		return offsetAndLength{}, false
+	}
+	return c.slots[i].oal(len(k)), true
+}
+
+func (c *compactIndex) set(k string, oal offsetAndLength) {
+	i, present := c.find(k)
+	if present {
+		c.slots[i] = newSlot(c.slots[i].ref(), oal)
+		return
+	}
+	if (c.n+1)*8 > len(c.slots)*7 {
+		c.resize(c.n + 1)
+		i, _ = c.find(k)
+	}
+	c.slots[i] = newSlot(c.store(k), oal)
+	c.n++
+}
+
+// Removes the given key, shifting back any entries after it that probing
+// would otherwise no longer reach.
+func (c *compactIndex) remove(k string) {
+	i, present := c.find(k)
+	if !present {
+		return
+	}
+	c.dead += binary.MaxVarintLen32 + len(k)
+	mask := len(c.slots) - 1
+	for j := (i + 1) & mask; c.slots[j].used(); j = (j + 1) & mask {
+		home := int(maphash.Bytes(c.seed, c.key(c.slots[j].ref()))) & mask
+		//The entry stays put if its home lies cyclically in (i, j]
+		if (j > i && (home <= i || home > j)) || (j < i && home <= i && home > j) {
+			c.slots[i] = c.slots[j]
+			i = j
+		}
+	}
+	c.slots[i] = slot{}
+	c.n--
+	if c.dead >= c.arenaSize() && c.dead*2 >= c.arenaBytes() {
+		c.repack()
+	}
+}
+
+// Returns the size of the index's arenas.
+func (c *compactIndex) arenaSize() int {
+	if c.location != "" {
+		return diskArenaSize
+	}
+	return arenaSize
+}
+
+// Returns the bytes the arenas take up.
+func (c *compactIndex) arenaBytes() int {
+	n := 0
+	for _, a := range c.arenas {
+		n += cap(a)
+	}
+	return n
+}
+
+// Rebuilds the table with room for n keys at most half full.
+func (c *compactIndex) resize(n int) {
+	size := 16
+	for size < 2*n {
+		size *= 2
+	}
+	old, oldTable := c.slots, c.table
+	c.slots, c.table = c.allocSlots(size)
+	for _, s := range old {
+		if !s.used() {
+			continue
+		}
+		i, _ := c.probe(maphash.Bytes(c.seed, c.key(s.ref())), func([]byte) bool {
+			return false
+		})
+		c.slots[i] = s
+	}
+	if oldTable != nil {
+		oldTable.release()
+	}
+}
+
+// Returns a zeroed table of n slots, and its mapping if the index is on disk.
+func (c *compactIndex) allocSlots(n int) ([]slot, *scratch) {
+	if c.location == "" {
+		return make([]slot, n), nil
+	}
+	s := newScratch(c.location, n*int(unsafe.Sizeof(slot{})))
+	return unsafe.Slice((*slot)(unsafe.Pointer(unsafe.SliceData(s.buf))), n), s
+}
+
+// Copies the live keys into fresh arenas, leaving behind those removed.
+func (c *compactIndex) repack() {
+	old, oldMapped := c.arenas, c.mapped
+	//Any clones keep the old mappings alive as long as they need them
+	c.arenas, c.dead, c.mapped = nil, 0, nil
+	for i, s := range c.slots {
+		if !s.used() {
+			continue
+		}
+		ref := c.store(string(arenaKey(old, s.ref())))
+		c.slots[i].key, c.slots[i].keyHi = uint32(ref), uint16(ref>>32)
+	}
+	//The arenas are only slices of the mappings, which are unmapped once
+	//collected, so they must outlive the copying
+	runtime.KeepAlive(oldMapped)
+}
+
+func (c *compactIndex) all(yield func(string, offsetAndLength) bool) {
+	for _, s := range c.slots {
+		if !s.used() {
+			continue
+		}
+		k := c.key(s.ref())
+		if !yield(string(k), s.oal(len(k))) {
+			return
+		}
+	}
+}
+
+// Returns a copy of the index.  The arenas are shared, as keys once stored
+// never change, but capped in the copy, so that it starts its own rather than
+// appending where the original does.
+func (c *compactIndex) clone() *compactIndex {
+	out := &compactIndex{c.seed, nil, c.n, make([][]byte, len(c.arenas)), c.dead, c.location, append([]*scratch(nil), c.mapped...), nil}
+	if len(c.slots) > 0 {
+		out.slots, out.table = out.allocSlots(len(c.slots))
+		copy(out.slots, c.slots)
+	}
+	for i, a := range c.arenas {
+		out.arenas[i] = a[:len(a):len(a)]
+	}
+	return out
+}
@@ -0,0 +1,203 @@
+package bitcesque
+
+import (
+	"hash/crc32"
+	"os"
+)
+
+// The index log holds groups of keyfile-format entries, each describing the
+// keys changed by writes since the previous group, with removed keys given a
+// zero length.  A group is a crc32c of the rest of it, the length of its
+// entries, then the id, tag and size of the active segment as of the group,
+// a flags field, and the entries, sealed if keys are encrypted.  OpenDB
+// applies the groups that follow on from the keyfile before indexing
+// anything left over from the data files.
+const (
+	ilogHeaderSize = 24
+	ilogSealed     = 1
+)
+
+// Returns where the index log of the DB at location is kept.
+func indexLogPath(location string) string {
+	return location + ".ilog"
+}
+
+// Starts appending to the index log, if the options call for one, and
+// otherwise deletes any left over.  Unless the keyfile and the log together
+// already describe the index, the keyfile is written first and the log
+// emptied.  Assumes the write lock is held.
+func (d *DB) startIndexLog(covered bool) error {
+	if d.snapshot {
+		return nil
+	}
+	if !d.opts.IndexLog {
+		//A log left from before would not follow on from this session's
+		//keyfile
+		os.Remove(indexLogPath(d.location))
+		return nil
+	}
+	f, e := os.OpenFile(indexLogPath(d.location), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if e != nil {
+		return e
+	}
+	d.ilog, d.ilogKeys = f, make(map[string]struct{})
+	if !covered {
+		e = d.dumpKeys()
+		if e == nil {
+			e = d.resetIndexLog()
+		}
+	}
+	return e
+}
+
+// Records that the index entry for k has changed.  Assumes the write lock is
+// held.
+func (d *DB) logIndex(k string) {
+	if d.ilog != nil {
+		d.ilogKeys[k] = struct{}{}
+	}
+}
+
+// Appends the entries changed since the last call to the index log, marked
+// with the current end of the active segment.  Called before each append, so
+// that each group covers exactly the writes made since the one before.  If
+// the log can't be written it is abandoned, leaving OpenDB to index from the
+// keyfile alone.  Assumes the write lock is held.
+func (d *DB) flushIndexLog() {
+	if d.ilog == nil || len(d.ilogKeys) == 0 {
+		return
+	}
+	header := make([]byte, ilogHeaderSize)
+	var entries []byte
+	for k := range d.ilogKeys {
+		oal, present := d.kToPos.get(k)
+		if !present {
+			oal = offsetAndLength{}
+		}
+		entries = appendEntry(entries, k, oal, d.expiries[k])
+	}
+	uint32ToBytes(header, 8, d.activeID)
+	tag := fileTag(d.filebuffer, d.filledSize)
+	header[12], header[13] = byte(tag), byte(tag>>8)
+	uint64ToBytes(header, 16, d.logEnd())
+	if d.opts.EncryptKeys && d.opts.Encryption != nil {
+		header[14] = ilogSealed
+		sealed, e := sealKeyfile(d.opts.Encryption, header[8:], entries)
+		if e != nil {
+			d.abandonIndexLog()
+			return
+		}
+		entries = sealed
+	}
+	uint32ToBytes(header, 4, uint32(len(entries)))
+	buf := append(header, entries...)
+	uint32ToBytes(buf, 0, crc32.Checksum(buf[4:], crcTable))
+	n, e := d.ilog.Write(buf)
+	d.io.index.Add(uint64(n))
+	if e != nil {
+		d.abandonIndexLog()
+		return
+	}
+	clear(d.ilogKeys)
+}
+
+// Empties the index log once the keyfile has been written.  Assumes the
+// write lock is held.
+func (d *DB) resetIndexLog() error {
+	if d.ilog == nil {
+		return nil
+	}
+	e := d.ilog.Truncate(0)
+	if e != nil {
+		d.abandonIndexLog()
+		return e
+	}
+	clear(d.ilogKeys)
+	return nil
+}
+
+// Stops keeping the index log and deletes it, since it no longer follows on
+// from the keyfile.  Assumes the write lock is held.
+func (d *DB) abandonIndexLog() {
+	if d.ilog == nil {
+		return
+	}
+	d.ilog.Close()
+	os.Remove(d.ilog.Name())
+	d.ilog, d.ilogKeys = nil, nil
+}
+
+// Writes the keyfile and empties the index log after compaction has moved
+// records, since the log describes them where they were.  Assumes the write
+// lock is held, as well as the checkpointing one.
+func (d *DB) compactIndexLog() error {
+	if d.ilog == nil {
+		return nil
+	}
+	e := d.dumpKeys()
+	if e != nil {
+		d.abandonIndexLog()
+		return e
+	}
+	return d.resetIndexLog()
+}
+
+// Closes the index log, leaving it in place.  Assumes the write lock is held.
+func (d *DB) closeIndexLog() error {
+	if d.ilog == nil {
+		return nil
+	}
+	e := d.ilog.Close()
+	d.ilog, d.ilogKeys = nil, nil
+	return e
+}
+
+// Mutatively applies to a partially initialized DB the groups of its index
+// log that carry on from the given keyfile marks, and updates the marks to
+// match, so that only what was written after the last group needs indexing
+// from the data files.  Stops at the first torn or damaged group.
+func (d *DB) replayIndexLog(marks map[uint32]fileMark) {
+	buf, e := os.ReadFile(indexLogPath(d.location))
+	if e != nil {
+		return
+	}
+	maxID := uint32(0)
+	for id := range marks {
+		maxID = max(maxID, id)
+	}
+	pos := uint64(0)
+	for uint64(len(buf))-pos >= ilogHeaderSize {
+		header := buf[pos : pos+ilogHeaderSize]
+		n := uint64(uint32FromBytes(header, 4))
+		if uint64(len(buf))-pos-ilogHeaderSize < n {
+			return
+		}
+		group := buf[pos : pos+ilogHeaderSize+n]
+		pos += ilogHeaderSize + n
+		if uint32FromBytes(group, 0) != crc32.Checksum(group[4:], crcTable) {
+			return
+		}
+		id := uint32FromBytes(header, 8)
+		tag := uint16(header[12]) | uint16(header[13])<<8
+		size := uint64FromBytes(header, 16)
+		mark, present := marks[id]
+		if present && mark.tag != tag {
+			return
+		}
+		//Groups already covered by the keyfile, or for segments merged away
+		//since, are skipped
+		if (present && size <= mark.size) || (!present && id <= maxID) {
+			continue
+		}
+		entries := group[ilogHeaderSize:]
+		if header[14]&ilogSealed != 0 {
+			entries, e = openKeyfile(d.opts.Encryption, header[8:], entries)
+			if e != nil {
+				return
+			}
+		}
+		applyEntries(d.kToPos, d.expiries, entries)
+		marks[id] = fileMark{tag, size}
+		maxID = max(maxID, id)
+	}
+}
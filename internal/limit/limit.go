@@ -0,0 +1,64 @@
+// Package limit provides the token bucket the servers limit request rates
+// with.
+package limit
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket, allowing events at an average rate, in bursts of up to a
+// set size.  Safe for concurrent use.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   float64 //Tokens added per second
+	burst  float64
+	tokens float64 //Negative while events are waiting on tokens yet to come
+	last   time.Time
+}
+
+// Returns a limiter allowing rate events per second, in bursts of up to
+// burst, starting full.  A burst below 1 is taken as 1.
+func New(rate float64, burst int) *Limiter {
+	b := float64(max(burst, 1))
+	return &Limiter{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// Adds the tokens accrued since the last call.  Assumes the lock is held.
+func (l *Limiter) refill(t time.Time) {
+	l.tokens = min(l.burst, l.tokens+t.Sub(l.last).Seconds()*l.rate)
+	l.last = t
+}
+
+// Takes a token if one is available, returning whether it did.
+func (l *Limiter) Allow() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill(time.Now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Takes a token, returning how long to wait before the event it allows, which
+// is zero if one was available.  Later events wait behind this one.
+func (l *Limiter) Reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill(time.Now())
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Returns whether the limiter is full, so is no different from a new one.
+func (l *Limiter) Full() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill(time.Now())
+	return l.tokens == l.burst
+}
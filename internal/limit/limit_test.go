@@ -0,0 +1,32 @@
+package limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(10, 3)
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Fatal("Burst refused")
+		}
+	}
+	if l.Allow() || l.Full() {
+		t.Error("Allowed past the burst")
+	}
+	if wait := l.Reserve(); wait <= 0 || wait > 100*time.Millisecond {
+		t.Error("Wrong wait for one token", wait)
+	}
+	if wait := l.Reserve(); wait <= 100*time.Millisecond || wait > 200*time.Millisecond {
+		t.Error("Wrong wait behind a reservation", wait)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if !l.Allow() || !l.Allow() || l.Allow() {
+		t.Error("Wrong tokens after refilling")
+	}
+	time.Sleep(350 * time.Millisecond)
+	if !l.Full() {
+		t.Error("Not full after refilling")
+	}
+}
@@ -0,0 +1,114 @@
+package bitcesque
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// One line of the JSON export.  Keys and values that are valid UTF-8 are
+// given as strings in k and v, and others base64 encoded in k64 and v64.
+type jsonRecord struct {
+	K       *string `json:"k,omitempty"`
+	K64     []byte  `json:"k64,omitempty"`
+	V       *string `json:"v,omitempty"`
+	V64     []byte  `json:"v64,omitempty"`
+	Expires int64   `json:"expires,omitempty"` //Unix nanoseconds
+}
+
+// Records are imported in batches of this many.
+const importBatchSize = 1000
+
+// Writes every live pair to w as newline-delimited JSON objects, in key
+// order, of the form {"k":...,"v":...}.  Keys or values that aren't valid
+// UTF-8 are written base64 encoded as "k64" or "v64" instead, and keys that
+// expire carry "expires" in Unix nanoseconds.  Pairs are read one at a time,
+// so writes made during the export may or may not be included.
+func (d *DB) ExportJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	it := d.Scan(nil)
+	for it.Next() {
+		var rec jsonRecord
+		k, v := it.Key(), it.Value()
+		if utf8.Valid(k) {
+			s := string(k)
+			rec.K = &s
+		} else {
+			rec.K64 = k
+		}
+		if utf8.Valid(v) {
+			s := string(v)
+			rec.V = &s
+		} else {
+			rec.V64 = v
+		}
+		if t, present := d.ExpiresAt(k); present {
+			rec.Expires = t.UnixNano()
+		}
+		e := enc.Encode(&rec)
+		if e != nil {
+			return e
+		}
+	}
+	if e := it.Err(); e != nil {
+		return e
+	}
+	return bw.Flush()
+}
+
+// Upserts every pair read from r, in the format written by ExportJSON.  Pairs
+// whose expiry has passed are skipped.  Pairs are committed in batches as
+// they are read, so on error those before the offending line remain
+// imported.
+func (d *DB) ImportJSON(r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	b := d.NewBatch()
+	for line := 1; ; line++ {
+		var rec jsonRecord
+		e := dec.Decode(&rec)
+		if e == io.EOF {
+			break
+		}
+		if e == nil && (rec.K == nil) == (rec.K64 == nil) {
+			e = errors.New("exactly one of k and k64 required")
+		} else if e == nil && (rec.V == nil) == (rec.V64 == nil) {
+			e = errors.New("exactly one of v and v64 required")
+		}
+		if e != nil {
+			b.Commit()
+			return errors.New("JSON record " + strconv.Itoa(line) + ": " + e.Error())
+		}
+		k, v := rec.K64, rec.V64
+		if rec.K != nil {
+			k = []byte(*rec.K)
+		}
+		if rec.V != nil {
+			v = []byte(*rec.V)
+		}
+		if rec.Expires != 0 {
+			ttl := time.Until(time.Unix(0, rec.Expires))
+			if ttl <= 0 {
+				continue
+			}
+			//Batches don't carry expiries, so keep order by flushing first
+			e = b.Commit()
+			if e == nil {
+				e = d.UpsertWithTTL(k, v, ttl)
+			}
+		} else {
+			b.Upsert(k, v)
+			if b.Len() >= importBatchSize {
+				e = b.Commit()
+			}
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return b.Commit()
+}
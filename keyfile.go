@@ -1,63 +1,349 @@
 package bitcesque
 
 import (
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
-	"syscall"
+	"time"
 )
 
-// Dumps current map from db to d.location + ".keys"
+// Keyfiles with the trailer flag end in an 8 byte trailer: the length of
+// what lies between header and trailer, then a crc32c of everything before
+// the checksum.  Those with the marks flag go on after the header with a
+// count, then the id, tag and size of each segment as of the dump, 16 bytes
+// apiece, so that data appended since can be found.
+const (
+	keyfileTrailer = 2
+	keyfileMarks   = 4
+	trailerSize    = 8
+	markSize       = 16
+)
+
+// What a keyfile recorded about a segment.
+type fileMark struct {
+	tag  uint16
+	size uint64
+}
+
+// Dumps current map from db to d.location + ".keys".  The top byte of each
+// key length field holds the format byte of the key's document, and keys with
+// an expiry have it following the fixed fields.  If keys are encrypted, the
+// entries are sealed as a whole.  Assumes the write lock is held.
 func (d *DB) dumpKeys() error {
-	loc := d.location + ".keys"
-	filehandle, e := os.OpenFile(loc, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	buf, e := d.encodeKeyfile()
 	if e != nil {
 		return e
 	}
-	for k, v := range d.kToPos {
-		buf := make([]byte, 16, 16+len(k))
-		uint32ToBytes(buf, 0, uint32(len(k)))
-		uint32ToBytes(buf, 4, v.length)
-		uint64ToBytes(buf, 8, v.offset)
-		buf = append(buf, k...)
-		filehandle.Write(buf)
+	e = writeKeyfile(d.location, buf)
+	if e != nil {
+		return e
 	}
-	return filehandle.Close()
+	d.wroteFile(len(buf))
+	d.unsaved = 0
+	return nil
 }
 
-// Mutatively populates the keys of a partially initialized DB based on the
-// keyfile in the appropriate location.  Meant to be called during
-// initialization, so does not lock the db.
-func (d *DB) populateKeys() error {
-	loc := d.location + ".keys"
-	filehandle, e := os.OpenFile(loc, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// Returns the contents of a keyfile describing the DB as it stands.  Assumes
+// at least a read lock is held.
+func (d *DB) encodeKeyfile() ([]byte, error) {
+	header := fileHeader(keyfileMagic)
+	header[5] |= keyfileTrailer | keyfileMarks
+	ids := d.segmentIDs()
+	marks := make([]byte, 4, 4+markSize*len(ids))
+	uint32ToBytes(marks, 0, uint32(len(ids)))
+	for _, id := range ids {
+		//Buffered appends are counted, so that should they be lost, the
+		//keyfile isn't trusted
+		buf, size := d.filebuffer, d.logEnd()
+		if id != d.activeID {
+			buf, size = d.sealed[id].filebuffer, d.sealed[id].size
+		}
+		mark := make([]byte, markSize)
+		uint32ToBytes(mark, 0, id)
+		tag := fileTag(buf, size)
+		mark[4], mark[5] = byte(tag), byte(tag>>8)
+		uint64ToBytes(mark, 8, size)
+		marks = append(marks, mark...)
+	}
+	var out []byte
+	for k, v := range d.kToPos.all() {
+		out = appendEntry(out, k, v, d.expiries[k])
+	}
+	if d.opts.EncryptKeys && d.opts.Encryption != nil {
+		header[5] |= keyfileSealed
+		sealed, e := sealKeyfile(d.opts.Encryption, header, out)
+		if e != nil {
+			return nil, e
+		}
+		out = sealed
+	}
+	buf := append(append(header, marks...), out...)
+	trailer := make([]byte, trailerSize)
+	uint32ToBytes(trailer, 0, uint32(len(marks)+len(out)))
+	buf = append(buf, trailer[:4]...)
+	uint32ToBytes(trailer, 4, crc32.Checksum(buf, crcTable))
+	return append(buf, trailer[4:]...), nil
+}
+
+// Replaces the keyfile of the DB at location with buf.
+func writeKeyfile(location string, buf []byte) error {
+	return writeFileAtomic(location+".keys", buf)
+}
+
+// Replaces the file at loc with buf.  The file is written in full alongside
+// and then renamed into place, so a crash leaves either the old or the new
+// one.
+func writeFileAtomic(loc string, buf []byte) error {
+	filehandle, e := os.OpenFile(loc+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if e != nil {
 		return e
 	}
-	stats, e := filehandle.Stat()
+	_, e = filehandle.Write(buf)
+	if e == nil {
+		e = filehandle.Sync()
+	}
 	if e != nil {
+		filehandle.Close()
+		os.Remove(filehandle.Name())
 		return e
 	}
-	mmap, e := syscall.Mmap(int(filehandle.Fd()), 0, int(stats.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	e = filehandle.Close()
+	if e == nil {
+		e = os.Rename(filehandle.Name(), loc)
+	}
 	if e != nil {
-		return e
+		os.Remove(filehandle.Name())
+	}
+	return e
+}
+
+// Writes the keyfile without waiting for the DB to close, so that after an
+// unclean shutdown OpenDB need only index what was appended since.  Writers
+// are only held up while the index is encoded, not while it is written.  The
+// index log is emptied unless written to meanwhile.
+func (d *DB) Checkpoint() error {
+	d.checkpointing.Lock()
+	defer d.checkpointing.Unlock()
+	d.mutex.RLock()
+	if d.closed {
+		d.mutex.RUnlock()
+		return ErrDatabaseClosed
+	}
+	if d.snapshot || d.reader {
+		d.mutex.RUnlock()
+		return ErrReadOnly
 	}
-	e = syscall.Madvise(mmap, syscall.MADV_SEQUENTIAL)
+	buf, e := d.encodeKeyfile()
+	saved := d.unsaved
+	d.mutex.RUnlock()
 	if e != nil {
 		return e
 	}
-	m := make(map[string]offsetAndLength)
-	pos := uint64(0)
-	for pos < uint64(len(mmap)) {
-		kLen := uint32FromBytes(mmap, pos)
-		vLen := uint32FromBytes(mmap, pos+4)
-		vPos := uint64FromBytes(mmap, pos+8)
-		k := mmap[pos+16 : pos+16+uint64(kLen)]
-		pos = pos + 16 + uint64(kLen)
-		m[string(k)] = offsetAndLength{vPos, vLen}
-	}
-	e = syscall.Munmap(mmap)
+	e = writeKeyfile(d.location, buf)
 	if e != nil {
 		return e
 	}
-	d.kToPos = m
+	d.wroteFile(len(buf))
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.unsaved == saved {
+		return d.resetIndexLog()
+	}
+	if d.unsaved > saved {
+		d.unsaved -= saved
+	}
 	return nil
 }
+
+// Counts an append towards the next checkpoint, asking for one if enough
+// have accumulated.  Assumes the write lock is held.
+func (d *DB) noteAppend() {
+	d.unsaved++
+	if n := d.opts.CheckpointWrites; n > 0 && d.unsaved >= n {
+		select {
+		case d.checkpointDue <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Checkpoints the DB periodically and whenever enough writes accumulate,
+// until it is closed.
+func (d *DB) checkpointer() {
+	defer d.background.Done()
+	var tick <-chan time.Time
+	if d.opts.CheckpointInterval > 0 {
+		ticker := time.NewTicker(d.opts.CheckpointInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-tick:
+		case <-d.checkpointDue:
+		}
+		e := d.Checkpoint()
+		if e != nil && e != ErrDatabaseClosed && d.opts.OnCheckpointError != nil {
+			d.opts.OnCheckpointError(e)
+		}
+	}
+}
+
+// Mutatively populates the keys of a partially initialized DB based on the
+// keyfile in the appropriate location.  Meant to be called during
+// initialization, so does not lock the db.  Returns what the keyfile recorded
+// about each segment, which is empty if there was no keyfile, or nil if it
+// predates recording that.
+func (d *DB) populateKeys() (map[uint32]fileMark, error) {
+	loc := d.location + ".keys"
+	filehandle, e := os.OpenFile(loc, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if e != nil {
+		return nil, e
+	}
+	defer filehandle.Close()
+	stats, e := filehandle.Stat()
+	if e != nil {
+		return nil, e
+	}
+	if stats.Size() == 0 {
+		d.kToPos = newIndex(&d.opts, d.location, 0)
+		d.expiries = make(map[string]int64)
+		return make(map[uint32]fileMark), nil
+	}
+	var mmap []byte
+	if d.opts.NoMmap {
+		mmap = make([]byte, stats.Size())
+		_, e = io.ReadFull(filehandle, mmap)
+	} else {
+		mmap, e = mapReadOnly(filehandle, uint64(stats.Size()))
+		if e == nil {
+			defer unmap(mmap)
+			e = adviseSequential(mmap)
+		}
+	}
+	if e != nil {
+		return nil, e
+	}
+	pos, e := checkHeader(mmap, uint64(len(mmap)), keyfileMagic)
+	if e != nil {
+		return nil, e
+	}
+	entries := mmap[pos:]
+	if pos == headerSize && mmap[5]&keyfileTrailer != 0 {
+		entries, e = checkTrailer(mmap)
+		if e != nil {
+			return nil, e
+		}
+	}
+	var marks map[uint32]fileMark
+	if pos == headerSize && mmap[5]&keyfileMarks != 0 {
+		marks, entries, e = parseMarks(entries)
+		if e != nil {
+			return nil, e
+		}
+	}
+	if pos == headerSize && mmap[5]&keyfileSealed != 0 {
+		entries, e = openKeyfile(d.opts.Encryption, mmap[:headerSize], entries)
+		if e != nil {
+			return nil, e
+		}
+	}
+	d.kToPos, d.expiries = parseKeyfile(entries, &d.opts, d.location)
+	return marks, nil
+}
+
+// Returns the segment marks leading buf, and the rest of it.
+func parseMarks(buf []byte) (map[uint32]fileMark, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, fmt.Errorf("%w in keyfile: truncated", ErrCorrupt)
+	}
+	n := uint64(uint32FromBytes(buf, 0))
+	if uint64(len(buf)-4)/markSize < n {
+		return nil, nil, fmt.Errorf("%w in keyfile: truncated", ErrCorrupt)
+	}
+	marks := make(map[uint32]fileMark, n)
+	for i := uint64(0); i < n; i++ {
+		mark := buf[4+i*markSize:]
+		marks[uint32FromBytes(mark, 0)] = fileMark{uint16(mark[4]) | uint16(mark[5])<<8, uint64FromBytes(mark, 8)}
+	}
+	return marks, buf[4+n*markSize:], nil
+}
+
+// Returns the entries of a keyfile with a trailer, or an error wrapping
+// ErrCorrupt if they are torn or damaged.
+func checkTrailer(buf []byte) ([]byte, error) {
+	size := uint64(len(buf))
+	if size < headerSize+trailerSize {
+		return nil, fmt.Errorf("%w in keyfile: truncated", ErrCorrupt)
+	}
+	n := uint64(uint32FromBytes(buf, size-trailerSize))
+	if n != size-headerSize-trailerSize || uint32FromBytes(buf, size-4) != crc32.Checksum(buf[:size-4], crcTable) {
+		return nil, fmt.Errorf("%w in keyfile: checksum mismatch", ErrCorrupt)
+	}
+	return buf[headerSize : size-trailerSize], nil
+}
+
+// Appends the keyfile entry for k to out.
+func appendEntry(out []byte, k string, v offsetAndLength, expiry int64) []byte {
+	buf := make([]byte, 16, 24+len(k))
+	uint32ToBytes(buf, 0, uint32(v.format)<<24|uint32(len(k)))
+	uint32ToBytes(buf, 4, v.length)
+	uint64ToBytes(buf, 8, uint64(v.segment)<<segmentShift|v.offset)
+	if uint32(v.format)<<24&expiryFlag != 0 {
+		buf = buf[:24]
+		uint64ToBytes(buf, 16, uint64(expiry))
+	}
+	return append(append(out, buf...), k...)
+}
+
+// Returns the index, of the kind opts ask for, and expiry times held in the
+// given keyfile entries.
+func parseKeyfile(buf []byte, opts *Options, location string) (index, map[string]int64) {
+	m := newIndex(opts, location, 0)
+	expiries := make(map[string]int64)
+	applyEntries(m, expiries, buf)
+	return m, expiries
+}
+
+// Mutatively applies the given keyfile entries to an index, removing the
+// keys of any with a zero length, as found in the index log.
+func applyEntries(m index, expiries map[string]int64, buf []byte) {
+	eachEntry(buf, func(k string, oal offsetAndLength, expiry int64) {
+		if oal.length == 0 {
+			m.remove(k)
+			delete(expiries, k)
+			return
+		}
+		m.set(k, oal)
+		if expiry != 0 {
+			expiries[k] = expiry
+		} else {
+			delete(expiries, k)
+		}
+	})
+}
+
+// Calls fn with the key, position and expiry, or 0, of each of the given
+// keyfile entries in turn.
+func eachEntry(buf []byte, fn func(k string, oal offsetAndLength, expiry int64)) {
+	pos := uint64(0)
+	for pos < uint64(len(buf)) {
+		kField := uint32FromBytes(buf, pos)
+		flags, kLen := kField&^keyLenMask, uint64(kField&keyLenMask)
+		vLen := uint32FromBytes(buf, pos+4)
+		vPos := uint64FromBytes(buf, pos+8)
+		pos += 16
+		expiry := int64(0)
+		if flags&expiryFlag != 0 {
+			expiry = int64(uint64FromBytes(buf, pos))
+			pos += 8
+		}
+		k := string(buf[pos : pos+kLen])
+		pos += kLen
+		prefix := docPrefix(flags, int(kLen))
+		fn(k, offsetAndLength{vPos & (1<<segmentShift - 1), uint32(vPos >> segmentShift), vLen, prefix, uint8(flags >> 24)}, expiry)
+	}
+}
@@ -0,0 +1,37 @@
+package bitcesque
+
+import (
+	"os"
+	"strconv"
+)
+
+// Takes an exclusive lock on the DB at location by creating location +
+// ".lock" and writing the process id to it, for systems without flock.
+// Unlike flock the file outlives a process that dies holding the lock, and
+// the DB can't be opened until it is gone.  If no process with the id in the
+// file is running, the lock is stale, and removing the file by hand releases
+// it.
+func lockByFile(location string) (*os.File, error) {
+	f, e := os.OpenFile(location+".lock", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(e) {
+		return nil, ErrDatabaseLocked
+	}
+	if e != nil {
+		return nil, e
+	}
+	if _, e = f.WriteString(strconv.Itoa(os.Getpid())); e != nil {
+		f.Close()
+		os.Remove(location + ".lock")
+		return nil, e
+	}
+	return f, nil
+}
+
+// Releases a lock taken by lockByFile.
+func unlockByFile(location string, f *os.File) error {
+	e := f.Close()
+	if e != nil {
+		return e
+	}
+	return os.Remove(location + ".lock")
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package bitcesque
+
+import (
+	"os"
+)
+
+// Takes an exclusive lock on the DB at location, as lockByFile does, there
+// being no flock.
+func lockDB(location string) (*os.File, error) {
+	return lockByFile(location)
+}
+
+// Releases a lock taken by lockDB.
+func unlockDB(location string, f *os.File) error {
+	return unlockByFile(location, f)
+}
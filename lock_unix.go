@@ -0,0 +1,34 @@
+//go:build unix
+
+package bitcesque
+
+import (
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive advisory lock on the DB at location, held until it is
+// released by unlockDB.  The lock lives on a separate location + ".lock"
+// file rather than the data file itself, since compaction replaces data
+// files by renaming over them.
+func lockDB(location string) (*os.File, error) {
+	f, e := os.OpenFile(location+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if e != nil {
+		return nil, e
+	}
+	e = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if e == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, ErrDatabaseLocked
+	}
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+	return f, nil
+}
+
+// Releases a lock taken by lockDB.
+func unlockDB(location string, f *os.File) error {
+	return f.Close()
+}
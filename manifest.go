@@ -0,0 +1,205 @@
+package bitcesque
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Records which segment files make up a DB, and the progress of any merge,
+// so that a merge interrupted by a crash can be finished or discarded on the
+// next open.  Stored as text at location + ".manifest", and always replaced
+// atomically.
+type manifest struct {
+	segments  []uint32 //Ids of the live segments, in ascending order
+	merging   []uint32 //Ids being merged, the first of which is the target
+	merged    bool     //Whether the merged file has been completely written
+	compacted uint64   //Log offset as of the last compaction, before which the log was rewritten
+}
+
+func manifestPath(location string) string {
+	return location + ".manifest"
+}
+
+// Where a merge in progress writes its output.
+func mergePath(location string) string {
+	return location + ".merge"
+}
+
+// Reads the manifest for the DB at location, returning nil if there is none.
+func readManifest(location string) (*manifest, error) {
+	f, e := os.Open(manifestPath(location))
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	m := &manifest{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "compacted" && len(fields) == 2 {
+			m.compacted, e = strconv.ParseUint(fields[1], 10, 64)
+			if e != nil {
+				return nil, errors.New("Malformed manifest line: " + scanner.Text())
+			}
+			continue
+		}
+		var ids []uint32
+		for _, field := range fields[1:] {
+			id, e := strconv.ParseUint(field, 10, 32)
+			if e != nil {
+				return nil, errors.New("Malformed manifest line: " + scanner.Text())
+			}
+			ids = append(ids, uint32(id))
+		}
+		switch fields[0] {
+		case "segments":
+			m.segments = ids
+		case "merging":
+			m.merging = ids
+		case "merged":
+			m.merged = true
+		default:
+			return nil, errors.New("Malformed manifest line: " + scanner.Text())
+		}
+	}
+	if e = scanner.Err(); e != nil {
+		return nil, e
+	}
+	if len(m.segments) == 0 {
+		return nil, errors.New("Manifest lists no segments")
+	}
+	return m, nil
+}
+
+// Durably replaces the manifest for the DB at location.
+func (m *manifest) write(location string) error {
+	tmp := manifestPath(location) + ".tmp"
+	f, e := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if e != nil {
+		return e
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprint(w, "segments")
+	for _, id := range m.segments {
+		fmt.Fprintf(w, " %d", id)
+	}
+	fmt.Fprintln(w)
+	if m.compacted != 0 {
+		fmt.Fprintf(w, "compacted %d\n", m.compacted)
+	}
+	if len(m.merging) > 0 {
+		fmt.Fprint(w, "merging")
+		for _, id := range m.merging {
+			fmt.Fprintf(w, " %d", id)
+		}
+		fmt.Fprintln(w)
+		if m.merged {
+			fmt.Fprintln(w, "merged")
+		}
+	}
+	e = w.Flush()
+	if e == nil {
+		e = f.Sync()
+	}
+	if e != nil {
+		f.Close()
+		return e
+	}
+	e = f.Close()
+	if e != nil {
+		return e
+	}
+	return os.Rename(tmp, manifestPath(location))
+}
+
+// Returns the ids of the segments making up the DB at location, first
+// finishing or discarding any merge a crash left in progress.  DBs predating
+// the manifest have their segments discovered from the directory, and a
+// manifest written for them.
+func recoverSegments(location string) ([]uint32, error) {
+	m, e := readManifest(location)
+	if e != nil {
+		return nil, e
+	}
+	if m == nil {
+		ids, e := listSegments(location)
+		if e != nil {
+			return nil, e
+		}
+		if len(ids) == 0 {
+			ids = []uint32{0}
+		}
+		m = &manifest{segments: ids}
+		return ids, m.write(location)
+	}
+	if len(m.merging) == 0 {
+		//Merges write their output before recording it, so any is partial
+		e = os.Remove(mergePath(location))
+		if e != nil && !os.IsNotExist(e) {
+			return nil, e
+		}
+		return m.segments, nil
+	}
+	if !m.merged {
+		//The inputs are untouched, so just throw away the partial output
+		e = os.Remove(mergePath(location))
+		if e != nil && !os.IsNotExist(e) {
+			return nil, e
+		}
+		m.merging = nil
+		return m.segments, m.write(location)
+	}
+	//The output is complete, so roll the merge forward
+	e = os.Rename(mergePath(location), segmentPath(location, m.merging[0]))
+	if e != nil && !os.IsNotExist(e) {
+		return nil, e
+	}
+	for _, id := range m.merging[1:] {
+		e = os.Remove(segmentPath(location, id))
+		if e != nil && !os.IsNotExist(e) {
+			return nil, e
+		}
+	}
+	m.segments = withoutSegments(m.segments, m.merging[1:])
+	m.merging = nil
+	m.merged = false
+	return m.segments, m.write(location)
+}
+
+// Returns ids less any that appear in removed.
+func withoutSegments(ids, removed []uint32) []uint32 {
+	out := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		keep := true
+		for _, r := range removed {
+			if id == r {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// Returns the ids of all segments of the DB in ascending order.  Assumes at
+// least a read lock is held.
+func (d *DB) segmentIDs() []uint32 {
+	ids := make([]uint32, 0, len(d.sealed)+1)
+	for _, s := range sortedSegments(d.sealed) {
+		ids = append(ids, s.id)
+	}
+	return append(ids, d.activeID)
+}
@@ -0,0 +1,81 @@
+package bitcesque
+
+import (
+	"bytes"
+	"time"
+)
+
+// Upserts every live pair of src into dst, calling resolve for keys present
+// in both with different values to choose the value dst keeps, or nil to
+// remove the key.  A nil resolve keeps whichever value was written last, by
+// the records' timestamps, with dst winning ties and records predating
+// timestamps.  Keys only in src keep any TTL they have.  src is read from a
+// snapshot, so may be written meanwhile, or even be dst itself.  Writes are
+// committed in batches, so on error those already committed remain.
+func MergeInto(dst, src *DB, resolve func(k, dstV, srcV []byte) []byte) error {
+	return src.viewing(func(s *DB) error {
+		return s.mergeInto(dst, resolve)
+	})
+}
+
+// Runs the merge described by MergeInto from a snapshot, holding its read
+// lock throughout.
+func (d *DB) mergeInto(dst *DB, resolve func(k, dstV, srcV []byte) []byte) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	b := dst.NewBatch()
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if d.expired(k, t) {
+			continue
+		}
+		v, e := d.getVal(oal)
+		if e != nil {
+			b.Reset()
+			return e
+		}
+		dstV, e := dst.Lookup([]byte(k))
+		missing := e == ErrKeyNotFound
+		if missing {
+			e = nil
+		}
+		switch {
+		case e != nil:
+			//Returned below
+		case missing:
+			if expiry, present := d.expiries[k]; present {
+				//Batches don't carry expiries, so keep order by flushing first
+				e = b.Commit()
+				if e == nil {
+					e = dst.UpsertWithTTL([]byte(k), v, time.Duration(expiry-t))
+				}
+			} else {
+				b.Upsert([]byte(k), v)
+			}
+		case bytes.Equal(dstV, v):
+		case resolve != nil:
+			if out := resolve([]byte(k), dstV, v); out != nil {
+				b.Upsert([]byte(k), out)
+			} else {
+				b.Remove([]byte(k))
+			}
+		default:
+			srcStat, statErr := d.stat(oal)
+			dstStat, _ := dst.Stat([]byte(k))
+			if statErr == nil && srcStat.Timestamp.After(dstStat.Timestamp) {
+				b.Upsert([]byte(k), v)
+			}
+		}
+		if e == nil && b.Len() >= importBatchSize {
+			e = b.Commit()
+		}
+		if e != nil {
+			b.Reset()
+			return e
+		}
+	}
+	return b.Commit()
+}
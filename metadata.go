@@ -0,0 +1,178 @@
+package bitcesque
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Facts about a DB as a whole, kept as text at location + ".meta" and always
+// replaced atomically.  Each line is a field name followed by its value, with
+// properties giving their name and value quoted.
+type Metadata struct {
+	// A random identifier given the DB when it was created, as a UUID.
+	ID string
+	// When the DB was created, or for DBs predating metadata, when it was
+	// first opened since.
+	Created time.Time
+	// The file format version the DB was created with.
+	FormatVersion int
+	// Properties set with SetProperty.
+	Properties map[string]string
+}
+
+func metaPath(location string) string {
+	return location + ".meta"
+}
+
+// Returns metadata for a DB created now.
+func newMetadata() *Metadata {
+	id := make([]byte, 16)
+	rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40 //Version 4
+	id[8] = id[8]&0x3f | 0x80 //RFC 4122 variant
+	return &Metadata{
+		ID:            fmt.Sprintf("%x-%x-%x-%x-%x", id[:4], id[4:6], id[6:8], id[8:10], id[10:]),
+		Created:       time.Now(),
+		FormatVersion: formatVersion,
+		Properties:    make(map[string]string),
+	}
+}
+
+// Returns a copy of the metadata that can be changed without affecting it.
+func (m *Metadata) clone() *Metadata {
+	out := *m
+	out.Properties = make(map[string]string, len(m.Properties))
+	for name, value := range m.Properties {
+		out.Properties[name] = value
+	}
+	return &out
+}
+
+// Reads the metadata of the DB at location, returning nil if there is none.
+func readMetadata(location string) (*Metadata, error) {
+	buf, e := os.ReadFile(metaPath(location))
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	m := &Metadata{Properties: make(map[string]string)}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), " ")
+		switch field {
+		case "":
+			continue
+		case "id":
+			m.ID = value
+		case "created":
+			var nanos int64
+			nanos, e = strconv.ParseInt(value, 10, 64)
+			m.Created = time.Unix(0, nanos)
+		case "version":
+			m.FormatVersion, e = strconv.Atoi(value)
+		case "property":
+			var name string
+			name, value, e = unquotePair(value)
+			m.Properties[name] = value
+		default:
+			e = errors.New("unknown field")
+		}
+		if e != nil {
+			return nil, errors.New("Malformed metadata line: " + scanner.Text())
+		}
+	}
+	if e = scanner.Err(); e != nil {
+		return nil, e
+	}
+	if m.ID == "" {
+		return nil, errors.New("Metadata gives no id")
+	}
+	return m, nil
+}
+
+// Returns the two quoted strings, separated by a space, that s consists of.
+func unquotePair(s string) (string, string, error) {
+	first, e := strconv.QuotedPrefix(s)
+	if e != nil || len(s) == len(first) || s[len(first)] != ' ' {
+		return "", "", errors.New("malformed pair")
+	}
+	second := s[len(first)+1:]
+	first, _ = strconv.Unquote(first)
+	second, e = strconv.Unquote(second)
+	return first, second, e
+}
+
+// Durably replaces the metadata of the DB at location.
+func (m *Metadata) write(location string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id %s\n", m.ID)
+	fmt.Fprintf(&buf, "created %d\n", m.Created.UnixNano())
+	fmt.Fprintf(&buf, "version %d\n", m.FormatVersion)
+	for name, value := range m.Properties {
+		fmt.Fprintf(&buf, "property %s %s\n", strconv.Quote(name), strconv.Quote(value))
+	}
+	return writeFileAtomic(metaPath(location), buf.Bytes())
+}
+
+// Returns the metadata of the DB at location, first writing some for it if it
+// has none.
+func loadMetadata(location string) (*Metadata, error) {
+	m, e := readMetadata(location)
+	if e != nil || m != nil {
+		return m, e
+	}
+	m = newMetadata()
+	return m, m.write(location)
+}
+
+// Returns the DB's metadata.  The properties are a copy.
+func (d *DB) Metadata() Metadata {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return *d.meta.clone()
+}
+
+// Returns the value of the given property, and whether it is set.
+func (d *DB) GetProperty(name string) (string, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	value, present := d.meta.Properties[name]
+	return value, present
+}
+
+// Durably sets the given property of the DB, kept in its metadata rather than
+// among its keys, e.g. to label it for fleet management.  An empty value
+// removes the property.  Properties are meant to be few and small, as each
+// change rewrites them all.
+func (d *DB) SetProperty(name, value string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.snapshot || d.reader {
+		return ErrReadOnly
+	}
+	m := d.meta.clone()
+	if value == "" {
+		delete(m.Properties, name)
+	} else {
+		m.Properties[name] = value
+	}
+	d.io.syncs.Add(1)
+	e := m.write(d.location)
+	if e != nil {
+		return e
+	}
+	d.meta = m
+	return nil
+}
@@ -0,0 +1,185 @@
+// Package metrics exposes the operation rates and latencies of bitcesque DBs,
+// along with their sizes and fragmentation, in the Prometheus text format.
+// It needs no Prometheus client library: a Metrics is an http.Handler to be
+// scraped directly.
+//
+//	m := metrics.New()
+//	db, e := bitcesque.OpenDBWithOptions(path, &bitcesque.Options{OnOperation: m.Observer("users")})
+//	...
+//	m.Attach("users", db)
+//	http.Handle("/metrics", m)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+// Upper bounds of the latency histogram buckets, in seconds.
+var buckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+var ops = []bitcesque.Op{bitcesque.OpRead, bitcesque.OpWrite, bitcesque.OpCompact}
+
+// Latencies of one kind of operation on one DB.
+type histogram struct {
+	mutex  sync.Mutex
+	counts []uint64 //Observations falling in each bucket, the last being +Inf
+	sum    float64
+	total  uint64
+}
+
+func (h *histogram) observe(took time.Duration) {
+	s := took.Seconds()
+	i := sort.SearchFloat64s(buckets, s)
+	h.mutex.Lock()
+	h.counts[i]++
+	h.sum += s
+	h.total++
+	h.mutex.Unlock()
+}
+
+// Collects metrics for any number of DBs, each known by a name that labels
+// its series.
+type Metrics struct {
+	mutex sync.Mutex
+	hists map[string][]*histogram //By DB name, then Op
+	dbs   map[string]*bitcesque.DB
+}
+
+// Returns an empty set of metrics.
+func New() *Metrics {
+	return &Metrics{hists: make(map[string][]*histogram), dbs: make(map[string]*bitcesque.DB)}
+}
+
+// Returns the histograms for the named DB, creating them if need be.
+func (m *Metrics) histograms(name string) []*histogram {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	hs, present := m.hists[name]
+	if !present {
+		hs = make([]*histogram, len(ops))
+		for i := range hs {
+			hs[i] = &histogram{counts: make([]uint64, len(buckets)+1)}
+		}
+		m.hists[name] = hs
+	}
+	return hs
+}
+
+// Returns a function to set as Options.OnOperation of the named DB.
+func (m *Metrics) Observer(name string) func(bitcesque.Op, time.Duration) {
+	hs := m.histograms(name)
+	return func(op bitcesque.Op, took time.Duration) {
+		if int(op) < len(hs) {
+			hs[op].observe(took)
+		}
+	}
+}
+
+// Reports the size and fragmentation of the given DB under the given name,
+// read from its Stats at each scrape.
+func (m *Metrics) Attach(name string, d *bitcesque.DB) {
+	m.histograms(name)
+	m.mutex.Lock()
+	m.dbs[name] = d
+	m.mutex.Unlock()
+}
+
+// Stops reporting on the named DB.
+func (m *Metrics) Detach(name string) {
+	m.mutex.Lock()
+	delete(m.dbs, name)
+	delete(m.hists, name)
+	m.mutex.Unlock()
+}
+
+// Writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	names := make([]string, 0, len(m.hists))
+	for name := range m.hists {
+		names = append(names, name)
+	}
+	hists := make(map[string][]*histogram, len(m.hists))
+	for name, hs := range m.hists {
+		hists[name] = hs
+	}
+	dbs := make(map[string]*bitcesque.DB, len(m.dbs))
+	for name, d := range m.dbs {
+		dbs[name] = d
+	}
+	m.mutex.Unlock()
+	sort.Strings(names)
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	fmt.Fprintln(bw, "# HELP bitcesque_operation_duration_seconds Time taken by DB operations, including waiting for the lock.")
+	fmt.Fprintln(bw, "# TYPE bitcesque_operation_duration_seconds histogram")
+	for _, name := range names {
+		for i, h := range hists[name] {
+			labels := fmt.Sprintf("db=%s,op=%q", strconv.Quote(name), ops[i])
+			h.mutex.Lock()
+			cumulative := uint64(0)
+			for j, n := range h.counts {
+				cumulative += n
+				le := "+Inf"
+				if j < len(buckets) {
+					le = strconv.FormatFloat(buckets[j], 'g', -1, 64)
+				}
+				fmt.Fprintf(bw, "bitcesque_operation_duration_seconds_bucket{%s,le=%q} %d\n", labels, le, cumulative)
+			}
+			fmt.Fprintf(bw, "bitcesque_operation_duration_seconds_sum{%s} %g\n", labels, h.sum)
+			fmt.Fprintf(bw, "bitcesque_operation_duration_seconds_count{%s} %d\n", labels, h.total)
+			h.mutex.Unlock()
+		}
+	}
+	stats := make(map[string]bitcesque.DBStats, len(dbs))
+	for name, d := range dbs {
+		stats[name] = d.Stats()
+	}
+	gauge := func(metric, help string, value func(bitcesque.DBStats) float64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n", metric, help, metric)
+		for _, name := range names {
+			if st, present := stats[name]; present {
+				fmt.Fprintf(bw, "%s{db=%s} %g\n", metric, strconv.Quote(name), value(st))
+			}
+		}
+	}
+	gauge("bitcesque_keys", "Number of live keys.", func(st bitcesque.DBStats) float64 { return float64(st.Keys) })
+	gauge("bitcesque_segments", "Number of segment files.", func(st bitcesque.DBStats) float64 { return float64(st.Segments) })
+	gauge("bitcesque_file_size_bytes", "Bytes taken up by the data files.", func(st bitcesque.DBStats) float64 { return float64(st.FileSize) })
+	gauge("bitcesque_dead_bytes", "Bytes of the data files compaction would reclaim.", func(st bitcesque.DBStats) float64 { return float64(st.DeadBytes) })
+	gauge("bitcesque_dead_ratio", "Fraction of the data files compaction would reclaim.", func(st bitcesque.DBStats) float64 {
+		if st.FileSize == 0 {
+			return 0
+		}
+		return float64(st.DeadBytes) / float64(st.FileSize)
+	})
+	e := bw.Flush()
+	return cw.n, e
+}
+
+// Serves the metrics for scraping.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, e := c.w.Write(b)
+	c.n += int64(n)
+	return n, e
+}
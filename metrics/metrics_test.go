@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+func TestMetrics(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "metrics")
+	defer os.RemoveAll(dir)
+	m := New()
+	db, e := bitcesque.NewDBWithOptions(filepath.Join(dir, "db"), &bitcesque.Options{OnOperation: m.Observer("users")})
+	if e != nil {
+		t.Fatal(e)
+	}
+	m.Attach("users", db)
+	db.Upsert([]byte("Tom"), []byte("Oregon"))
+	db.Upsert([]byte("Tom"), []byte("Washington"))
+	db.Get([]byte("Tom"))
+	db.Consolidate()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, line := range []string{
+		`bitcesque_operation_duration_seconds_count{db="users",op="write"} 2`,
+		`bitcesque_operation_duration_seconds_count{db="users",op="read"} 1`,
+		`bitcesque_operation_duration_seconds_bucket{db="users",op="compact",le="+Inf"} 1`,
+		`bitcesque_keys{db="users"} 1`,
+		`bitcesque_dead_ratio{db="users"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Error("Missing metric: " + line)
+		}
+	}
+	db.Close()
+}
@@ -0,0 +1,60 @@
+//go:build !unix
+
+package bitcesque
+
+import (
+	"io"
+	"os"
+)
+
+// Platforms without mmap instead read files into memory with ReadAt, and
+// keep the in-memory copy of the active file current as it is appended to.
+
+// Reads the file into a buffer that will be extended as it is appended to.
+func makeFilebuf(f *os.File) ([]byte, error) {
+	stats, e := f.Stat()
+	if e != nil {
+		return nil, e
+	}
+	return mapReadOnly(f, uint64(stats.Size()))
+}
+
+// Extends the in-memory copy of a file being appended to with the bytes just
+// written to it.  Nothing is released, so retire goes uncalled.
+func growFilebuf(buf []byte, f *os.File, written []byte, filled uint64, retire func()) ([]byte, error) {
+	return append(buf, written...), nil
+}
+
+// Overwrites the in-memory copy at pos with b, after the same was done to the
+// file, if the copy extends that far.
+func patchFilebuf(buf []byte, pos uint64, b []byte) {
+	if pos < uint64(len(buf)) {
+		copy(buf[pos:], b)
+	}
+}
+
+// Shortens the in-memory copy after the file was truncated to size.
+func truncateFilebuf(buf []byte, size uint64) []byte {
+	return buf[:min(size, uint64(len(buf)))]
+}
+
+// Reads exactly the first size bytes of a file that will not change.
+func mapReadOnly(f *os.File, size uint64) ([]byte, error) {
+	buf := make([]byte, size)
+	_, e := f.ReadAt(buf, 0)
+	if e == io.EOF {
+		e = nil
+	}
+	return buf, e
+}
+
+// Returns a buffer for reading and writing the first size bytes of a file,
+// which here is only ever a fresh one of zeros.  Writes to it aren't written
+// back.
+func mapReadWrite(f *os.File, size uint64) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func unmap(buf []byte) error {
+	return nil
+}
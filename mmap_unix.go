@@ -0,0 +1,92 @@
+//go:build unix
+
+package bitcesque
+
+import (
+	"os"
+	"syscall"
+)
+
+// The smallest mapping made of a file being appended to: 4gb, or 250mb where
+// int is 32 bits and address space is scarce.  Variable only for tests.
+var minFilebufLen = 4000000000 >> (4 * (1 - ^uint(0)>>63))
+
+// Indirected so tests can simulate mapping failures.
+var sysMmap = syscall.Mmap
+
+// Maps the file for reading while it is appended to.  Maps at least
+// minFilebufLen to avoid constantly remapping, but never reads the invalid
+// part since it will have no pointers in.
+func makeFilebuf(f *os.File) ([]byte, error) {
+	stats, e := f.Stat()
+	if e != nil {
+		return nil, e
+	}
+	mmapLen := int(stats.Size())
+	if mmapLen < minFilebufLen {
+		mmapLen = minFilebufLen
+	} else {
+		mmapLen *= 2
+	}
+	return sysMmap(int(f.Fd()), 0, mmapLen, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// Extends the read buffer of a file being appended to, after written was
+// appended to it bringing it to filled bytes, if the buffer no longer covers
+// the file.  The new mapping is made before the old one is released, so on
+// failure the old buffer is returned intact along with the error.  retire is
+// called before the old one is released.
+func growFilebuf(buf []byte, f *os.File, written []byte, filled uint64, retire func()) ([]byte, error) {
+	if filled <= uint64(len(buf)) {
+		return buf, nil
+	}
+	newLen := len(buf)
+	if newLen < minFilebufLen {
+		newLen = minFilebufLen
+	}
+	for uint64(newLen) < filled {
+		newLen *= 2
+		if newLen <= 0 {
+			return buf, syscall.ENOMEM
+		}
+	}
+	grown, e := sysMmap(int(f.Fd()), 0, newLen, syscall.PROT_READ, syscall.MAP_SHARED)
+	if e != nil {
+		return buf, e
+	}
+	if buf != nil {
+		retire()
+		syscall.Munmap(buf)
+	}
+	return grown, nil
+}
+
+// The mapping is shared, so writes made to the file are already visible.
+func patchFilebuf(buf []byte, pos uint64, b []byte) {}
+
+// The mapping is sized independently of the file, so needs no change.
+func truncateFilebuf(buf []byte, size uint64) []byte {
+	return buf
+}
+
+// Maps exactly the first size bytes of a file that will not change.
+func mapReadOnly(f *os.File, size uint64) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return sysMmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// Maps the first size bytes of a file for reading and writing, with writes
+// reaching the file.
+func mapReadWrite(f *os.File, size uint64) ([]byte, error) {
+	return sysMmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// Releases a buffer obtained from any of the above.
+func unmap(buf []byte) error {
+	if buf == nil {
+		return nil
+	}
+	return syscall.Munmap(buf)
+}
@@ -0,0 +1,69 @@
+//go:build unix
+
+package bitcesque
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+func TestMappingGrowth(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer removeAll(loc)
+
+	oldMin, oldMmap := minFilebufLen, sysMmap
+	defer func() { minFilebufLen, sysMmap = oldMin, oldMmap }()
+	minFilebufLen = 4096
+
+	d, e := NewDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	val := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		e = d.Upsert([]byte(strconv.Itoa(i)), append(val, strconv.Itoa(i)...))
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	if len(d.filebuffer) < int(d.filledSize) {
+		t.Error("Mapping not grown past initial size")
+	}
+
+	//Once mapping fails, reads past the mapping fall back to ReadAt
+	mapped := len(d.filebuffer)
+	sysMmap = func(int, int64, int, int, int) ([]byte, error) {
+		return nil, errors.New("Simulated mmap failure")
+	}
+	for i := 20; uint64(mapped) >= d.filledSize; i++ {
+		e = d.Upsert([]byte(strconv.Itoa(i)), append(val, strconv.Itoa(i)...))
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	if len(d.filebuffer) != mapped {
+		t.Error("Mapping changed despite failure")
+	}
+	check := func(stage string) {
+		for _, k := range d.Keys() {
+			r, _ := d.Get([]byte(k))
+			if r[1000:] != k {
+				t.Error("Retrieval error " + stage + " for " + k)
+			}
+		}
+	}
+	check("with failed remap")
+
+	//And growth is retried on the next append
+	sysMmap = oldMmap
+	d.Upsert([]byte("last"), append(val, "last"...))
+	if len(d.filebuffer) < int(d.filledSize) {
+		t.Error("Remap not retried")
+	}
+	check("after retried remap")
+	d.Close()
+}
@@ -0,0 +1,216 @@
+package bitcesque
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// With Options.NoMmap, data files are never mapped.  The read buffer of each
+// holds only its header, which is enough to know where its documents start,
+// so every read falls through to ReadAt, and scans read the file a window at
+// a time.
+
+// Size of the windows data files are scanned through when not mapped.
+const scanWindow = 1 << 20
+
+// Buffers for windows, and for values read only for the length of a call.
+var readBuffers = sync.Pool{New: func() any { b := make([]byte, scanWindow); return &b }}
+
+// Returns a read buffer for the first size bytes of a data file: a mapping
+// of them, one that will grow with the file if it is being appended to, or
+// only its header if noMmap is set.
+func mapSegment(f *os.File, size uint64, appending, noMmap bool) ([]byte, error) {
+	if noMmap {
+		buf := make([]byte, min(size, headerSize))
+		_, e := f.ReadAt(buf, 0)
+		if e == io.EOF {
+			e = nil
+		}
+		return buf, e
+	}
+	if appending {
+		return makeFilebuf(f)
+	}
+	return mapReadOnly(f, size)
+}
+
+// Extends the read buffer of the active segment after b was appended to it,
+// if it is a mapping.  Assumes the write lock is held.
+func (d *DB) growActive(b []byte) {
+	if !d.opts.NoMmap {
+		d.filebuffer, _ = growFilebuf(d.filebuffer, d.filehandle, b, d.filledSize, d.quiesce)
+	}
+}
+
+// Releases the read buffer of the active segment, if it is a mapping.
+func (d *DB) unmapActive() error {
+	if d.opts.NoMmap {
+		return nil
+	}
+	return unmap(d.filebuffer)
+}
+
+// Reads from the DB's segments into a pooled buffer, which is overwritten by
+// the next read.
+type pooledReader struct {
+	d   *DB
+	buf *[]byte
+}
+
+func (r pooledReader) readSegment(segment uint32, pos, length uint64) []byte {
+	if b, ok := r.d.buffered(segment, pos, length); ok {
+		return b
+	}
+	f := r.d.filehandle
+	if segment != r.d.activeID {
+		f = r.d.sealed[segment].filehandle
+	}
+	if uint64(cap(*r.buf)) < length {
+		*r.buf = make([]byte, length)
+	}
+	out := (*r.buf)[:length]
+	n, _ := f.ReadAt(out, int64(pos))
+	return out[:n]
+}
+
+// Calls fn with the value oal points to, which is only valid during the call.
+// Without mappings to read from, the value is read into a pooled buffer
+// rather than a fresh one.  Assumes at least a read lock is held.
+func (d *DB) withVal(oal offsetAndLength, fn func(v []byte)) error {
+	cacheable := d.cacheable(oal)
+	if cacheable {
+		if v, present := d.cache.get(oal.segment, oal.offset); present {
+			fn(v)
+			return nil
+		}
+	}
+	var src segmentReader = d
+	if d.opts.NoMmap {
+		buf := readBuffers.Get().(*[]byte)
+		defer func() {
+			//Outsized buffers are left for the collector
+			if cap(*buf) <= scanWindow {
+				readBuffers.Put(buf)
+			}
+		}()
+		src = pooledReader{d, buf}
+	}
+	v, e := d.valFrom(src, oal)
+	if e != nil {
+		return e
+	}
+	if cacheable {
+		//Decoded values are fresh, but plain ones are in the pooled buffer
+		if oal.compressed() || oal.format&(encryptedFlag>>24) != 0 {
+			d.cache.put(oal.segment, oal.offset, v)
+		} else {
+			d.cache.put(oal.segment, oal.offset, append([]byte{}, v...))
+		}
+	}
+	fn(v)
+	return nil
+}
+
+// Reads a segment for scanning: from its read buffer where that covers it,
+// and otherwise from its file, through a window that slides forward.
+type scanner struct {
+	buf    []byte
+	f      *os.File
+	window *[]byte
+	base   uint64
+	filled uint64
+	sum    Checksum //As the segment's header gives
+}
+
+func newScanner(buf []byte, f *os.File) *scanner {
+	return &scanner{buf: buf, f: f, sum: fileChecksum(buf, uint64(len(buf)))}
+}
+
+// Returns up to n bytes from pos onwards, fewer only if the file ends first.
+// The bytes are only valid until the next call.
+func (s *scanner) bytes(pos, n uint64) []byte {
+	if pos+n <= uint64(len(s.buf)) {
+		return s.buf[pos : pos+n]
+	}
+	if s.window != nil && pos >= s.base && pos+n <= s.base+s.filled {
+		return (*s.window)[pos-s.base : pos-s.base+n]
+	}
+	if s.window == nil {
+		s.window = readBuffers.Get().(*[]byte)
+	}
+	if uint64(cap(*s.window)) < n {
+		*s.window = make([]byte, n)
+	}
+	w := (*s.window)[:cap(*s.window)]
+	read, _ := s.f.ReadAt(w, int64(pos))
+	s.base, s.filled = pos, uint64(read)
+	return w[:min(n, s.filled)]
+}
+
+// Returns the window to the pool.
+func (s *scanner) release() {
+	if s.window != nil && cap(*s.window) <= scanWindow {
+		readBuffers.Put(s.window)
+	}
+	s.window = nil
+}
+
+// As scanDocuments, over the segment being scanned.
+func (s *scanner) scan(start, end uint64, fn func(r *record) error) (uint64, error) {
+	if end <= uint64(len(s.buf)) {
+		return scanDocuments(s.buf, start, end, s.sum, fn)
+	}
+	pos := start
+	for pos < end {
+		head := s.bytes(pos, min(12, end-pos))
+		n, ok := docLength(head, 0, uint64(len(head)))
+		if !ok || end-pos < n {
+			return pos, corruptionAt(pos)
+		}
+		doc := s.bytes(pos, n)
+		if uint64(len(doc)) < n {
+			return pos, corruptionAt(pos)
+		}
+		base := pos
+		_, e := scanDocuments(doc, 0, n, s.sum, func(r *record) error {
+			r.pos += base
+			return fn(r)
+		})
+		if e != nil && !checkDocument(doc, s.sum) {
+			return pos, corruptionAt(pos)
+		}
+		if e != nil {
+			return pos, e
+		}
+		pos += n
+	}
+	return pos, nil
+}
+
+// As intactDocument, over the segment being scanned.
+func (s *scanner) intact(pos, end uint64) (uint64, bool) {
+	head := s.bytes(pos, min(12, end-pos))
+	n, ok := docLength(head, 0, uint64(len(head)))
+	if !ok || end-pos < n {
+		return 0, false
+	}
+	doc := s.bytes(pos, n)
+	if uint64(len(doc)) < n {
+		return 0, false
+	}
+	return intactDocument(doc, 0, n, s.sum)
+}
+
+// Returns whether the segment holds only zeros from pos up to end.
+func (s *scanner) zeroFrom(pos, end uint64) bool {
+	for pos < end {
+		n := min(scanWindow, end-pos)
+		chunk := s.bytes(pos, n)
+		if uint64(len(chunk)) < n || !allZero(chunk) {
+			return false
+		}
+		pos += n
+	}
+	return true
+}
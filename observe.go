@@ -0,0 +1,43 @@
+package bitcesque
+
+import (
+	"time"
+)
+
+// A kind of DB operation, as reported to Options.OnOperation.
+type Op int
+
+const (
+	OpRead Op = iota
+	OpWrite
+	OpCompact
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpCompact:
+		return "compact"
+	}
+	return "unknown"
+}
+
+// Returns when an operation started, or the zero time if no one is
+// observing operations, sparing the clock read.
+func (d *DB) startOp() time.Time {
+	if d.opts.OnOperation == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// Reports an operation begun at start, as returned by startOp.  Meant to be
+// deferred before taking the lock, so that time spent waiting for it counts.
+func (d *DB) endOp(op Op, start time.Time) {
+	if d.opts.OnOperation != nil {
+		d.opts.OnOperation(op, time.Since(start))
+	}
+}
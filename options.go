@@ -0,0 +1,223 @@
+package bitcesque
+
+import (
+	"crypto/cipher"
+	"time"
+)
+
+// Tunables for opening a DB.  The zero value gives the default behaviour.
+type Options struct {
+	// If positive, a background goroutine consolidates the DB whenever the
+	// fraction of the file taken up by overwritten or removed records exceeds
+	// this ratio.
+	AutoCompactDeadRatio float64
+	// How often the background goroutine checks the dead ratio.  Defaults to
+	// one minute.
+	AutoCompactInterval time.Duration
+	// Files smaller than this many bytes are never compacted automatically,
+	// however fragmented.
+	AutoCompactMinSize uint64
+	// Called with any error from an automatic compaction.
+	OnAutoCompactError func(error)
+	// If positive, the active data file is sealed and a new one started once
+	// it would grow past this many bytes.  Zero keeps everything in a single
+	// file.
+	MaxSegmentSize uint64
+	// How often a background goroutine purges expired keys from the index.
+	// Defaults to one minute; negative disables the sweeper, leaving expired
+	// keys to be hidden lazily and dropped at the next compaction.
+	ExpirySweepInterval time.Duration
+	// Keeps the keys in a skip list alongside the hash index, so that scans,
+	// paging and prefix counts walk them in order rather than sorting or
+	// sampling the whole keyset, and iterators see keys added as they go.
+	// Costs around 60 bytes of memory per key on top of the hash index.
+	OrderedIndex bool
+	// Keeps the hash index in a few large arenas rather than a map, cutting
+	// its overhead per key from around a hundred bytes to thirty or so, at
+	// some cost in speed.  Worth it for DBs of many millions of keys,
+	// especially without OrderedIndex.
+	CompactIndex bool
+	// Keeps the hash index as CompactIndex does, but in memory-mapped scratch
+	// files beside the DB rather than on the heap, so that DBs with more keys
+	// than fit in memory can still be opened, at the cost of slower lookups
+	// once the OS has to page the index in.  The files are removed as soon as
+	// they are made, the index being rebuilt from the keyfile on opening.
+	// Where mmap is unavailable, the index is kept in memory.  With
+	// OrderedIndex, the ordered index still holds every key in memory.
+	//
+	// So that lookups of absent keys needn't page the index in, the DB also
+	// keeps a Bloom filter of the keys in each segment in memory, written
+	// alongside any hint files and consulted before the index.
+	DiskIndex bool
+	// If set, values are stored compressed with this codec when that makes
+	// them smaller.  Compaction recompresses values written with other
+	// codecs, or uncompressed, to match.
+	Compression Codec
+	// Values shorter than this many bytes are never compressed.  Defaults to
+	// 64.
+	CompressionThreshold int
+	// If set, values are encrypted with this cipher, e.g. from NewAESGCM.
+	// Records that are already encrypted can only be read with the same key.
+	// Compaction encrypts any plaintext records.
+	Encryption cipher.AEAD
+	// Encrypts keys as well as values, along with the keyfile.  Requires
+	// Encryption.
+	EncryptKeys bool
+	// Bytes of recent appends kept in memory while serving replication, for
+	// followers to catch up from after a disconnection.  Defaults to 16MB.
+	ReplicationLogSize int
+	// Called after every read, write and compaction with how long it took,
+	// including any wait for the lock, e.g. to feed the metrics package.
+	// Must be safe to call concurrently, and quick.
+	OnOperation func(op Op, took time.Duration)
+	// The algorithm records are checked with, for DBs created with these
+	// options.  Existing DBs keep the one their data files record, and
+	// followers must use their primary's.  Defaults to CRC32C.
+	Checksum Checksum
+	// Checks each record read against its checksum, at the cost of reading
+	// the whole document.  Lookup then returns an error wrapping ErrCorrupt
+	// for a damaged record, and Get and its variants report the key absent.
+	VerifyOnRead bool
+	// Bytes per second read by the scrubber started with StartScrub.
+	// Defaults to 16MB.
+	ScrubRate int
+	// Called by the scrubber with the segment id and offset of each damaged
+	// record it finds.  Everything from there to the end of the segment is
+	// unverified.
+	OnCorruption func(segment uint32, offset uint64)
+	// What OpenAndVerifyDB does on finding a damaged record.
+	Recovery RecoveryPolicy
+	// Called as OpenAndVerifyDB works through the data files, with the bytes
+	// verified so far and in total, and once more when it finishes.  Calls
+	// may come from different goroutines, but never at once.
+	OnVerifyProgress func(scanned, total uint64)
+	// How many segments OpenAndVerifyDB verifies at once.  Defaults to
+	// GOMAXPROCS.
+	VerifyWorkers int
+	// If positive, the active data file is extended this many bytes at a
+	// time ahead of writes, with fallocate where available, so that its space
+	// is allocated up front and growing it costs less.  The unused remainder
+	// is trimmed when the file is sealed or the DB closed, and after an
+	// unclean shutdown, OpenDB disregards a tail of zeros.
+	Preallocate uint64
+	// Never memory map data files, for filesystems such as NFS or CIFS where
+	// mappings are unreliable.  Reads go through ReadAt into pooled buffers,
+	// and indexing on open streams through the files, so GetZeroCopy returns
+	// a copy.  The files themselves are unchanged.
+	NoMmap bool
+	// If positive, up to this many bytes of recently read values are kept in
+	// a cache keyed by where they are stored, forgetting the least recently
+	// used first.  Worth it with NoMmap, and for compressed or encrypted
+	// values, which are otherwise decoded on every read.  Plain values read
+	// through mappings aren't cached.  Stats reports its hits and misses.
+	ValueCacheSize int
+	// If positive, the DB acts as a cache of this many bytes of live
+	// records, as Stats counts them: once a write takes it past that, the
+	// keys CacheEviction chooses are removed, tombstones being written for
+	// them, until it is back within it.  Compaction, e.g. automatic with
+	// AutoCompactDeadRatio, then reclaims their space.  A record larger than
+	// the cache is evicted as soon as it is written.  The order keys are
+	// evicted in is kept across reopening by the order their records are
+	// stored in, which compaction keeps to, so reads since the last
+	// compaction are forgotten.
+	CacheMaxBytes uint64
+	// Which keys are evicted first with CacheMaxBytes.  Defaults to
+	// EvictFIFO.
+	CacheEviction EvictionPolicy
+	// If positive, writes of keys longer than this many bytes fail with
+	// ErrKeyTooLarge.  Keys can never be longer than 16mb - 1 bytes.
+	MaxKeySize int
+	// If positive, writes of values longer than this many bytes fail with
+	// ErrValueTooLarge.  Values, once compressed or encrypted, can never be
+	// longer than 4gb - 1 bytes.  Compressed values recording a greater
+	// length are taken to be corrupt.
+	MaxValueSize int
+	// If positive, writes that would take the data files past this many
+	// bytes in total fail with ErrQuotaExceeded, as do writes that find the
+	// disk full.  Nothing of a failed write is left in the files.
+	MaxFileSize uint64
+	// Once a write has failed with ErrQuotaExceeded, refuse all writes with
+	// ErrReadOnly until a compaction succeeds.
+	ReadOnlyWhenFull bool
+	// Called, from a goroutine of its own, with the error each write refused
+	// with ErrQuotaExceeded failed with.
+	OnQuotaExceeded func(error)
+	// Flushes each write to disk before it returns.
+	SyncWrites bool
+	// If positive, Upsert and Remove hand their writes to a single writer
+	// goroutine through a queue of this length, blocking while it is full.
+	// The writer commits whatever has queued as one batch, with one write
+	// and, with SyncWrites, one sync, and only the last write of each key.
+	// Each call returns once its batch is committed.
+	WriteQueue int
+	// Serves Get, GetInto, Lookup and Contains from an immutable copy of the
+	// index without taking any lock.  Each write discards the copy, and
+	// it is rebuilt once enough reads have missed it, so this suits
+	// read-mostly workloads.  Memory the copy refers to is only released once
+	// reads using it have finished.
+	LockFreeReads bool
+	// Writes a hint file summarizing each segment as it is sealed or merged,
+	// from which OpenAndVerifyDB indexes the segment rather than reading and
+	// verifying its records.  Hints that no longer match their segment are
+	// ignored.
+	HintFiles bool
+	// If positive, the keyfile is written in the background this often, and
+	// whenever this many writes have been made since it last was, as well as
+	// on Close.  After an unclean shutdown OpenDB then only has to index what
+	// was written since.
+	CheckpointInterval time.Duration
+	CheckpointWrites   uint64
+	// Called with any error from a background checkpoint.
+	OnCheckpointError func(error)
+	// Logs the index entries changed by each write to a file alongside the
+	// keyfile, so that after an unclean shutdown OpenDB need only replay the
+	// log rather than index the data written since the last checkpoint.
+	// Compaction writes the keyfile afresh and empties the log.
+	IndexLog bool
+	// If positive, the index remembers up to this many earlier values of each
+	// key, for GetVersion and History, and compaction keeps their records.
+	// Removing a key, or its expiry, forgets them.  They are held only in
+	// memory, so each opening of the DB starts without them.
+	KeepVersions int
+	// If positive, compaction keeps tombstones of removed keys written within
+	// this long, rather than dropping them, so that consumers reading the
+	// files, e.g. with ViewAt or a merge of two DBs, still learn of the
+	// removal.  Finding them costs compaction a read through every file it
+	// rewrites.
+	TombstoneRetention time.Duration
+	// If positive, appends are gathered in memory up to this many bytes and
+	// written to the active file with one call, rather than one each, and
+	// served from memory until then.  Buffered appends are written out when
+	// the buffer fills, by Sync, when the file is sealed, compacted or
+	// closed, and every FlushInterval, which also syncs the file.  Appends
+	// still buffered are lost to a crash.  Ignored with SyncWrites.
+	WriteBuffer int
+	// The longest an append waits in the write buffer.  Defaults to 10ms.
+	FlushInterval time.Duration
+	// How often a DB opened with OpenReadOnlyDB indexes what the writer has
+	// appended since.  Defaults to a second.  If negative, it only does so
+	// when Refresh is called.
+	RefreshInterval time.Duration
+	// Bytes of key and value in the largest request ServeUnix accepts, and
+	// of payload in the largest answer a client from DialUnixWithOptions
+	// accepts.  Defaults to 16mb.
+	MaxSocketMessage int
+}
+
+// What OpenAndVerifyDB does on finding a damaged record.
+type RecoveryPolicy int
+
+const (
+	// Stops loading, returning the DB as of the records before the damage
+	// along with an error wrapping ErrCorrupt.  Later writes are kept, but
+	// the damage stays in the file for the next verification to stop at.
+	StopAtCorruption RecoveryPolicy = iota
+	// Returns the error without opening the DB.
+	FailOnCorruption
+	// Truncates the damaged segment file just before the damage, discarding
+	// everything after it in that file, and carries on.
+	TruncateAtCorruption
+	// Skips to the next intact document, leaving the file untouched, and
+	// carries on.  RepairDB removes the damage for good.
+	SkipCorruptRecords
+)
@@ -0,0 +1,394 @@
+package bitcesque
+
+import (
+	"iter"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Keys are additionally kept in a skip list, so they can be walked in order
+// without copying and sorting the whole keyset.
+const maxSkipLevel = 32
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+type skipList struct {
+	head  skipNode
+	level int
+	rnd   uint64 //Xorshift state for choosing node heights
+}
+
+func newSkipList() *skipList {
+	return &skipList{skipNode{"", make([]*skipNode, maxSkipLevel)}, 1, 0x9E3779B97F4A7C15}
+}
+
+// Returns a node height, each level being half as likely as the last.
+func (s *skipList) randomLevel() int {
+	s.rnd ^= s.rnd << 13
+	s.rnd ^= s.rnd >> 7
+	s.rnd ^= s.rnd << 17
+	level := 1
+	for r := s.rnd; r&1 == 1 && level < maxSkipLevel; r >>= 1 {
+		level++
+	}
+	return level
+}
+
+// Fills update with the last node at each level whose key is less than k,
+// and returns the first node whose key is at least k, or nil.
+func (s *skipList) search(k string, update []*skipNode) *skipNode {
+	x := &s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < k {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// Adds k to the list, if it is not already present.
+func (s *skipList) insert(k string) {
+	var update [maxSkipLevel]*skipNode
+	if n := s.search(k, update[:]); n != nil && n.key == k {
+		return
+	}
+	level := s.randomLevel()
+	for i := s.level; i < level; i++ {
+		update[i] = &s.head
+	}
+	if level > s.level {
+		s.level = level
+	}
+	n := &skipNode{k, make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+}
+
+// Removes k from the list, if present.
+func (s *skipList) remove(k string) {
+	var update [maxSkipLevel]*skipNode
+	n := s.search(k, update[:])
+	if n == nil || n.key != k {
+		return
+	}
+	for i := 0; i < len(n.next); i++ {
+		update[i].next[i] = n.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+}
+
+// Returns the first node whose key is at least k, or nil.
+func (s *skipList) seek(k string) *skipNode {
+	return s.search(k, nil)
+}
+
+// Returns the smallest key greater than every key with the given prefix, or
+// nil if there is none, i.e. the prefix is empty or all 0xff.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Walks the keys of a DB in ascending order, along with their values.  An
+// iterator holds no lock between calls, so writers are never blocked by a
+// slow consumer; each step resumes after the last key returned, and sees the
+// DB as of that step.  If the DB has no ordered index, the keys in range are
+// instead sorted up front, and keys added after that are not seen.
+type Iterator struct {
+	db     *DB
+	start  string   //Inclusive lower bound
+	end    []byte   //Exclusive upper bound, or nil for none
+	next   string   //Where to resume from, inclusive
+	keys   []string //Sorted keys in range, if the DB has no ordered index
+	trim   int      //Bytes of bucket prefix left off returned keys
+	key    []byte
+	value  []byte
+	err    error //Why the iteration stopped early, if it did
+	closed bool
+}
+
+// Returns an iterator over the keys starting with the given prefix, in
+// ascending order.
+func (d *DB) Scan(prefix []byte) *Iterator {
+	return d.RangeScan(prefix, prefixEnd(prefix))
+}
+
+// Returns an iterator over the keys from start, inclusive, up to end,
+// exclusive, in ascending lexicographic order.  A nil end means no upper
+// bound.
+func (d *DB) RangeScan(start, end []byte) *Iterator {
+	it := &Iterator{db: d, start: string(start), next: string(start)}
+	if end != nil {
+		it.end = append([]byte{}, end...)
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.ordered == nil {
+		it.keys = d.keysInRange(it.start, it.end)
+	}
+	return it
+}
+
+// Returns the indexed keys from start, inclusive, up to end, exclusive, in
+// ascending order.  A nil end means no upper bound.  Assumes at least a read
+// lock is held.
+func (d *DB) keysInRange(start string, end []byte) []string {
+	var out []string
+	if d.ordered != nil {
+		for n := d.ordered.seek(start); n != nil && (end == nil || n.key < string(end)); n = n.next[0] {
+			out = append(out, n.key)
+		}
+		return out
+	}
+	for k := range d.kToPos.all() {
+		if k >= start && (end == nil || k < string(end)) {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Returns up to limit keys in ascending order, starting after afterKey, or
+// from the first key if afterKey is nil.  Passing the last key of one page as
+// afterKey gives the next, so the whole keyset can be paged through without
+// holding it all in memory at once.  Without an ordered index each page
+// costs a pass over every key.
+func (d *DB) KeysPage(afterKey []byte, limit int) []string {
+	if limit <= 0 {
+		return nil
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	after := func(k string) bool {
+		return afterKey == nil || k > string(afterKey)
+	}
+	t := now()
+	out := make([]string, 0, limit)
+	if d.ordered != nil {
+		for n := d.ordered.seek(string(afterKey)); n != nil && len(out) < limit; n = n.next[0] {
+			if after(n.key) && !d.expired(n.key, t) {
+				out = append(out, n.key)
+			}
+		}
+		return out
+	}
+	for k := range d.kToPos.all() {
+		if !after(k) || d.expired(k, t) {
+			continue
+		}
+		out = append(out, k)
+		//Only the least limit keys are kept, pruning as the slice fills
+		if len(out) >= 2*limit {
+			sort.Strings(out)
+			out = out[:limit]
+		}
+	}
+	sort.Strings(out)
+	return out[:min(limit, len(out))]
+}
+
+// Keys CountPrefix looks at to estimate a count without an ordered index.
+const countPrefixSample = 4096
+
+// Returns the number of live keys starting with the given prefix.  The count
+// is exact if the DB has an ordered index, or has no more keys than
+// countPrefixSample; otherwise it is estimated from a sample of that many
+// keys, so is only a guide to prefixes holding a sizeable share of them.
+func (d *DB) CountPrefix(prefix []byte) int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	t := now()
+	end := prefixEnd(prefix)
+	n := 0
+	if d.ordered != nil {
+		for x := d.ordered.seek(string(prefix)); x != nil && (end == nil || x.key < string(end)); x = x.next[0] {
+			if !d.expired(x.key, t) {
+				n++
+			}
+		}
+		return n
+	}
+	sampled := 0
+	for k := range d.kToPos.all() {
+		if sampled == countPrefixSample {
+			break
+		}
+		sampled++
+		if strings.HasPrefix(k, string(prefix)) && !d.expired(k, t) {
+			n++
+		}
+	}
+	if total := d.kToPos.len(); sampled < total {
+		return int(math.Round(float64(n) * float64(total) / float64(sampled)))
+	}
+	return n
+}
+
+// Removes every key starting with the given prefix, as RemoveRange.
+func (d *DB) RemovePrefix(prefix []byte) (int, error) {
+	return d.RemoveRange(prefix, prefixEnd(prefix))
+}
+
+// Removes every key from start, inclusive, up to end, exclusive, writing all
+// the removals as one batch under a single lock acquisition.  A nil end means
+// no upper bound.  Returns the number of keys removed.
+func (d *DB) RemoveRange(start, end []byte) (int, error) {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return 0, ErrDatabaseClosed
+	}
+	if d.readOnly() {
+		return 0, ErrReadOnly
+	}
+	b := d.NewBatch()
+	n := 0
+	t := now()
+	for _, k := range d.keysInRange(string(start), end) {
+		if !d.expired(k, t) {
+			n++
+		}
+		b.Remove([]byte(k))
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.Len() == 0 {
+		return 0, nil
+	}
+	e := b.commit()
+	if e != nil {
+		return 0, e
+	}
+	return n, nil
+}
+
+// Positions the iterator so the following call to Next moves to the first
+// key at or after k, within the iterator's range.
+func (it *Iterator) Seek(k []byte) {
+	it.next = string(k)
+	if it.next < it.start {
+		it.next = it.start
+	}
+}
+
+// Returns the first candidate key at or after where the iterator resumes
+// from, or false if there are none.  Assumes at least a read lock is held.
+func (it *Iterator) seek() (string, bool) {
+	if it.db.ordered == nil {
+		i := sort.SearchStrings(it.keys, it.next)
+		if i < len(it.keys) {
+			return it.keys[i], true
+		}
+		return "", false
+	}
+	if n := it.db.ordered.seek(it.next); n != nil {
+		return n.key, true
+	}
+	return "", false
+}
+
+// Advances to the next key, returning false once there are none left, the
+// iterator has been closed, or a value couldn't be read, as Err then reports.
+func (it *Iterator) Next() bool {
+	if it.closed {
+		return false
+	}
+	d := it.db
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	t := now()
+	for {
+		k, ok := it.seek()
+		if !ok || (it.end != nil && k >= string(it.end)) {
+			break
+		}
+		//Appending a zero byte gives the least key greater than k
+		it.next = k + "\x00"
+		oal, present := d.kToPos.get(k)
+		if !present || d.expired(k, t) {
+			continue
+		}
+		v, e := d.getVal(oal)
+		if e != nil {
+			it.err = e
+			it.closed = true
+			break
+		}
+		it.key = []byte(k)
+		it.value = append([]byte{}, v...)
+		return true
+	}
+	it.key, it.value = nil, nil
+	return false
+}
+
+// Returns the error reading a value that ended the iteration, or nil if it
+// ran to the end or was closed.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Returns the current key.  Only valid after Next has returned true.
+func (it *Iterator) Key() []byte {
+	if it.key == nil {
+		return nil
+	}
+	return it.key[it.trim:]
+}
+
+// Returns a copy of the current value.  Only valid after Next has returned
+// true.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Ends the iteration, releasing what the iterator holds.  Iterators hold no
+// lock, so this is only needed to stop early and free memory promptly.
+func (it *Iterator) Close() {
+	it.closed = true
+	it.keys, it.key, it.value = nil, nil, nil
+}
+
+// Returns the iterator's remaining pairs as a sequence for use with range.
+// Keys and values are fresh copies, so may be retained.  The iterator is
+// closed when the loop ends, after which Err reports any failure to read a
+// value.
+func (it *Iterator) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		defer it.Close()
+		for it.Next() {
+			if !yield(it.Key(), it.Value()) {
+				return
+			}
+		}
+	}
+}
+
+// Returns every live pair in ascending key order, as a sequence for use with
+// range.  Like an Iterator, it holds no lock between pairs, so breaking out
+// of the loop early leaks nothing.
+func (d *DB) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		d.Scan(nil).All()(yield)
+	}
+}
@@ -0,0 +1,15 @@
+package bitcesque
+
+import (
+	"os"
+	"syscall"
+)
+
+// Allocates disk space for the file up to size, extending it with zeros.
+func preallocate(f *os.File, size uint64) error {
+	e := syscall.Fallocate(int(f.Fd()), 0, 0, int64(size))
+	if e == syscall.EOPNOTSUPP {
+		return f.Truncate(int64(size))
+	}
+	return e
+}
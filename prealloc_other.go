@@ -0,0 +1,13 @@
+//go:build !linux
+
+package bitcesque
+
+import (
+	"os"
+)
+
+// Extends the file with zeros up to size.  Without fallocate the space may
+// be sparse, and only taken up as it is written.
+func preallocate(f *os.File, size uint64) error {
+	return f.Truncate(int64(size))
+}
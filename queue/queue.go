@@ -0,0 +1,211 @@
+// Package queue keeps durable FIFO queues in a bitcesque DB, alongside its
+// other keys.  Each item is a key of its own, numbered in order, so pushing
+// and popping each cost a single write, and named consumers can each read
+// through the queue at their own pace, their positions kept as keys too.
+//
+//	q, e := queue.Open(db, "jobs")
+//	e = q.Push([]byte("resize 1.jpg"))
+//	v, e := q.Pop()
+//
+// A DB can hold any number of queues, but each should be opened only once at
+// a time.
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+var (
+	// Returned on reading from a queue with nothing left to read.
+	ErrEmpty = errors.New("Queue is empty")
+	// Returned on pushing an empty item, which the DB would take for a
+	// removal once reopened.
+	ErrEmptyItem = errors.New("Item is empty")
+)
+
+// Items are kept under the first prefix and their sequence number,
+// big-endian so that they sort in order, and consumers' positions under the
+// second.  An emptied queue records the number its next item is to have, so
+// that numbers are never reused.
+const (
+	itemPrefix     = "i"
+	consumerPrefix = "c"
+	nextKey        = "n"
+)
+
+// A durable FIFO queue.  Safe for concurrent use.
+type Queue struct {
+	bucket    *bitcesque.Bucket
+	mutex     sync.Mutex
+	head      uint64 //Sequence number of the oldest item
+	tail      uint64 //Sequence number the next item pushed is given
+	consumers map[string]uint64
+}
+
+func itemKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(itemPrefix), seq)
+}
+
+// Opens the named queue in db, which needs no creating; it exists while it
+// holds items or consumers.
+func Open(db *bitcesque.DB, name string) (*Queue, error) {
+	q := &Queue{bucket: db.Bucket("queue." + name), consumers: make(map[string]uint64)}
+	v, e := q.bucket.Lookup([]byte(nextKey))
+	switch {
+	case e == nil && len(v) == 8:
+		q.tail = binary.BigEndian.Uint64(v)
+	case e == nil:
+		return nil, errors.New("Malformed next sequence number")
+	case e != bitcesque.ErrKeyNotFound:
+		return nil, e
+	}
+	it := q.bucket.Scan([]byte(consumerPrefix))
+	for it.Next() {
+		if len(it.Value()) != 8 {
+			return nil, errors.New("Malformed consumer position")
+		}
+		pos := binary.BigEndian.Uint64(it.Value())
+		q.consumers[string(it.Key()[len(consumerPrefix):])] = pos
+		q.tail = max(q.tail, pos)
+	}
+	if e = it.Err(); e != nil {
+		return nil, e
+	}
+	it = q.bucket.Scan([]byte(itemPrefix))
+	if it.Next() {
+		if len(it.Key()) != len(itemPrefix)+8 {
+			return nil, errors.New("Malformed queue item key")
+		}
+		q.head = binary.BigEndian.Uint64(it.Key()[len(itemPrefix):])
+		it.Close()
+		//Items run unbroken from the head, so the tail can be found by
+		//doubling then bisecting
+		step := uint64(1)
+		for q.bucket.Contains(itemKey(q.head + step)) {
+			step *= 2
+		}
+		lo, hi := q.head+step/2, q.head+step //lo is present, hi absent
+		for hi-lo > 1 {
+			mid := lo + (hi-lo)/2
+			if q.bucket.Contains(itemKey(mid)) {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		q.tail = max(q.tail, hi)
+	} else if e = it.Err(); e != nil {
+		return nil, e
+	} else {
+		q.head = q.tail
+	}
+	return q, nil
+}
+
+// Appends v, which must not be empty, to the queue, returning its sequence
+// number.
+func (q *Queue) Push(v []byte) (uint64, error) {
+	if len(v) == 0 {
+		return 0, ErrEmptyItem
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	seq := q.tail
+	if e := q.bucket.Upsert(itemKey(seq), v); e != nil {
+		return 0, e
+	}
+	q.tail++
+	return seq, nil
+}
+
+// Removes and returns the oldest item, or fails with ErrEmpty.  Consumers
+// that haven't yet read it then never will.
+func (q *Queue) Pop() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	v, e := q.item(q.head)
+	if e != nil {
+		return nil, e
+	}
+	if q.head+1 == q.tail {
+		e = q.bucket.Upsert([]byte(nextKey), binary.BigEndian.AppendUint64(nil, q.tail))
+		if e != nil {
+			return nil, e
+		}
+	}
+	if e = q.bucket.Remove(itemKey(q.head)); e != nil {
+		return nil, e
+	}
+	q.head++
+	return v, nil
+}
+
+// Returns the oldest item without removing it, or fails with ErrEmpty.
+func (q *Queue) Peek() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.item(q.head)
+}
+
+// Returns the item with the given sequence number, or ErrEmpty if it is past
+// the end.  Assumes the queue's mutex is held.
+func (q *Queue) item(seq uint64) ([]byte, error) {
+	if seq >= q.tail {
+		return nil, ErrEmpty
+	}
+	return q.bucket.Lookup(itemKey(seq))
+}
+
+// Returns the number of items in the queue.
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return int(q.tail - q.head)
+}
+
+// Returns the next item for the named consumer, and its sequence number,
+// without removing it from the queue, or fails with ErrEmpty if the consumer
+// has read everything.  The same item is returned until the consumer
+// acknowledges it with Ack.  Consumers new to the queue start from its head.
+func (q *Queue) Next(consumer string) (uint64, []byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	seq := max(q.consumers[consumer], q.head)
+	v, e := q.item(seq)
+	if e != nil {
+		return 0, nil, e
+	}
+	return seq, v, nil
+}
+
+// Durably records that the named consumer has dealt with every item up to
+// and including seq, so that Next moves on past it, even after the DB is
+// reopened.  Acknowledging an item before the consumer's position leaves it
+// where it is.
+func (q *Queue) Ack(consumer string, seq uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	pos := max(q.consumers[consumer], min(seq+1, q.tail))
+	e := q.bucket.Upsert([]byte(consumerPrefix+consumer), binary.BigEndian.AppendUint64(nil, pos))
+	if e != nil {
+		return e
+	}
+	q.consumers[consumer] = pos
+	return nil
+}
+
+// Forgets the named consumer's position, so that it starts again from the
+// head of the queue.
+func (q *Queue) RemoveConsumer(consumer string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if e := q.bucket.Remove([]byte(consumerPrefix + consumer)); e != nil {
+		return e
+	}
+	delete(q.consumers, consumer)
+	return nil
+}
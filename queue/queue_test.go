@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+func TestQueue(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	loc := filepath.Join(dir, "db")
+	db, e := bitcesque.NewDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	q, _ := Open(db, "jobs")
+	if _, e = q.Pop(); e != ErrEmpty {
+		t.Error("Pop from empty queue error")
+	}
+	for _, v := range []string{"a", "b", "c", "d", "e"} {
+		q.Push([]byte(v))
+	}
+	if v, _ := q.Pop(); string(v) != "a" {
+		t.Error("Pop error: " + string(v))
+	}
+	if v, _ := q.Peek(); string(v) != "b" || q.Len() != 4 {
+		t.Error("Peek error: " + string(v))
+	}
+	seq, v, _ := q.Next("reader")
+	if string(v) != "b" {
+		t.Error("Consumer not started at head: " + string(v))
+	}
+	q.Ack("reader", seq)
+	if _, v, _ = q.Next("reader"); string(v) != "c" {
+		t.Error("Consumer not moved on: " + string(v))
+	}
+	q.Ack("reader", seq-1)
+	if _, v, _ = q.Next("reader"); string(v) != "c" {
+		t.Error("Consumer moved back by a stale ack: " + string(v))
+	}
+	if _, e = q.Push(nil); e != ErrEmptyItem || q.Len() != 4 {
+		t.Error("Empty item pushed")
+	}
+	other, _ := Open(db, "other")
+	other.Push([]byte("x"))
+	db.Close()
+
+	db, _ = bitcesque.OpenDB(loc)
+	defer db.Close()
+	q, _ = Open(db, "jobs")
+	if q.Len() != 4 {
+		t.Error("Wrong length after reopening")
+	}
+	if _, v, _ = q.Next("reader"); string(v) != "c" {
+		t.Error("Consumer position not kept: " + string(v))
+	}
+	q.Push([]byte("f"))
+	for _, want := range []string{"b", "c", "d", "e", "f"} {
+		if v, _ := q.Pop(); string(v) != want {
+			t.Error("Wrong order: " + string(v))
+		}
+	}
+	if _, _, e = q.Next("reader"); e != ErrEmpty {
+		t.Error("Consumer read past the end")
+	}
+	q, _ = Open(db, "jobs")
+	seq, _ = q.Push([]byte("g"))
+	if _, v, _ = q.Next("reader"); string(v) != "g" || seq != 6 {
+		t.Error("Numbering restarted under a consumer")
+	}
+	other, _ = Open(db, "other")
+	if v, _ := other.Pop(); string(v) != "x" {
+		t.Error("Queues not kept apart")
+	}
+}
@@ -0,0 +1,41 @@
+package bitcesque
+
+import (
+	"fmt"
+)
+
+// Fails with ErrQuotaExceeded if appending n bytes would take the data files
+// past Options.MaxFileSize.  Assumes the write lock is held.
+func (d *DB) checkQuota(n uint64) error {
+	if d.opts.MaxFileSize > 0 && d.totalSize()+n > d.opts.MaxFileSize {
+		return d.quotaExceeded(ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// Returns the error a failed append should fail the write with: one wrapping
+// ErrQuotaExceeded if it ran out of disk.  Assumes the write lock is held.
+func (d *DB) writeFailed(e error) error {
+	if diskFull(e) {
+		return d.quotaExceeded(fmt.Errorf("%w: %v", ErrQuotaExceeded, e))
+	}
+	return e
+}
+
+// Counts and reports a write refused for want of space, turning the DB
+// read-only if the options ask for that, and returns e.  Assumes the write
+// lock is held.
+func (d *DB) quotaExceeded(e error) error {
+	d.quotaFailures++
+	if d.opts.ReadOnlyWhenFull {
+		d.full = true
+	}
+	if hook := d.opts.OnQuotaExceeded; hook != nil {
+		d.background.Add(1)
+		go func() {
+			defer d.background.Done()
+			hook(e)
+		}()
+	}
+	return e
+}
@@ -0,0 +1,329 @@
+package bitcesque
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Opens the DB at location for reading alongside the process that has it
+// open for writing, without taking its lock, so that any number of other
+// processes can read a DB one process writes.  The reader indexes the DB by
+// reading all of its data files, then keeps up with the writer by indexing
+// only what it has appended since, at each call to Refresh, which a
+// background goroutine makes every Options.RefreshInterval.  Once the writer
+// has compacted or cleared the DB, the reader indexes it afresh.  Appends
+// the writer has yet to flush from its write buffer aren't seen.
+//
+// Writes fail with ErrReadOnly, as do compaction and checkpoints.  Options
+// that only concern writing, such as the write buffer and the index log, are
+// ignored.  A nil opts gives the defaults.
+func OpenReadOnlyDB(location string, opts *Options) (*DB, error) {
+	var ro Options
+	if opts != nil {
+		ro = *opts
+	}
+	ro.AutoCompactDeadRatio, ro.WriteQueue, ro.WriteBuffer, ro.Preallocate = 0, 0, 0, 0
+	ro.CheckpointInterval, ro.CheckpointWrites = 0, 0
+	ro.IndexLog, ro.HintFiles = false, false
+	sealed, active, horizon, e := openReaderSegments(location, ro.NoMmap)
+	if e != nil {
+		return nil, e
+	}
+	d := newDB(location, nil, sealed, active, newIndex(&ro, location, 0), make(map[string]int64), &ro)
+	d.reader = true
+	d.horizon = horizon
+	d.meta, e = readMetadata(location)
+	if e == nil && d.meta == nil {
+		d.meta = &Metadata{Properties: make(map[string]string)}
+	}
+	if e == nil {
+		d.mutex.Lock()
+		e = d.indexReader(active.size)
+		d.mutex.Unlock()
+	}
+	if e != nil {
+		d.Close()
+		return nil, e
+	}
+	if ro.RefreshInterval >= 0 {
+		d.background.Add(1)
+		go d.refresher()
+	}
+	return d, nil
+}
+
+// Returns the ids of the DB's segments in order, as its manifest lists them
+// or failing that as found in its directory, and the log offset before which
+// compaction has rewritten them.
+func listedSegments(location string) ([]uint32, uint64, error) {
+	m, e := readManifest(location)
+	if e != nil {
+		return nil, 0, e
+	}
+	if m != nil {
+		return m.segments, m.compacted, nil
+	}
+	ids, e := listSegments(location)
+	if e == nil && len(ids) == 0 {
+		ids = []uint32{0} //Fails to open as the writer hasn't created it
+	}
+	return ids, 0, e
+}
+
+// Opens read-only every segment of the DB at location, returning the sealed
+// ones, the active one, and the log offset before which compaction has
+// rewritten them.
+func openReaderSegments(location string, noMmap bool) (map[uint32]*segment, *segment, uint64, error) {
+	ids, horizon, e := listedSegments(location)
+	if e != nil {
+		return nil, nil, 0, e
+	}
+	sealed := make(map[uint32]*segment, len(ids))
+	for _, id := range ids {
+		seg, e := openSealedSegment(location, id, noMmap)
+		if e != nil {
+			for _, s := range sealed {
+				s.close()
+			}
+			return nil, nil, 0, e
+		}
+		sealed[id] = seg
+	}
+	active := sealed[ids[len(ids)-1]]
+	delete(sealed, active.id)
+	return sealed, active, horizon, nil
+}
+
+// Indexes the whole of each sealed segment, and the active segment as far as
+// its records are whole, given the active file's size.  Assumes the write
+// lock is held, and that nothing is yet indexed.
+func (d *DB) indexReader(activeSize uint64) error {
+	for _, seg := range sortedSegments(d.sealed) {
+		sc := newScanner(seg.filebuffer, seg.filehandle)
+		_, e := d.indexDocuments(seg.id, dataStart(seg.filebuffer, seg.size), seg.size, sc.scan)
+		sc.release()
+		if e != nil {
+			return e
+		}
+	}
+	//The active segment's buffer grows as its records are indexed
+	d.filledSize = dataStart(d.filebuffer, activeSize)
+	d.filebuffer = truncateFilebuf(d.filebuffer, d.filledSize)
+	return d.catchUpActive(activeSize)
+}
+
+// Indexes the documents from start up to end in the given segment, read
+// with scan, stopping short of any that don't check out, as the writer may be
+// part way through appending them.  Returns where the whole documents end.
+// Assumes the write lock is held.
+func (d *DB) indexDocuments(id uint32, start, end uint64, scan func(start, end uint64, fn func(r *record) error) (uint64, error)) (uint64, error) {
+	pos, e := scan(start, end, func(r *record) error {
+		oal := r.oal(id)
+		e := openRecord(d.opts.Encryption, r)
+		if e != nil {
+			return e
+		}
+		k := string(r.key)
+		if len(r.value) == 0 {
+			d.drop(k)
+			d.tombstones[id]++
+			return nil
+		}
+		d.point(k, oal)
+		if r.expiry != 0 {
+			d.expiries[k] = r.expiry
+		} else {
+			delete(d.expiries, k)
+		}
+		return nil
+	})
+	if e != nil && !errors.Is(e, ErrCorrupt) {
+		return pos, e
+	}
+	return pos, nil
+}
+
+// Indexes what has been appended to the active segment since it was last
+// indexed, up to the given size of its file, and extends its read buffer
+// over it.  Assumes the write lock is held.
+func (d *DB) catchUpActive(size uint64) error {
+	if size <= d.filledSize {
+		return nil
+	}
+	appended := make([]byte, size-d.filledSize)
+	n, e := d.filehandle.ReadAt(appended, int64(d.filledSize))
+	if e != nil && e != io.EOF {
+		return e
+	}
+	appended = appended[:n]
+	base := d.filledSize
+	end, e := d.indexDocuments(d.activeID, 0, uint64(n), func(start, end uint64, fn func(r *record) error) (uint64, error) {
+		return scanDocuments(appended, start, end, d.sum, func(r *record) error {
+			r.pos += base
+			return fn(r)
+		})
+	})
+	if e != nil {
+		return e
+	}
+	d.filledSize = base + end
+	d.growActive(appended[:end])
+	return nil
+}
+
+// Brings a DB opened with OpenReadOnlyDB up to date with what the writer
+// has appended since, or indexes it afresh if the writer has compacted or
+// cleared it.  Reads wait meanwhile, and values from GetZeroCopy become
+// invalid.  Does nothing on other DBs.
+func (d *DB) Refresh() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if !d.reader {
+		return nil
+	}
+	return d.refresh()
+}
+
+// As Refresh.  Assumes the write lock is held.
+func (d *DB) refresh() error {
+	ids, horizon, e := listedSegments(d.location)
+	if e != nil {
+		return e
+	}
+	active, e := os.Stat(segmentPath(d.location, d.activeID))
+	if e != nil {
+		return d.reload()
+	}
+	own, e := d.filehandle.Stat()
+	if e != nil {
+		return e
+	}
+	if horizon != d.horizon || !os.SameFile(active, own) || uint64(active.Size()) < d.filledSize || !d.listsSegments(ids) {
+		return d.reload()
+	}
+	if e = d.catchUpActive(uint64(own.Size())); e != nil {
+		return e
+	}
+	//Segments the writer has since started follow the active one
+	for _, id := range ids {
+		if id <= d.activeID {
+			continue
+		}
+		seg, e := openSealedSegment(d.location, id, d.opts.NoMmap)
+		if e != nil {
+			return e
+		}
+		d.sealed[d.activeID] = &segment{d.activeID, d.filehandle, d.filebuffer, d.filledSize, !d.opts.NoMmap}
+		d.activeID, d.filehandle, d.filebuffer = seg.id, seg.filehandle, seg.filebuffer
+		d.filledSize = dataStart(seg.filebuffer, seg.size)
+		d.filebuffer = truncateFilebuf(d.filebuffer, d.filledSize)
+		if e = d.catchUpActive(seg.size); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Returns whether ids, from the manifest, still list every segment the
+// reader has open, and add no others before the active one.
+func (d *DB) listsSegments(ids []uint32) bool {
+	listed := 0
+	for _, id := range ids {
+		if id < d.activeID && d.sealed[id] == nil {
+			return false
+		}
+		if id <= d.activeID {
+			listed++
+		}
+	}
+	return listed == len(d.sealed)+1
+}
+
+// Replaces the reader's segments and index with those of the DB as it now
+// stands.  Assumes the write lock is held.
+func (d *DB) reload() error {
+	var sealed map[uint32]*segment
+	var active *segment
+	var horizon uint64
+	var e error
+	//Files come and go while the writer compacts, so try a few times
+	for tries := 0; tries < 5; tries++ {
+		sealed, active, horizon, e = openReaderSegments(d.location, d.opts.NoMmap)
+		if !os.IsNotExist(e) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if e != nil {
+		return e
+	}
+	d.quiesce()
+	for _, seg := range d.sealed {
+		seg.close()
+	}
+	d.unmapActive()
+	d.filehandle.Close()
+	d.sealed, d.activeID = sealed, active.id
+	d.filehandle, d.filebuffer = active.filehandle, active.filebuffer
+	d.horizon, d.sum = horizon, fileChecksum(active.filebuffer, active.size)
+	d.kToPos = newIndex(&d.opts, d.location, 0)
+	d.expiries = make(map[string]int64)
+	d.history = nil
+	if d.ordered != nil {
+		d.ordered = newSkipList()
+	}
+	if d.cache != nil {
+		d.cache.clear()
+	}
+	d.tombstones = make(map[uint32]int)
+	d.recountLiveBytes()
+	d.loadFilters()
+	return d.indexReader(active.size)
+}
+
+// Returned by Snapshot of a reader when the files it opened aren't those the
+// reader has indexed, as the writer is compacting faster than it refreshes.
+var errStaleFiles = errors.New("Data files were replaced while taking a snapshot")
+
+// Returns whether the snapshot s opened the same files as the reader holds.
+// Assumes at least a read lock is held.
+func (d *DB) sameFiles(s *DB) bool {
+	same := func(a, b *os.File) bool {
+		x, e := a.Stat()
+		if e != nil {
+			return false
+		}
+		y, e := b.Stat()
+		return e == nil && os.SameFile(x, y)
+	}
+	for id, seg := range d.sealed {
+		if !same(seg.filehandle, s.sealed[id].filehandle) {
+			return false
+		}
+	}
+	return same(d.filehandle, s.filehandle)
+}
+
+// Calls Refresh every Options.RefreshInterval until the DB is closed.
+func (d *DB) refresher() {
+	defer d.background.Done()
+	interval := d.opts.RefreshInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		d.Refresh()
+	}
+}
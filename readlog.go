@@ -0,0 +1,170 @@
+package bitcesque
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// A record as read from the log by ReadLog.
+type Record struct {
+	// The log offset of the record's document.  Records written in a batch
+	// each have their own.
+	Offset uint64
+	Key    []byte
+	// The value, decrypted and decompressed, or empty for a removal.
+	Value []byte
+	// Whether the record removes the key.
+	Removed bool
+	// When the record was written, or the zero time for records written
+	// before timestamps were recorded.
+	Timestamp time.Time
+	// When the record expires, or the zero time if it does not.
+	Expiry time.Time
+	// The flags given by UpsertWithFlags, or zero.
+	Flags uint8
+}
+
+// Calls fn with each record in the log from the given log offset onwards, in
+// the order written, verifying each against its checksum, and returns the
+// offset just past the last record fn dealt with, to carry on from later.
+// An offset of 0 reads from the start of the log as it now stands.  Stops at
+// the first error fn returns, leaving the record it failed on to be read
+// again; returning ErrStop instead ends the read after the record, without
+// ReadLog returning an error.  Records are read from handles of
+// ReadLog's own on the files, so writers aren't held up meanwhile, and fn may
+// itself write to the DB without those writes being seen.  The record's key
+// and value are only valid during the call.
+//
+// Merge and Consolidate rewrite the log before where they finish, so an
+// offset from before the last fails with ErrBadOffset, as does one beyond
+// the end of the log or within a document.  Offsets taken
+// before a Consolidate or Clear may name positions in the new log, so should
+// not be used after one.
+func (d *DB) ReadLog(fromOffset uint64, fn func(rec Record) error) (uint64, error) {
+	if e := d.flush(); e != nil {
+		return fromOffset, e
+	}
+	segs, horizon, e := d.openLog()
+	if e != nil {
+		return fromOffset, e
+	}
+	defer func() {
+		if !d.snapshot {
+			for _, seg := range segs {
+				seg.close()
+			}
+		}
+	}()
+	active := segs[len(segs)-1]
+	if fromOffset != 0 && (fromOffset < horizon || fromOffset > logOffset(active.id, active.size)) {
+		return fromOffset, ErrBadOffset
+	}
+	id, pos := uint32(fromOffset>>segmentShift), fromOffset&(1<<segmentShift-1)
+	next := fromOffset
+	for _, seg := range segs {
+		if seg.id < id {
+			continue
+		}
+		start := dataStart(seg.filebuffer, seg.size)
+		resumed := seg.id == id && pos > start
+		if resumed {
+			if pos > seg.size {
+				return fromOffset, ErrBadOffset
+			}
+			start = pos
+		}
+		segID := seg.id
+		sc := newScanner(seg.filebuffer, seg.filehandle)
+		_, e = sc.scan(start, seg.size, func(r *record) error {
+			end := r.pos + r.oal(0).docSize()
+			rec, e := d.logRecord(segID, r)
+			if e == nil {
+				e = fn(rec)
+			}
+			if e == nil || e == ErrStop {
+				next = logOffset(segID, end)
+			}
+			return e
+		})
+		sc.release()
+		if errors.Is(e, ErrCorrupt) && resumed && next == fromOffset {
+			//Starting within a document reads as a damaged one
+			return next, ErrBadOffset
+		}
+		if e == ErrStop {
+			return next, nil
+		}
+		if e != nil {
+			return next, e
+		}
+		next = max(next, logOffset(segID, seg.size))
+	}
+	return next, nil
+}
+
+// Returns the given record as ReadLog passes it on, from the given segment.
+func (d *DB) logRecord(segment uint32, r *record) (Record, error) {
+	rec := Record{Offset: logOffset(segment, r.pos), Flags: r.userFlags}
+	e := openRecord(d.opts.Encryption, r)
+	if e != nil {
+		return rec, e
+	}
+	*r, e = d.decompressRecord(*r)
+	if e != nil {
+		return rec, e
+	}
+	rec.Key, rec.Value, rec.Removed = r.key, r.value, len(r.value) == 0
+	if r.timestamp != 0 {
+		rec.Timestamp = time.Unix(0, r.timestamp)
+	}
+	if r.expiry != 0 {
+		rec.Expiry = time.Unix(0, r.expiry)
+	}
+	return rec, nil
+}
+
+// Returns the DB's segments as they now stand, ordered by id with the active
+// one last, and the log offset before which compaction has rewritten them.
+// Unless the DB is a snapshot, whose own segments never change, the segments
+// are opened afresh, so can be read without holding the lock but must be
+// closed.
+func (d *DB) openLog() ([]*segment, uint64, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return nil, 0, ErrDatabaseClosed
+	}
+	if d.snapshot {
+		active := &segment{d.activeID, d.filehandle, d.filebuffer, d.filledSize, false}
+		return append(sortedSegments(d.sealed), active), d.horizon, nil
+	}
+	segs := make([]*segment, 0, len(d.sealed)+1)
+	fail := func(e error) ([]*segment, uint64, error) {
+		for _, seg := range segs {
+			seg.close()
+		}
+		return nil, 0, e
+	}
+	for _, id := range d.segmentIDs() {
+		if id == d.activeID {
+			continue
+		}
+		seg, e := openSealedSegment(d.location, id, d.opts.NoMmap)
+		if e != nil {
+			return fail(e)
+		}
+		segs = append(segs, seg)
+	}
+	f, e := os.Open(segmentPath(d.location, d.activeID))
+	if e != nil {
+		return fail(e)
+	}
+	active := &segment{d.activeID, f, nil, d.filledSize, !d.opts.NoMmap}
+	active.filebuffer, e = mapSegment(f, d.filledSize, false, d.opts.NoMmap)
+	if e != nil {
+		f.Close()
+		return fail(e)
+	}
+	return append(segs, active), d.horizon, nil
+}
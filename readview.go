@@ -0,0 +1,157 @@
+package bitcesque
+
+import (
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+// An immutable copy of the index and the segments it points into, published
+// for reads that take no lock.  Any write discards it, and it is rebuilt
+// once enough reads have missed it to pay for the copy.
+type readView struct {
+	kToPos   index
+	expiries map[string]int64
+	bufs     map[uint32][]byte
+	files    map[uint32]*os.File
+	active   uint32
+	filled   uint64 //Where the active segment's buffered appends start
+	wbuf     []byte //Those appends
+}
+
+// Returns length bytes from pos onwards in the given segment, as
+// DB.readSegment.
+func (v *readView) readSegment(segment uint32, pos, length uint64) []byte {
+	if segment == v.active && pos >= v.filled && len(v.wbuf) > 0 {
+		return v.wbuf[pos-v.filled : pos-v.filled+length]
+	}
+	buf := v.bufs[segment]
+	end := pos + length
+	if end <= uint64(len(buf)) {
+		return buf[pos:end]
+	}
+	out := make([]byte, length)
+	n, _ := v.files[segment].ReadAt(out, int64(pos))
+	return out[:n]
+}
+
+// Counts readers working from a published view, in one of two generations,
+// sharded as the DB lock is so that readers don't contend.
+type epochs struct {
+	current atomic.Uint32
+	readers [2][lockShards]struct {
+		n atomic.Int64
+		_ [56]byte //Pads each count out to 64 bytes
+	}
+}
+
+// Registers a reader of the given key, returning the count to pass to exit.
+func (p *epochs) enter(k []byte) *atomic.Int64 {
+	for {
+		epoch := p.current.Load()
+		n := &p.readers[epoch&1][keyShard(k)].n
+		n.Add(1)
+		//Retrying if the generation moved on ensures synchronize sees us
+		if p.current.Load() == epoch {
+			return n
+		}
+		n.Add(-1)
+	}
+}
+
+func (p *epochs) exit(n *atomic.Int64) {
+	n.Add(-1)
+}
+
+// Waits until every reader registered before the call has exited.
+func (p *epochs) synchronize() {
+	old := p.current.Add(1) - 1
+	for i := range p.readers[old&1] {
+		for p.readers[old&1][i].n.Load() != 0 {
+			runtime.Gosched()
+		}
+	}
+}
+
+// Discards the published view, if reads are lock-free.  Assumes the write
+// lock is held.
+func (d *DB) invalidateView() {
+	if d.opts.LockFreeReads {
+		d.view.Store(nil)
+	}
+}
+
+// Discards the published view and waits for any reads still using it, before
+// memory or files it refers to are released.  Assumes the write lock is held.
+func (d *DB) quiesce() {
+	if d.opts.LockFreeReads {
+		d.view.Store(nil)
+		d.epochs.synchronize()
+	}
+}
+
+// Calls fn with the value of k from the published view without locking,
+// returning whether k is present, and whether there was a view to consult at
+// all; if not, the caller must take the lock.  The value is only valid
+// during the call.
+func (d *DB) readView(k []byte, fn func(v []byte)) (bool, bool) {
+	if !d.opts.LockFreeReads {
+		return false, false
+	}
+	n := d.epochs.enter(k)
+	defer d.epochs.exit(n)
+	v := d.view.Load()
+	if v == nil {
+		if d.viewMisses.Add(1) >= max(64, d.viewSize.Load()/8) && d.rebuildingView.CompareAndSwap(false, true) {
+			go d.publishView()
+		}
+		return false, false
+	}
+	oal, present := v.kToPos.lookup(k)
+	if !present {
+		return false, true
+	}
+	if expiry, present := v.expiries[string(k)]; present && expiry <= now() {
+		return false, true
+	}
+	if d.evictions != nil {
+		d.evictions.read(k)
+	}
+	if fn != nil {
+		val, e := d.valFrom(v, oal)
+		if e != nil {
+			//Left for the locked path to report
+			return false, false
+		}
+		fn(val)
+	}
+	return true, true
+}
+
+// Builds and publishes a view of the index as it stands.
+func (d *DB) publishView() {
+	defer d.rebuildingView.Store(false)
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return
+	}
+	v := &readView{
+		d.kToPos.clone(),
+		make(map[string]int64, len(d.expiries)),
+		map[uint32][]byte{d.activeID: d.filebuffer},
+		map[uint32]*os.File{d.activeID: d.filehandle},
+		d.activeID,
+		d.filledSize,
+		d.wbuf[:len(d.wbuf):len(d.wbuf)],
+	}
+	for k, expiry := range d.expiries {
+		v.expiries[k] = expiry
+	}
+	for id, seg := range d.sealed {
+		v.bufs[id], v.files[id] = seg.filebuffer, seg.filehandle
+	}
+	d.viewMisses.Store(0)
+	d.viewSize.Store(uint64(v.kToPos.len()))
+	d.view.Store(v)
+}
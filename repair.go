@@ -0,0 +1,166 @@
+package bitcesque
+
+import (
+	"os"
+)
+
+// What RepairDB found and did.
+type RepairReport struct {
+	// Segment files checked, and the records found intact in them.
+	Segments int
+	Records  int
+	// Damaged regions dropped from the files, and their total size.
+	Dropped      []DroppedRegion
+	BytesDropped uint64
+}
+
+// A run of bytes RepairDB removed from a segment file.
+type DroppedRegion struct {
+	Segment uint32
+	Offset  uint64 //Position in the file as it was before repair
+	Length  uint64
+}
+
+// Rewrites the data files of the DB at location without any records that
+// fail verification, then rebuilds the keyfile.  Rather than stopping at the
+// first damaged record, as OpenAndVerifyDB does, it resynchronizes at the
+// next document whose checksum matches, so only the damaged regions are
+// lost.  Files without damage are left untouched.  The DB must not be open.
+func RepairDB(location string) (RepairReport, error) {
+	return RepairDBWithOptions(location, nil)
+}
+
+// As RepairDB, but with the options the DB is opened with to rebuild the
+// keyfile, such as its cipher.
+func RepairDBWithOptions(location string, opts *Options) (RepairReport, error) {
+	var report RepairReport
+	lockfile, e := lockDB(location)
+	if e != nil {
+		return report, e
+	}
+	ids, e := recoverSegments(location)
+	if e == nil {
+		for _, id := range ids {
+			e = repairSegment(location, id, &report)
+			if e != nil {
+				break
+			}
+		}
+	}
+	unlockDB(location, lockfile)
+	if e != nil {
+		return report, e
+	}
+	d, e := OpenAndVerifyDBWithOptions(location, opts)
+	if e != nil {
+		if d != nil {
+			d.Close()
+		}
+		return report, e
+	}
+	return report, d.Close()
+}
+
+// Checks one segment file, replacing it with a copy holding only its intact
+// documents if any are damaged.
+func repairSegment(location string, id uint32, report *RepairReport) error {
+	path := segmentPath(location, id)
+	f, e := os.Open(path)
+	if os.IsNotExist(e) {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	stats, e := f.Stat()
+	if e != nil {
+		return e
+	}
+	size := uint64(stats.Size())
+	buf, e := mapReadOnly(f, size)
+	if e != nil {
+		return e
+	}
+	defer func() { unmap(buf) }()
+	start, e := checkHeader(buf, size, dataMagic)
+	if e != nil {
+		return e
+	}
+	c := fileChecksum(buf, size)
+	report.Segments++
+	var keep [][2]uint64 //Runs of intact documents, as start and end
+	var dropped []DroppedRegion
+	pos := start
+	for pos < size {
+		n, ok := intactDocument(buf, pos, size, c)
+		if ok {
+			if len(keep) > 0 && keep[len(keep)-1][1] == pos {
+				keep[len(keep)-1][1] = pos + n
+			} else {
+				keep = append(keep, [2]uint64{pos, pos + n})
+			}
+			scanDocuments(buf, pos, pos+n, c, func(r *record) error {
+				report.Records++
+				return nil
+			})
+			pos += n
+			continue
+		}
+		bad := pos
+		for pos++; pos < size; pos++ {
+			if _, ok := intactDocument(buf, pos, size, c); ok {
+				break
+			}
+		}
+		dropped = append(dropped, DroppedRegion{id, bad, pos - bad})
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	tmp, e := os.OpenFile(path+".repair", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if e != nil {
+		return e
+	}
+	_, e = tmp.Write(buf[:start])
+	for _, run := range keep {
+		if e == nil {
+			_, e = tmp.Write(buf[run[0]:run[1]])
+		}
+	}
+	if e == nil {
+		e = tmp.Sync()
+	}
+	if e == nil {
+		e = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if e == nil {
+		//Some platforms can't replace a file that is still open
+		unmap(buf)
+		buf = nil
+		f.Close()
+		e = os.Rename(tmp.Name(), path)
+	}
+	if e != nil {
+		os.Remove(tmp.Name())
+		return e
+	}
+	report.Dropped = append(report.Dropped, dropped...)
+	for _, r := range dropped {
+		report.BytesDropped += r.Length
+	}
+	return nil
+}
+
+// Returns the length of the document or batch frame at pos, and whether it
+// is intact by the given checksum.
+func intactDocument(buf []byte, pos, end uint64, c Checksum) (uint64, bool) {
+	n, ok := docLength(buf, pos, end)
+	if !ok || end-pos < n {
+		return 0, false
+	}
+	_, e := scanDocuments(buf, pos, pos+n, c, func(r *record) error { return nil })
+	return n, e == nil
+}
@@ -0,0 +1,523 @@
+package bitcesque
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Replication streams every document a primary appends, in order, to any
+// number of followers, which append the same bytes to their own files.  Each
+// append is numbered in a sequence, and the primary keeps the most recent in
+// memory so that a follower reconnecting after a brief interruption can catch
+// up from the last one it applied.  A follower that is new, too far behind,
+// or was following a different primary is instead sent a full snapshot.
+//
+// The stream from primary to follower is a run of messages, each a type byte
+// and then:
+//
+//	'R' epoch (8) | seq (8)    discard everything; a snapshot as of seq follows
+//	'D' length (4) | documents  part of the snapshot
+//	'S'                         the end of the snapshot
+//	'E' seq (8) | length (4) | frame  the append numbered seq
+//
+// The follower opens the connection by sending replMagic, the epoch of the
+// primary it last followed, and the last seq it applied.  Epochs are chosen
+// at random each time a DB starts serving replication, since sequence numbers
+// are only meaningful within one.  A follower cut off mid-snapshot has
+// applied no sequence number, so it is sent a fresh snapshot when it
+// reconnects.
+
+const (
+	replMagic             = "BCSR"
+	defaultReplicationLog = 16 << 20
+	replSnapshotChunk     = 1 << 20 //Snapshot documents are sent in runs of about this size
+	replMaxMessage        = 1 << 31
+	replBackoff           = time.Second //Between attempts to reach the primary
+)
+
+// The recent appends of a DB serving replication.
+type replLog struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	epoch     uint64
+	entries   [][]byte //The appends numbered first onwards
+	first     uint64
+	size      int //Total bytes in entries
+	max       int
+	closed    bool
+	listeners map[net.Listener]bool
+}
+
+// Returns a random nonzero epoch.
+func newEpoch() uint64 {
+	b := make([]byte, 8)
+	for {
+		rand.Read(b)
+		if epoch := uint64FromBytes(b, 0); epoch != 0 {
+			return epoch
+		}
+	}
+}
+
+// Returns the sequence number the next append will be given.  Assumes the
+// log's lock is held.
+func (l *replLog) next() uint64 {
+	return l.first + uint64(len(l.entries))
+}
+
+// Records an append, made up of the given parts, forgetting the oldest once
+// the log is over its size.
+func (l *replLog) append(parts ...[]byte) {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, b)
+	l.size += len(b)
+	for l.size > l.max && len(l.entries) > 1 {
+		l.size -= len(l.entries[0])
+		l.entries[0] = nil
+		l.entries = l.entries[1:]
+		l.first++
+	}
+	l.cond.Broadcast()
+}
+
+// Waits for appends after the given one, returning them, or false if they
+// have already been forgotten, or nil once the log is closed.
+func (l *replLog) since(applied uint64) ([][]byte, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for !l.closed && applied+1 >= l.next() {
+		l.cond.Wait()
+	}
+	if l.closed {
+		return nil, true
+	}
+	if applied+1 < l.first {
+		return nil, false
+	}
+	return append([][]byte{}, l.entries[applied+1-l.first:]...), true
+}
+
+// Stops serving replication, closing the listeners.
+func (l *replLog) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	for listener := range l.listeners {
+		listener.Close()
+	}
+	l.cond.Broadcast()
+}
+
+// Serves the DB's appends to followers connecting through l, until l or the
+// DB is closed.  Only appends made from the first call onwards are logged for
+// catching up; followers connecting before then receive a snapshot.
+func (d *DB) ServeReplication(l net.Listener) error {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return ErrDatabaseClosed
+	}
+	if d.snapshot || d.reader {
+		d.mutex.Unlock()
+		return ErrReadOnly
+	}
+	if d.replLog == nil {
+		max := d.opts.ReplicationLogSize
+		if max <= 0 {
+			max = defaultReplicationLog
+		}
+		d.replLog = &replLog{epoch: newEpoch(), first: 1, max: max, listeners: make(map[net.Listener]bool)}
+		d.replLog.cond = sync.NewCond(&d.replLog.mutex)
+	}
+	log := d.replLog
+	d.mutex.Unlock()
+
+	log.mutex.Lock()
+	log.listeners[l] = true
+	log.mutex.Unlock()
+	defer func() {
+		log.mutex.Lock()
+		delete(log.listeners, l)
+		log.mutex.Unlock()
+	}()
+	for {
+		conn, e := l.Accept()
+		if e != nil {
+			log.mutex.Lock()
+			closed := log.closed
+			log.mutex.Unlock()
+			if closed {
+				return ErrDatabaseClosed
+			}
+			return e
+		}
+		go d.serveFollower(conn, log)
+	}
+}
+
+// Streams appends to one follower until either side goes away.
+func (d *DB) serveFollower(conn net.Conn, log *replLog) {
+	defer conn.Close()
+	hello := make([]byte, 20)
+	_, e := io.ReadFull(conn, hello)
+	if e != nil || string(hello[:4]) != replMagic {
+		return
+	}
+	epoch, applied := uint64FromBytes(hello, 4), uint64FromBytes(hello, 12)
+	w := bufio.NewWriter(conn)
+	resync := epoch != log.epoch
+	for {
+		if resync {
+			applied, e = d.sendSnapshot(w, log)
+			if e != nil {
+				return
+			}
+			resync = false
+		}
+		entries, ok := log.since(applied)
+		if !ok {
+			resync = true
+			continue
+		}
+		if entries == nil {
+			return
+		}
+		for _, entry := range entries {
+			applied++
+			head := make([]byte, 13)
+			head[0] = 'E'
+			uint64ToBytes(head, 1, applied)
+			uint32ToBytes(head, 9, uint32(len(entry)))
+			w.Write(head)
+			w.Write(entry)
+		}
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// Sends a snapshot of the DB's live records, returning the sequence number it
+// is as of.  The records are gathered under a read lock, so the snapshot is
+// buffered in memory rather than making writers wait on the network.
+func (d *DB) sendSnapshot(w *bufio.Writer, log *replLog) (uint64, error) {
+	var chunks [][]byte
+	var chunk []byte
+	d.mutex.RLock()
+	if d.closed {
+		d.mutex.RUnlock()
+		return 0, ErrDatabaseClosed
+	}
+	log.mutex.Lock()
+	seq := log.next() - 1
+	log.mutex.Unlock()
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if d.expired(k, t) {
+			continue
+		}
+		chunk = append(chunk, d.readSegment(oal.segment, oal.offset-uint64(oal.prefix), oal.docSize())...)
+		if len(chunk) >= replSnapshotChunk {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+	}
+	d.mutex.RUnlock()
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	head := make([]byte, 17)
+	head[0] = 'R'
+	uint64ToBytes(head, 1, log.epoch)
+	uint64ToBytes(head, 9, seq)
+	w.Write(head)
+	for _, chunk := range chunks {
+		head := make([]byte, 5)
+		head[0] = 'D'
+		uint32ToBytes(head, 1, uint32(len(chunk)))
+		w.Write(head)
+		w.Write(chunk)
+	}
+	w.WriteByte('S')
+	return seq, w.Flush()
+}
+
+// Follows a primary, applying its appends to a DB.
+type Follower struct {
+	db      *DB
+	addr    string
+	stop    chan struct{}
+	done    chan struct{}
+	mutex   sync.Mutex
+	conn    net.Conn
+	epoch   uint64
+	applied uint64
+	err     error
+	halted  bool
+}
+
+// Starts following the primary serving replication at the given TCP address,
+// replacing the DB's contents with the primary's.  The DB rejects writes
+// with ErrReadOnly until the follower is promoted.  Connection failures are
+// retried until then, or until the DB is closed.  If the primary encrypts
+// keys, the DB must have been opened with the same cipher.
+func (d *DB) Follow(addr string) (*Follower, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return nil, ErrDatabaseClosed
+	}
+	if d.snapshot || d.reader {
+		return nil, ErrReadOnly
+	}
+	if d.follower != nil {
+		return nil, errors.New("Database is already following a primary")
+	}
+	f := &Follower{db: d, addr: addr, stop: make(chan struct{}), done: make(chan struct{})}
+	d.follower = f
+	go f.run()
+	return f, nil
+}
+
+// Returns the sequence number of the last append applied from the primary.
+func (f *Follower) Applied() uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.applied
+}
+
+// Returns the error that most recently interrupted following, if any.
+func (f *Follower) Err() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+// Stops following and makes the DB writable, e.g. so it can take over from a
+// failed primary.
+func (f *Follower) Promote() {
+	f.halt()
+	d := f.db
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.follower == f {
+		d.follower = nil
+	}
+}
+
+// Stops following and waits for the follower's goroutine to exit.
+func (f *Follower) halt() {
+	f.mutex.Lock()
+	if !f.halted {
+		f.halted = true
+		close(f.stop)
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}
+	f.mutex.Unlock()
+	<-f.done
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	for {
+		e := f.follow()
+		f.mutex.Lock()
+		f.err = e
+		f.conn = nil
+		f.mutex.Unlock()
+		if e == ErrDatabaseClosed {
+			return
+		}
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(replBackoff):
+		}
+	}
+}
+
+// Connects to the primary and applies what it sends until an error.
+func (f *Follower) follow() error {
+	conn, e := net.DialTimeout("tcp", f.addr, 10*time.Second)
+	if e != nil {
+		return e
+	}
+	defer conn.Close()
+	f.mutex.Lock()
+	if f.halted {
+		f.mutex.Unlock()
+		return nil
+	}
+	f.conn = conn
+	hello := make([]byte, 20)
+	copy(hello, replMagic)
+	uint64ToBytes(hello, 4, f.epoch)
+	uint64ToBytes(hello, 12, f.applied)
+	f.mutex.Unlock()
+	_, e = conn.Write(hello)
+	if e != nil {
+		return e
+	}
+	r := bufio.NewReader(conn)
+	var snapshot []byte //The head of the snapshot being applied, if any
+	for {
+		kind, e := r.ReadByte()
+		if e != nil {
+			return e
+		}
+		switch kind {
+		case 'R':
+			head := make([]byte, 16)
+			_, e = io.ReadFull(r, head)
+			if e != nil {
+				return e
+			}
+			//Until the snapshot is complete the DB matches no sequence number
+			f.setPosition(0, 0)
+			e = f.db.applyReset()
+			if e != nil {
+				return e
+			}
+			snapshot = head
+		case 'D':
+			if snapshot == nil {
+				return errors.New("Malformed replication stream")
+			}
+			head := make([]byte, 4)
+			_, e = io.ReadFull(r, head)
+			if e != nil {
+				return e
+			}
+			b, e := readReplPayload(r, uint64(uint32FromBytes(head, 0)))
+			if e == nil {
+				e = f.db.applyFrames(b)
+			}
+			if e != nil {
+				return e
+			}
+		case 'S':
+			if snapshot == nil {
+				return errors.New("Malformed replication stream")
+			}
+			f.setPosition(uint64FromBytes(snapshot, 0), uint64FromBytes(snapshot, 8))
+			snapshot = nil
+		case 'E':
+			if snapshot != nil {
+				return errors.New("Malformed replication stream")
+			}
+			head := make([]byte, 12)
+			_, e = io.ReadFull(r, head)
+			if e != nil {
+				return e
+			}
+			seq := uint64FromBytes(head, 0)
+			b, e := readReplPayload(r, uint64(uint32FromBytes(head, 8)))
+			if e != nil {
+				return e
+			}
+			if seq != f.Applied()+1 {
+				return errors.New("Replication stream out of sequence")
+			}
+			e = f.db.applyFrames(b)
+			if e != nil {
+				return e
+			}
+			f.mutex.Lock()
+			f.applied = seq
+			f.mutex.Unlock()
+		default:
+			return errors.New("Malformed replication stream")
+		}
+	}
+}
+
+func (f *Follower) setPosition(epoch, applied uint64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.epoch, f.applied = epoch, applied
+}
+
+func readReplPayload(r io.Reader, length uint64) ([]byte, error) {
+	if length > replMaxMessage {
+		return nil, errors.New("Malformed replication stream")
+	}
+	b := make([]byte, length)
+	_, e := io.ReadFull(r, b)
+	return b, e
+}
+
+// Removes every key, as one batch frame of tombstones, ahead of applying a
+// snapshot.
+func (d *DB) applyReset() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	b := d.NewBatch()
+	for k := range d.kToPos.all() {
+		b.Remove([]byte(k))
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	return b.commit()
+}
+
+// Appends documents and batch frames received from a primary, verifying them
+// and pointing the index at them.
+func (d *DB) applyFrames(b []byte) error {
+	_, e := scanDocuments(b, 0, uint64(len(b)), d.sum, func(r *record) error { return nil })
+	if e != nil {
+		return e
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	pos, e := d.appendBytes(b)
+	if e != nil {
+		return e
+	}
+	id := d.activeID
+	_, e = scanDocuments(b, 0, uint64(len(b)), d.sum, func(r *record) error {
+		oal := r.oal(id)
+		oal.offset += pos
+		e := openRecord(d.opts.Encryption, r)
+		if e != nil {
+			return e
+		}
+		seenStamp(r.timestamp)
+		k := string(r.key)
+		if len(r.value) == 0 {
+			d.drop(k)
+			d.tombstones[id]++
+			return nil
+		}
+		d.point(k, oal)
+		if r.expiry != 0 {
+			d.expiries[k] = r.expiry
+		} else {
+			delete(d.expiries, k)
+		}
+		return nil
+	})
+	return e
+}
@@ -0,0 +1,51 @@
+package bitcesque
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// A zeroed buffer mapped from a scratch file, which is unmapped once nothing
+// refers to it any more, or on release.
+type scratch struct {
+	buf     []byte
+	mapped  bool
+	cleanup runtime.Cleanup
+}
+
+// Returns a scratch buffer of the given size, mapped from a file beside the
+// given location.  The file is removed as soon as it is mapped, so its space
+// is freed along with the mapping.  If it can't be made, the buffer is
+// allocated in memory instead.
+func newScratch(location string, size int) *scratch {
+	f, e := os.CreateTemp(filepath.Dir(location), filepath.Base(location)+".index")
+	if e != nil {
+		return &scratch{buf: make([]byte, size)}
+	}
+	var buf []byte
+	e = preallocate(f, uint64(size))
+	if e == nil {
+		buf, e = mapReadWrite(f, uint64(size))
+	}
+	f.Close()
+	os.Remove(f.Name())
+	if e != nil {
+		return &scratch{buf: make([]byte, size)}
+	}
+	s := &scratch{buf: buf, mapped: true}
+	s.cleanup = runtime.AddCleanup(s, func(buf []byte) {
+		unmap(buf)
+	}, buf)
+	return s
+}
+
+// Unmaps the buffer without waiting for the collector, for when it is known
+// to be unused.
+func (s *scratch) release() {
+	if s.mapped {
+		s.cleanup.Stop()
+		unmap(s.buf)
+	}
+	s.buf, s.mapped = nil, false
+}
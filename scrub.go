@@ -0,0 +1,141 @@
+package bitcesque
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	defaultScrubRate = 16 << 20
+	scrubChunk       = 1 << 20 //Bytes verified per lock acquisition
+)
+
+// Returns the length of the document or batch frame at pos as its header
+// claims, or false if the header doesn't fit before end.
+func docLength(buf []byte, pos, end uint64) (uint64, bool) {
+	if end-pos < 12 {
+		return 0, false
+	}
+	kField := uint32FromBytes(buf, pos+4)
+	vLen := uint64(uint32FromBytes(buf, pos+8))
+	if kField&batchFlag != 0 {
+		return uint64(docPrefix(kField&^keyLenMask, 0)) + vLen, true
+	}
+	return uint64(docPrefix(kField&^keyLenMask, int(kField&keyLenMask))) + vLen, true
+}
+
+// Starts a background goroutine that verifies every record in the data files
+// against its checksum once per interval, until the DB is closed, reading at
+// most Options.ScrubRate bytes per second.  Each damaged region found is
+// counted in Stats and reported to Options.OnCorruption.  Calling it again
+// while scrubbing does nothing.
+func (d *DB) StartScrub(interval time.Duration) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.scrubbing {
+		return nil
+	}
+	d.scrubbing = true
+	d.background.Add(1)
+	go d.scrub(interval)
+	return nil
+}
+
+func (d *DB) scrub(interval time.Duration) {
+	defer d.background.Done()
+	reported := make(map[[2]uint64]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if !d.scrubPass(reported) {
+			return
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Verifies every segment once, returning false if the DB was closed first.
+func (d *DB) scrubPass(reported map[[2]uint64]bool) bool {
+	rate := d.opts.ScrubRate
+	if rate <= 0 {
+		rate = defaultScrubRate
+	}
+	pause := time.Duration(float64(scrubChunk) / float64(rate) * float64(time.Second))
+	d.mutex.RLock()
+	ids := d.segmentIDs()
+	d.mutex.RUnlock()
+	for _, id := range ids {
+		var f *os.File
+		pos := uint64(0)
+		for done := false; !done; {
+			select {
+			case <-d.stop:
+				return false
+			default:
+			}
+			var bad bool
+			d.mutex.RLock()
+			f, pos, done, bad = d.scrubChunk(id, f, pos)
+			d.mutex.RUnlock()
+			if bad && !reported[[2]uint64{uint64(id), pos}] {
+				reported[[2]uint64{uint64(id), pos}] = true
+				d.mutex.Lock()
+				d.corrupt++
+				d.mutex.Unlock()
+				if d.opts.OnCorruption != nil {
+					d.opts.OnCorruption(id, pos)
+				}
+			}
+			if !done {
+				time.Sleep(pause)
+			}
+		}
+	}
+	d.mutex.Lock()
+	d.scrubbed = time.Now()
+	d.mutex.Unlock()
+	return true
+}
+
+// Verifies about a chunk's worth of the given segment from pos, which is
+// expected to still be held in file f unless f is nil at the start.  Returns
+// the file, where to resume, whether the segment is finished with, and
+// whether corruption was found at the returned position.  A segment that has
+// been replaced by compaction in the meantime is abandoned until the next
+// pass.  Assumes at least a read lock is held.
+func (d *DB) scrubChunk(id uint32, f *os.File, pos uint64) (*os.File, uint64, bool, bool) {
+	if d.closed {
+		return f, pos, true, false
+	}
+	buf, size, current := d.filebuffer, d.filledSize, d.filehandle
+	if id != d.activeID {
+		s, present := d.sealed[id]
+		if !present {
+			return f, pos, true, false
+		}
+		buf, size, current = s.filebuffer, s.size, s.filehandle
+	}
+	if f == nil {
+		f, pos = current, dataStart(buf, size)
+	} else if f != current {
+		return f, pos, true, false
+	}
+	s := newScanner(buf, current)
+	defer s.release()
+	end := pos + scrubChunk
+	for pos < size && pos < end {
+		n, ok := s.intact(pos, size)
+		if !ok {
+			return f, pos, true, true
+		}
+		pos += n
+	}
+	return f, pos, pos >= size, false
+}
@@ -0,0 +1,588 @@
+package bitcesque
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segment ids are packed into the top bits of offsets in the keyfile, which
+// bounds how many times a DB can rotate before it must be consolidated.
+const (
+	segmentShift = 48
+	maxSegmentID = 1<<(64-segmentShift) - 1
+)
+
+// One of the append-only files making up a DB.  The first lives at the DB's
+// location, and later ones alongside it suffixed with their id.
+type segment struct {
+	id         uint32
+	filehandle *os.File
+	filebuffer []byte //Mmap'd over the file
+	size       uint64 //Bytes of valid data in the file
+	mapped     bool   //Whether filebuffer must be unmapped, rather than holding only the header
+}
+
+func segmentPath(location string, id uint32) string {
+	if id == 0 {
+		return location
+	}
+	return location + "." + strconv.FormatUint(uint64(id), 10)
+}
+
+// Returns the ids of the segment files present for the DB at location, in
+// ascending order.
+func listSegments(location string) ([]uint32, error) {
+	dir, base := filepath.Split(location)
+	if dir == "" {
+		dir = "."
+	}
+	entries, e := ioutil.ReadDir(dir)
+	if e != nil {
+		return nil, e
+	}
+	out := []uint32{}
+	for _, fi := range entries {
+		name := fi.Name()
+		if name == base {
+			out = append(out, 0)
+			continue
+		}
+		if !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		id, e := strconv.ParseUint(name[len(base)+1:], 10, 32)
+		if e == nil && id > 0 {
+			out = append(out, uint32(id))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
+// Opens a sealed segment read-only, mapping exactly its contents unless
+// noMmap is set.
+func openSealedSegment(location string, id uint32, noMmap bool) (*segment, error) {
+	filehandle, e := os.Open(segmentPath(location, id))
+	if e != nil {
+		return nil, e
+	}
+	stats, e := filehandle.Stat()
+	if e != nil {
+		filehandle.Close()
+		return nil, e
+	}
+	seg := &segment{id, filehandle, nil, uint64(stats.Size()), !noMmap}
+	seg.filebuffer, e = mapSegment(filehandle, seg.size, false, noMmap)
+	if e == nil {
+		_, e = checkHeader(seg.filebuffer, seg.size, dataMagic)
+	}
+	if e != nil {
+		seg.close()
+		return nil, e
+	}
+	return seg, nil
+}
+
+// Opens the segment with the given id for appending, creating it with a
+// header naming the given checksum if it is new or empty.
+func openActiveSegment(location string, id uint32, noMmap bool, c Checksum) (*segment, error) {
+	filehandle, e := os.OpenFile(segmentPath(location, id), os.O_RDWR|os.O_CREATE, 0666)
+	if e != nil {
+		return nil, e
+	}
+	stats, e := filehandle.Stat()
+	if e == nil && stats.Size() == 0 {
+		_, e = filehandle.Write(dataHeader(c))
+		if e == nil {
+			stats, e = filehandle.Stat()
+		}
+	}
+	if e != nil {
+		filehandle.Close()
+		return nil, e
+	}
+	mmap, e := mapSegment(filehandle, uint64(stats.Size()), true, noMmap)
+	if e != nil {
+		filehandle.Close()
+		return nil, e
+	}
+	seg := &segment{id, filehandle, mmap, uint64(stats.Size()), !noMmap}
+	_, e = checkHeader(mmap, seg.size, dataMagic)
+	if e != nil {
+		seg.close()
+		return nil, e
+	}
+	return seg, nil
+}
+
+// Opens every segment of the DB at location, as recorded by its manifest,
+// with the given options.  The newest is opened for appending, and the rest
+// read-only.  Should the newest be empty, it is given the checksum of the one
+// before, or failing that the one the options ask for.
+func openSegments(location string, opts *Options) (map[uint32]*segment, *segment, error) {
+	var c Checksum
+	noMmap := opts != nil && opts.NoMmap
+	if opts != nil {
+		c = opts.Checksum
+	}
+	ids, e := recoverSegments(location)
+	if e != nil {
+		return nil, nil, e
+	}
+	sealed := make(map[uint32]*segment, len(ids)-1)
+	for _, id := range ids[:len(ids)-1] {
+		seg, e := openSealedSegment(location, id, noMmap)
+		if e != nil {
+			for _, s := range sealed {
+				s.close()
+			}
+			return nil, nil, e
+		}
+		sealed[id] = seg
+	}
+	if len(ids) > 1 {
+		seg := sealed[ids[len(ids)-2]]
+		c = fileChecksum(seg.filebuffer, seg.size)
+	}
+	active, e := openActiveSegment(location, ids[len(ids)-1], noMmap, c)
+	if e != nil {
+		for _, s := range sealed {
+			s.close()
+		}
+		return nil, nil, e
+	}
+	return sealed, active, nil
+}
+
+func (s *segment) close() error {
+	if s.mapped {
+		e := unmap(s.filebuffer)
+		if e != nil {
+			return e
+		}
+	}
+	return s.filehandle.Close()
+}
+
+// Returns the given segments ordered by id.
+func sortedSegments(m map[uint32]*segment) []*segment {
+	out := make([]*segment, 0, len(m))
+	for _, s := range m {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+// Returns the total bytes in use across all segments.  Assumes at least a
+// read lock is held.
+func (d *DB) totalSize() uint64 {
+	total := d.logEnd()
+	for _, s := range d.sealed {
+		total += s.size
+	}
+	return total
+}
+
+// Returns the number of segment files making up the DB.
+func (d *DB) Segments() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return len(d.sealed) + 1
+}
+
+// Seals the active segment and starts appending to a fresh one.  Assumes the
+// write lock is held.
+func (d *DB) rotate() error {
+	if d.activeID == maxSegmentID {
+		return errors.New("Segment ids exhausted; consolidate the DB")
+	}
+	e := d.flushWrites()
+	if e != nil {
+		return e
+	}
+	next, e := openActiveSegment(d.location, d.activeID+1, d.opts.NoMmap, d.sum)
+	if e != nil {
+		return e
+	}
+	m := &manifest{segments: append(d.segmentIDs(), next.id), compacted: d.horizon}
+	e = m.write(d.location)
+	if e != nil {
+		next.close()
+		os.Remove(segmentPath(d.location, next.id))
+		return e
+	}
+	d.io.appended.Add(next.size)
+	d.io.syncs.Add(1)
+	e = d.trimAllocation()
+	if e != nil {
+		next.close()
+		os.Remove(segmentPath(d.location, next.id))
+		return e
+	}
+	d.sealed[d.activeID] = &segment{d.activeID, d.filehandle, d.filebuffer, d.filledSize, !d.opts.NoMmap}
+	d.hintSegment(d.activeID)
+	d.activeID = next.id
+	d.filehandle = next.filehandle
+	d.filebuffer = next.filebuffer
+	d.filledSize = next.size
+	d.allocated = next.size
+	return nil
+}
+
+// A merge's output, written in full but not yet swapped in for the segments
+// it replaces.
+type pendingMerge struct {
+	ids       []uint32
+	tmp       *os.File                   //The output, open for appending
+	pos       uint64                     //Bytes written to it
+	moved     []relocation               //Records rewritten into it
+	expired   map[string]offsetAndLength //Keys found expired, and the records they then had
+	graves    int                        //Tombstones kept
+	keptBytes uint64                     //Bytes of those tombstones
+}
+
+// A record a merge rewrote, for the index to follow if it still refers to it.
+type relocation struct {
+	k        string
+	from, to offsetAndLength
+}
+
+// Discards the output of a merge that won't be installed.
+func (p *pendingMerge) discard() {
+	p.tmp.Close()
+	os.Remove(p.tmp.Name())
+}
+
+// Rewrites the live records held in the given segments, which must be the
+// oldest segments of the DB in ascending order, into a file that is to take
+// the id of the first once installMerge swaps it in.  Records are read via the
+// index, so tombstones and overwritten values are dropped, other than the
+// earlier versions and recent tombstones the options keep.  Only reads the DB,
+// so may run on a frozen view of it.
+func (d *DB) writeMerge(ids []uint32) (*pendingMerge, error) {
+	merging := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		merging[id] = true
+	}
+	target := ids[0]
+	tmp, e := os.OpenFile(mergePath(d.location), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if e != nil {
+		return nil, e
+	}
+	p := &pendingMerge{ids: ids, tmp: tmp, pos: headerSize, expired: make(map[string]offsetAndLength)}
+	_, e = tmp.Write(dataHeader(d.sum))
+	if e != nil {
+		p.discard()
+		return nil, e
+	}
+	t := now()
+	rewrite := func(k string, oal offsetAndLength) (offsetAndLength, error) {
+		r, e := d.rewriteRecord(d.getRecordAtOAL(oal))
+		if e != nil {
+			return oal, e
+		}
+		doc := r.encode(d.sum)
+		_, e = tmp.Write(doc)
+		if e != nil {
+			return oal, e
+		}
+		r.pos = p.pos
+		p.pos += uint64(len(doc))
+		out := r.oal(target)
+		if k != "" {
+			p.moved = append(p.moved, relocation{k, oal, out})
+		}
+		return out, nil
+	}
+	for k, oal := range d.inEvictionOrder() {
+		h := d.history[k]
+		if !merging[oal.segment] && len(h) == 0 {
+			continue
+		}
+		if d.expired(k, t) {
+			p.expired[k] = oal
+			continue
+		}
+		//Earlier versions go first, oldest first, so that indexing the file
+		//afresh leaves the current record in place
+		for i := len(h) - 1; i >= 0 && e == nil; i-- {
+			if merging[h[i].segment] {
+				_, e = rewrite(k, h[i])
+			}
+		}
+		if e == nil && merging[oal.segment] {
+			_, e = rewrite(k, oal)
+		}
+		if e != nil {
+			p.discard()
+			return nil, e
+		}
+	}
+	graves, e := d.retainedTombstones(ids)
+	for _, oal := range graves {
+		if e != nil {
+			break
+		}
+		oal, e = rewrite("", oal)
+		p.keptBytes += oal.docSize()
+	}
+	if e != nil {
+		p.discard()
+		return nil, e
+	}
+	p.graves = len(graves)
+	return p, nil
+}
+
+// Swaps the output of a merge in for the segments it replaces, first copying
+// onto its end everything in later segments if folding, so that it becomes
+// the only segment.  The index follows records the merge rewrote where it
+// still refers to them, so writes made since writeMerge read the index keep
+// precedence.  Progress is recorded in the manifest, so that a crash before
+// the merged file is complete discards it, and one after rolls the merge
+// forward.  Returns the new segment's file, open for appending, and its size.
+// Assumes the write lock is held.
+func (d *DB) installMerge(p *pendingMerge, folding bool) (*os.File, uint64, error) {
+	ids := p.ids
+	target := ids[0]
+	//Where each folded segment's data now starts, less where it started
+	type fold struct{ from, to uint64 }
+	folded := make(map[uint32]fold)
+	if folding {
+		active := &segment{d.activeID, d.filehandle, d.filebuffer, d.filledSize, false}
+		for _, seg := range append(sortedSegments(d.sealed), active) {
+			if seg.id <= ids[len(ids)-1] {
+				continue
+			}
+			start := dataStart(seg.filebuffer, seg.size)
+			_, e := p.tmp.Write(d.readSegment(seg.id, start, seg.size-start))
+			if e != nil {
+				p.discard()
+				return nil, 0, e
+			}
+			folded[seg.id] = fold{start, p.pos}
+			p.pos += seg.size - start
+			ids = append(ids, seg.id)
+		}
+	}
+	d.io.compacted.Add(p.pos)
+	d.io.syncs.Add(1)
+	e := p.tmp.Sync()
+	if e == nil {
+		e = p.tmp.Close()
+	}
+	if e != nil {
+		os.Remove(p.tmp.Name())
+		return nil, 0, e
+	}
+	//Views of the log are only possible from here on, which for a merge of
+	//every segment is the end of its output
+	horizon := logOffset(d.activeID, d.logEnd())
+	if folding {
+		horizon = logOffset(target, p.pos)
+	}
+	m := &manifest{segments: d.segmentIDs(), merging: ids, merged: true, compacted: horizon}
+	d.io.syncs.Add(1)
+	e = m.write(d.location)
+	if e != nil {
+		os.Remove(p.tmp.Name())
+		return nil, 0, e
+	}
+	d.quiesce()
+	for _, id := range ids {
+		if id == d.activeID {
+			e = d.unmapActive()
+			if e == nil {
+				e = d.filehandle.Close()
+			}
+		} else {
+			e = d.sealed[id].close()
+			delete(d.sealed, id)
+		}
+		if e != nil {
+			return nil, 0, e
+		}
+	}
+	for _, id := range ids {
+		os.Remove(hintPath(d.location, id))
+		os.Remove(filterPath(d.location, id))
+	}
+	e = os.Rename(p.tmp.Name(), segmentPath(d.location, target))
+	if e != nil {
+		return nil, 0, e
+	}
+	for _, id := range ids[1:] {
+		e = os.Remove(segmentPath(d.location, id))
+		if e != nil {
+			return nil, 0, e
+		}
+	}
+	m = &manifest{segments: withoutSegments(m.segments, ids[1:]), compacted: horizon}
+	d.io.syncs.Add(1)
+	e = m.write(d.location)
+	if e != nil {
+		return nil, 0, e
+	}
+	d.horizon = horizon
+	for _, mv := range p.moved {
+		if oal, _ := d.kToPos.get(mv.k); oal == mv.from {
+			d.kToPos.set(mv.k, mv.to)
+			continue
+		}
+		for i, oal := range d.history[mv.k] {
+			if oal == mv.from {
+				d.history[mv.k][i] = mv.to
+			}
+		}
+	}
+	if len(folded) > 0 {
+		move := func(oal offsetAndLength) offsetAndLength {
+			if f, present := folded[oal.segment]; present {
+				oal.segment, oal.offset = target, oal.offset-f.from+f.to
+			}
+			return oal
+		}
+		for k, oal := range d.kToPos.all() {
+			d.kToPos.set(k, move(oal))
+		}
+		for _, h := range d.history {
+			for i, oal := range h {
+				h[i] = move(oal)
+			}
+		}
+	}
+	graves := p.graves
+	for _, id := range ids {
+		if _, present := folded[id]; present {
+			graves += d.tombstones[id]
+		}
+		delete(d.tombstones, id)
+		delete(d.keptTombstones, id)
+	}
+	if graves > 0 {
+		d.tombstones[target] = graves
+	}
+	if p.keptBytes > 0 {
+		if d.keptTombstones == nil {
+			d.keptTombstones = make(map[uint32]uint64)
+		}
+		d.keptTombstones[target] = p.keptBytes
+	}
+	for k, oal := range p.expired {
+		if cur, _ := d.kToPos.get(k); cur == oal {
+			d.drop(k)
+		}
+	}
+	if d.cache != nil {
+		d.cache.purge(ids)
+	}
+	if d.filters != nil {
+		for _, id := range ids {
+			delete(d.filters, id)
+		}
+		d.rebuildFilters([]uint32{target})
+	}
+	filehandle, e := os.OpenFile(segmentPath(d.location, target), os.O_RDWR, 0666)
+	return filehandle, p.pos, e
+}
+
+// Rewrites the given segments as writeMerge does and swaps in the result
+// without folding in later ones.  Assumes the write lock is held.
+func (d *DB) mergeSegments(ids []uint32) (*os.File, uint64, error) {
+	p, e := d.writeMerge(ids)
+	if e != nil {
+		return nil, 0, e
+	}
+	return d.installMerge(p, false)
+}
+
+// Merges all sealed segments into one, leaving the active segment untouched.
+// Unlike Consolidate this only rewrites data that can no longer change, so
+// its cost is bounded by the size of the older segments.
+func (d *DB) Merge() error {
+	defer d.endOp(OpCompact, d.startOp())
+	d.checkpointing.Lock()
+	defer d.checkpointing.Unlock()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.snapshot || d.reader {
+		return ErrReadOnly
+	}
+	if len(d.sealed) == 0 {
+		return nil
+	}
+	start := time.Now()
+	ids := d.segmentIDs()
+	ids = ids[:len(ids)-1]
+	filehandle, size, e := d.mergeSegments(ids)
+	if e != nil {
+		d.abandonIndexLog()
+		return e
+	}
+	seg := &segment{ids[0], filehandle, nil, size, !d.opts.NoMmap}
+	seg.filebuffer, e = mapSegment(filehandle, size, false, d.opts.NoMmap)
+	if e != nil {
+		filehandle.Close()
+		return e
+	}
+	d.sealed[seg.id] = seg
+	d.hintSegment(seg.id)
+	d.recountLiveBytes()
+	d.finishCompaction(start, size)
+	d.full = false
+	return d.compactIndexLog()
+}
+
+// Ensures the active file has space for n more bytes at the end of its data,
+// preallocating another chunk if the options call for it.  Assumes the write
+// lock is held.
+func (d *DB) reserve(n uint64) error {
+	end := d.filledSize + n
+	if end <= d.allocated {
+		return nil
+	}
+	chunk := d.opts.Preallocate
+	if chunk == 0 {
+		d.allocated = end
+		return nil
+	}
+	size := (end + chunk - 1) / chunk * chunk
+	e := preallocate(d.filehandle, size)
+	if e != nil {
+		return e
+	}
+	d.allocated = size
+	return nil
+}
+
+// Discards everything in the active segment from pos on, after an append
+// failed.  Assumes the write lock is held.
+func (d *DB) truncateActive(pos uint64) {
+	d.filehandle.Truncate(int64(pos))
+	d.filledSize = pos
+	d.allocated = pos
+	d.filebuffer = truncateFilebuf(d.filebuffer, pos)
+}
+
+// Truncates away any space allocated past the end of the active file's
+// data.  Assumes the write lock is held.
+func (d *DB) trimAllocation() error {
+	if d.allocated <= d.filledSize {
+		return nil
+	}
+	e := d.filehandle.Truncate(int64(d.filledSize))
+	if e == nil {
+		d.allocated = d.filledSize
+	}
+	return e
+}
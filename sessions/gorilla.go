@@ -0,0 +1,109 @@
+//go:build gorilla
+
+package sessions
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bnyeggen/bitcesque"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Implements the Store interface of github.com/gorilla/sessions, keeping
+// session values in a DB as its FilesystemStore keeps them in files: the
+// cookie carries the session id, and both are encoded with the store's
+// codecs.  Sessions expire from the DB along with their cookies.
+type GorillaStore struct {
+	bucket  *bitcesque.Bucket
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+// Returns a store keeping sessions in db, with codecs made from keyPairs as
+// for sessions.NewFilesystemStore.
+func NewGorillaStore(db *bitcesque.DB, keyPairs ...[]byte) *GorillaStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			//Values are stored in the DB rather than a cookie, so needn't fit one
+			sc.MaxLength(0)
+		}
+	}
+	return &GorillaStore{db.Bucket(bucketName), codecs, &sessions.Options{Path: "/", MaxAge: 86400 * 30}}
+}
+
+// Returns the named session from the request's registry, loading it first if
+// need be.
+func (g *GorillaStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(g, name)
+}
+
+// Returns the session named by the request's cookie, or a new one.
+func (g *GorillaStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(g, name)
+	opts := *g.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, e := r.Cookie(name)
+	if e != nil {
+		return session, nil
+	}
+	e = securecookie.DecodeMulti(name, c.Value, &session.ID, g.Codecs...)
+	if e != nil {
+		return session, e
+	}
+	v, e := g.bucket.Lookup([]byte(session.ID))
+	if e == bitcesque.ErrKeyNotFound {
+		return session, nil
+	}
+	if e != nil {
+		return session, e
+	}
+	e = securecookie.DecodeMulti(name, string(v), &session.Values, g.Codecs...)
+	if e == nil {
+		session.IsNew = false
+	}
+	return session, e
+}
+
+// Writes the session to the DB and sets its cookie, or removes both if the
+// session's MaxAge is negative.
+func (g *GorillaStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			e := g.bucket.Remove([]byte(session.ID))
+			if e != nil {
+				return e
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		id, e := newID()
+		if e != nil {
+			return e
+		}
+		session.ID = id
+	}
+	v, e := securecookie.EncodeMulti(session.Name(), session.Values, g.Codecs...)
+	if e != nil {
+		return e
+	}
+	if session.Options.MaxAge > 0 {
+		e = g.bucket.UpsertWithTTL([]byte(session.ID), []byte(v), time.Duration(session.Options.MaxAge)*time.Second)
+	} else {
+		e = g.bucket.Upsert([]byte(session.ID), []byte(v))
+	}
+	if e != nil {
+		return e
+	}
+	encoded, e := securecookie.EncodeMulti(session.Name(), session.ID, g.Codecs...)
+	if e != nil {
+		return e
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
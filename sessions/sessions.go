@@ -0,0 +1,115 @@
+// Package sessions keeps HTTP session data in a bitcesque DB.  The cookie
+// carries only a random session id, and the session's values live in the DB
+// under it, expiring along with the cookie.
+//
+//	store := sessions.NewStore(db, 24*time.Hour)
+//	s, e := store.Get(r, "session")
+//	s.Values["user"] = "tom"
+//	e = store.Save(w, s)
+//
+// With the gorilla build tag, GorillaStore implements the Store interface of
+// github.com/gorilla/sessions over the same DB, for code already written
+// against it.
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+// Sessions are kept in this bucket of the DB.
+const bucketName = "sessions"
+
+// Keeps sessions in a DB, identified by cookies.
+type Store struct {
+	bucket *bitcesque.Bucket
+	// How long a session lasts after it was last saved.
+	MaxAge time.Duration
+	// The attributes of the cookies set, such as Path, Domain and Secure.
+	// Name, Value, Expires and MaxAge are filled in per session.
+	Cookie http.Cookie
+}
+
+// Returns a store keeping sessions in db for maxAge after they were last
+// saved, with cookies for path /, hidden from scripts.
+func NewStore(db *bitcesque.DB, maxAge time.Duration) *Store {
+	return &Store{db.Bucket(bucketName), maxAge, http.Cookie{Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}}
+}
+
+// The values of one client's session.
+type Session struct {
+	// Random and unguessable, so it needs no signing.
+	ID string
+	// The name of the cookie carrying the id.
+	Name   string
+	Values map[string]string
+	// Whether the session was started by this request.
+	IsNew bool
+}
+
+// Returns the session named by the request's cookie of the given name, or a
+// new one if it has none, or its session has expired.
+func (s *Store) Get(r *http.Request, name string) (*Session, error) {
+	c, e := r.Cookie(name)
+	if e == nil {
+		v, e := s.bucket.Lookup([]byte(c.Value))
+		if e == nil {
+			sess := &Session{c.Value, name, nil, false}
+			return sess, json.Unmarshal(v, &sess.Values)
+		}
+		if e != bitcesque.ErrKeyNotFound {
+			return nil, e
+		}
+	}
+	id, e := newID()
+	if e != nil {
+		return nil, e
+	}
+	return &Session{id, name, make(map[string]string), true}, nil
+}
+
+// Writes the session to the DB, extending its life by MaxAge, and sets its
+// cookie on the response.  Must be called before the response is written.
+func (s *Store) Save(w http.ResponseWriter, sess *Session) error {
+	v, e := json.Marshal(sess.Values)
+	if e != nil {
+		return e
+	}
+	e = s.bucket.UpsertWithTTL([]byte(sess.ID), v, s.MaxAge)
+	if e != nil {
+		return e
+	}
+	c := s.Cookie
+	c.Name, c.Value = sess.Name, sess.ID
+	c.MaxAge = int(s.MaxAge / time.Second)
+	c.Expires = time.Now().Add(s.MaxAge)
+	http.SetCookie(w, &c)
+	return nil
+}
+
+// Removes the session from the DB, and tells the client to drop its cookie.
+func (s *Store) Delete(w http.ResponseWriter, sess *Session) error {
+	e := s.bucket.Remove([]byte(sess.ID))
+	if e != nil {
+		return e
+	}
+	c := s.Cookie
+	c.Name, c.MaxAge = sess.Name, -1
+	http.SetCookie(w, &c)
+	return nil
+}
+
+// Returns a new random session id.
+func newID() (string, error) {
+	b := make([]byte, 32)
+	_, e := rand.Read(b)
+	if e != nil {
+		return "", e
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,52 @@
+package sessions
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+func TestStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sessions")
+	defer os.RemoveAll(dir)
+	db, e := bitcesque.NewDB(filepath.Join(dir, "db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	store := NewStore(db, time.Hour)
+
+	s, e := store.Get(httptest.NewRequest("GET", "/", nil), "session")
+	if e != nil || !s.IsNew {
+		t.Fatal("New session not started", e)
+	}
+	s.Values["user"] = "tom"
+	rec := httptest.NewRecorder()
+	if e := store.Save(rec, s); e != nil {
+		t.Fatal(e)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != s.ID || cookies[0].MaxAge != 3600 {
+		t.Fatal("Cookie not set")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	s, e = store.Get(r, "session")
+	if e != nil || s.IsNew || s.Values["user"] != "tom" {
+		t.Error("Session not loaded", e)
+	}
+	rec = httptest.NewRecorder()
+	store.Delete(rec, s)
+	if s, _ = store.Get(r, "session"); !s.IsNew {
+		t.Error("Deleted session loaded")
+	}
+	if rec.Result().Cookies()[0].MaxAge != -1 {
+		t.Error("Cookie not dropped")
+	}
+}
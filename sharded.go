@@ -0,0 +1,61 @@
+package bitcesque
+
+import (
+	"sync"
+)
+
+// How many shards the read side of a DB's lock is split across.
+const lockShards = 16
+
+// A reader/writer lock whose read side is split across shards, each on its
+// own cache line, so that concurrent readers of different keys don't contend
+// on a single reader count.  Writers take every shard, in order, so holding
+// any one shard's read lock excludes them.  The zero value is unlocked.
+type shardedRWMutex struct {
+	shards [lockShards]struct {
+		sync.RWMutex
+		_ [40]byte //Pads each shard out to 64 bytes
+	}
+}
+
+func (l *shardedRWMutex) Lock() {
+	for i := range l.shards {
+		l.shards[i].Lock()
+	}
+}
+
+func (l *shardedRWMutex) Unlock() {
+	for i := len(l.shards) - 1; i >= 0; i-- {
+		l.shards[i].Unlock()
+	}
+}
+
+// Read locks the first shard, for readers of more than a single key.
+func (l *shardedRWMutex) RLock() {
+	l.shards[0].RLock()
+}
+
+func (l *shardedRWMutex) RUnlock() {
+	l.shards[0].RUnlock()
+}
+
+// Read locks the shard for the given key, returning it to be unlocked.
+func (l *shardedRWMutex) rlockKey(k []byte) *sync.RWMutex {
+	shard := &l.shards[keyShard(k)].RWMutex
+	shard.RLock()
+	return shard
+}
+
+// Returns which shard the given key falls in, by its FNV-1a hash.
+func keyShard(k []byte) uint32 {
+	return fnv32(k) % lockShards
+}
+
+// Returns the 32 bit FNV-1a hash of k.
+func fnv32(k []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range k {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return h
+}
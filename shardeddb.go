@@ -0,0 +1,210 @@
+package bitcesque
+
+import (
+	"errors"
+	"iter"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A set of DBs in one directory, each holding the keys that hash to it, as
+// HashPartition assigns them.  Each shard has its own files, lock and
+// mapping, so writes to different shards don't contend, and each is compacted
+// on its own.  The shards live at ShardLocation(dir, i) for each index i.
+type ShardedDB struct {
+	dir    string
+	shards []*DB
+	part   func(k []byte) int
+}
+
+// Returns the location of the given shard of a ShardedDB in dir, e.g. to
+// SplitTo an existing DB into.
+func ShardLocation(dir string, i int) string {
+	return filepath.Join(dir, "shard."+strconv.Itoa(i))
+}
+
+// Creates a ShardedDB of n shards in dir, creating dir if need be and
+// *deleting* any shards there.  A nil opts gives the defaults.
+func NewShardedDB(dir string, n int, opts *Options) (*ShardedDB, error) {
+	if n <= 0 {
+		return nil, errors.New("A ShardedDB needs at least one shard")
+	}
+	e := os.MkdirAll(dir, 0777)
+	if e != nil {
+		return nil, e
+	}
+	return openShards(dir, n, func(location string) (*DB, error) {
+		return NewDBWithOptions(location, opts)
+	})
+}
+
+// Opens the pre-existing ShardedDB in dir, finding how many shards it has
+// from the files there, each opened as by OpenDBWithOptions.
+func OpenShardedDB(dir string, opts *Options) (*ShardedDB, error) {
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		return nil, e
+	}
+	n := 0
+	for _, entry := range entries {
+		rest, ok := strings.CutPrefix(entry.Name(), "shard.")
+		if !ok {
+			continue
+		}
+		if i, e := strconv.Atoi(rest); e == nil && i >= n {
+			n = i + 1
+		}
+	}
+	if n == 0 {
+		return nil, errors.New("No shards in " + dir)
+	}
+	return openShards(dir, n, func(location string) (*DB, error) {
+		return OpenDBWithOptions(location, opts)
+	})
+}
+
+// Opens n shards in dir with open, closing those already opened on error.
+func openShards(dir string, n int, open func(location string) (*DB, error)) (*ShardedDB, error) {
+	s := &ShardedDB{dir, make([]*DB, 0, n), HashPartition(n)}
+	for i := 0; i < n; i++ {
+		d, e := open(ShardLocation(dir, i))
+		if e != nil {
+			s.Close()
+			return nil, e
+		}
+		s.shards = append(s.shards, d)
+	}
+	return s, nil
+}
+
+// Returns the directory holding the shards.
+func (s *ShardedDB) GetLocation() string {
+	return s.dir
+}
+
+// Returns the shards, in order, e.g. to compact or back up one on its own.
+func (s *ShardedDB) Shards() []*DB {
+	return s.shards
+}
+
+// Returns the shard holding the given key.
+func (s *ShardedDB) Shard(k []byte) *DB {
+	return s.shards[s.part(k)]
+}
+
+// Returns the value associated with the given key, and whether it is present.
+func (s *ShardedDB) Get(k []byte) (string, bool) {
+	return s.Shard(k).Get(k)
+}
+
+// As DB.Lookup, on the shard holding the key.
+func (s *ShardedDB) Lookup(k []byte) ([]byte, error) {
+	return s.Shard(k).Lookup(k)
+}
+
+// Returns whether the given key is present.
+func (s *ShardedDB) Contains(k []byte) bool {
+	return s.Shard(k).Contains(k)
+}
+
+// Inserts or updates the given key with the given value.
+func (s *ShardedDB) Upsert(k, v []byte) error {
+	return s.Shard(k).Upsert(k, v)
+}
+
+// As DB.UpsertWithTTL, on the shard holding the key.
+func (s *ShardedDB) UpsertWithTTL(k, v []byte, ttl time.Duration) error {
+	return s.Shard(k).UpsertWithTTL(k, v, ttl)
+}
+
+// As DB.UpsertWithFlags, on the shard holding the key.
+func (s *ShardedDB) UpsertWithFlags(k, v []byte, flags uint8) error {
+	return s.Shard(k).UpsertWithFlags(k, v, flags)
+}
+
+// Removes the given key.
+func (s *ShardedDB) Remove(k []byte) error {
+	return s.Shard(k).Remove(k)
+}
+
+// Returns the number of live keys across all shards.
+func (s *ShardedDB) Size() int {
+	n := 0
+	for _, d := range s.shards {
+		n += d.Size()
+	}
+	return n
+}
+
+// Returns the live keys of every shard, shard by shard.
+func (s *ShardedDB) Keys() []string {
+	var out []string
+	for _, d := range s.shards {
+		out = append(out, d.Keys()...)
+	}
+	return out
+}
+
+// Iterates over the live pairs of every shard, shard by shard, each in key
+// order.
+func (s *ShardedDB) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for _, d := range s.shards {
+			for k, v := range d.All() {
+				if !yield(k, v) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// As DB.Fold, over every shard in turn.
+func (s *ShardedDB) Fold(fn func(k, v []byte) error) error {
+	stopped := false
+	for _, d := range s.shards {
+		e := d.Fold(func(k, v []byte) error {
+			e := fn(k, v)
+			stopped = e == ErrStop
+			return e
+		})
+		if e != nil || stopped {
+			return e
+		}
+	}
+	return nil
+}
+
+// Consolidates each shard in turn, so only one is being rewritten at once.
+func (s *ShardedDB) Consolidate() error {
+	for _, d := range s.shards {
+		if e := d.Consolidate(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Flushes every shard to disk.
+func (s *ShardedDB) Sync() error {
+	for _, d := range s.shards {
+		if e := d.Sync(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Closes every shard, returning the first error.
+func (s *ShardedDB) Close() error {
+	var out error
+	for _, d := range s.shards {
+		if e := d.Close(); e != nil && out == nil {
+			out = e
+		}
+	}
+	return out
+}
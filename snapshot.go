@@ -0,0 +1,102 @@
+package bitcesque
+
+import (
+	"os"
+)
+
+// Returns a read-only view of the DB as it stands now, which later writes do
+// not affect and which never blocks writers.  The view is itself a DB, on
+// which every read works as usual, but writes and compaction fail with
+// ErrReadOnly.  Close it once done.
+//
+// A snapshot copies the index, and holds its own handles on the data files
+// it refers to, so compaction can proceed while it is open: the files it
+// replaces stay readable until the snapshot is closed.  Where data files
+// aren't memory mapped, each snapshot reads them into memory, and compaction
+// may fail while snapshots hold open files it would remove.  A DB opened with
+// OpenReadOnlyDB is refreshed first if the writer has compacted it since.
+func (d *DB) Snapshot() (*DB, error) {
+	s, e := d.takeSnapshot()
+	for tries := 0; e == errStaleFiles && tries < 3; tries++ {
+		if e = d.Refresh(); e == nil {
+			s, e = d.takeSnapshot()
+		}
+	}
+	return s, e
+}
+
+// Takes the snapshot described by Snapshot.
+func (d *DB) takeSnapshot() (*DB, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return nil, ErrDatabaseClosed
+	}
+	if d.snapshot {
+		//Its files may since have been replaced by compaction
+		return nil, ErrReadOnly
+	}
+	s := &DB{
+		kToPos:     d.kToPos.clone(),
+		expiries:   make(map[string]int64, len(d.expiries)),
+		location:   d.location,
+		activeID:   d.activeID,
+		filledSize: d.filledSize,
+		wbuf:       d.wbuf[:len(d.wbuf):len(d.wbuf)],
+		horizon:    d.horizon,
+		sealed:     make(map[uint32]*segment, len(d.sealed)),
+		opts:       d.opts,
+		sum:        d.sum,
+		meta:       d.meta,
+		snapshot:   true,
+		stop:       make(chan struct{}),
+	}
+	for k, expiry := range d.expiries {
+		s.expiries[k] = expiry
+	}
+	if d.history != nil {
+		s.history = make(map[string][]offsetAndLength, len(d.history))
+		for k, h := range d.history {
+			s.history[k] = append([]offsetAndLength{}, h...)
+		}
+	}
+	for id := range d.sealed {
+		own, e := openSealedSegment(d.location, id, d.opts.NoMmap)
+		if e != nil {
+			s.closeSegments()
+			return nil, e
+		}
+		s.sealed[id] = own
+	}
+	filehandle, e := os.Open(segmentPath(d.location, d.activeID))
+	if e == nil {
+		s.filehandle = filehandle
+		s.filebuffer, e = mapSegment(filehandle, d.filledSize, false, d.opts.NoMmap)
+	}
+	if e != nil {
+		s.closeSegments()
+		return nil, e
+	}
+	if d.reader && !d.sameFiles(s) {
+		s.closeSegments()
+		return nil, errStaleFiles
+	}
+	s.recountLiveBytes()
+	return s, nil
+}
+
+// Releases the files held by a snapshot that failed to open.
+func (d *DB) closeSegments() {
+	for _, seg := range d.sealed {
+		seg.close()
+	}
+	if d.filehandle != nil {
+		d.filehandle.Close()
+	}
+}
+
+// Returns whether writes to the DB are refused.  Assumes at least a read lock
+// is held.
+func (d *DB) readOnly() bool {
+	return d.snapshot || d.reader || d.follower != nil || d.full || d.moved
+}
@@ -0,0 +1,297 @@
+package bitcesque
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServeUnix lets other processes on the same host share a DB through a Unix
+// domain socket, with a protocol lighter than HTTP or RESP.  Each request is
+//
+//	op (1) | key length (4) | value length (4) | key | value
+//
+// with lengths little-endian, as throughout the data files, and is answered
+// in order, so requests can be pipelined, with
+//
+//	status (1) | length (4) | payload
+//
+// the length again little-endian.  The ops, and their answers, are:
+//
+//	'G' get          'V' and the value, or 'N' if absent
+//	'P' upsert       'K'
+//	'T' upsert with a TTL, the value prefixed by the TTL in nanoseconds (8)
+//	                 'K'
+//	'R' remove       'K'
+//	'C' contains     'K' if present, or 'N'
+//
+// Any op may instead be answered with 'E' and an error message.  Requests of
+// more than Options.MaxSocketMessage bytes of key and value are answered with
+// 'E' and ErrKeyTooLarge or ErrValueTooLarge, their bodies being read and
+// discarded rather than held.
+
+// Bytes of key and value, or of payload, in the largest message ServeUnix or
+// a UnixClient accepts, unless Options.MaxSocketMessage says otherwise.
+const defaultSocketMaxMessage = 16 << 20
+
+// Returns the largest message the given options, which may be nil, allow
+// over a Unix domain socket.
+func socketMaxMessage(opts *Options) uint64 {
+	if opts == nil || opts.MaxSocketMessage <= 0 {
+		return defaultSocketMaxMessage
+	}
+	return uint64(opts.MaxSocketMessage)
+}
+
+// Answers a 'T' request too short to hold its TTL.
+var errSocketTTL = errors.New("Missing TTL")
+
+// Errors a socket client recognizes in answers, to return as themselves.
+var socketErrors = []error{ErrKeyNotFound, ErrDatabaseClosed, ErrReadOnly, ErrKeyTooLarge, ErrValueTooLarge, ErrQuotaExceeded}
+
+// Listens on a Unix domain socket at path and serves the DB to clients
+// connecting through it, as DialUnix does, until the DB is closed.  A socket
+// left at path by a server that has gone away is replaced, and the socket is
+// removed on return.
+func (d *DB) ServeUnix(path string) error {
+	d.mutex.RLock()
+	closed := d.closed
+	d.mutex.RUnlock()
+	if closed {
+		return ErrDatabaseClosed
+	}
+	if fi, e := os.Lstat(path); e == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, e := net.Dial("unix", path); e == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	l, e := net.Listen("unix", path)
+	if e != nil {
+		return e
+	}
+	var mutex sync.Mutex
+	conns := make(map[net.Conn]bool)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-d.stop:
+		case <-done:
+		}
+		l.Close()
+		mutex.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+		mutex.Unlock()
+	}()
+	for {
+		conn, e := l.Accept()
+		if e != nil {
+			select {
+			case <-d.stop:
+				return ErrDatabaseClosed
+			default:
+				return e
+			}
+		}
+		mutex.Lock()
+		if conns == nil {
+			mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		conns[conn] = true
+		mutex.Unlock()
+		go func() {
+			d.serveSocket(conn)
+			mutex.Lock()
+			delete(conns, conn)
+			mutex.Unlock()
+		}()
+	}
+}
+
+// Answers one client's requests until it hangs up or sends one malformed.
+func (d *DB) serveSocket(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	head := make([]byte, 9)
+	limit := socketMaxMessage(&d.opts)
+	for {
+		_, e := io.ReadFull(r, head)
+		if e != nil {
+			return
+		}
+		kLen, vLen := uint64(uint32FromBytes(head, 1)), uint64(uint32FromBytes(head, 5))
+		var k, v []byte
+		op := head[0]
+		if kLen+vLen > limit {
+			if _, e = io.CopyN(io.Discard, r, int64(kLen+vLen)); e != nil {
+				return
+			}
+			op = 0
+		} else {
+			body := make([]byte, kLen+vLen)
+			if _, e = io.ReadFull(r, body); e != nil {
+				return
+			}
+			k, v = body[:kLen], body[kLen:]
+		}
+		status, payload := byte('K'), []byte(nil)
+		switch op {
+		case 0:
+			e = ErrValueTooLarge
+			if kLen > limit {
+				e = ErrKeyTooLarge
+			}
+		case 'G':
+			payload, e = d.Lookup(k)
+			status = 'V'
+			if e == ErrKeyNotFound {
+				status, e = 'N', nil
+			}
+		case 'P':
+			e = d.Upsert(k, v)
+		case 'T':
+			if len(v) < 8 {
+				e = errSocketTTL
+				break
+			}
+			e = d.UpsertWithTTL(k, v[8:], time.Duration(uint64FromBytes(v, 0)))
+		case 'R':
+			e = d.Remove(k)
+		case 'C':
+			if !d.Contains(k) {
+				status = 'N'
+			}
+		default:
+			return
+		}
+		if e != nil {
+			status, payload = 'E', []byte(e.Error())
+		}
+		reply := make([]byte, 5)
+		reply[0] = status
+		uint32ToBytes(reply, 1, uint32(len(payload)))
+		w.Write(reply)
+		w.Write(payload)
+		//Answers to pipelined requests go out together
+		if r.Buffered() == 0 && w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// A connection to a DB served by ServeUnix.  Safe for concurrent use, though
+// requests are made one at a time.
+type UnixClient struct {
+	mutex sync.Mutex
+	conn  net.Conn
+	r     *bufio.Reader
+	w     *bufio.Writer
+	limit uint64 //Largest payload accepted in an answer
+}
+
+// Connects to the DB served on the Unix domain socket at path.
+func DialUnix(path string) (*UnixClient, error) {
+	return DialUnixWithOptions(path, nil)
+}
+
+// As DialUnix, accepting answers up to Options.MaxSocketMessage long.  Other
+// options are ignored.
+func DialUnixWithOptions(path string, opts *Options) (*UnixClient, error) {
+	conn, e := net.Dial("unix", path)
+	if e != nil {
+		return nil, e
+	}
+	return &UnixClient{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), limit: socketMaxMessage(opts)}, nil
+}
+
+// Sends a request and returns the answer's status and payload.
+func (c *UnixClient) request(op byte, k, v []byte) (byte, []byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	head := make([]byte, 9)
+	head[0] = op
+	uint32ToBytes(head, 1, uint32(len(k)))
+	uint32ToBytes(head, 5, uint32(len(v)))
+	c.w.Write(head)
+	c.w.Write(k)
+	c.w.Write(v)
+	if e := c.w.Flush(); e != nil {
+		return 0, nil, e
+	}
+	reply := make([]byte, 5)
+	if _, e := io.ReadFull(c.r, reply); e != nil {
+		return 0, nil, e
+	}
+	n := uint64(uint32FromBytes(reply, 1))
+	if n > c.limit {
+		//The rest of the answer can't be skipped without reading it
+		c.conn.Close()
+		return 0, nil, ErrValueTooLarge
+	}
+	payload := make([]byte, n)
+	if _, e := io.ReadFull(c.r, payload); e != nil {
+		return 0, nil, e
+	}
+	if reply[0] == 'E' {
+		for _, known := range socketErrors {
+			if string(payload) == known.Error() {
+				return 0, nil, known
+			}
+		}
+		return 0, nil, errors.New(string(payload))
+	}
+	return reply[0], payload, nil
+}
+
+// Returns the value associated with the given key, or ErrKeyNotFound if it
+// is absent.
+func (c *UnixClient) Get(k []byte) ([]byte, error) {
+	status, v, e := c.request('G', k, nil)
+	if e == nil && status == 'N' {
+		e = ErrKeyNotFound
+	}
+	return v, e
+}
+
+// Inserts or updates the given key with the given value.
+func (c *UnixClient) Upsert(k, v []byte) error {
+	_, _, e := c.request('P', k, v)
+	return e
+}
+
+// As Upsert, with the key expiring after the given duration.
+func (c *UnixClient) UpsertWithTTL(k, v []byte, ttl time.Duration) error {
+	b := make([]byte, 8, 8+len(v))
+	uint64ToBytes(b, 0, uint64(ttl))
+	_, _, e := c.request('T', k, append(b, v...))
+	return e
+}
+
+// Removes the given key.
+func (c *UnixClient) Remove(k []byte) error {
+	_, _, e := c.request('R', k, nil)
+	return e
+}
+
+// Returns whether the given key is present.
+func (c *UnixClient) Contains(k []byte) (bool, error) {
+	status, _, e := c.request('C', k, nil)
+	return status == 'K', e
+}
+
+// Closes the connection.
+func (c *UnixClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,104 @@
+package bitcesque
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Returns a partition function for SplitTo that spreads keys evenly over n
+// parts by a jump consistent hash, so that going from n to n+1 parts moves
+// only a 1/(n+1) share of the keys.  A ShardedDB routes keys the same way, so
+// can open the parts of a split into the locations it uses.
+func HashPartition(n int) func(k []byte) int {
+	return func(k []byte) int {
+		return jumpHash(uint64(fnv32(k)), n)
+	}
+}
+
+// Returns the bucket in [0, n) that Lamping and Veach's jump consistent hash
+// assigns key to.
+func jumpHash(key uint64, n int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64(key>>33+1)))
+	}
+	return int(b)
+}
+
+// Writes the DB's live records into new DBs at the given locations,
+// *deleting* the data there, sending each key to the location whose index
+// partFn returns for it.  Records are copied as stored, in one pass over a
+// snapshot, so they keep their timestamps and expiries, and the new DBs are
+// created with the DB's options, which they should be opened with again if
+// records are encrypted.  The new DBs are closed once written.  On error,
+// what has been written so far is left in place.
+func (d *DB) SplitTo(locations []string, partFn func(k []byte) int) error {
+	return d.viewing(func(s *DB) error {
+		return s.splitTo(locations, partFn)
+	})
+}
+
+// Runs the split described by SplitTo from a snapshot.
+func (d *DB) splitTo(locations []string, partFn func(k []byte) int) error {
+	parts := make([]*DB, 0, len(locations))
+	closeAll := func(e error) error {
+		for _, p := range parts {
+			if closeErr := p.Close(); e == nil {
+				e = closeErr
+			}
+		}
+		return e
+	}
+	for _, location := range locations {
+		p, e := NewDBWithOptions(location, d.copyOptions())
+		if e != nil {
+			return closeAll(e)
+		}
+		parts = append(parts, p)
+	}
+	return closeAll(d.copyLive(parts, partFn))
+}
+
+// Appends the DB's live records, as stored, to the given DBs, sending each
+// key to the one whose index partFn returns for it, or to the first if partFn
+// is nil.  Holds the read lock throughout.
+func (d *DB) copyLive(parts []*DB, partFn func(k []byte) int) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	pending := make([][]byte, len(parts))
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if d.expired(k, t) {
+			continue
+		}
+		i := 0
+		if partFn != nil {
+			i = partFn([]byte(k))
+		}
+		if i < 0 || i >= len(parts) {
+			return errors.New("Partition " + strconv.Itoa(i) + " out of range for key " + strconv.Quote(k))
+		}
+		start := oal.offset - uint64(oal.prefix)
+		pending[i] = append(pending[i], d.readSegment(oal.segment, start, oal.docSize())...)
+		if len(pending[i]) >= replSnapshotChunk {
+			if e := parts[i].applyFrames(pending[i]); e != nil {
+				return e
+			}
+			pending[i] = pending[i][:0]
+		}
+	}
+	for i, b := range pending {
+		if len(b) == 0 {
+			continue
+		}
+		if e := parts[i].applyFrames(b); e != nil {
+			return e
+		}
+	}
+	return nil
+}
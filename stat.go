@@ -0,0 +1,208 @@
+package bitcesque
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Metadata about the current record for a key.
+type KeyStat struct {
+	// Length of the value in bytes.
+	Size int
+	// Bytes the value takes up on disk, after compression and encryption.
+	StoredSize int
+	// Id of the segment file holding the record, and the offset of the value
+	// within it.
+	Segment uint32
+	Offset  int64
+	// Whether the value is stored compressed or encrypted.
+	Compressed bool
+	Encrypted  bool
+	// When the record was written, or the zero time for records written
+	// before timestamps were recorded.
+	Timestamp time.Time
+	// When the record expires, or the zero time if it does not.
+	Expiry time.Time
+	// The flags given by UpsertWithFlags, or zero.
+	Flags uint8
+}
+
+// Returns metadata about the given key's current record, and whether the key
+// is present.  Reads only the record's header, not its value, unless the
+// value is encrypted.
+func (d *DB) Stat(k []byte) (KeyStat, bool) {
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return KeyStat{}, false
+	}
+	out, e := d.stat(oal)
+	return out, e == nil
+}
+
+// Returns metadata about the record oal points to.  Assumes at least a read
+// lock is held.
+func (d *DB) stat(oal offsetAndLength) (KeyStat, error) {
+	start := oal.offset - uint64(oal.prefix)
+	r := decodeRecord(d.readSegment(oal.segment, start, uint64(oal.prefix)), start)
+	out := KeyStat{Size: int(oal.length), StoredSize: int(oal.length), Segment: oal.segment, Offset: int64(oal.offset)}
+	out.Compressed = oal.compressed()
+	out.Encrypted = oal.format&(encryptedFlag>>24) != 0
+	if out.Encrypted {
+		v, e := d.getVal(oal)
+		if e != nil {
+			return KeyStat{}, e
+		}
+		out.Size = len(v)
+	} else if oal.compressed() {
+		//The uncompressed length leads the value
+		n := uint64(oal.length)
+		if n > 11 {
+			n = 11
+		}
+		out.Size = decompressedSize(d.readSegment(oal.segment, oal.offset, n))
+	}
+	if r.timestamp != 0 {
+		out.Timestamp = time.Unix(0, r.timestamp)
+	}
+	if r.expiry != 0 {
+		out.Expiry = time.Unix(0, r.expiry)
+	}
+	out.Flags = r.userFlags
+	return out, nil
+}
+
+// Statistics about a DB as a whole.
+type DBStats struct {
+	// Number of live keys.
+	Keys int
+	// Number of segment files, and the bytes they take up in total.
+	Segments int
+	FileSize uint64
+	// Bytes taken up by current records, which compaction would keep, and by
+	// overwritten, removed or expired ones, which it would reclaim.
+	LiveBytes uint64
+	DeadBytes uint64
+	// Removal records in the files.  Those written before the DB was opened
+	// are only known if it was opened with OpenAndVerifyDB.
+	Tombstones int
+	// When the DB was last compacted, or the zero time if it hasn't been
+	// since opening.
+	LastCompaction time.Time
+	// Appends made since the keyfile was last written, which would be lost to
+	// OpenDB after an unclean shutdown.  Batches count once.
+	UnsavedWrites uint64
+	// Damaged regions found by the scrubber, and when it last finished a pass
+	// over every segment, or the zero time if it hasn't.
+	CorruptRegions int
+	LastScrub      time.Time
+	// Writes refused with ErrQuotaExceeded, and whether the DB has turned
+	// read-only after one, as Options.ReadOnlyWhenFull asks.
+	QuotaFailures int
+	Full          bool
+	// Reads served from and missing the value cache, and the bytes it holds
+	// including overhead, if Options.ValueCacheSize enables it.
+	CacheHits   uint64
+	CacheMisses uint64
+	CacheBytes  int
+	// Key and value bytes given to writes since opening, and the bytes then
+	// written for them: appended to the data files, headers and tombstones
+	// included, rewritten by compaction, and written to keyfiles, hint and
+	// filter files and the index log.  WriteAmplification relates them.
+	LogicalBytes   uint64
+	AppendedBytes  uint64
+	CompactedBytes uint64
+	IndexBytes     uint64
+	// Times data files and the other files the DB writes have been synced to
+	// disk since opening.
+	Syncs uint64
+}
+
+// Returns the bytes written to disk for each byte of keys and values written
+// to the DB, or 0 if none have been.
+func (s DBStats) WriteAmplification() float64 {
+	if s.LogicalBytes == 0 {
+		return 0
+	}
+	return float64(s.AppendedBytes+s.CompactedBytes+s.IndexBytes) / float64(s.LogicalBytes)
+}
+
+// Running totals of the DB's IO, for Stats.  Updated atomically, as some IO
+// happens without the write lock.
+type ioCounters struct {
+	logical   atomic.Uint64
+	appended  atomic.Uint64
+	compacted atomic.Uint64
+	index     atomic.Uint64
+	syncs     atomic.Uint64
+}
+
+// Counts a file of n bytes written in full and synced, such as a keyfile.
+func (d *DB) wroteFile(n int) {
+	d.io.index.Add(uint64(n))
+	d.io.syncs.Add(1)
+}
+
+// Returns statistics about the DB as a whole.
+func (d *DB) Stats() DBStats {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	out := DBStats{Segments: len(d.sealed) + 1, FileSize: d.totalSize(), LastCompaction: d.compacted, UnsavedWrites: d.unsaved}
+	out.CorruptRegions, out.LastScrub = d.corrupt, d.scrubbed
+	out.QuotaFailures, out.Full = d.quotaFailures, d.full
+	if d.cache != nil {
+		out.CacheHits, out.CacheMisses, out.CacheBytes = d.cache.stats()
+	}
+	out.LogicalBytes, out.AppendedBytes = d.io.logical.Load(), d.io.appended.Load()
+	out.CompactedBytes, out.IndexBytes, out.Syncs = d.io.compacted.Load(), d.io.index.Load(), d.io.syncs.Load()
+	t := now()
+	for k := range d.kToPos.all() {
+		if !d.expired(k, t) {
+			out.Keys++
+		}
+	}
+	for _, n := range d.liveBytes {
+		out.LiveBytes += n
+	}
+	out.DeadBytes = out.FileSize - out.LiveBytes
+	for _, n := range d.tombstones {
+		out.Tombstones += n
+	}
+	return out
+}
+
+// Distributions of the sizes of the live keys and values, by powers of two.
+// Element 0 counts those of no bytes, and element i those of at least
+// 2^(i-1) and less than 2^i bytes.  Values are measured as stored, after
+// compression and encryption.
+type SizeHistogram struct {
+	Keys   [33]int
+	Values [33]int
+}
+
+// Returns the range of sizes element i of a SizeHistogram counts, from min
+// up to and including max.
+func SizeBucket(i int) (min, max uint64) {
+	if i == 0 {
+		return 0, 0
+	}
+	return 1 << (i - 1), 1<<i - 1
+}
+
+// Returns the distributions of the sizes of the live keys and values.  Reads
+// only the index, not the data files.
+func (d *DB) SizeHistogram() SizeHistogram {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	var out SizeHistogram
+	t := now()
+	for k, oal := range d.kToPos.all() {
+		if !d.expired(k, t) {
+			out.Keys[bits.Len32(uint32(len(k)))]++
+			out.Values[bits.Len32(oal.length)]++
+		}
+	}
+	return out
+}
@@ -0,0 +1,175 @@
+package bitcesque
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Size of the chunks values are streamed to and from the data file in.
+const streamChunkSize = 64 << 10
+
+// Inserts or updates the given key with a value of the given length read
+// from r.  The value is streamed to the data file in chunks rather than held
+// in memory, unless it must be compressed, encrypted or replicated, all of
+// which need it whole.  If r fails or ends early, the partial record is
+// truncated away and the previous value left in place.
+func (d *DB) UpsertReader(k []byte, length uint32, r io.Reader) error {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	if e := d.checkSizes(k, uint64(length)); e != nil {
+		return e
+	}
+	if length == 0 || d.opts.Compression != nil || d.opts.Encryption != nil || d.replLog != nil {
+		v := make([]byte, length)
+		_, e := io.ReadFull(r, v)
+		if e != nil {
+			return e
+		}
+		return d.upsert(k, v, 0, 0)
+	}
+	rec := newRecord(k, nil, 0)
+	head := rec.encode(d.sum)
+	uint32ToBytes(head, 8, length)
+	if e := d.flushWrites(); e != nil {
+		return d.writeFailed(e)
+	}
+	d.flushIndexLog()
+	e := d.makeRoom(uint64(len(head)) + uint64(length))
+	if e != nil {
+		return d.writeFailed(e)
+	}
+	rec.pos = d.filledSize
+	sum := d.sum.begin(head)
+	e = d.appendChunk(head)
+	buf := make([]byte, streamChunkSize)
+	for remaining := length; remaining > 0 && e == nil; {
+		chunk := buf
+		if remaining < uint32(len(chunk)) {
+			chunk = buf[:remaining]
+		}
+		_, e = io.ReadFull(r, chunk)
+		if e == nil {
+			sum.write(chunk)
+			e = d.appendChunk(chunk)
+			remaining -= uint32(len(chunk))
+		}
+	}
+	if e == nil {
+		//The checksum leads the document, so is filled in last
+		d.sum.store(head, sum.sum())
+		e = d.patch(rec.pos, head[:docPrefix(d.sum.flags(), 0)])
+	}
+	if e == nil && d.opts.SyncWrites {
+		d.io.syncs.Add(1)
+		e = d.filehandle.Sync()
+	}
+	if e != nil {
+		d.truncateActive(rec.pos)
+		return d.writeFailed(e)
+	}
+	d.noteAppend()
+	d.io.logical.Add(uint64(len(k)) + uint64(length))
+	oal := rec.oal(d.activeID)
+	oal.length = length
+	d.point(string(k), oal)
+	delete(d.expiries, string(k))
+	d.evict()
+	return nil
+}
+
+// Appends part of a document to the active segment, which must already have
+// room for it.  Assumes the write lock is held.
+func (d *DB) appendChunk(b []byte) error {
+	e := d.reserve(uint64(len(b)))
+	if e != nil {
+		return e
+	}
+	n, e := d.filehandle.WriteAt(b, int64(d.filledSize))
+	d.filledSize += uint64(n)
+	d.io.appended.Add(uint64(n))
+	d.growActive(b[:n])
+	return e
+}
+
+// Overwrites already appended bytes of the active segment at pos, which the
+// appending handle can't do.  Assumes the write lock is held.
+func (d *DB) patch(pos uint64, b []byte) error {
+	f, e := os.OpenFile(segmentPath(d.location, d.activeID), os.O_WRONLY, 0)
+	if e != nil {
+		return e
+	}
+	_, e = f.WriteAt(b, int64(pos))
+	if e != nil {
+		f.Close()
+		return e
+	}
+	patchFilebuf(d.filebuffer, pos, b)
+	return f.Close()
+}
+
+// Streams a value straight from its data file, through a handle of its own so
+// that later writes or compactions don't disturb it.
+type valueReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r valueReader) Close() error {
+	return r.f.Close()
+}
+
+// Returns a reader over the value associated with the given key, its length,
+// and whether it is present.  Plain values are read from the data file as
+// the reader is consumed, so need not fit in memory, after writing them out if
+// they are still buffered; compressed or encrypted ones are decoded up front.
+// The reader must be closed when done with.
+func (d *DB) GetReader(k []byte) (io.ReadCloser, int64, bool) {
+	defer d.endOp(OpRead, d.startOp())
+	r, length, present, buffered := d.openValue(k, false)
+	if buffered {
+		//The value is written out first, so that it can be read from the file
+		//through the reader's own handle like any other
+		d.flush()
+		r, length, present, _ = d.openValue(k, true)
+	}
+	return r, length, present
+}
+
+// As GetReader, but also returns whether the value is still in the write
+// buffer, in which case it is only read from there if fromBuffer is set.
+// The buffer is never written over, so the reader can outlive the flush.
+func (d *DB) openValue(k []byte, fromBuffer bool) (io.ReadCloser, int64, bool, bool) {
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return nil, 0, false, false
+	}
+	if oal.compressed() || oal.format&(encryptedFlag>>24) != 0 {
+		v, e := d.getVal(oal)
+		if e != nil {
+			return nil, 0, false, false
+		}
+		return io.NopCloser(bytes.NewReader(v)), int64(len(v)), true, false
+	}
+	if v, ok := d.buffered(oal.segment, oal.offset, uint64(oal.length)); ok {
+		if !fromBuffer {
+			return nil, 0, false, true
+		}
+		return io.NopCloser(bytes.NewReader(v)), int64(len(v)), true, true
+	}
+	f, e := os.Open(segmentPath(d.location, oal.segment))
+	if e != nil {
+		return nil, 0, false, false
+	}
+	length := int64(oal.length)
+	return valueReader{io.NewSectionReader(f, int64(oal.offset), length), f}, length, true, false
+}
@@ -0,0 +1,46 @@
+package bitcesque
+
+// Returns the latest tombstone in the given segments for each key that is
+// absent from the index, where written within Options.TombstoneRetention, for
+// compaction to keep.  Tombstones predating timestamps are never kept.
+// Assumes the write lock is held.
+func (d *DB) retainedTombstones(ids []uint32) (map[string]offsetAndLength, error) {
+	if d.opts.TombstoneRetention <= 0 {
+		return nil, nil
+	}
+	cutoff := now() - int64(d.opts.TombstoneRetention)
+	out := make(map[string]offsetAndLength)
+	for _, id := range ids {
+		buf, f, size := d.filebuffer, d.filehandle, d.filledSize
+		if id != d.activeID {
+			buf, f, size = d.sealed[id].filebuffer, d.sealed[id].filehandle, d.sealed[id].size
+		}
+		s := newScanner(buf, f)
+		_, e := s.scan(dataStart(buf, size), size, func(r *record) error {
+			oal := r.oal(id)
+			e := openRecord(d.opts.Encryption, r)
+			if e != nil {
+				return e
+			}
+			k := string(r.key)
+			if len(r.value) != 0 {
+				delete(out, k)
+			} else if r.timestamp >= cutoff && r.timestamp != 0 {
+				out[k] = oal
+			} else {
+				delete(out, k)
+			}
+			return nil
+		})
+		s.release()
+		if e != nil {
+			return nil, e
+		}
+	}
+	for k := range out {
+		if _, present := d.kToPos.get(k); present {
+			delete(out, k)
+		}
+	}
+	return out, nil
+}
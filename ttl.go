@@ -0,0 +1,68 @@
+package bitcesque
+
+import (
+	"time"
+)
+
+func now() int64 {
+	return time.Now().UnixNano()
+}
+
+// Inserts or updates the given key with the given value, which will be
+// treated as absent once the given duration has passed.
+func (d *DB) UpsertWithTTL(k, v []byte, ttl time.Duration) error {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.upsert(k, v, time.Now().Add(ttl).UnixNano(), 0)
+}
+
+// Returns when the given key expires, and whether it is present and has an
+// expiry at all.
+func (d *DB) ExpiresAt(k []byte) (time.Time, bool) {
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	expiry, present := d.expiries[string(k)]
+	if !present || expiry <= now() {
+		return time.Time{}, false
+	}
+	return time.Unix(0, expiry), true
+}
+
+// Returns whether the given key has expired as of t, in Unix nanoseconds.
+// Assumes at least a read lock is held.
+func (d *DB) expired(k string, t int64) bool {
+	if len(d.expiries) == 0 {
+		return false
+	}
+	expiry, present := d.expiries[k]
+	return present && expiry <= t
+}
+
+// Periodically drops expired keys from the index until the DB is closed.
+// Nothing is written, since the expiry recorded with each document suffices
+// for it to be disregarded when the DB is next verified or compacted.
+func (d *DB) sweepExpired() {
+	defer d.background.Done()
+	interval := d.opts.ExpirySweepInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		d.mutex.Lock()
+		t := now()
+		for k, expiry := range d.expiries {
+			if expiry <= t {
+				d.drop(k)
+			}
+		}
+		d.mutex.Unlock()
+	}
+}
@@ -0,0 +1,127 @@
+package bitcesque
+
+import (
+	"bytes"
+	"math"
+)
+
+// An optimistic transaction against a DB.  Writes are staged in a Batch and
+// overlaid on reads, so the transaction sees its own writes, and each key it
+// reads keeps the value first read for as long as the transaction lasts.  No
+// lock is held in between: Commit checks that every key read still has the
+// value it had, failing with ErrConflict if not, then writes the batch as
+// one frame and applies it under the same lock acquisition.  Not safe for
+// concurrent use.
+type Txn struct {
+	db     *DB
+	batch  *Batch
+	reads  map[string]txnRead
+	writes map[string][]byte //Nil for removals
+	done   bool
+}
+
+// A value as first read by a transaction.
+type txnRead struct {
+	v       []byte
+	present bool
+}
+
+// Returns a new transaction against the DB.
+func (d *DB) Begin() *Txn {
+	return &Txn{d, d.NewBatch(), make(map[string]txnRead), make(map[string][]byte), false}
+}
+
+// Returns a copy of the value associated with the given key as the
+// transaction sees it, or ErrKeyNotFound if it is absent, expired or removed
+// by the transaction.
+func (t *Txn) Get(k []byte) ([]byte, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	if v, written := t.writes[string(k)]; written {
+		if v == nil {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte{}, v...), nil
+	}
+	r, read := t.reads[string(k)]
+	if !read {
+		v, e := t.db.Lookup(k)
+		if e != nil && e != ErrKeyNotFound {
+			return nil, e
+		}
+		r = txnRead{v, e == nil}
+		t.reads[string(k)] = r
+	}
+	if !r.present {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, r.v...), nil
+}
+
+// Stages an insert or update of the given key with the given value.  If
+// either is too large to store, the transaction will fail to commit.
+func (t *Txn) Upsert(k, v []byte) {
+	if t.done {
+		return
+	}
+	t.batch.Upsert(k, v)
+	t.writes[string(k)] = append([]byte{}, v...)
+}
+
+// Stages a removal of the given key.  Staging anything once the transaction
+// is over has no effect.
+func (t *Txn) Remove(k []byte) {
+	if t.done {
+		return
+	}
+	t.batch.Remove(k)
+	t.writes[string(k)] = nil
+}
+
+// Applies the transaction's writes to the DB atomically, unless a key it read
+// has since been changed, in which case nothing is written and ErrConflict is
+// returned.  Either way the transaction is over.  A transaction that wrote
+// nothing only checks its reads.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	b := t.batch
+	if b.err != nil {
+		return b.err
+	}
+	d := t.db
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	for k, r := range t.reads {
+		v, present, e := d.current([]byte(k))
+		if e != nil {
+			return e
+		}
+		if present != r.present || !bytes.Equal(v, r.v) {
+			return ErrConflict
+		}
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	if uint64(len(b.buf)-b.frameHeader()) > math.MaxUint32 {
+		return ErrValueTooLarge
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	return b.commit()
+}
+
+// Discards the transaction's writes.  The transaction is over.
+func (t *Txn) Rollback() {
+	t.done = true
+	t.batch.Reset()
+}
@@ -0,0 +1,23 @@
+//go:build protobuf
+
+package typed
+
+import (
+	"google.golang.org/protobuf/proto"
+)
+
+// Stores protocol buffer messages in their wire format.  T is the generated
+// message's pointer type.  Depends on google.golang.org/protobuf, so only
+// built with the protobuf build tag.
+type Proto[T proto.Message] struct{}
+
+func (Proto[T]) Encode(m T) ([]byte, error) {
+	return proto.Marshal(m)
+}
+
+func (Proto[T]) Decode(b []byte) (T, error) {
+	var zero T
+	m := zero.ProtoReflect().New().Interface().(T)
+	e := proto.Unmarshal(b, m)
+	return m, e
+}
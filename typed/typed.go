@@ -0,0 +1,158 @@
+// Package typed wraps a bitcesque DB in a view whose keys and values have
+// real types, converted to and from bytes by codecs, so that callers needn't
+// marshal by hand.
+//
+//	users := typed.New[string, User](db, typed.String{}, typed.JSON[User]{})
+//	e := users.Put("tom", User{Name: "Tom"})
+//	u, e := users.Get("tom")
+//
+// Proto, a codec for protocol buffer messages, depends on
+// google.golang.org/protobuf, so is only built with the protobuf build tag.
+package typed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+// Converts values of type T to and from their stored bytes.
+type Codec[T any] interface {
+	Encode(T) ([]byte, error)
+	Decode([]byte) (T, error)
+}
+
+// Stores strings as their bytes.
+type String struct{}
+
+func (String) Encode(s string) ([]byte, error) {
+	return []byte(s), nil
+}
+
+func (String) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// Stores integers big-endian in 8 bytes, so that their order is kept in key
+// order.
+type Uint64 struct{}
+
+func (Uint64) Encode(n uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, n), nil
+}
+
+func (Uint64) Decode(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, errors.New("Stored integer not 8 bytes")
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Stores values as JSON.
+type JSON[T any] struct{}
+
+func (JSON[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON[T]) Decode(b []byte) (T, error) {
+	var v T
+	e := json.Unmarshal(b, &v)
+	return v, e
+}
+
+// Stores values gob encoded.  Each value carries its own type description,
+// so this suits larger values best.
+type Gob[T any] struct{}
+
+func (Gob[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	e := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), e
+}
+
+func (Gob[T]) Decode(b []byte) (T, error) {
+	var v T
+	e := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, e
+}
+
+// A view of a DB whose keys and values are of types K and V, converted with
+// codecs as they are stored and read.
+type DB[K comparable, V any] struct {
+	db *bitcesque.DB
+	kc Codec[K]
+	vc Codec[V]
+}
+
+// Returns a typed view of db, storing keys with kc and values with vc.
+func New[K comparable, V any](db *bitcesque.DB, kc Codec[K], vc Codec[V]) *DB[K, V] {
+	return &DB[K, V]{db, kc, vc}
+}
+
+// Returns the value of the given key, or an error wrapping ErrKeyNotFound if
+// it is absent, as bitcesque.DB.Lookup.
+func (t *DB[K, V]) Get(k K) (V, error) {
+	var v V
+	kb, e := t.kc.Encode(k)
+	if e != nil {
+		return v, e
+	}
+	b, e := t.db.Lookup(kb)
+	if e != nil {
+		return v, e
+	}
+	return t.vc.Decode(b)
+}
+
+// Inserts or updates the given key with the given value.
+func (t *DB[K, V]) Put(k K, v V) error {
+	kb, e := t.kc.Encode(k)
+	if e != nil {
+		return e
+	}
+	vb, e := t.vc.Encode(v)
+	if e != nil {
+		return e
+	}
+	return t.db.Upsert(kb, vb)
+}
+
+// Removes the given key.
+func (t *DB[K, V]) Delete(k K) error {
+	kb, e := t.kc.Encode(k)
+	if e != nil {
+		return e
+	}
+	return t.db.Remove(kb)
+}
+
+// Calls fn with every pair in the order of their encoded keys, as an
+// Iterator walks them, stopping at the first error fn returns or any pair
+// that fails to decode.  Returning ErrStop ends the iteration early, and
+// Iterate then returns nil.
+func (t *DB[K, V]) Iterate(fn func(k K, v V) error) error {
+	it := t.db.Scan(nil)
+	defer it.Close()
+	for it.Next() {
+		k, e := t.kc.Decode(it.Key())
+		if e != nil {
+			return e
+		}
+		v, e := t.vc.Decode(it.Value())
+		if e == nil {
+			e = fn(k, v)
+		}
+		if e == bitcesque.ErrStop {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return it.Err()
+}
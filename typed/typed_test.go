@@ -0,0 +1,53 @@
+package typed
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bnyeggen/bitcesque"
+)
+
+type user struct {
+	Name  string
+	State string
+}
+
+func TestTyped(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "typed")
+	defer os.RemoveAll(dir)
+	db, e := bitcesque.NewDB(filepath.Join(dir, "db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+
+	for _, users := range []*DB[uint64, user]{New[uint64, user](db, Uint64{}, JSON[user]{}), New[uint64, user](db, Uint64{}, Gob[user]{})} {
+		for i, name := range []string{"Tom", "Jim", "Ann"} {
+			if e := users.Put(uint64(i), user{name, "Oregon"}); e != nil {
+				t.Fatal(e)
+			}
+		}
+		if u, e := users.Get(1); e != nil || u.Name != "Jim" {
+			t.Error("Get mismatch", u, e)
+		}
+		users.Delete(1)
+		if _, e := users.Get(1); e != bitcesque.ErrKeyNotFound {
+			t.Error("Delete failed", e)
+		}
+		var names []string
+		e := users.Iterate(func(k uint64, u user) error {
+			names = append(names, u.Name)
+			return bitcesque.ErrStop
+		})
+		if e != nil || len(names) != 1 || names[0] != "Tom" {
+			t.Error("Iterate mismatch", names, e)
+		}
+	}
+	names := New[string, string](db, String{}, String{})
+	names.Put("Tom", "Oregon")
+	if v, _ := names.Get("Tom"); v != "Oregon" {
+		t.Error("String codec mismatch")
+	}
+}
@@ -0,0 +1,85 @@
+// Package bitcesque is version 2 of the Bitcesque API, whose reads report
+// failures as errors rather than bools, so that a missing key can be told
+// apart from a closed DB with errors.Is.  It shares the original package's
+// on-disk format, and a DB wraps the original's, so every other method is
+// unchanged.
+package bitcesque
+
+import (
+	"github.com/bnyeggen/bitcesque"
+)
+
+type Options = bitcesque.Options
+
+var (
+	ErrKeyNotFound        = bitcesque.ErrKeyNotFound
+	ErrDatabaseClosed     = bitcesque.ErrDatabaseClosed
+	ErrDatabaseLocked     = bitcesque.ErrDatabaseLocked
+	ErrCorrupt            = bitcesque.ErrCorrupt
+	ErrKeyTooLarge        = bitcesque.ErrKeyTooLarge
+	ErrValueTooLarge      = bitcesque.ErrValueTooLarge
+	ErrNotInteger         = bitcesque.ErrNotInteger
+	ErrOverflow           = bitcesque.ErrOverflow
+	ErrUnsupportedVersion = bitcesque.ErrUnsupportedVersion
+	ErrUnknownCodec       = bitcesque.ErrUnknownCodec
+	ErrDecryption         = bitcesque.ErrDecryption
+	ErrReadOnly           = bitcesque.ErrReadOnly
+	ErrQuotaExceeded      = bitcesque.ErrQuotaExceeded
+	ErrStop               = bitcesque.ErrStop
+	ErrConflict           = bitcesque.ErrConflict
+	ErrTxnDone            = bitcesque.ErrTxnDone
+	ErrVersionMismatch    = bitcesque.ErrVersionMismatch
+	ErrBadOffset          = bitcesque.ErrBadOffset
+)
+
+// Represents a collection of key / value pairs of arbitrary bytes.
+type DB struct {
+	*bitcesque.DB
+}
+
+func wrap(d *bitcesque.DB, e error) (*DB, error) {
+	if d == nil {
+		return nil, e
+	}
+	return &DB{d}, e
+}
+
+// Creates a new DB at the given location, *deleting* the data there.
+func NewDB(location string) (*DB, error) {
+	return wrap(bitcesque.NewDB(location))
+}
+
+// As NewDB, but with the given options.  A nil opts gives the defaults.
+func NewDBWithOptions(location string, opts *Options) (*DB, error) {
+	return wrap(bitcesque.NewDBWithOptions(location, opts))
+}
+
+// Opens a pre-existing database, loading its keystore.  Assumes validity.
+func OpenDB(location string) (*DB, error) {
+	return wrap(bitcesque.OpenDB(location))
+}
+
+// As OpenDB, but with the given options.  A nil opts gives the defaults.
+func OpenDBWithOptions(location string, opts *Options) (*DB, error) {
+	return wrap(bitcesque.OpenDBWithOptions(location, opts))
+}
+
+// Loads the pre-existing db at the given location, verifying its records
+// and re-deriving the keyfile.  If invalid records are encountered, loading
+// is stopped and the db is returned with records up to that point, along
+// with an error wrapping ErrCorrupt.
+func OpenAndVerifyDB(location string) (*DB, error) {
+	return wrap(bitcesque.OpenAndVerifyDB(location))
+}
+
+// As OpenAndVerifyDB, but with the given options.  A nil opts gives the
+// defaults.
+func OpenAndVerifyDBWithOptions(location string, opts *Options) (*DB, error) {
+	return wrap(bitcesque.OpenAndVerifyDBWithOptions(location, opts))
+}
+
+// Returns a copy of the value associated with the given key, or
+// ErrKeyNotFound if it is absent, or ErrDatabaseClosed if the DB is closed.
+func (d *DB) Get(k []byte) ([]byte, error) {
+	return d.Lookup(k)
+}
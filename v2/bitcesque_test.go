@@ -0,0 +1,41 @@
+package bitcesque
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	f, _ := ioutil.TempFile("", "bitcesque")
+	f.Close()
+	loc := f.Name()
+	defer os.Remove(loc)
+	defer os.Remove(loc + ".keys")
+	defer os.Remove(loc + ".manifest")
+	defer os.Remove(loc + ".lock")
+
+	d, e := NewDB(loc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.Upsert([]byte("Tom"), []byte("Oregon"))
+	v, e := d.Get([]byte("Tom"))
+	if e != nil || string(v) != "Oregon" {
+		t.Error("Get error")
+	}
+	if _, e = d.Get([]byte("Dick")); !errors.Is(e, ErrKeyNotFound) {
+		t.Error("Missing key not reported")
+	}
+	d.Close()
+	if _, e = d.Get([]byte("Tom")); !errors.Is(e, ErrDatabaseClosed) {
+		t.Error("Closed DB not reported")
+	}
+	if e = d.Upsert([]byte("Tom"), []byte("Oregon")); !errors.Is(e, ErrDatabaseClosed) {
+		t.Error("Write to closed DB not reported")
+	}
+	if e = d.Close(); !errors.Is(e, ErrDatabaseClosed) {
+		t.Error("Second close not reported")
+	}
+}
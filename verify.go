@@ -0,0 +1,185 @@
+package bitcesque
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// What verifying a single segment found, to be merged into the index in
+// segment order.
+type fragment struct {
+	m          map[string]offsetAndLength
+	expiries   map[string]int64
+	removed    map[string]struct{} //Keys whose last record here was a tombstone or expired
+	tombstones int
+	records    uint64
+	err        error //Why verification stopped short, if it did
+}
+
+func newFragment() *fragment {
+	return &fragment{make(map[string]offsetAndLength), make(map[string]int64), make(map[string]struct{}), 0, 0, nil}
+}
+
+// Mutatively merges the fragment into an index built from earlier segments.
+func (f *fragment) mergeInto(m index, expiries map[string]int64) {
+	for k := range f.removed {
+		m.remove(k)
+		delete(expiries, k)
+	}
+	for k, oal := range f.m {
+		m.set(k, oal)
+		if expiry, present := f.expiries[k]; present {
+			expiries[k] = expiry
+		} else {
+			delete(expiries, k)
+		}
+	}
+}
+
+// Indexes a record of the segment, or notes its key as removed if it is a
+// tombstone or expired as of t.
+func (f *fragment) index(k string, oal offsetAndLength, expiry int64, tombstone bool, t int64) {
+	f.records++
+	if tombstone || (expiry != 0 && expiry <= t) {
+		if tombstone {
+			f.tombstones++
+		}
+		delete(f.m, k)
+		delete(f.expiries, k)
+		f.removed[k] = struct{}{}
+		return
+	}
+	delete(f.removed, k)
+	f.m[k] = oal
+	if expiry != 0 {
+		f.expiries[k] = expiry
+	} else {
+		delete(f.expiries, k)
+	}
+}
+
+// Carries what verifying a DB's segments concurrently shares.
+type verifier struct {
+	ctx      context.Context
+	location string
+	aead     cipher.AEAD
+	policy   RecoveryPolicy
+	t        int64 //Records expired as of this are dropped
+	progress func(scanned, total uint64)
+	hints    bool //Whether to index sealed segments from their hint files
+	total    uint64
+	mutex    sync.Mutex //Guards scanned and calls to progress
+	scanned  uint64
+}
+
+// Counts n more bytes as verified, reporting progress, and returns the
+// context's error if it is done.
+func (v *verifier) report(n uint64) error {
+	if e := v.ctx.Err(); e != nil {
+		return e
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.scanned += n
+	if v.progress != nil {
+		v.progress(v.scanned, v.total)
+	}
+	return nil
+}
+
+// Verifies the given segments using up to the given number of goroutines,
+// returning a fragment for each in the same order.
+func (v *verifier) verifyAll(segs []*segment, workers int) []*fragment {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	frags := make([]*fragment, len(segs))
+	next := make(chan int, len(segs))
+	for i := range segs {
+		next <- i
+	}
+	close(next)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(segs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				frags[i] = v.verifySegment(segs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return frags
+}
+
+// Verifies and indexes the records of a segment, dealing with damage as the
+// policy calls for.  Truncation shortens the segment in place.
+func (v *verifier) verifySegment(seg *segment) *fragment {
+	if v.hints {
+		if f, e := v.readHints(seg); e == nil {
+			f.err = v.report(seg.size)
+			return f
+		}
+	}
+	f := newFragment()
+	if f.err = v.ctx.Err(); f.err != nil {
+		return f
+	}
+	reported := uint64(0)
+	apply := func(r *record) error {
+		if r.pos-reported >= verifyProgressStep {
+			if e := v.report(r.pos - reported); e != nil {
+				return e
+			}
+			reported = r.pos
+		}
+		oal := r.oal(seg.id)
+		e := openRecord(v.aead, r)
+		if e != nil {
+			return e
+		}
+		f.index(string(r.key), oal, r.expiry, len(r.value) == 0, v.t)
+		return nil
+	}
+	s := newScanner(seg.filebuffer, seg.filehandle)
+	defer s.release()
+	pos := dataStart(seg.filebuffer, seg.size)
+	for pos < seg.size {
+		var e error
+		pos, e = s.scan(pos, seg.size, apply)
+		if errors.Is(e, ErrCorrupt) && s.zeroFrom(pos, seg.size) {
+			seg.size, e = pos, nil
+			seg.filebuffer = truncateFilebuf(seg.filebuffer, pos)
+		}
+		if e == nil {
+			break
+		}
+		if errors.Is(e, ErrCorrupt) && v.policy == SkipCorruptRecords {
+			for pos++; pos < seg.size; pos++ {
+				if _, ok := s.intact(pos, seg.size); ok {
+					break
+				}
+			}
+			continue
+		}
+		if errors.Is(e, ErrCorrupt) && v.policy == TruncateAtCorruption {
+			e = os.Truncate(segmentPath(v.location, seg.id), int64(pos))
+			if e == nil {
+				seg.size = pos
+				seg.filebuffer = truncateFilebuf(seg.filebuffer, pos)
+				break
+			}
+		}
+		f.err = e
+		return f
+	}
+	if e := v.report(seg.size - reported); e != nil {
+		f.err = e
+	}
+	return f
+}
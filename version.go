@@ -0,0 +1,123 @@
+package bitcesque
+
+import "sync/atomic"
+
+// The timestamp most recently given a record, or seen in a DB's files.
+var lastStamp atomic.Int64
+
+// Returns the current time in Unix nanoseconds to stamp a new record with, or
+// if the clock hasn't moved on since the last stamp, the nanosecond after it,
+// so that no two records written by the process share a timestamp, and none
+// is stamped earlier than a record already in a DB it has open.
+func stamp() int64 {
+	for {
+		last := lastStamp.Load()
+		t := now()
+		if t <= last {
+			t = last + 1
+		}
+		if lastStamp.CompareAndSwap(last, t) {
+			return t
+		}
+	}
+}
+
+// Raises the last stamp to at least the given one, so that records written
+// afterwards are stamped later even if the clock has since gone back.
+func seenStamp(t int64) {
+	for {
+		last := lastStamp.Load()
+		if t <= last || lastStamp.CompareAndSwap(last, t) {
+			return
+		}
+	}
+}
+
+// Raises the last stamp to that of the DB's newest live record, so that
+// versions carry on increasing from where they left off when it was last
+// open.  Assumes the DB is not yet shared.
+func (d *DB) seedStamp() {
+	for _, oal := range d.kToPos.all() {
+		seenStamp(int64(d.version(oal)))
+	}
+}
+
+// Returns the version of the record oal points to, its write timestamp.
+// Assumes at least a read lock is held.
+func (d *DB) version(oal offsetAndLength) uint64 {
+	if oal.format&(timestampFlag>>24) == 0 {
+		return 0
+	}
+	start := oal.offset - uint64(oal.prefix)
+	return uint64(decodeRecord(d.readSegment(oal.segment, start, uint64(oal.prefix)), start).timestamp)
+}
+
+// Returns the version of the given key's value, and whether it is present.
+// A key's version is the time its value was written, in Unix nanoseconds,
+// but never earlier than any version already in the DB, so it increases with
+// every write, even across reopening with the clock set back.  It is kept by
+// compaction, so tells whether the key has been written since, even to
+// another process reading the files.  Keys last written before records
+// carried timestamps have version 0.
+func (d *DB) Version(k []byte) (uint64, bool) {
+	defer d.endOp(OpRead, d.startOp())
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return 0, false
+	}
+	return d.version(oal), true
+}
+
+// Returns a copy of the value associated with the given key, its version as
+// Version gives it, and whether it is present.
+func (d *DB) GetWithVersion(k []byte) ([]byte, uint64, bool) {
+	defer d.endOp(OpRead, d.startOp())
+	shard := d.mutex.rlockKey(k)
+	defer shard.RUnlock()
+	oal, present := d.lookup(k)
+	if !present || d.expired(string(k), now()) {
+		return nil, 0, false
+	}
+	v, e := d.ownedVal(oal)
+	if e != nil {
+		return nil, 0, false
+	}
+	return v, d.version(oal), true
+}
+
+// Sets the given key to the given value only if it is present and its
+// version is still expected, and returns the new version.  Fails with
+// ErrVersionMismatch if the key has been written or removed since.  Use
+// InsertWithVersion to set an absent key.
+func (d *DB) UpsertIfVersion(k, v []byte, expected uint64) (uint64, error) {
+	return d.writeIfVersion(k, v, true, expected)
+}
+
+// Sets the given key to the given value only if it is absent, and returns
+// the new version.  Fails with ErrVersionMismatch if the key is present.
+func (d *DB) InsertWithVersion(k, v []byte) (uint64, error) {
+	return d.writeIfVersion(k, v, false, 0)
+}
+
+// Sets the given key if its presence, and if present its version, are as
+// expected, and returns the new version.
+func (d *DB) writeIfVersion(k, v []byte, present bool, expected uint64) (uint64, error) {
+	defer d.endOp(OpWrite, d.startOp())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return 0, ErrDatabaseClosed
+	}
+	oal, found := d.lookup(k)
+	found = found && !d.expired(string(k), now())
+	if found != present || found && d.version(oal) != expected {
+		return 0, ErrVersionMismatch
+	}
+	if e := d.upsert(k, v, 0, 0); e != nil {
+		return 0, e
+	}
+	oal, _ = d.lookup(k)
+	return d.version(oal), nil
+}
@@ -0,0 +1,101 @@
+package bitcesque
+
+import (
+	"errors"
+)
+
+// Returns the log offset of the given position in a segment: the segment id
+// in the top bits, as in the keyfile, and the position below.  Offsets
+// increase with every append, until Consolidate rewrites the log into the
+// first segment.
+func logOffset(segment uint32, pos uint64) uint64 {
+	return uint64(segment)<<segmentShift | pos
+}
+
+// Returns the log offset just past the last append, which ViewAt can later
+// be given to see the DB as it stands now.
+func (d *DB) CommittedOffset() uint64 {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return logOffset(d.activeID, d.logEnd())
+}
+
+// Returns a read-only view of the DB as it stood when CommittedOffset
+// returned offset, with its index rebuilt by replaying the log up to there.
+// As with Snapshot, later writes don't affect the view, and it should be
+// closed once done.  Keys with a TTL are hidden once expired as usual.
+//
+// Compaction rewrites the log before it, so fails with ErrBadOffset for
+// offsets from before the last Merge or Consolidate, as well as for any
+// beyond the end of the log or within a document.  Offsets taken before a
+// Consolidate or Clear may name positions in the new log, so should not be
+// used after one.
+func (d *DB) ViewAt(offset uint64) (*DB, error) {
+	//The log is replayed from the files
+	if e := d.flush(); e != nil {
+		return nil, e
+	}
+	s, e := d.Snapshot()
+	if e != nil {
+		return nil, e
+	}
+	e = s.replayTo(offset)
+	if e != nil {
+		s.Close()
+		return nil, e
+	}
+	return s, nil
+}
+
+// Replaces a snapshot's index with one built from its segments up to the
+// given offset.
+func (d *DB) replayTo(offset uint64) error {
+	if offset < d.horizon || offset > logOffset(d.activeID, d.filledSize) {
+		return ErrBadOffset
+	}
+	id, end := uint32(offset>>segmentShift), offset&(1<<segmentShift-1)
+	active := &segment{d.activeID, d.filehandle, d.filebuffer, d.filledSize, false}
+	segs := append(sortedSegments(d.sealed), active)
+	m := newIndex(&d.opts, d.location, 0)
+	expiries := make(map[string]int64)
+	t := now()
+	found := false
+	for _, seg := range segs {
+		if seg.id > id {
+			break
+		}
+		stop := seg.size
+		if seg.id == id {
+			found = true
+			if end > seg.size || end < dataStart(seg.filebuffer, seg.size) {
+				return ErrBadOffset
+			}
+			stop = end
+		}
+		segID := seg.id
+		sc := newScanner(seg.filebuffer, seg.filehandle)
+		_, e := sc.scan(dataStart(seg.filebuffer, seg.size), stop, func(r *record) error {
+			oal := r.oal(segID)
+			e := openRecord(d.opts.Encryption, r)
+			if e == nil {
+				indexRecord(m, expiries, r, oal, t)
+			}
+			return e
+		})
+		sc.release()
+		if errors.Is(e, ErrCorrupt) && seg.id == id {
+			//Ending within a document reads as a truncated one
+			return ErrBadOffset
+		}
+		if e != nil {
+			return e
+		}
+	}
+	if !found {
+		return ErrBadOffset
+	}
+	d.kToPos, d.expiries = m, expiries
+	d.recountLiveBytes()
+	d.rebuildFilters(d.segmentIDs())
+	return nil
+}
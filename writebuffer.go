@@ -0,0 +1,114 @@
+package bitcesque
+
+import (
+	"time"
+)
+
+// Returns whether appends are gathered in the write buffer.
+func (d *DB) buffering() bool {
+	return d.opts.WriteBuffer > 0 && !d.opts.SyncWrites
+}
+
+// Returns the position in the active segment the next append goes to, past
+// any appends still buffered.  Assumes at least a read lock is held.
+func (d *DB) logEnd() uint64 {
+	return d.filledSize + uint64(len(d.wbuf))
+}
+
+// Returns length bytes from pos onwards in the given segment, and true, if
+// they are still buffered.  The buffer is never written over in place, so
+// the bytes stay valid once it is written out.
+func (d *DB) buffered(segment uint32, pos, length uint64) ([]byte, bool) {
+	if segment != d.activeID || pos < d.filledSize || len(d.wbuf) == 0 {
+		return nil, false
+	}
+	pos -= d.filledSize
+	return d.wbuf[pos : pos+length], true
+}
+
+// Adds head and tail to the write buffer, first writing out what is already
+// buffered if there isn't room.  Returns the position they will be written
+// at.  Assumes the write lock is held.
+func (d *DB) bufferAppend(head, tail []byte) (uint64, error) {
+	if len(d.wbuf)+len(head)+len(tail) > d.opts.WriteBuffer {
+		if e := d.flushWrites(); e != nil {
+			return 0, e
+		}
+	}
+	if d.wbuf == nil {
+		d.wbuf = make([]byte, 0, d.opts.WriteBuffer)
+	}
+	pos := d.logEnd()
+	d.wbuf = append(append(d.wbuf, head...), tail...)
+	return pos, nil
+}
+
+// Writes out the buffered appends with one call.  On failure nothing of them
+// is left in the file, and they stay buffered for the next flush to retry.
+// Assumes the write lock is held.
+func (d *DB) flushWrites() error {
+	if len(d.wbuf) == 0 {
+		return nil
+	}
+	pos := d.filledSize
+	e := d.reserve(uint64(len(d.wbuf)))
+	if e == nil {
+		var n int
+		n, e = d.filehandle.WriteAt(d.wbuf, int64(pos))
+		d.filledSize += uint64(n)
+		d.io.appended.Add(uint64(n))
+	}
+	if e != nil {
+		d.truncateActive(pos)
+		return e
+	}
+	d.growActive(d.wbuf)
+	//Reads may still hold slices of the old buffer, so it isn't reused
+	d.wbuf = nil
+	return nil
+}
+
+// Writes out and syncs buffered appends every Options.FlushInterval until the
+// DB is closed, so that a crash loses at most that long's writes.  The sync
+// happens without holding up writers.  Errors are left for the next write,
+// Sync or Close to find.
+func (d *DB) flusher() {
+	defer d.background.Done()
+	interval := d.opts.FlushInterval
+	if interval <= 0 {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		d.mutex.Lock()
+		f, flushed := d.filehandle, len(d.wbuf) > 0
+		var e error
+		if flushed && !d.closed {
+			e = d.flushWrites()
+		}
+		d.mutex.Unlock()
+		if flushed && e == nil {
+			d.io.syncs.Add(1)
+			f.Sync()
+		}
+	}
+}
+
+// Writes out buffered appends, taking the write lock to do so.
+func (d *DB) flush() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.snapshot {
+		return nil
+	}
+	return d.flushWrites()
+}
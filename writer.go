@@ -0,0 +1,128 @@
+package bitcesque
+
+// A mutation waiting in the write queue.
+type writeRequest struct {
+	k, v   []byte
+	remove bool
+	done   chan error
+}
+
+// Inserts or updates the given key with the given value, returning a
+// channel that receives the outcome once the write is made, and durable if
+// Options.SyncWrites is set.  Without a write queue the write is made before
+// returning.
+func (d *DB) UpsertAsync(k, v []byte) <-chan error {
+	if d.writes == nil {
+		done := make(chan error, 1)
+		done <- d.Upsert(k, v)
+		return done
+	}
+	e := d.checkSizes(k, uint64(len(v)))
+	if e != nil {
+		return failed(e)
+	}
+	return d.enqueue(&writeRequest{append([]byte{}, k...), append([]byte{}, v...), false, make(chan error, 1)})
+}
+
+// Removes the given key, as UpsertAsync.
+func (d *DB) RemoveAsync(k []byte) <-chan error {
+	if d.writes == nil {
+		done := make(chan error, 1)
+		done <- d.Remove(k)
+		return done
+	}
+	if len(k) > keyLenMask {
+		return failed(ErrKeyTooLarge)
+	}
+	return d.enqueue(&writeRequest{append([]byte{}, k...), nil, true, make(chan error, 1)})
+}
+
+// Returns a channel holding only the given error.
+func failed(e error) <-chan error {
+	done := make(chan error, 1)
+	done <- e
+	return done
+}
+
+// Hands a mutation to the writer goroutine, blocking while the queue is
+// full.  Fails with ErrDatabaseClosed once the queue has been shut.
+func (d *DB) enqueue(req *writeRequest) <-chan error {
+	d.queueing.RLock()
+	defer d.queueing.RUnlock()
+	if d.queueClosed {
+		return failed(ErrDatabaseClosed)
+	}
+	d.writes <- req
+	return req.done
+}
+
+// Stops accepting mutations into the queue, letting the writer goroutine
+// finish those already queued and exit.
+func (d *DB) closeQueue() {
+	if d.writes == nil {
+		return
+	}
+	d.queueing.Lock()
+	defer d.queueing.Unlock()
+	if !d.queueClosed {
+		d.queueClosed = true
+		close(d.writes)
+	}
+}
+
+// Commits queued mutations until the queue is shut, taking everything
+// queued at once as a single batch, so that they share one write and one
+// sync.
+func (d *DB) writer() {
+	defer d.background.Done()
+	for req := range d.writes {
+		group := []*writeRequest{req}
+	gather:
+		for len(group) < cap(d.writes) {
+			select {
+			case req, ok := <-d.writes:
+				if !ok {
+					break gather
+				}
+				group = append(group, req)
+			default:
+				break gather
+			}
+		}
+		e := d.commitGroup(group)
+		for _, req := range group {
+			req.done <- e
+		}
+	}
+}
+
+// Writes a group of queued mutations as one batch.  Only the last mutation
+// of each key is written, since it supersedes any before it.
+func (d *DB) commitGroup(group []*writeRequest) error {
+	b := d.NewBatch()
+	seen := make(map[string]bool, len(group))
+	for i := len(group) - 1; i >= 0; i-- {
+		req := group[i]
+		if seen[string(req.k)] {
+			continue
+		}
+		seen[string(req.k)] = true
+		if req.remove {
+			b.Remove(req.k)
+		} else {
+			b.Upsert(req.k, req.v)
+		}
+	}
+	if b.err != nil {
+		return b.err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	return b.commit()
+}
@@ -0,0 +1,45 @@
+package bitcesque
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Bits in the offset arguments pwritev splits a file position across.
+const longBits = 32 << (^uintptr(0) >> 63)
+
+// Writes head followed by tail to f at pos with one pwritev call, finishing
+// any short write piecewise.  Returns the bytes written.
+func writeParts(f *os.File, head, tail []byte, pos int64) (int, error) {
+	if len(head) == 0 || len(tail) == 0 {
+		n, e := f.WriteAt(head, pos)
+		if e == nil {
+			var m int
+			m, e = f.WriteAt(tail, pos+int64(n))
+			n += m
+		}
+		return n, e
+	}
+	iov := []syscall.Iovec{{Base: &head[0]}, {Base: &tail[0]}}
+	iov[0].SetLen(len(head))
+	iov[1].SetLen(len(tail))
+	r, _, errno := syscall.Syscall6(syscall.SYS_PWRITEV, f.Fd(), uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)),
+		uintptr(pos), uintptr(uint64(pos)>>(longBits/2)>>(longBits/2)), 0)
+	if errno != 0 {
+		return 0, &os.PathError{Op: "pwritev", Path: f.Name(), Err: errno}
+	}
+	n := int(r)
+	var e error
+	if n < len(head) {
+		var m int
+		m, e = f.WriteAt(head[n:], pos+int64(n))
+		n += m
+	}
+	if e == nil && n < len(head)+len(tail) {
+		var m int
+		m, e = f.WriteAt(tail[n-len(head):], pos+int64(n))
+		n += m
+	}
+	return n, e
+}
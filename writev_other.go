@@ -0,0 +1,18 @@
+//go:build !linux
+
+package bitcesque
+
+import (
+	"os"
+)
+
+// Writes head followed by tail to f at pos.  Returns the bytes written.
+func writeParts(f *os.File, head, tail []byte, pos int64) (int, error) {
+	n, e := f.WriteAt(head, pos)
+	if e == nil && len(tail) > 0 {
+		var m int
+		m, e = f.WriteAt(tail, pos+int64(n))
+		n += m
+	}
+	return n, e
+}